@@ -2,8 +2,19 @@ package main
 
 import (
 	"connectly-interview/internal/bot/app"
+	"connectly-interview/internal/bot/domain/bot_auth"
+	"connectly-interview/internal/bot/domain/bot_usage"
+	"connectly-interview/internal/bot/infrastructure/kafka/segmentio"
+	"encoding/json"
 	"fmt"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/segmentio/kafka-go"
 )
 
 func main() {
@@ -14,22 +25,181 @@ func main() {
 		"OPENAI_API_KEY",
 	)
 
-	openaiKey := os.Getenv("OPENAI_API_KEY")
+	// BOT_LLM_PROVIDER is "openai" by default, "echo" echoes the prompts back without a model e.g. for local development
+	var providerOpt bot_app.Option
+	switch provider := os.Getenv("BOT_LLM_PROVIDER"); provider {
+	case "", "openai":
+		openaiKey := os.Getenv("OPENAI_API_KEY")
+		if openaiKey == "" {
+			panic(fmt.Errorf("no OPENAI_API_KEY found, set it or set BOT_LLM_PROVIDER to \"echo\" to echo the prompts back"))
+		}
+		providerOpt = bot_app.WithOpenAiKey(openaiKey)
+	case "echo":
+		fmt.Printf("answers will be echoed back by a local provider\n")
+		providerOpt = bot_app.WithEchoProvider()
+	default:
+		panic(fmt.Errorf("invalid BOT_LLM_PROVIDER: %q is neither \"openai\" nor \"echo\"", provider))
+	}
+
+	chatLogPath := os.Getenv("BOT_CHAT_LOG")
+	if chatLogPath == "" {
+		chatLogPath = "data/chats.log"
+	}
+
+	opts := []bot_app.Option{
+		providerOpt,
+		bot_app.WithChatLog(chatLogPath),
+	}
+
+	wsIdleTimeout := os.Getenv("BOT_WS_IDLE_TIMEOUT")
+	if wsIdleTimeout != "" {
+		timeout, err := time.ParseDuration(wsIdleTimeout)
+		if err != nil {
+			panic(fmt.Errorf("invalid BOT_WS_IDLE_TIMEOUT: %w", err))
+		}
+		opts = append(opts, bot_app.WithWebsocketIdleTimeout(timeout))
+	}
+
+	// BOT_API_KEYS are the API keys of the clients, as "key:user" pairs separated by commas
+	var authenticators []bot_auth.Authenticator
+	apiKeys := os.Getenv("BOT_API_KEYS")
+	if apiKeys != "" {
+		keys := make(map[string]bot_auth.UserId)
+		for _, pair := range strings.Split(apiKeys, ",") {
+			key, user, ok := strings.Cut(strings.TrimSpace(pair), ":")
+			if !ok || key == "" || user == "" {
+				panic(fmt.Errorf("invalid BOT_API_KEYS: %q is not a key:user pair", pair))
+			}
+			keys[key] = bot_auth.UserId(user)
+		}
+		authenticators = append(authenticators, bot_auth.NewStaticKeys(keys))
+	}
+
+	jwtKey := os.Getenv("BOT_JWT_KEY")
+	if jwtKey != "" {
+		authenticators = append(authenticators, bot_auth.NewJWT(bot_auth.JWTArgs{
+			Key:      []byte(jwtKey),
+			Issuer:   os.Getenv("BOT_JWT_ISSUER"),
+			Audience: os.Getenv("BOT_JWT_AUDIENCE"),
+			Leeway:   time.Minute,
+		}))
+	}
+
+	if len(authenticators) > 0 {
+		opts = append(opts, bot_app.WithAuthenticator(bot_auth.NewChain(authenticators...)))
+	} else {
+		fmt.Printf("no BOT_API_KEYS nor BOT_JWT_KEY found, every client is the %q user\n", bot_auth.AnonymousUser)
+	}
+
+	// BOT_RATE_LIMIT_RPM and BOT_RATE_LIMIT_TOKENS_PER_DAY are the messages per minute
+	// and the model tokens per day of each user, unlimited if not set
+	rateLimits := make([]int, 2)
+	for i, key := range []string{"BOT_RATE_LIMIT_RPM", "BOT_RATE_LIMIT_TOKENS_PER_DAY"} {
+		value := os.Getenv(key)
+		if value == "" {
+			continue
+		}
+		rateLimits[i], err = strconv.Atoi(value)
+		if err != nil || rateLimits[i] < 0 {
+			panic(fmt.Errorf("invalid %s: %q is not a positive number", key, value))
+		}
+	}
+	opts = append(opts, bot_app.WithRateLimit(rateLimits[0], rateLimits[1]))
+
+	// BOT_PRICES is a json file of the prices of the models in dollars per million tokens,
+	// e.g. {"gpt-4o": {"prompt": 2.5, "completion": 10}}, instead of bot_usage.DefaultPrices
+	pricesPath := os.Getenv("BOT_PRICES")
+	if pricesPath != "" {
+		data, err := os.ReadFile(pricesPath)
+		if err != nil {
+			panic(fmt.Errorf("could not read BOT_PRICES: %w", err))
+		}
+		var prices bot_usage.Prices
+		err = json.Unmarshal(data, &prices)
+		if err != nil {
+			panic(fmt.Errorf("invalid BOT_PRICES: %w", err))
+		}
+		opts = append(opts, bot_app.WithPrices(prices))
+	}
+
+	opts = append(opts, bot_app.WithHttpServer("localhost:8080"))
+
+	// BOT_KAFKA_ADDR is the address of a Kafka broker, BOT_KAFKA_ACKS how many replicas must have a message
+	// (none, one or all) and BOT_KAFKA_COMPRESSION the codec of the batches (gzip, snappy, lz4 or zstd).
+	// BOT_BUS_DIR keeps the messages of the embedded broker on the disk, otherwise they're only kept in memory
+	kafkaAddr := os.Getenv("BOT_KAFKA_ADDR")
+	busDir := os.Getenv("BOT_BUS_DIR")
+	if kafkaAddr != "" {
+		kafkaOpts := []bot_infastructure_kafka_segmentio.Option{}
+		acks := os.Getenv("BOT_KAFKA_ACKS")
+		if acks != "" {
+			var requiredAcks kafka.RequiredAcks
+			err = requiredAcks.UnmarshalText([]byte(acks))
+			if err != nil {
+				panic(fmt.Errorf("invalid BOT_KAFKA_ACKS: %w", err))
+			}
+			kafkaOpts = append(kafkaOpts, bot_infastructure_kafka_segmentio.WithRequiredAcks(requiredAcks))
+		}
+		compression := os.Getenv("BOT_KAFKA_COMPRESSION")
+		if compression != "" {
+			var codec kafka.Compression
+			err = codec.UnmarshalText([]byte(compression))
+			if err != nil {
+				panic(fmt.Errorf("invalid BOT_KAFKA_COMPRESSION: %w", err))
+			}
+			kafkaOpts = append(kafkaOpts, bot_infastructure_kafka_segmentio.WithCompression(codec))
+		}
+		opts = append(opts, bot_app.WithKafka(kafkaAddr, kafkaOpts...))
+	} else if busDir != "" {
+		opts = append(opts, bot_app.WithEmbeddedKafka(busDir))
+	} else {
+		opts = append(opts, bot_app.WithNoKafka())
+	}
+
+	// BOT_DEAD_LETTER_DIR keeps the messages that could not be sent or handled on the disk instead of the bus,
+	// see cmd/deadletters to inspect and replay them
+	deadLetterDir := os.Getenv("BOT_DEAD_LETTER_DIR")
+	if deadLetterDir != "" {
+		opts = append(opts, bot_app.WithDeadLetterDir(deadLetterDir))
+	}
+
+	daemonSocket := os.Getenv("BOT_DAEMON_SOCKET")
+	if daemonSocket != "" {
+		opts = append(opts, bot_app.WithDaemon(daemonSocket))
+	}
+
+	grpcAddr := os.Getenv("BOT_GRPC_ADDR")
+	if grpcAddr != "" {
+		opts = append(opts, bot_app.WithGrpcServer(grpcAddr))
+	}
 
 	fmt.Printf("initializing bot...\n")
-	bot, err := bot_app.New(
-		bot_app.WithOpenAiKey(openaiKey),
-		bot_app.WithHttpServer("localhost:8080"),
-		bot_app.WithNoKafka(),
-	)
+	bot, err := bot_app.New(opts...)
 	if err != nil {
 		panic(err)
 	}
 
+	// the bot is stopped on SIGINT and SIGTERM, so the interfaces stop and the bus is closed,
+	// which flushes the messages waiting to be sent and releases the directory of an embedded broker
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan error, 1)
+	go func() {
+		sig := <-signals
+		fmt.Printf("received %s, stopping bot...\n", sig)
+		stopped <- bot.Stop()
+	}()
+
 	fmt.Printf("starting bot...\n")
 	err = bot.Start()
 	if err != nil {
 		panic(err)
-		return
 	}
+
+	// Start returns once the interfaces are stopped, the bus is closed after them
+	err = <-stopped
+	if err != nil {
+		panic(fmt.Errorf("could not stop bot: %w", err))
+	}
+	fmt.Printf("bot stopped\n")
 }
@@ -0,0 +1,244 @@
+// Command deadletters inspects and replays the messages of the bus that the bot gave up on.
+//
+//	deadletters inspect                       lists the dead letters
+//	deadletters replay -id <id> [-force]      sends the dead letter back to its topic
+//	deadletters replay -all [-force]          sends all the dead letters back to their topics
+//
+// It finds the bus like the bot does: BOT_KAFKA_ADDR, otherwise the embedded broker in BOT_BUS_DIR,
+// and the dead letters in BOT_DEAD_LETTER_DIR if they're kept apart from the bus.
+// An embedded broker locks its directory, so the bot must be stopped first.
+//
+// A replayed message is read again by every consumer group of its topic, and handled again:
+// the consumers do not skip the events they already handled, so only replay the messages that were never handled.
+// The dead letters that are replayed are recorded in TopicDeadLetterReplayed and skipped afterwards, unless -force is set.
+package main
+
+import (
+	"connectly-interview/internal/bot/infrastructure/kafka"
+	"connectly-interview/internal/bot/infrastructure/kafka/embedded"
+	"connectly-interview/internal/bot/infrastructure/kafka/segmentio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	ErrNoBus        = fmt.Errorf("no BOT_KAFKA_ADDR nor BOT_BUS_DIR found")
+	ErrNotFound     = fmt.Errorf("dead letter not found")
+	ErrReplayed     = fmt.Errorf("dead letter was already replayed, replay it again with -force")
+	ErrNothingToDo  = fmt.Errorf("neither -id nor -all is set")
+	ErrUnknownUsage = fmt.Errorf("usage: deadletters inspect | replay -id <id> [-force] | replay -all [-force]")
+)
+
+// replayMarker records that a dead letter was replayed, as it's sent to TopicDeadLetterReplayed
+type replayMarker struct {
+	Id         string    `json:"id"`
+	ReplayedAt time.Time `json:"replayed_at"`
+}
+
+func main() {
+	err := run(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	if len(args) == 0 {
+		return ErrUnknownUsage
+	}
+
+	ctx := context.Background()
+	bus, err := openBus(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeBus(bus)
+
+	deadLetters := bus
+	deadLetterDir := os.Getenv("BOT_DEAD_LETTER_DIR")
+	if deadLetterDir != "" {
+		deadLetters, err = bot_infrastructure_kafka_embedded.New(bot_infrastructure_kafka_embedded.WithDir(deadLetterDir))
+		if err != nil {
+			return fmt.Errorf("could not open dead letters in %q: %w", deadLetterDir, err)
+		}
+		defer closeBus(deadLetters)
+	}
+
+	switch args[0] {
+	case "inspect":
+		return inspect(ctx, deadLetters)
+	case "replay":
+		flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+		id := flags.String("id", "", "the id of the dead letter to replay")
+		all := flags.Bool("all", false, "replay all the dead letters")
+		force := flags.Bool("force", false, "replay the dead letters that were already replayed too")
+		err = flags.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+		if *id == "" && !*all {
+			return ErrNothingToDo
+		}
+		return replay(ctx, deadLetters, bus, *id, *force)
+	default:
+		return ErrUnknownUsage
+	}
+}
+
+func openBus(ctx context.Context) (bot_infrastructure_kafka.Kafka, error) {
+	kafkaAddr := os.Getenv("BOT_KAFKA_ADDR")
+	if kafkaAddr != "" {
+		return bot_infastructure_kafka_segmentio.New(ctx, kafkaAddr), nil
+	}
+
+	busDir := os.Getenv("BOT_BUS_DIR")
+	if busDir != "" {
+		broker, err := bot_infrastructure_kafka_embedded.New(bot_infrastructure_kafka_embedded.WithDir(busDir))
+		if err != nil {
+			return nil, fmt.Errorf("could not open bus in %q: %w", busDir, err)
+		}
+		return broker, nil
+	}
+
+	return nil, ErrNoBus
+}
+
+// closeBus closes the bus, which sends the messages that are waiting to be sent
+func closeBus(bus bot_infrastructure_kafka.Kafka) {
+	if closer, ok := bus.(io.Closer); ok {
+		err := closer.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not close bus: %s\n", err)
+		}
+	}
+}
+
+func inspect(ctx context.Context, deadLetters bot_infrastructure_kafka.Kafka) error {
+	replayed, err := readReplayed(ctx, deadLetters)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tFAILED AT\tSTAGE\tTOPIC\tGROUP\tATTEMPTS\tREPLAYED AT\tERROR\tMESSAGE\n")
+
+	err = readDeadLetters(ctx, deadLetters, func(letter bot_infrastructure_kafka.DeadLetter) error {
+		replayedAt := "-"
+		if at, ok := replayed[letter.Id]; ok {
+			replayedAt = at.Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			letter.Id,
+			letter.FailedAt.Format(time.RFC3339),
+			letter.Stage,
+			letter.Topic,
+			letter.Group,
+			letter.Attempts,
+			replayedAt,
+			letter.Error,
+			letter.Value,
+		)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// replay sends the dead letter with the id back to its topic, or all of them if the id is empty,
+// the ones that were already replayed are skipped unless it's forced
+func replay(ctx context.Context, deadLetters bot_infrastructure_kafka.Kafka, bus bot_infrastructure_kafka.Kafka, id string, force bool) error {
+	replayed, err := readReplayed(ctx, deadLetters)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	sent := 0
+	skipped := 0
+	err = readDeadLetters(ctx, deadLetters, func(letter bot_infrastructure_kafka.DeadLetter) error {
+		if id != "" && letter.Id != id {
+			return nil
+		}
+		found = true
+
+		if _, ok := replayed[letter.Id]; ok && !force {
+			skipped++
+			return nil
+		}
+
+		err := bus.Send(letter.Topic, letter.Key, letter.Value)
+		if err != nil {
+			return fmt.Errorf("could not replay dead letter %s to topic %q: %w", letter.Id, letter.Topic, err)
+		}
+		sent++
+		fmt.Printf("replayed dead letter %s to topic %q\n", letter.Id, letter.Topic)
+
+		replayedAt := time.Now().UTC()
+		marker, err := json.Marshal(replayMarker{Id: letter.Id, ReplayedAt: replayedAt})
+		if err != nil {
+			return err
+		}
+		err = deadLetters.Send(bot_infrastructure_kafka.TopicDeadLetterReplayed, []byte(letter.Id), marker)
+		if err != nil {
+			return fmt.Errorf("replayed dead letter %s but could not record it, it's not skipped the next time: %w", letter.Id, err)
+		}
+		replayed[letter.Id] = replayedAt
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if id != "" && !found {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if id != "" && skipped > 0 {
+		return fmt.Errorf("%w: %s", ErrReplayed, id)
+	}
+	fmt.Printf("replayed %d dead letters, skipped %d that were already replayed\n", sent, skipped)
+
+	return nil
+}
+
+func readDeadLetters(ctx context.Context, deadLetters bot_infrastructure_kafka.Kafka, f func(letter bot_infrastructure_kafka.DeadLetter) error) error {
+	return deadLetters.Read(ctx, bot_infrastructure_kafka.TopicDeadLetter, func(ctx context.Context, msg bot_infrastructure_kafka.Message) error {
+		letter, err := bot_infrastructure_kafka.DecodeDeadLetter(msg.Value)
+		if err != nil {
+			return fmt.Errorf("dead letter at offset %d of partition %d: %w", msg.Offset, msg.Partition, err)
+		}
+
+		return f(letter)
+	})
+}
+
+// readReplayed returns when the dead letters that were replayed were last replayed, by their id
+func readReplayed(ctx context.Context, deadLetters bot_infrastructure_kafka.Kafka) (map[string]time.Time, error) {
+	replayed := make(map[string]time.Time)
+	err := deadLetters.Read(ctx, bot_infrastructure_kafka.TopicDeadLetterReplayed, func(ctx context.Context, msg bot_infrastructure_kafka.Message) error {
+		marker := replayMarker{}
+		err := json.Unmarshal(msg.Value, &marker)
+		if err != nil {
+			return fmt.Errorf("invalid replay marker at offset %d of partition %d: %w", msg.Offset, msg.Partition, err)
+		}
+		replayed[marker.Id] = marker.ReplayedAt
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read the replayed dead letters: %w", err)
+	}
+
+	return replayed, nil
+}
@@ -1,72 +1,376 @@
 package bot_app
 
 import (
+	"connectly-interview/internal/bot/domain/bot_auth"
 	"connectly-interview/internal/bot/domain/bot_chat"
 	"connectly-interview/internal/bot/domain/bot_prompter"
+	"connectly-interview/internal/bot/domain/bot_ratelimit"
+	"connectly-interview/internal/bot/domain/bot_usage"
+	"connectly-interview/internal/bot/infrastructure/chatlog"
 	"connectly-interview/internal/bot/infrastructure/kafka"
-	"connectly-interview/internal/bot/infrastructure/kafka/nokafka"
+	"connectly-interview/internal/bot/infrastructure/kafka/embedded"
 	"connectly-interview/internal/bot/infrastructure/kafka/segmentio"
+	"connectly-interview/internal/bot/infrastructure/llm"
+	"connectly-interview/internal/bot/infrastructure/llm/echo"
 	"connectly-interview/internal/bot/infrastructure/openai"
 	"connectly-interview/internal/bot/interfaces"
+	"connectly-interview/internal/bot/interfaces/daemon"
+	"connectly-interview/internal/bot/interfaces/grpc"
+	"connectly-interview/internal/bot/interfaces/http_server"
 	"connectly-interview/internal/bot/types"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"sync"
 	"time"
 )
 
+var (
+	ErrNoProvider = fmt.Errorf("no llm provider found")
+)
+
 const (
-	DefaultPromptTimeout       = time.Second * 30
+	DefaultPromptTimeout = time.Second * 30
+	// DefaultPingTimeout is how long to wait for the llm provider to answer the ping on start
+	DefaultPingTimeout         = time.Second * 10
 	DefaultWorkersAmount       = 30
 	DefaultQueueBuffer   uint8 = 125
 	DefaultChatsCapacity       = 256
+
+	// answerEventsBuffer is how many events of an answer wait to be sent to the bus before its chunks are dropped
+	answerEventsBuffer = 256
 )
 
 type Bot struct {
-	m              sync.RWMutex
-	ctx            context.Context
-	interfaces     *bot_interfaces.Interfaces
-	prompter       bot_prompter.Prompter
-	chats          *bot_chat.Chats
-	bus            bot_infrastructure_kafka.Kafka
-	openaiApiKey   string
-	newChatChan    <-chan struct{}
-	newChatMsgChan <-chan []byte
+	m                  sync.RWMutex
+	ctx                context.Context
+	interfaces         *bot_interfaces.Interfaces
+	prompter           bot_prompter.Prompter
+	chats              *bot_chat.Chats
+	chatStore          bot_chat.ChatStore
+	chatsCapacity      uint16
+	chatsIdleTimeout   time.Duration
+	onChatEvict        func(chat *bot_chat.Chat, reason bot_chat.EvictionReason)
+	bus                bot_infrastructure_kafka.Kafka
+	retryPolicy        bot_infrastructure_kafka.RetryPolicy
+	deadLetters        bot_infrastructure_kafka.Kafka
+	provider           bot_infrastructure_llm.Provider
+	model              bot_infrastructure_llm.Model
+	systemPrompt       string
+	contextTokenBudget int
+	workersAmount      uint8
+	queueBuffer        uint8
+	queueFullPolicy    bot_prompter.QueueFullPolicy
+	wsIdleTimeout      time.Duration
+	authenticator      bot_auth.Authenticator
+	limiter            bot_ratelimit.Limiter
+	prices             bot_usage.Prices
+	ledger             bot_usage.Ledger
+	// interfaceBuilds build and register the communication interfaces once all the options are applied
+	interfaceBuilds []func() error
+	// answerPublishers are done once the events of the last answer of each chat are sent to the bus
+	answerPublishers map[bot_chat.ChatId]chan struct{}
 }
 
 type Option func(b *Bot) error
 
 func WithOpenAiKey(key string) Option {
 	return func(b *Bot) error {
-		b.openaiApiKey = key
+		b.provider = openai.New(key)
 		return nil
 	}
 }
 
-func WithHttpServer(addr string) Option {
+// WithEchoProvider uses a local provider that needs no network or API key,
+// replying with the given script of answers or echoing the prompt back if there's none.
+func WithEchoProvider(script ...string) Option {
+	return func(b *Bot) error {
+		b.provider = bot_infrastructure_llm_echo.New(bot_infrastructure_llm_echo.WithScript(script...))
+		return nil
+	}
+}
+
+func WithProvider(provider bot_infrastructure_llm.Provider) Option {
+	return func(b *Bot) error {
+		b.provider = provider
+		return nil
+	}
+}
+
+// WithModel sets the model the answers are compiled with, instead of the provider's default one
+func WithModel(model bot_infrastructure_llm.Model) Option {
+	return func(b *Bot) error {
+		b.model = model
+		return nil
+	}
+}
+
+// WithSystemPrompt sets the system prompt that every new chat starts with
+func WithSystemPrompt(prompt string) Option {
+	return func(b *Bot) error {
+		b.systemPrompt = prompt
+		return nil
+	}
+}
+
+// WithContextTokenBudget limits how many tokens of a chat's history are sent to the model along with each prompt,
+// by default as much history as fits in the model's context window is sent
+func WithContextTokenBudget(tokens int) Option {
+	return func(b *Bot) error {
+		b.contextTokenBudget = tokens
+		return nil
+	}
+}
+
+// WithChatStore persists the chats to the store, by default they're only kept in memory
+func WithChatStore(store bot_chat.ChatStore) Option {
+	return func(b *Bot) error {
+		b.chatStore = store
+		return nil
+	}
+}
+
+// WithChatLog persists the chats to an append-only log file on the local disk,
+// so they survive restarts and deploys
+func WithChatLog(path string) Option {
 	return func(b *Bot) error {
-		err := b.interfaces.InitHttpServer(addr, nil, nil)
+		store, err := bot_infrastructure_chatlog.Open(path)
 		if err != nil {
-			return err
+			return fmt.Errorf("could not open chat log: %w", err)
 		}
+		b.chatStore = store
+		return nil
+	}
+}
+
+// WithChatsCapacity sets how many chats are kept open in memory,
+// when full the least recently used chat is closed to make room
+func WithChatsCapacity(capacity uint16) Option {
+	return func(b *Bot) error {
+		b.chatsCapacity = capacity
+		return nil
+	}
+}
+
+// WithChatsIdleTimeout closes the chats that are not used for that long
+func WithChatsIdleTimeout(timeout time.Duration) Option {
+	return func(b *Bot) error {
+		b.chatsIdleTimeout = timeout
+		return nil
+	}
+}
+
+// WithChatEvictionHandler is called with every chat that is closed from memory, e.g. to archive it
+func WithChatEvictionHandler(cb func(chat *bot_chat.Chat, reason bot_chat.EvictionReason)) Option {
+	return func(b *Bot) error {
+		b.onChatEvict = cb
+		return nil
+	}
+}
+
+// WithWorkers sets how many answers are compiled at the same time
+// and how many prompts can wait in the queue for a worker
+func WithWorkers(amount uint8, queueBuffer uint8) Option {
+	return func(b *Bot) error {
+		b.workersAmount = amount
+		b.queueBuffer = queueBuffer
+		return nil
+	}
+}
+
+// WithQueueFullPolicy decides what happens to new prompts when all the workers are busy and the queue is full,
+// by default they wait for room in the queue
+func WithQueueFullPolicy(policy bot_prompter.QueueFullPolicy) Option {
+	return func(b *Bot) error {
+		b.queueFullPolicy = policy
+		return nil
+	}
+}
+
+// WithRateLimit limits how many messages each user can send in a minute
+// and how many model tokens their messages and answers can cost in a day, 0 is unlimited.
+// A message over the limits is rejected with a *bot_ratelimit.RateLimitedError before it's queued.
+func WithRateLimit(requestsPerMinute int, tokensPerDay int) Option {
+	return func(b *Bot) error {
+		b.limiter = bot_ratelimit.New(bot_ratelimit.Args{
+			RequestsPerMinute: requestsPerMinute,
+			TokensPerDay:      tokensPerDay,
+		})
+		return nil
+	}
+}
+
+// WithPrices sets the prices of the models that the usage of the prompts is priced with,
+// by default they're bot_usage.DefaultPrices
+func WithPrices(prices bot_usage.Prices) Option {
+	return func(b *Bot) error {
+		b.prices = prices
+		return nil
+	}
+}
+
+// WithAuthenticator makes the clients of every communication interface present a token the authenticator accepts,
+// by default they're all the bot_auth.AnonymousUser
+func WithAuthenticator(authenticator bot_auth.Authenticator) Option {
+	return func(b *Bot) error {
+		b.authenticator = authenticator
+		return nil
+	}
+}
+
+// WithWebsocketIdleTimeout disconnects the websocket clients that send nothing for that long
+func WithWebsocketIdleTimeout(timeout time.Duration) Option {
+	return func(b *Bot) error {
+		b.wsIdleTimeout = timeout
+		return nil
+	}
+}
+
+func WithHttpServer(addr string) Option {
+	return func(b *Bot) error {
+		return WithInterface(bot_interfaces.InterfaceTypeHttpServer, func(handlers bot_interfaces.Handlers) (bot_interfaces.Interface, error) {
+			if handlers.NewChat == nil || handlers.NewChatMessage == nil {
+				return nil, fmt.Errorf("no chat handlers provided to http server")
+			}
+
+			return bot_interface_http.New(bot_interface_http.Server_Args{
+				Context:               b.ctx,
+				Address:               addr,
+				AuthenticateHandler:   handlers.Authenticate,
+				NewChatHandler:        handlers.NewChat,
+				NewChatMessageHandler: handlers.NewChatMessage,
+				CancelAnswerHandler:   handlers.CancelAnswer,
+				GetChatHandler:        handlers.GetChat,
+				GetHistoryHandler:     handlers.GetHistory,
+				ListChatsHandler:      handlers.ListChats,
+				DeleteChatHandler:     handlers.DeleteChat,
+				GetUsageHandler:       handlers.GetUsage,
+				GetChatUsageHandler:   handlers.GetChatUsage,
+				WebsocketIdleTimeout:  b.wsIdleTimeout,
+			}), nil
+		})(b)
+	}
+}
+
+// WithDaemon lets local clients talk to the bot through a unix domain socket at the path
+func WithDaemon(socketPath string) Option {
+	return func(b *Bot) error {
+		return WithInterface(bot_interfaces.InterfaceTypeDaemon, func(handlers bot_interfaces.Handlers) (bot_interfaces.Interface, error) {
+			return bot_interface_daemon.New(bot_interface_daemon.Args{
+				Context:               b.ctx,
+				SocketPath:            socketPath,
+				AuthenticateHandler:   handlers.Authenticate,
+				NewChatHandler:        handlers.NewChat,
+				NewChatMessageHandler: handlers.NewChatMessage,
+				CancelAnswerHandler:   handlers.CancelAnswer,
+				ListChatsHandler:      handlers.ListChats,
+				DeleteChatHandler:     handlers.DeleteChat,
+				GetChatHandler:        handlers.GetChat,
+			}), nil
+		})(b)
+	}
+}
+
+// WithGrpcServer lets backend services talk to the bot through the gRPC ChatService on the address
+func WithGrpcServer(addr string) Option {
+	return func(b *Bot) error {
+		return WithInterface(bot_interfaces.InterfaceTypeGrpc, func(handlers bot_interfaces.Handlers) (bot_interfaces.Interface, error) {
+			return bot_interface_grpc.New(bot_interface_grpc.Args{
+				Context:               b.ctx,
+				Address:               addr,
+				AuthenticateHandler:   handlers.Authenticate,
+				NewChatHandler:        handlers.NewChat,
+				NewChatMessageHandler: handlers.NewChatMessage,
+				CancelAnswerHandler:   handlers.CancelAnswer,
+				GetHistoryHandler:     handlers.GetHistory,
+				DeleteChatHandler:     handlers.DeleteChat,
+				GetChatHandler:        handlers.GetChat,
+			}), nil
+		})(b)
+	}
+}
+
+// WithInterface registers a communication interface under the name,
+// built with the handlers it should call when its clients talk to the bot.
+// It's built once all the options are applied, so it sees the settings of the options that come after it.
+func WithInterface(name string, build func(handlers bot_interfaces.Handlers) (bot_interfaces.Interface, error)) Option {
+	return func(b *Bot) error {
+		b.interfaceBuilds = append(b.interfaceBuilds, func() error {
+			iface, err := build(b.interfaces.Handlers())
+			if err != nil {
+				return fmt.Errorf("could not build communication interface %q: %w", name, err)
+			}
+
+			err = b.interfaces.Register(name, iface)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("initiated %s\n", name)
+
+			return nil
+		})
 
 		return nil
 	}
 }
 
-func WithKafka(addr string) Option {
+// WithKafka sends the messages of the bus to the Kafka brokers at the address,
+// the options tune its writer (batches, acks, compression) and its consumers
+func WithKafka(addr string, opts ...bot_infastructure_kafka_segmentio.Option) Option {
 	return func(b *Bot) error {
-		kafkaDialer := bot_infastructure_kafka_segmentio.New(b.ctx, addr)
+		kafkaDialer := bot_infastructure_kafka_segmentio.New(b.ctx, addr, opts...)
 		b.bus = kafkaDialer
 		return nil
 	}
 }
 
+// WithNoKafka uses a broker that runs inside the bot instead of Kafka, keeping the messages only in memory
 func WithNoKafka() Option {
 	return func(b *Bot) error {
-		kafkaDialer := bot_infrastructure_kafka_nokafka.NewNoKafka()
-		b.bus = kafkaDialer
+		broker, err := bot_infrastructure_kafka_embedded.New()
+		if err != nil {
+			return fmt.Errorf("could not start embedded broker: %w", err)
+		}
+		b.bus = broker
+		return nil
+	}
+}
+
+// WithEmbeddedKafka uses a broker that runs inside the bot instead of Kafka,
+// keeping the messages in the directory so that they survive restarts
+func WithEmbeddedKafka(dir string, opts ...bot_infrastructure_kafka_embedded.Option) Option {
+	return func(b *Bot) error {
+		broker, err := bot_infrastructure_kafka_embedded.New(append([]bot_infrastructure_kafka_embedded.Option{
+			bot_infrastructure_kafka_embedded.WithDir(dir),
+		}, opts...)...)
+		if err != nil {
+			return fmt.Errorf("could not start embedded broker: %w", err)
+		}
+		b.bus = broker
+		return nil
+	}
+}
+
+// WithRetryPolicy sets how many times the messages of the bus are sent or handled before they're sent
+// to the dead letters, and how long is waited in between, by default it's bot_infrastructure_kafka.DefaultRetryPolicy
+func WithRetryPolicy(policy bot_infrastructure_kafka.RetryPolicy) Option {
+	return func(b *Bot) error {
+		b.retryPolicy = policy
+		return nil
+	}
+}
+
+// WithDeadLetterDir keeps the dead letters in an embedded broker in the directory instead of the bus,
+// so the messages that could not be sent because the bus is down are not lost with it
+func WithDeadLetterDir(dir string) Option {
+	return func(b *Bot) error {
+		broker, err := bot_infrastructure_kafka_embedded.New(bot_infrastructure_kafka_embedded.WithDir(dir))
+		if err != nil {
+			return fmt.Errorf("could not start embedded broker of dead letters: %w", err)
+		}
+		b.deadLetters = broker
 		return nil
 	}
 }
@@ -74,77 +378,165 @@ func WithNoKafka() Option {
 func New(opts ...Option) (*Bot, error) {
 	// bot vars
 	ctx := context.Background()
-	bot := &Bot{}
-
-	newChatChan := make(chan struct{})
-	newChatMsgChan := make(chan []byte)
+	bot := &Bot{
+		chatsCapacity: DefaultChatsCapacity,
+		workersAmount: DefaultWorkersAmount,
+		queueBuffer:   DefaultQueueBuffer,
+		authenticator: bot_auth.NewAnonymous(),
+		limiter:       bot_ratelimit.New(bot_ratelimit.Args{}),
+
+		answerPublishers: make(map[bot_chat.ChatId]chan struct{}),
+	}
 
-	prompter := bot_prompter.New(bot_prompter.Args{
-		Context:           ctx,
-		PromptTimeout:     DefaultPromptTimeout,
-		WorkersAmount:     DefaultWorkersAmount,
-		PromptQueueBuffer: DefaultQueueBuffer,
-		ChatsCapacity:     DefaultChatsCapacity,
-	})
-	chats := bot_chat.NewChats(bot_chat.ChatsArgs{
-		Capacity: 24,
-	})
 	comm_interfaces := bot_interfaces.New(
 		ctx,
 		bot_interfaces.WithMessageQueueCapacity(24),
-		bot_interfaces.WithNewChatHandler(func() {
+		bot_interfaces.WithAuthenticateHandler(func(token string) (bot_auth.UserId, error) {
+			return bot.authenticator.Authenticate(token)
+		}),
+		bot_interfaces.WithNewChatHandler(func(ctx context.Context) (bot_chat.ChatId, error) {
 			if bot.bus == nil {
-				fmt.Printf("no bus found\n")
-				return
+				return bot_chat.ChatId{}, fmt.Errorf("no bus found")
 			}
 
-			_, err := chats.New(0)
+			user, err := bot_auth.UserFrom(ctx)
 			if err != nil {
-				fmt.Printf("could not create new chat: %s", err)
-				return
+				return bot_chat.ChatId{}, err
+			}
+
+			chat, err := bot.chats.New(user, 0)
+			if err != nil {
+				return bot_chat.ChatId{}, fmt.Errorf("could not create new chat: %w", err)
 			}
 			newChatBusMsg := types.Communication_interface_incoming_new_chat{
-				FromUser: "exapsy", // TODO: hard-written ...... we want this to be from the specific user that the chat was made from
+				FromUser: user.String(),
 			}
-			err = bot.bus.Send(bot_infrastructure_kafka.TopicPrompt, []byte(newChatBusMsg.Json()))
+			// the chat is already created, the client should get its id even if the bus is slow to accept the message
+			go func() {
+				err := bot.publish(types.EventNewChat, chat.Id(), user.String(), newChatBusMsg)
+				if err != nil {
+					fmt.Printf("could not send new chat %q to the bus: %s\n", chat.Id(), err)
+				}
+			}()
+
+			return chat.Id(), nil
+		}),
+		bot_interfaces.WithNewChatMessageHandler(func(ctx context.Context, chatId bot_chat.ChatId, msg []byte) error {
+			if bot.bus == nil {
+				return fmt.Errorf("no bus found")
+			}
+
+			_, err := bot.ownedChat(ctx, chatId)
 			if err != nil {
-				fmt.Printf("could not send : %s\n", err)
-				return
+				return err
+			}
+			// the chat stays open until the prompt is over, so the answer is recorded to the chat that's open
+			chat := bot.chats.Pin(chatId)
+			if chat == nil {
+				return fmt.Errorf("%w: %s", bot_chat.ErrChatNotFound, chatId)
 			}
 
+			// the limits are enforced before the message takes room in the queue with the estimated tokens of the prompt,
+			// what it really cost is charged once it's over, which refunds the messages that never reached the model
+			user := chat.Owner().String()
+			estimate := bot.prompter.Estimate(chat, string(msg))
+			err = bot.limiter.Take(user, estimate)
+			if err != nil {
+				bot.chats.Unpin(chatId)
+				return err
+			}
+
+			answerChan, err := bot.prompter.Prompt(&bot_prompter.Prompt{
+				Chat:    chat,
+				Msg:     string(msg),
+				Context: ctx,
+				OnUsage: func(usage bot_prompter.Usage) {
+					bot.limiter.Charge(user, usage.TotalTokens-estimate)
+					bot.recordUsage(chat, usage)
+					bot.chats.Unpin(chatId)
+				},
+			})
+			if err != nil {
+				return fmt.Errorf("could not prompt message %q: %w", string(msg), err)
+			}
+			bot.interfaces.Queued(chatId)
+
+			// the interfaces that wait for the answer of this very message give it an id, the others get a new one
+			promptId := bot_chat.PromptIdFrom(ctx)
+			if promptId == "" {
+				promptId = bot_chat.NewPromptId()
+			}
+			go bot.deliverAnswer(chat, promptId, answerChan)
+
+			return nil
 		}),
-		bot_interfaces.WithNewChatMessageHandler(func(chatId bot_chat.ChatId, msg []byte) error {
-			var err error
+		bot_interfaces.WithCancelAnswerHandler(func(ctx context.Context, chatId bot_chat.ChatId) error {
+			_, err := bot.ownedChat(ctx, chatId)
+			if err != nil {
+				return err
+			}
 
-			if bot.bus == nil {
-				return fmt.Errorf("no bus found")
+			return bot.prompter.Cancel(chatId)
+		}),
+		bot_interfaces.WithListChatsHandler(func(ctx context.Context) ([]bot_chat.ChatId, error) {
+			user, err := bot_auth.UserFrom(ctx)
+			if err != nil {
+				return nil, err
 			}
 
-			//newChatMsgBusMsg := types.Communication_interface_incoming_new_chat_reply{
-			//	ChatId: chatId,
-			//	Prompt: string(msg),
-			//}
+			return bot.chats.List(user)
+		}),
+		bot_interfaces.WithGetChatHandler(func(ctx context.Context, chatId bot_chat.ChatId) (*bot_chat.Chat, error) {
+			return bot.ownedChat(ctx, chatId)
+		}),
+		bot_interfaces.WithGetHistoryHandler(func(ctx context.Context, chatId bot_chat.ChatId) ([]bot_chat.Turn, error) {
+			chat, err := bot.ownedChat(ctx, chatId)
+			if err != nil {
+				return nil, err
+			}
 
-			prompt, err := openai.Prompt(bot.openaiApiKey, string(msg))
+			return chat.History(), nil
+		}),
+		bot_interfaces.WithDeleteChatHandler(func(ctx context.Context, chatId bot_chat.ChatId) error {
+			_, err := bot.ownedChat(ctx, chatId)
 			if err != nil {
 				return err
 			}
 
-			err = bot.bus.Send(bot_infrastructure_kafka.TopicPrompt, []byte(prompt))
+			err = bot.chats.Delete(chatId)
 			if err != nil {
-				return fmt.Errorf("could not send message %q to bus: %w", string(msg), err)
+				return err
+			}
+			bot.ledger.ForgetChat(chatId)
+
+			// nobody is waiting for the answers of a deleted chat
+			err = bot.prompter.Cancel(chatId)
+			if err != nil && !errors.Is(err, bot_prompter.ErrPromptNotFound) {
+				return err
 			}
 
 			return nil
 		}),
+		bot_interfaces.WithGetUsageHandler(func(ctx context.Context) (bot_usage.Report, error) {
+			user, err := bot_auth.UserFrom(ctx)
+			if err != nil {
+				return bot_usage.Report{}, err
+			}
+
+			return bot.ledger.User(user), nil
+		}),
+		bot_interfaces.WithGetChatUsageHandler(func(ctx context.Context, chatId bot_chat.ChatId) (bot_usage.Totals, error) {
+			_, err := bot.ownedChat(ctx, chatId)
+			if err != nil {
+				return bot_usage.Totals{}, err
+			}
+
+			return bot.ledger.Chat(chatId), nil
+		}),
 	)
 
-	bot.chats = chats
 	bot.ctx = ctx
 	bot.interfaces = comm_interfaces
-	bot.prompter = prompter
-	bot.newChatMsgChan = newChatMsgChan
-	bot.newChatChan = newChatChan
 
 	// apply options
 	for _, o := range opts {
@@ -154,17 +546,62 @@ func New(opts ...Option) (*Bot, error) {
 		}
 	}
 
+	if bot.provider == nil {
+		return nil, ErrNoProvider
+	}
+
+	for _, build := range bot.interfaceBuilds {
+		err := build()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if bot.bus != nil {
+		bot.bus = bot_infrastructure_kafka.NewRetrying(bot_infrastructure_kafka.RetryArgs{
+			Bus:         bot.bus,
+			Policy:      bot.retryPolicy,
+			DeadLetters: bot.deadLetters,
+		})
+	}
+
+	bot.ledger = bot_usage.New(bot_usage.Args{Prices: bot.prices})
+	bot.chats = bot_chat.NewChats(bot_chat.ChatsArgs{
+		Context:      ctx,
+		Capacity:     bot.chatsCapacity,
+		SystemPrompt: bot.systemPrompt,
+		Store:        bot.chatStore,
+		IdleTimeout:  bot.chatsIdleTimeout,
+		OnEvict:      bot.onChatEvict,
+	})
+	bot.prompter = bot_prompter.New(bot_prompter.Args{
+		Context:            ctx,
+		PromptTimeout:      DefaultPromptTimeout,
+		WorkersAmount:      bot.workersAmount,
+		PromptQueueBuffer:  bot.queueBuffer,
+		QueueFullPolicy:    bot.queueFullPolicy,
+		ChatsCapacity:      DefaultChatsCapacity,
+		Provider:           bot.provider,
+		Model:              bot.model,
+		ContextTokenBudget: bot.contextTokenBudget,
+	})
+
 	return bot, nil
 }
 
 func (b *Bot) Start() error {
-	var wg sync.WaitGroup
-
 	var err error
 
-	err = openai.Ping(b.openaiApiKey)
+	pingCtx, cancelPing := context.WithTimeout(b.ctx, DefaultPingTimeout)
+	defer cancelPing()
+	err = b.provider.Ping(pingCtx)
 	if err != nil {
-		return fmt.Errorf("could not ping to openai - make sure to provide the OpenAI key and that it is a valid one:\n%w", err)
+		return fmt.Errorf("could not ping the llm provider - if it's OpenAI make sure to provide the OpenAI key and that it is a valid one:\n%w", err)
+	}
+
+	err = b.chats.Start()
+	if err != nil {
+		return fmt.Errorf("failed to start chats: %w", err)
 	}
 
 	err = b.prompter.Start()
@@ -172,63 +609,215 @@ func (b *Bot) Start() error {
 		return fmt.Errorf("failed to start promtper: %w", err)
 	}
 
-	reqsChan := b.interfaces.Listen()
+	errs := b.interfaces.Start()
+	go func() {
+		for err := range errs {
+			fmt.Printf("error on communication interface: %s\n", err)
+		}
+	}()
+	// the messages of the chats are sent straight to the handlers,
+	// the interfaces close their prompts once they're stopped and that's when the bot stops too
+	for range b.interfaces.Listen() {
+	}
+	fmt.Printf("interfaces channel is closed, returning ...\n")
 
-	// Loop looking over prompt requests
-	for {
-		select {
-		case req, closed := <-reqsChan:
-			if closed {
-				fmt.Printf("interfaces channel is closed, returning ...")
-				return nil
-			}
-			// unmarshall msg prompt
-			msg := types.Communication_interface_incoming_msg{}
-			err = json.Unmarshal(req, &msg)
+	return nil
+}
+
+// ownedChat returns the chat if it belongs to the user of the context.
+// The chats of other users are not found, so that nobody learns which chats exist.
+func (b *Bot) ownedChat(ctx context.Context, chatId bot_chat.ChatId) (*bot_chat.Chat, error) {
+	user, err := bot_auth.UserFrom(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	chat := b.chats.Get(chatId)
+	if chat == nil || chat.Owner() != user {
+		return nil, fmt.Errorf("%w: %s", bot_chat.ErrChatNotFound, chatId)
+	}
+
+	return chat, nil
+}
+
+// deliverAnswer streams the deltas of an answer back to the communication interfaces and the bus as they come,
+// and once the answer is over, it sends the end of the answer to the interfaces and the whole answer to the bus.
+// An answer that fails ends with its error on the interfaces instead, and is not sent to the bus as an answer.
+// The interfaces never wait for the bus, the events are sent to it in the background.
+func (b *Bot) deliverAnswer(chat *bot_chat.Chat, promptId bot_chat.PromptId, answerChan <-chan bot_prompter.Delta) {
+	chatId := chat.Id()
+	user := chat.Owner().String()
+	events := b.publishAnswer(chatId, user)
+	defer close(events)
+
+	var answer []byte
+	for delta := range answerChan {
+		if delta.Err != nil {
+			err := b.interfaces.Fail(chatId, promptId, delta.Err)
 			if err != nil {
-				continue
+				fmt.Printf("could not send failed answer of chat %q: %s\n", chatId, err)
 			}
+			return
+		}
 
-			fmt.Printf("got message: %+v\n", msg)
+		answer = append(answer, delta.Content...)
+		err := b.interfaces.Answer(chatId, promptId, delta.Content, false)
+		if err != nil {
+			fmt.Printf("could not send partial answer of chat %q: %s\n", chatId, err)
+		}
+
+		chunkBusMsg := types.Communication_interface_outgoing_answer_chunk{
+			ChatId: chatId,
+			User:   user,
+			Chunk:  string(delta.Content),
+		}
+		select {
+		case events <- busEvent{eventType: types.EventAnswerChunk, payload: chunkBusMsg}:
+		default:
+			fmt.Printf("the bus is too slow, dropped partial answer of chat %q\n", chatId)
+		}
+	}
+
+	err := b.interfaces.Answer(chatId, promptId, answer, true)
+	if err != nil {
+		fmt.Printf("could not send answer of chat %q: %s\n", chatId, err)
+	}
+
+	answerBusMsg := types.Communication_interface_outgoing_answer{
+		ChatId: chatId,
+		User:   user,
+		Answer: string(answer),
+	}
+	// the clients already have the answer, only this goroutine waits for room
+	events <- busEvent{eventType: types.EventAnswer, payload: answerBusMsg}
+}
+
+// busEvent is an event that waits to be sent to the bus
+type busEvent struct {
+	eventType types.EventType
+	payload   any
+}
+
+// publishAnswer returns where the events of a chat's answer go, they're sent to the bus in the background
+// once the events of the chat's previous answers are, until it's closed
+func (b *Bot) publishAnswer(chatId bot_chat.ChatId, user string) chan<- busEvent {
+	events := make(chan busEvent, answerEventsBuffer)
+	done := make(chan struct{})
+
+	b.m.Lock()
+	previous := b.answerPublishers[chatId]
+	b.answerPublishers[chatId] = done
+	b.m.Unlock()
+
+	go func() {
+		defer func() {
+			b.m.Lock()
+			if b.answerPublishers[chatId] == done {
+				delete(b.answerPublishers, chatId)
+			}
+			b.m.Unlock()
+			close(done)
+		}()
 
-			// compile an answer
-			prompt := &bot_prompter.Prompt{}
-			responseChan, err := b.prompter.Prompt(prompt)
+		if previous != nil {
+			<-previous
+		}
+		for event := range events {
+			err := b.publish(event.eventType, chatId, user, event.payload)
 			if err != nil {
-				fmt.Printf("error on prompt %+v: %s", prompt, err)
+				fmt.Printf("could not send %s of chat %q to the bus: %s\n", event.eventType, chatId, err)
 			}
+		}
+	}()
 
-			fmt.Printf("got answer for message %q: %q\n", msg, prompt.Msg)
+	return events
+}
 
-			// Wait for response from the prompt
-			go func() {
-				wg.Add(1)
-				defer wg.Done()
-				// TODO:
-				//   should it be configurable?
-				//   Like "ReadPromptTimeout"?
-				//   And shouldn't we cancel the job then to put the prompt's worker at rest?
-				//   Things to think ... second part about the job could change the whole architecture of how workers work, with jobs
-				timeout := time.Second * 10
-				timeoutTicker := time.NewTicker(timeout)
-				for {
-					select {
-					case response := <-responseChan:
-						// Send response to bus
-						err = b.bus.Send(bot_infrastructure_kafka.TopicPrompt, response)
-						if err != nil {
-							fmt.Printf("error sending to msg %q to the bus: %s", err)
-							return
-						}
-					case <-timeoutTicker.C:
-						return
-					}
-				}
-			}()
+// eventTopics are the topics of the bus that every kind of event is sent to
+var eventTopics = map[types.EventType]bot_infrastructure_kafka.Topic{
+	types.EventNewChat:     bot_infrastructure_kafka.TopicNewChat,
+	types.EventAnswer:      bot_infrastructure_kafka.TopicAnswer,
+	types.EventAnswerChunk: bot_infrastructure_kafka.TopicAnswerChunk,
+	types.EventUsage:       bot_infrastructure_kafka.TopicUsage,
+}
+
+// publish sends the payload to the topic of its event type, in the envelope of an event of the chat
+func (b *Bot) publish(eventType types.EventType, chatId bot_chat.ChatId, user string, payload any) error {
+	event, err := types.NewEvent(eventType, chatId, user, payload)
+	if err != nil {
+		return err
+	}
+
+	return b.bus.Send(eventTopics[eventType], busKey(chatId), []byte(event.Json()))
+}
+
+// busKey is the key of the messages of the chat on the bus, so they're all in the same partition and in order,
+// the messages that are not about a chat have no key
+func busKey(chatId bot_chat.ChatId) []byte {
+	if chatId == (bot_chat.ChatId{}) {
+		return nil
+	}
+
+	return []byte(chatId.String())
+}
+
+// recordUsage adds what a prompt of the chat cost to the ledger and sends it to the bus,
+// the prompts that never reached the model cost nothing and are not recorded
+func (b *Bot) recordUsage(chat *bot_chat.Chat, usage bot_prompter.Usage) {
+	if usage.TotalTokens == 0 {
+		return
+	}
+
+	record := b.ledger.Record(bot_usage.Record{
+		ChatId:    chat.Id(),
+		User:      chat.Owner(),
+		Model:     usage.Model,
+		Usage:     usage.Usage,
+		Estimated: usage.Estimated,
+	})
+
+	usageBusMsg := types.Communication_interface_outgoing_usage{
+		ChatId:           record.ChatId,
+		User:             record.User.String(),
+		Model:            record.Model.String(),
+		PromptTokens:     record.PromptTokens,
+		CompletionTokens: record.CompletionTokens,
+		TotalTokens:      record.TotalTokens,
+		Estimated:        record.Estimated,
+		Cost:             record.Cost,
+		Priced:           record.Priced,
+		At:               record.At,
+	}
+	// the prompter calls this from its workers, which should not wait for the bus
+	go func() {
+		err := b.publish(types.EventUsage, record.ChatId, usageBusMsg.User, usageBusMsg)
+		if err != nil {
+			fmt.Printf("could not send usage of chat %q to the bus: %s\n", record.ChatId, err)
+		}
+	}()
+}
+
+// Stop stops the communication interfaces, once they're stopped Start returns,
+// and closes the bus if it has to be closed, e.g. to flush the files of an embedded broker
+func (b *Bot) Stop() error {
+	err := b.interfaces.Stop()
+
+	if closer, ok := b.bus.(io.Closer); ok {
+		closeErr := closer.Close()
+		if closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("could not close bus: %w", closeErr))
 		}
 	}
+
+	return err
 }
 
-func (b *Bot) Prompt(prompt string) error {
-	return nil
+// PrompterStats returns how loaded the prompter's queue is and what each of its workers has done so far
+func (b *Bot) PrompterStats() bot_prompter.Stats {
+	return b.prompter.Stats()
+}
+
+// Usage returns the ledger of what the prompts cost, e.g. to charge every user back
+func (b *Bot) Usage() bot_usage.Ledger {
+	return b.ledger
 }
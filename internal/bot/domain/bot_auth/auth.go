@@ -0,0 +1,95 @@
+// Package bot_auth tells who the clients of the bot are.
+//
+// Every communication interface hands the token of its client to an Authenticator,
+// and the user it returns is carried along with the client's calls in their context.
+// The chats belong to the user that created them, and only that user can read and write them.
+package bot_auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrUnauthenticated = fmt.Errorf("unauthenticated")
+)
+
+// UserId is who a client is
+type UserId string
+
+func (id UserId) String() string {
+	return string(id)
+}
+
+// AnonymousUser is every client when the bot has no authenticator,
+// and the owner of the chats that were stored before they had owners
+const AnonymousUser UserId = "anonymous"
+
+// Authenticator is the interface that describes
+// how the token a client presents is turned to the user it belongs to.
+type Authenticator interface {
+	// Authenticate returns the user of the token, or an ErrUnauthenticated
+	Authenticate(token string) (UserId, error)
+}
+
+// anonymous lets every client in as the AnonymousUser
+type anonymous struct{}
+
+// NewAnonymous returns the authenticator of a bot that does not authenticate its clients,
+// any token, even none, is the AnonymousUser
+func NewAnonymous() Authenticator {
+	return anonymous{}
+}
+
+func (anonymous) Authenticate(token string) (UserId, error) {
+	return AnonymousUser, nil
+}
+
+// chain is many authenticators, e.g. API keys for the services and JWTs for the users
+type chain []Authenticator
+
+// NewChain returns an authenticator that asks the authenticators in order,
+// the token belongs to the user of the first one that accepts it
+func NewChain(authenticators ...Authenticator) Authenticator {
+	return chain(authenticators)
+}
+
+func (c chain) Authenticate(token string) (UserId, error) {
+	errs := make([]error, 0, len(c))
+	for _, authenticator := range c {
+		user, err := authenticator.Authenticate(token)
+		if err == nil {
+			return user, nil
+		}
+		errs = append(errs, err)
+	}
+
+	if len(errs) == 0 {
+		return "", fmt.Errorf("%w: no authenticator", ErrUnauthenticated)
+	}
+
+	err := errors.Join(errs...)
+	if !errors.Is(err, ErrUnauthenticated) {
+		err = fmt.Errorf("%w: %w", ErrUnauthenticated, err)
+	}
+
+	return "", err
+}
+
+type userKey struct{}
+
+// WithUser returns a copy of the context that carries the authenticated user
+func WithUser(ctx context.Context, user UserId) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// UserFrom returns the user the context was authenticated as, or ErrUnauthenticated if it was not
+func UserFrom(ctx context.Context) (UserId, error) {
+	user, ok := ctx.Value(userKey{}).(UserId)
+	if !ok || user == "" {
+		return "", ErrUnauthenticated
+	}
+
+	return user, nil
+}
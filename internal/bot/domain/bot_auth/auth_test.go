@@ -0,0 +1,143 @@
+package bot_auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type AuthTestSuite struct {
+	suite.Suite
+	key []byte
+	now time.Time
+}
+
+func (suite *AuthTestSuite) SetupTest() {
+	suite.key = []byte("secret")
+	suite.now = time.Unix(1700000000, 0)
+}
+
+func (suite *AuthTestSuite) newJWT(args JWTArgs) Authenticator {
+	args.Key = suite.key
+	authenticator := NewJWT(args).(*jwt)
+	authenticator.now = func() time.Time { return suite.now }
+	return authenticator
+}
+
+// sign returns a token of the claims signed with HS256, whatever algorithm its header says
+func (suite *AuthTestSuite) sign(alg string, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	suite.Require().NoError(err)
+	payload, err := json.Marshal(claims)
+	suite.Require().NoError(err)
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, suite.key)
+	mac.Write([]byte(unsigned))
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (suite *AuthTestSuite) TestStaticKeys() {
+	authenticator := NewStaticKeys(map[string]UserId{"key-a": "alice", "key-b": "bob"})
+
+	user, err := authenticator.Authenticate("key-b")
+	suite.NoError(err)
+	suite.Equal(UserId("bob"), user)
+
+	for _, token := range []string{"", "key-c", "key-a "} {
+		_, err = authenticator.Authenticate(token)
+		suite.ErrorIs(err, ErrUnauthenticated, token)
+	}
+}
+
+func (suite *AuthTestSuite) TestJWT() {
+	authenticator := suite.newJWT(JWTArgs{Issuer: "idp", Audience: "bot", Leeway: time.Minute})
+	valid := map[string]interface{}{
+		"sub": "alice",
+		"iss": "idp",
+		"aud": []string{"bot", "other"},
+		"exp": suite.now.Add(time.Hour).Unix(),
+		"nbf": suite.now.Add(-time.Hour).Unix(),
+	}
+
+	user, err := authenticator.Authenticate(suite.sign("HS256", valid))
+	suite.NoError(err)
+	suite.Equal(UserId("alice"), user)
+
+	with := func(claim string, value interface{}) map[string]interface{} {
+		claims := make(map[string]interface{}, len(valid))
+		for k, v := range valid {
+			claims[k] = v
+		}
+		if value == nil {
+			delete(claims, claim)
+		} else {
+			claims[claim] = value
+		}
+		return claims
+	}
+
+	// within the leeway
+	_, err = authenticator.Authenticate(suite.sign("HS256", with("exp", suite.now.Add(-time.Second*30).Unix())))
+	suite.NoError(err)
+	_, err = authenticator.Authenticate(suite.sign("HS256", with("aud", "bot")))
+	suite.NoError(err)
+
+	for name, token := range map[string]string{
+		"expired":        suite.sign("HS256", with("exp", suite.now.Add(-time.Hour).Unix())),
+		"not yet valid":  suite.sign("HS256", with("nbf", suite.now.Add(time.Hour).Unix())),
+		"other issuer":   suite.sign("HS256", with("iss", "someone")),
+		"other audience": suite.sign("HS256", with("aud", "other")),
+		"no subject":     suite.sign("HS256", with("sub", nil)),
+		"alg none":       suite.sign("none", valid),
+		"wrong alg":      suite.sign("HS512", valid),
+		"tampered":       suite.sign("HS256", valid) + "x",
+		"not a jwt":      "key-a",
+	} {
+		_, err = authenticator.Authenticate(token)
+		suite.ErrorIs(err, ErrUnauthenticated, name)
+	}
+
+	suite.key = []byte("other secret")
+	_, err = authenticator.Authenticate(suite.sign("HS256", valid))
+	suite.ErrorIs(err, ErrUnauthenticated, "signed with another key")
+}
+
+func (suite *AuthTestSuite) TestChain() {
+	authenticator := NewChain(NewStaticKeys(map[string]UserId{"key-a": "service"}), suite.newJWT(JWTArgs{}))
+
+	user, err := authenticator.Authenticate("key-a")
+	suite.NoError(err)
+	suite.Equal(UserId("service"), user)
+
+	user, err = authenticator.Authenticate(suite.sign("HS256", map[string]interface{}{"sub": "alice"}))
+	suite.NoError(err)
+	suite.Equal(UserId("alice"), user)
+
+	_, err = authenticator.Authenticate("key-b")
+	suite.ErrorIs(err, ErrUnauthenticated)
+}
+
+func (suite *AuthTestSuite) TestContextCarriesTheUser() {
+	_, err := UserFrom(context.Background())
+	suite.ErrorIs(err, ErrUnauthenticated)
+
+	user, err := UserFrom(WithUser(context.Background(), "alice"))
+	suite.NoError(err)
+	suite.Equal(UserId("alice"), user)
+
+	user, err = NewAnonymous().Authenticate("")
+	suite.NoError(err)
+	suite.Equal(AnonymousUser, user)
+}
+
+func TestAuthTestSuite(t *testing.T) {
+	suite.Run(t, new(AuthTestSuite))
+}
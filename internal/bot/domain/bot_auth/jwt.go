@@ -0,0 +1,155 @@
+package bot_auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+// jwtAlgorithms are the HMAC algorithms the JWTs can be signed with, "none" and the asymmetric ones are rejected
+var jwtAlgorithms = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+// jwt verifies JSON Web Tokens signed with a key that's shared with their issuer
+type jwt struct {
+	key      []byte
+	issuer   string
+	audience string
+	leeway   time.Duration
+	now      func() time.Time
+}
+
+type JWTArgs struct {
+	// Key is the HMAC key the tokens are signed with
+	Key []byte
+	// Issuer, if provided, is the only "iss" the tokens are accepted from
+	Issuer string
+	// Audience, if provided, has to be one of the "aud" of the tokens
+	Audience string
+	// Leeway is how much the clocks of the issuer and the bot may differ when the times of the tokens are checked
+	Leeway time.Duration
+}
+
+// NewJWT returns an authenticator of the JWTs signed with HMAC,
+// the user of a token is its "sub" and the token is not accepted before its "nbf" or after its "exp"
+func NewJWT(args JWTArgs) Authenticator {
+	return &jwt{
+		key:      args.Key,
+		issuer:   args.Issuer,
+		audience: args.Audience,
+		leeway:   args.Leeway,
+		now:      time.Now,
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+}
+
+type jwtClaims struct {
+	Sub string      `json:"sub"`
+	Iss string      `json:"iss,omitempty"`
+	Aud jwtAudience `json:"aud,omitempty"`
+	Exp *int64      `json:"exp,omitempty"`
+	Nbf *int64      `json:"nbf,omitempty"`
+}
+
+// jwtAudience is the "aud" claim, which is either a single audience or many of them
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		return json.Unmarshal(data, (*[]string)(a))
+	}
+
+	var audience string
+	err := json.Unmarshal(data, &audience)
+	if err != nil {
+		return err
+	}
+	*a = jwtAudience{audience}
+
+	return nil
+}
+
+func (j *jwt) Authenticate(token string) (UserId, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("%w: not a jwt", ErrUnauthenticated)
+	}
+
+	var header jwtHeader
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid jwt header: %s", ErrUnauthenticated, err)
+	}
+	newHash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return "", fmt.Errorf("%w: unsupported jwt algorithm %q", ErrUnauthenticated, header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid jwt signature: %s", ErrUnauthenticated, err)
+	}
+	mac := hmac.New(newHash, j.key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", fmt.Errorf("%w: wrong jwt signature", ErrUnauthenticated)
+	}
+
+	var claims jwtClaims
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid jwt claims: %s", ErrUnauthenticated, err)
+	}
+
+	now := j.now()
+	if claims.Exp != nil && now.After(time.Unix(*claims.Exp, 0).Add(j.leeway)) {
+		return "", fmt.Errorf("%w: jwt expired", ErrUnauthenticated)
+	}
+	if claims.Nbf != nil && now.Before(time.Unix(*claims.Nbf, 0).Add(-j.leeway)) {
+		return "", fmt.Errorf("%w: jwt not valid yet", ErrUnauthenticated)
+	}
+	if j.issuer != "" && claims.Iss != j.issuer {
+		return "", fmt.Errorf("%w: jwt of unknown issuer %q", ErrUnauthenticated, claims.Iss)
+	}
+	if j.audience != "" && !claims.Aud.contains(j.audience) {
+		return "", fmt.Errorf("%w: jwt is not meant for %q", ErrUnauthenticated, j.audience)
+	}
+	if claims.Sub == "" {
+		return "", fmt.Errorf("%w: jwt has no subject", ErrUnauthenticated)
+	}
+
+	return UserId(claims.Sub), nil
+}
+
+func (a jwtAudience) contains(audience string) bool {
+	for _, aud := range a {
+		if aud == audience {
+			return true
+		}
+	}
+
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
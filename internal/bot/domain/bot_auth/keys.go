@@ -0,0 +1,37 @@
+package bot_auth
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// staticKeys are API keys that are known ahead, each one of a user
+type staticKeys struct {
+	// keys are the users by the sha256 of their keys,
+	// so the lookup does not leak how much of a key is right through its timing
+	keys map[[sha256.Size]byte]UserId
+}
+
+// NewStaticKeys returns an authenticator of the API keys, the map is the user of each key
+func NewStaticKeys(keys map[string]UserId) Authenticator {
+	hashed := make(map[[sha256.Size]byte]UserId, len(keys))
+	for key, user := range keys {
+		hashed[sha256.Sum256([]byte(key))] = user
+	}
+
+	return &staticKeys{keys: hashed}
+}
+
+func (s *staticKeys) Authenticate(token string) (UserId, error) {
+	if token == "" {
+		return "", fmt.Errorf("%w: no api key", ErrUnauthenticated)
+	}
+
+	hash := sha256.Sum256([]byte(token))
+	user, ok := s.keys[hash]
+	if !ok {
+		return "", fmt.Errorf("%w: unknown api key", ErrUnauthenticated)
+	}
+
+	return user, nil
+}
@@ -1,13 +1,16 @@
 package bot_chat
 
 import (
-	"connectly-interview/internal/libs/lists"
+	"connectly-interview/internal/bot/domain/bot_auth"
+	"context"
 	"fmt"
 	"github.com/google/uuid"
+	"sync"
+	"time"
 )
 
 var (
-	ErrChatsCapacityFull = fmt.Errorf("chats' capacity is full")
+	ErrChatNotFound = fmt.Errorf("chat not found")
 )
 
 type ChatId uuid.UUID
@@ -21,107 +24,229 @@ func NewChatId() ChatId {
 	return ChatId(uuid)
 }
 
+func (id ChatId) String() string {
+	return uuid.UUID(id).String()
+}
+
+// MarshalText marshals the chat id as a uuid string instead of an array of bytes
+func (id ChatId) MarshalText() ([]byte, error) {
+	return uuid.UUID(id).MarshalText()
+}
+
+func (id *ChatId) UnmarshalText(data []byte) error {
+	return (*uuid.UUID)(id).UnmarshalText(data)
+}
+
+// PromptId is the id of a message that is sent to a chat, its answer is sent back with it,
+// so that the client that sent the message gets its answer and not the answer of another message of the chat
+type PromptId string
+
+func NewPromptId() PromptId {
+	return PromptId(uuid.NewString())
+}
+
+type promptIdKey struct{}
+
+// WithPromptId returns a copy of the context that carries the id of the message it's sent with
+func WithPromptId(ctx context.Context, id PromptId) context.Context {
+	return context.WithValue(ctx, promptIdKey{}, id)
+}
+
+// PromptIdFrom returns the id of the message the context carries, empty if it carries none
+func PromptIdFrom(ctx context.Context) PromptId {
+	id, _ := ctx.Value(promptIdKey{}).(PromptId)
+	return id
+}
+
+const (
+	DefaultHistoryCapacity uint16 = 1024
+)
+
+// Role is who said a turn of the chat
+type Role string
+
+func (r Role) String() string {
+	return string(r)
+}
+
+const (
+	// RoleSystem is an instruction to the bot on how to behave throughout the chat
+	RoleSystem    Role = "system"
+	RoleUser      Role = "user"
+	RoleAssistant Role = "assistant"
+)
+
+// Turn is a single message of the chat's history
+type Turn struct {
+	Role      Role      `json:"role"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
 type Chat struct {
+	m               sync.RWMutex
 	id              ChatId
-	history         [][]byte
+	owner           bot_auth.UserId
+	createdAt       time.Time
+	history         []Turn
 	historyCapacity uint16
+	lastUsedAt      time.Time
+	// store is where the chat's turns are persisted, if nil they're only kept in memory
+	store ChatStore
+	// onUse is called whenever the chat is used, so the chats can tell which one is the least recently used
+	onUse func(chat *Chat)
 }
 
 type Args struct {
+	// Owner is the user the chat belongs to, the only one that can read and write it
+	Owner bot_auth.UserId
+	// HistoryCapacity is how many turns the chat remembers, system turns included.
+	// When full, the oldest non-system turn is forgotten.
 	HistoryCapacity uint16
+	// SystemPrompt, if any, is the first turn of the chat
+	SystemPrompt string
 }
 
 func New(args Args) *Chat {
-	chatId := NewChatId()
-	history := make([][]byte, args.HistoryCapacity)
-	return &Chat{
-		id:              chatId,
-		history:         history,
+	if args.HistoryCapacity == 0 {
+		args.HistoryCapacity = DefaultHistoryCapacity
+	}
+
+	chat := &Chat{
+		id:              NewChatId(),
+		owner:           args.Owner,
+		createdAt:       time.Now(),
+		lastUsedAt:      time.Now(),
+		history:         make([]Turn, 0),
 		historyCapacity: args.HistoryCapacity,
 	}
-}
 
-func (c *Chat) Id() ChatId {
-	return c.id
+	if args.SystemPrompt != "" {
+		chat.appendTurn(Turn{
+			Role:      RoleSystem,
+			Content:   args.SystemPrompt,
+			CreatedAt: chat.createdAt,
+		})
+	}
+
+	return chat
 }
 
-func (c *Chat) AppendAnswer(answer []byte) {
-	if uint16(len(c.history)) > c.historyCapacity {
-		curHistorySize := len(c.history)
-		c.history = c.history[:curHistorySize-1]
+// fromRecord brings a stored chat back to life, remembering only the turns that fit in its history
+func fromRecord(record *ChatRecord, historyCapacity uint16, store ChatStore) *Chat {
+	if historyCapacity == 0 {
+		historyCapacity = DefaultHistoryCapacity
+	}
+
+	chat := &Chat{
+		id:              record.Id,
+		owner:           record.owner(),
+		createdAt:       record.CreatedAt,
+		lastUsedAt:      time.Now(),
+		history:         make([]Turn, 0, len(record.Turns)),
+		historyCapacity: historyCapacity,
+		store:           store,
+	}
+
+	for _, turn := range record.Turns {
+		chat.appendTurn(turn)
 	}
-	c.history = append(c.history, answer)
+
+	return chat
 }
 
-type Chats struct {
-	items      map[ChatId]*Chat
-	itemsQueue *lists.Queue[*Chat]
-	capacity   uint16
-	length     uint16
+func (c *Chat) Id() ChatId {
+	return c.id
 }
 
-type ChatsArgs struct {
-	Capacity uint16
+// Owner returns the user the chat belongs to
+func (c *Chat) Owner() bot_auth.UserId {
+	return c.owner
 }
 
-func NewChats(args ChatsArgs) *Chats {
-	chatsMap := make(map[ChatId]*Chat, args.Capacity)
-	return &Chats{
-		items:      chatsMap,
-		capacity:   args.Capacity,
-		itemsQueue: nil,
-		length:     0,
-	}
+func (c *Chat) CreatedAt() time.Time {
+	return c.createdAt
 }
 
-func (c *Chats) Get(chatId ChatId) *Chat {
-	if c.items == nil {
-		c.items = make(map[ChatId]*Chat)
-	}
-	chat, ok := c.items[chatId]
-	if !ok {
-		return nil
-	}
-	return chat
+// LastUsedAt returns when the chat was last read or written to through the chats
+func (c *Chat) LastUsedAt() time.Time {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	return c.lastUsedAt
 }
 
-func (c *Chats) Delete(chatId ChatId) error {
-	if c.length == 0 {
-		return fmt.Errorf("no chats exist")
-	}
+func (c *Chat) setLastUsedAt(t time.Time) {
+	c.m.Lock()
+	defer c.m.Unlock()
 
-	chat, found := c.items[chatId]
-	if !found {
-		return fmt.Errorf("chat with id %q not found", chatId)
+	c.lastUsedAt = t
+}
+
+// AppendTurn records a turn to the chat's history and to the chat's store, if any,
+// forgetting the oldest non-system turn if the history is full.
+func (c *Chat) AppendTurn(role Role, content string) error {
+	turn := Turn{
+		Role:      role,
+		Content:   content,
+		CreatedAt: time.Now(),
 	}
 
-	// delete from queue
-	err := c.itemsQueue.Delete(chat)
-	if err != nil {
-		return fmt.Errorf("could not delete chat with id %q from the chat queue", chatId)
+	if c.store != nil {
+		err := c.store.AppendTurn(c.id, turn)
+		if err != nil {
+			return fmt.Errorf("could not store turn of chat %q: %w", c.id, err)
+		}
 	}
 
-	// remove from hashmap
-	delete(c.items, chatId)
+	c.appendTurn(turn)
 
-	c.length--
+	if c.onUse != nil {
+		c.onUse(c)
+	}
 
 	return nil
 }
 
-func (c *Chats) New(historyCapacity uint16) (*Chat, error) {
-	// full capacity reached
-	if c.length >= c.capacity {
-		return nil, ErrChatsCapacityFull
+func (c *Chat) appendTurn(turn Turn) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.history = append(c.history, turn)
+
+	if uint16(len(c.history)) <= c.historyCapacity {
+		return
+	}
+
+	for i, turn := range c.history {
+		if turn.Role != RoleSystem {
+			c.history = append(c.history[:i], c.history[i+1:]...)
+			return
+		}
 	}
+}
+
+func (c *Chat) AppendAnswer(answer []byte) error {
+	return c.AppendTurn(RoleAssistant, string(answer))
+}
 
-	newChat := New(Args{
-		HistoryCapacity: historyCapacity,
-	})
+// History returns a copy of the chat's turns, oldest first
+func (c *Chat) History() []Turn {
+	c.m.RLock()
+	defer c.m.RUnlock()
 
-	c.itemsQueue.Enqueue(newChat)
-	c.items[newChat.id] = newChat
-	c.length++
+	history := make([]Turn, len(c.history))
+	copy(history, c.history)
 
-	return newChat, nil
+	return history
+}
+
+// record returns the chat as it should be kept in a ChatStore
+func (c *Chat) record() ChatRecord {
+	return ChatRecord{
+		Id:        c.id,
+		Owner:     c.owner,
+		CreatedAt: c.createdAt,
+		Turns:     c.History(),
+	}
 }
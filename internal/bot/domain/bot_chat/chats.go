@@ -0,0 +1,386 @@
+package bot_chat
+
+import (
+	"connectly-interview/internal/bot/domain/bot_auth"
+	"connectly-interview/internal/libs/lists"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrChatsCapacityFull = fmt.Errorf("chats' capacity is full")
+)
+
+// EvictionReason is why a chat was closed from memory
+type EvictionReason uint8
+
+const (
+	// EvictionReasonCapacity is when the least recently used chat made room for another one
+	EvictionReasonCapacity EvictionReason = iota + 1
+	// EvictionReasonIdle is when the chat was not used for longer than the idle timeout
+	EvictionReasonIdle
+)
+
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictionReasonCapacity:
+		return "capacity"
+	case EvictionReasonIdle:
+		return "idle"
+	default:
+		return "unknown"
+	}
+}
+
+// Chats are the chats that currently are open in memory.
+// If the capacity is full the least recently used chat is closed to make room,
+// it's still kept in the store and opened again the next time it's asked for.
+// The pinned chats are never closed, if all of them are pinned the capacity is exceeded until they're unpinned.
+type Chats struct {
+	m     sync.Mutex
+	ctx   context.Context
+	items map[ChatId]*lists.DoubleLinkedNode[*Chat]
+	// itemsQueue has the open chats that are not pinned ordered from the least recently used to the most recently used
+	itemsQueue *lists.Queue[*Chat]
+	// pins counts how many times each pinned chat is pinned
+	pins         map[ChatId]int
+	capacity     uint16
+	length       uint16
+	systemPrompt string
+	store        ChatStore
+	idleTimeout  time.Duration
+	onEvict      func(chat *Chat, reason EvictionReason)
+}
+
+type ChatsArgs struct {
+	Context  context.Context
+	Capacity uint16
+	// SystemPrompt is the system prompt that every new chat starts with
+	SystemPrompt string
+	// Store is where the chats are persisted, if nil they're only kept in memory
+	Store ChatStore
+	// IdleTimeout, if not zero, closes the chats that are not used for that long
+	IdleTimeout time.Duration
+	// OnEvict is called with every chat that is closed to make room or because it was idle, e.g. to archive it
+	OnEvict func(chat *Chat, reason EvictionReason)
+}
+
+func NewChats(args ChatsArgs) *Chats {
+	if args.Context == nil {
+		args.Context = context.Background()
+	}
+
+	if args.Store == nil {
+		args.Store = NewMemoryStore()
+	}
+
+	chatsMap := make(map[ChatId]*lists.DoubleLinkedNode[*Chat], args.Capacity)
+	return &Chats{
+		ctx:          args.Context,
+		items:        chatsMap,
+		capacity:     args.Capacity,
+		itemsQueue:   lists.NewQueue[*Chat](),
+		pins:         make(map[ChatId]int),
+		length:       0,
+		systemPrompt: args.SystemPrompt,
+		store:        args.Store,
+		idleTimeout:  args.IdleTimeout,
+		onEvict:      args.OnEvict,
+	}
+}
+
+// Start starts sweeping the idle chats away, if there's an idle timeout
+func (c *Chats) Start() error {
+	if c.idleTimeout <= 0 {
+		return nil
+	}
+
+	go func() {
+		ticker := time.NewTicker(c.idleTimeout / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				c.Sweep()
+			case <-c.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Sweep closes the chats that were not used for longer than the idle timeout
+func (c *Chats) Sweep() {
+	if c.idleTimeout <= 0 {
+		return
+	}
+
+	var evicted []*Chat
+
+	c.m.Lock()
+	idleSince := time.Now().Add(-c.idleTimeout)
+	for {
+		chat, err := c.itemsQueue.Peek()
+		if err != nil || chat.LastUsedAt().After(idleSince) {
+			break
+		}
+
+		c.remove(chat.id)
+		evicted = append(evicted, chat)
+	}
+	c.m.Unlock()
+
+	for _, chat := range evicted {
+		c.evicted(chat, EvictionReasonIdle)
+	}
+}
+
+// Get returns the chat, loading it from the store if it's not open in memory,
+// or nil if the chat does not exist.
+func (c *Chats) Get(chatId ChatId) *Chat {
+	c.m.Lock()
+	node, ok := c.items[chatId]
+	if ok {
+		c.touch(node)
+		c.m.Unlock()
+		return node.Value()
+	}
+	c.m.Unlock()
+
+	record, err := c.store.Get(chatId)
+	if err != nil {
+		if !errors.Is(err, ErrChatNotFound) {
+			fmt.Printf("could not load chat %q from the store: %s\n", chatId, err)
+		}
+		return nil
+	}
+
+	c.m.Lock()
+	// it may have been loaded while we were reading the store
+	if node, ok := c.items[chatId]; ok {
+		c.touch(node)
+		c.m.Unlock()
+		return node.Value()
+	}
+
+	chat := fromRecord(record, 0, c.store)
+	evicted, err := c.add(chat)
+	c.m.Unlock()
+
+	if evicted != nil {
+		c.evicted(evicted, EvictionReasonCapacity)
+	}
+	if err != nil {
+		fmt.Printf("could not open chat %q: %s\n", chatId, err)
+		return nil
+	}
+
+	return chat
+}
+
+// Pin returns the chat like Get does, and keeps it open until it's unpinned as many times as it was pinned,
+// e.g. while it has prompts that are queued or answered, so their turns are recorded to the chat that's open.
+func (c *Chats) Pin(chatId ChatId) *Chat {
+	for {
+		chat := c.Get(chatId)
+		if chat == nil {
+			return nil
+		}
+
+		c.m.Lock()
+		node, ok := c.items[chatId]
+		if ok && node.Value() == chat {
+			c.pin(node)
+			c.m.Unlock()
+			return chat
+		}
+		// it was closed to make room for another chat before it was pinned
+		c.m.Unlock()
+	}
+}
+
+// Unpin releases a pin of the chat, once it's not pinned anymore it's closed like any other chat
+func (c *Chats) Unpin(chatId ChatId) {
+	var evicted []*Chat
+
+	c.m.Lock()
+	node, ok := c.items[chatId]
+	if !ok || c.pins[chatId] == 0 {
+		c.m.Unlock()
+		return
+	}
+	c.pins[chatId]--
+	if c.pins[chatId] > 0 {
+		c.m.Unlock()
+		return
+	}
+	delete(c.pins, chatId)
+
+	chat := node.Value()
+	chat.setLastUsedAt(time.Now())
+	c.items[chatId] = c.itemsQueue.Enqueue(chat)
+	// the chats that were opened while every chat was pinned are closed now that there's one to close
+	for c.length > c.capacity {
+		lru, err := c.itemsQueue.Peek()
+		if err != nil {
+			break
+		}
+		c.remove(lru.id)
+		evicted = append(evicted, lru)
+	}
+	c.m.Unlock()
+
+	for _, chat := range evicted {
+		c.evicted(chat, EvictionReasonCapacity)
+	}
+}
+
+// List returns the ids of the stored chats of the owner, open or not
+func (c *Chats) List(owner bot_auth.UserId) ([]ChatId, error) {
+	return c.store.List(owner)
+}
+
+func (c *Chats) Delete(chatId ChatId) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	err := c.store.Delete(chatId)
+	if err != nil {
+		return fmt.Errorf("could not delete chat with id %q from the store: %w", chatId, err)
+	}
+
+	c.remove(chatId)
+
+	return nil
+}
+
+// New creates a chat of the owner
+func (c *Chats) New(owner bot_auth.UserId, historyCapacity uint16) (*Chat, error) {
+	newChat := New(Args{
+		Owner:           owner,
+		HistoryCapacity: historyCapacity,
+		SystemPrompt:    c.systemPrompt,
+	})
+
+	c.m.Lock()
+	if c.capacity == 0 {
+		c.m.Unlock()
+		return nil, ErrChatsCapacityFull
+	}
+
+	err := c.store.Create(newChat.record())
+	if err != nil {
+		c.m.Unlock()
+		return nil, fmt.Errorf("could not store new chat: %w", err)
+	}
+	newChat.store = c.store
+
+	evicted, err := c.add(newChat)
+	c.m.Unlock()
+
+	if evicted != nil {
+		c.evicted(evicted, EvictionReasonCapacity)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return newChat, nil
+}
+
+// add opens the chat in memory, closing the least recently used chat if the capacity is full,
+// and returns the closed chat, if any. The caller must hold the lock.
+func (c *Chats) add(chat *Chat) (evicted *Chat, err error) {
+	if c.capacity == 0 {
+		return nil, ErrChatsCapacityFull
+	}
+
+	if c.length >= c.capacity {
+		evicted, err = c.itemsQueue.Peek()
+		switch {
+		case errors.Is(err, lists.ErrQueueEmpty):
+			// every chat is pinned, there's none to close until they're unpinned
+			evicted = nil
+		case err != nil:
+			return nil, fmt.Errorf("could not find least recently used chat: %w", err)
+		default:
+			c.remove(evicted.id)
+		}
+	}
+
+	chat.onUse = c.use
+	chat.setLastUsedAt(time.Now())
+	c.items[chat.id] = c.itemsQueue.Enqueue(chat)
+	c.length++
+
+	return evicted, nil
+}
+
+// remove closes the chat from memory, the caller must hold the lock
+func (c *Chats) remove(chatId ChatId) {
+	node, ok := c.items[chatId]
+	if !ok {
+		return
+	}
+
+	// the pinned chats are not in the queue
+	if c.pins[chatId] == 0 {
+		err := c.itemsQueue.Remove(node)
+		if err != nil {
+			fmt.Printf("could not remove chat %q from the chats queue: %s\n", chatId, err)
+		}
+	}
+	delete(c.pins, chatId)
+	delete(c.items, chatId)
+	c.length--
+}
+
+// pin keeps the chat of the node open, the caller must hold the lock
+func (c *Chats) pin(node *lists.DoubleLinkedNode[*Chat]) {
+	chatId := node.Value().id
+	if c.pins[chatId] == 0 {
+		err := c.itemsQueue.Remove(node)
+		if err != nil {
+			fmt.Printf("could not remove chat %q from the chats queue: %s\n", chatId, err)
+		}
+	}
+	c.pins[chatId]++
+}
+
+// use marks the chat as the most recently used, if it's still open
+func (c *Chats) use(chat *Chat) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	node, ok := c.items[chat.id]
+	if !ok || node.Value() != chat {
+		return
+	}
+
+	c.touch(node)
+}
+
+// touch marks the chat of the node as the most recently used, the caller must hold the lock
+func (c *Chats) touch(node *lists.DoubleLinkedNode[*Chat]) {
+	node.Value().setLastUsedAt(time.Now())
+	// the pinned chats are queued again once they're unpinned
+	if c.pins[node.Value().id] > 0 {
+		return
+	}
+	err := c.itemsQueue.MoveToBack(node)
+	if err != nil {
+		fmt.Printf("could not move chat %q to the back of the chats queue: %s\n", node.Value().id, err)
+	}
+}
+
+func (c *Chats) evicted(chat *Chat, reason EvictionReason) {
+	if c.onEvict != nil {
+		c.onEvict(chat, reason)
+	}
+}
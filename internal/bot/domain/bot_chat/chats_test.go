@@ -0,0 +1,154 @@
+package bot_chat
+
+import (
+	"connectly-interview/internal/bot/domain/bot_auth"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ChatsTestSuite struct {
+	suite.Suite
+	evicted []ChatId
+	reasons []EvictionReason
+}
+
+func (suite *ChatsTestSuite) SetupTest() {
+	suite.evicted = nil
+	suite.reasons = nil
+}
+
+func (suite *ChatsTestSuite) newChats(capacity uint16, idleTimeout time.Duration) *Chats {
+	return NewChats(ChatsArgs{
+		Capacity:    capacity,
+		IdleTimeout: idleTimeout,
+		OnEvict: func(chat *Chat, reason EvictionReason) {
+			suite.evicted = append(suite.evicted, chat.Id())
+			suite.reasons = append(suite.reasons, reason)
+		},
+	})
+}
+
+func (suite *ChatsTestSuite) TestLeastRecentlyUsedIsEvicted() {
+	chats := suite.newChats(2, 0)
+	first, err := chats.New(bot_auth.AnonymousUser, 0)
+	suite.NoError(err)
+	second, err := chats.New(bot_auth.AnonymousUser, 0)
+	suite.NoError(err)
+
+	// reading the first chat makes the second one the least recently used
+	suite.Equal(first, chats.Get(first.Id()))
+
+	_, err = chats.New(bot_auth.AnonymousUser, 0)
+	suite.NoError(err)
+	suite.Equal([]ChatId{second.Id()}, suite.evicted)
+	suite.Equal([]EvictionReason{EvictionReasonCapacity}, suite.reasons)
+}
+
+func (suite *ChatsTestSuite) TestAppendingTouchesTheChat() {
+	chats := suite.newChats(2, 0)
+	first, err := chats.New(bot_auth.AnonymousUser, 0)
+	suite.NoError(err)
+	second, err := chats.New(bot_auth.AnonymousUser, 0)
+	suite.NoError(err)
+
+	suite.NoError(first.AppendTurn(RoleUser, "hi"))
+
+	_, err = chats.New(bot_auth.AnonymousUser, 0)
+	suite.NoError(err)
+	suite.Equal([]ChatId{second.Id()}, suite.evicted)
+}
+
+func (suite *ChatsTestSuite) TestEvictedChatIsReopenedFromTheStore() {
+	chats := suite.newChats(1, 0)
+	first, err := chats.New(bot_auth.AnonymousUser, 0)
+	suite.NoError(err)
+	suite.NoError(first.AppendTurn(RoleUser, "hi"))
+
+	_, err = chats.New(bot_auth.AnonymousUser, 0)
+	suite.NoError(err)
+	suite.Equal([]ChatId{first.Id()}, suite.evicted)
+
+	reopened := chats.Get(first.Id())
+	suite.Require().NotNil(reopened)
+	suite.NotSame(first, reopened)
+	suite.Len(reopened.History(), 1)
+	suite.Equal("hi", reopened.History()[0].Content)
+	suite.Len(suite.evicted, 2)
+}
+
+func (suite *ChatsTestSuite) TestPinnedChatsAreNotEvicted() {
+	chats := suite.newChats(1, time.Minute)
+	pinned, err := chats.New(bot_auth.AnonymousUser, 0)
+	suite.NoError(err)
+	suite.Same(pinned, chats.Pin(pinned.Id()))
+	suite.Same(pinned, chats.Pin(pinned.Id()))
+
+	// the capacity is exceeded, and the pinned chat is not swept even if it's idle
+	other, err := chats.New(bot_auth.AnonymousUser, 0)
+	suite.NoError(err)
+	pinned.setLastUsedAt(time.Now().Add(-2 * time.Minute))
+	chats.Sweep()
+	suite.Empty(suite.evicted)
+	suite.NoError(pinned.AppendTurn(RoleUser, "hi"))
+
+	// it's closed once it's unpinned as many times as it was pinned, the other chat is the least recently used by then
+	chats.Unpin(pinned.Id())
+	suite.Empty(suite.evicted)
+	chats.Unpin(pinned.Id())
+	suite.Equal([]ChatId{other.Id()}, suite.evicted)
+	suite.Same(pinned, chats.Get(pinned.Id()))
+}
+
+func (suite *ChatsTestSuite) TestIdleChatsAreSwept() {
+	chats := suite.newChats(4, time.Minute)
+	idle, err := chats.New(bot_auth.AnonymousUser, 0)
+	suite.NoError(err)
+	active, err := chats.New(bot_auth.AnonymousUser, 0)
+	suite.NoError(err)
+
+	idle.setLastUsedAt(time.Now().Add(-2 * time.Minute))
+	chats.Sweep()
+
+	suite.Equal([]ChatId{idle.Id()}, suite.evicted)
+	suite.Equal([]EvictionReason{EvictionReasonIdle}, suite.reasons)
+	suite.Equal(active, chats.Get(active.Id()))
+}
+
+func (suite *ChatsTestSuite) TestDelete() {
+	chats := suite.newChats(2, 0)
+	chat, err := chats.New(bot_auth.AnonymousUser, 0)
+	suite.NoError(err)
+
+	suite.NoError(chats.Delete(chat.Id()))
+	suite.Nil(chats.Get(chat.Id()))
+	suite.ErrorIs(chats.Delete(chat.Id()), ErrChatNotFound)
+	suite.Empty(suite.evicted)
+}
+
+func (suite *ChatsTestSuite) TestChatsBelongToTheirOwner() {
+	chats := suite.newChats(1, 0)
+	alices, err := chats.New("alice", 0)
+	suite.NoError(err)
+	bobs, err := chats.New("bob", 0)
+	suite.NoError(err)
+
+	// the owner outlives the eviction of the chat
+	suite.Equal([]ChatId{alices.Id()}, suite.evicted)
+	suite.Equal(bot_auth.UserId("alice"), chats.Get(alices.Id()).Owner())
+
+	chatIds, err := chats.List("bob")
+	suite.NoError(err)
+	suite.Equal([]ChatId{bobs.Id()}, chatIds)
+}
+
+func (suite *ChatsTestSuite) TestNoCapacity() {
+	chats := suite.newChats(0, 0)
+	_, err := chats.New(bot_auth.AnonymousUser, 0)
+	suite.ErrorIs(err, ErrChatsCapacityFull)
+}
+
+func TestChatsTestSuite(t *testing.T) {
+	suite.Run(t, new(ChatsTestSuite))
+}
@@ -0,0 +1,149 @@
+package bot_chat
+
+import (
+	"connectly-interview/internal/bot/domain/bot_auth"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrChatExists = fmt.Errorf("chat already exists")
+)
+
+// ChatRecord is how a chat is kept in a ChatStore
+type ChatRecord struct {
+	Id ChatId `json:"id"`
+	// Owner is empty for the chats that were stored before they had owners, they belong to bot_auth.AnonymousUser
+	Owner     bot_auth.UserId `json:"owner,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	Turns     []Turn          `json:"turns"`
+}
+
+// owner returns the user the chat belongs to
+func (r *ChatRecord) owner() bot_auth.UserId {
+	if r.Owner == "" {
+		return bot_auth.AnonymousUser
+	}
+
+	return r.Owner
+}
+
+// OwnedBy tells if the chat belongs to the user
+func (r *ChatRecord) OwnedBy(user bot_auth.UserId) bool {
+	return r.owner() == user
+}
+
+// ChatStore is the interface that describes
+// where the chats and their turns are persisted, so they can outlive the bot.
+type ChatStore interface {
+	// Create stores a new chat, or returns ErrChatExists
+	Create(record ChatRecord) error
+	// Get returns the stored chat with all of its turns, or ErrChatNotFound
+	Get(chatId ChatId) (*ChatRecord, error)
+	// Delete deletes the chat and its turns, or returns ErrChatNotFound
+	Delete(chatId ChatId) error
+	// AppendTurn appends a turn to the chat, or returns ErrChatNotFound
+	AppendTurn(chatId ChatId, turn Turn) error
+	// List returns the ids of the stored chats of the owner, oldest first
+	List(owner bot_auth.UserId) ([]ChatId, error)
+	// Close releases whatever the store holds, it can't be used afterward
+	Close() error
+}
+
+// memoryStore keeps the chats only in memory, it's lost on every restart
+type memoryStore struct {
+	m     sync.RWMutex
+	chats map[ChatId]*ChatRecord
+}
+
+func NewMemoryStore() ChatStore {
+	return &memoryStore{
+		chats: make(map[ChatId]*ChatRecord),
+	}
+}
+
+func (s *memoryStore) Create(record ChatRecord) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if _, ok := s.chats[record.Id]; ok {
+		return fmt.Errorf("%w: %s", ErrChatExists, record.Id)
+	}
+
+	record.Turns = append([]Turn(nil), record.Turns...)
+	s.chats[record.Id] = &record
+
+	return nil
+}
+
+func (s *memoryStore) Get(chatId ChatId) (*ChatRecord, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	record, ok := s.chats[chatId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrChatNotFound, chatId)
+	}
+
+	return &ChatRecord{
+		Id:        record.Id,
+		Owner:     record.Owner,
+		CreatedAt: record.CreatedAt,
+		Turns:     append([]Turn(nil), record.Turns...),
+	}, nil
+}
+
+func (s *memoryStore) Delete(chatId ChatId) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if _, ok := s.chats[chatId]; !ok {
+		return fmt.Errorf("%w: %s", ErrChatNotFound, chatId)
+	}
+
+	delete(s.chats, chatId)
+
+	return nil
+}
+
+func (s *memoryStore) AppendTurn(chatId ChatId, turn Turn) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	record, ok := s.chats[chatId]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrChatNotFound, chatId)
+	}
+
+	record.Turns = append(record.Turns, turn)
+
+	return nil
+}
+
+func (s *memoryStore) List(owner bot_auth.UserId) ([]ChatId, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	records := make([]*ChatRecord, 0, len(s.chats))
+	for _, record := range s.chats {
+		if record.OwnedBy(owner) {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+
+	chatIds := make([]ChatId, len(records))
+	for i, record := range records {
+		chatIds[i] = record.Id
+	}
+
+	return chatIds, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -2,48 +2,162 @@ package bot_prompter
 
 import (
 	"connectly-interview/internal/bot/domain/bot_chat"
-	"connectly-interview/internal/bot/infrastructure/openai"
+	"connectly-interview/internal/bot/infrastructure/llm"
+	"connectly-interview/internal/bot/infrastructure/tokenizer"
 	"context"
 	"fmt"
 	"sync"
 	"time"
 )
 
+var (
+	ErrPromptNoChat   = fmt.Errorf("prompt has no chat")
+	ErrPromptNotFound = fmt.Errorf("no prompt found")
+	ErrQueueFull      = fmt.Errorf("prompt queue is full")
+	ErrNoWorkers      = fmt.Errorf("no workers to compile the prompts")
+)
+
 const (
 	DefaultChatsCapacity   uint16 = 256
 	DefaultHistoryCapacity uint16 = 1024
+	// answerBuffer is how many deltas of an answer can wait for the reader before the prompter blocks
+	answerBuffer = 64
+)
+
+// QueueFullPolicy decides what happens to a new prompt when the queue of the prompter is full
+type QueueFullPolicy uint8
+
+const (
+	// QueueFullBlock waits until there's room in the queue, or the prompt's context is done
+	QueueFullBlock QueueFullPolicy = iota
+	// QueueFullReject rejects the new prompt with ErrQueueFull
+	QueueFullReject
+	// QueueFullDropOldest drops the oldest queued prompt to make room for the new one
+	QueueFullDropOldest
 )
 
+func (policy QueueFullPolicy) String() string {
+	switch policy {
+	case QueueFullBlock:
+		return "block"
+	case QueueFullReject:
+		return "reject"
+	case QueueFullDropOldest:
+		return "drop oldest"
+	default:
+		return "unknown"
+	}
+}
+
 type Prompt struct {
 	Chat *bot_chat.Chat
 	Msg  string
+	// Context is the context of the job, e.g. the connection of the client that prompted.
+	// When it's done, the prompt is dropped from the queue or its answer is aborted, if nil it's the prompter's context.
+	Context context.Context
+	// OnUsage, if provided, is called once the prompt is over, whether it was answered, aborted, dropped or rejected,
+	// with the tokens the prompt and its answer cost, none if the model was never asked
+	OnUsage func(usage Usage)
+	// usage is what the prompt cost so far
+	usage Usage
+	// ctx is the context of the job, done when the prompt is canceled or its deadline passes
+	ctx    context.Context
+	cancel context.CancelFunc
+	// answer is where the deltas of the answer are streamed to, closed when the answer is over
+	answer chan Delta
+}
+
+// Delta is a part of an answer as it's streamed.
+// An answer that fails ends with a delta that has the error instead of content, and what came before it is not an answer.
+type Delta struct {
+	Content []byte
+	Err     error
+}
+
+// Usage is what a prompt and its answer cost
+type Usage struct {
+	bot_infrastructure_llm.Usage
+	// Model is the model the prompt was sent to
+	Model bot_infrastructure_llm.Model
+	// Estimated is true when the provider did not tell what the prompt cost, e.g. because its answer was aborted,
+	// and its tokens were counted with the tokenizer of the model instead
+	Estimated bool
 }
 
 type Prompter interface {
 	Start() error
-	Prompt(prompt *Prompt) (answer <-chan []byte, err error)
+	// Prompt queues the prompt and returns a channel streaming the answer's deltas as they are compiled.
+	// The channel is closed when the answer is over or the prompt is canceled,
+	// if the prompt could not be answered its last delta has the error.
+	Prompt(prompt *Prompt) (answer <-chan Delta, err error)
+	// Cancel cancels the queued and in-flight prompts of the chat, aborting their answers
+	Cancel(chatId bot_chat.ChatId) error
+	// Estimate returns how many tokens sending the message to the chat would cost, before its answer
+	Estimate(chat *bot_chat.Chat, msg string) int
+	// Stats returns how loaded the queue is and what each worker has done so far
+	Stats() Stats
+}
+
+// Stats are the statistics of the prompter's queue and workers
+type Stats struct {
+	Queued        int
+	QueueCapacity int
+	// Rejected is how many prompts were rejected because the queue was full
+	Rejected uint64
+	// Backlogged is how many prompts wait for an earlier prompt of their chat to be answered
+	Backlogged int
+	// Dropped is how many queued prompts were dropped to make room for newer ones
+	Dropped uint64
+	Workers []WorkerStats
 }
 
 // Prompter is the engine that compiles the strings into answers
 type prompter struct {
 	ctx context.Context
-	// queue is used to store
-	// the int that is hash for the user that prompts a string,
-	// string is the prompt
-	queue          chan *Prompt
-	m              sync.RWMutex
-	workers        Workers
-	promptTimeout  time.Duration
-	answersMapChan map[bot_chat.ChatId]chan []byte
+	// queue is where the prompts wait for a worker to pick them up
+	queue           chan *Prompt
+	queueFullPolicy QueueFullPolicy
+	m               sync.RWMutex
+	workers         Workers
+	promptTimeout   time.Duration
+	// model is the model the prompts are compiled with
+	model bot_infrastructure_llm.Model
+	// budget decides how much of the chat's history is sent to the model along with the prompt
+	budget Budget
+	// jobs are the queued and in-flight prompts of each chat, so they can be canceled
+	jobs map[bot_chat.ChatId]map[*Prompt]struct{}
+	// chats keep the prompts of each chat in order
+	chats      map[bot_chat.ChatId]*chatQueue
+	backlogged int
+	rejected   uint64
+	dropped    uint64
 }
 
 type Args struct {
-	Context           context.Context
-	PromptTimeout     time.Duration
-	WorkersAmount     uint8
-	HistoryCapacity   uint16
+	Context context.Context
+	// PromptTimeout is the deadline of each prompt, from the moment it's queued until its answer is over
+	PromptTimeout time.Duration
+	// WorkersAmount is how many prompts are compiled at the same time
+	WorkersAmount   uint8
+	HistoryCapacity uint16
+	// PromptQueueBuffer is how many prompts can wait for a worker,
+	// and how many prompts of the same chat can wait for the chat's earlier prompt to be answered
 	PromptQueueBuffer uint8
-	ChatsCapacity     uint16
+	// QueueFullPolicy decides what happens to a new prompt when the queue is full, by default it blocks
+	QueueFullPolicy QueueFullPolicy
+	ChatsCapacity   uint16
+	// Provider is the large language model that the workers compile the answers with
+	Provider bot_infrastructure_llm.Provider
+	// Model is the model the prompts are compiled with, if empty it's the provider's default model
+	Model bot_infrastructure_llm.Model
+	// Tokenizer counts the tokens of the prompts, if nil it's the tokenizer of the model
+	Tokenizer bot_infrastructure_tokenizer.Tokenizer
+	// ContextWindow is how many tokens the model can handle, if zero it's the model's known context window
+	ContextWindow int
+	// ResponseTokens is how many tokens of the context window are kept for the answer
+	ResponseTokens int
+	// ContextTokenBudget, if not zero, limits how many tokens of the chat's history are sent to the model along with the prompt
+	ContextTokenBudget int
 }
 
 func New(args Args) Prompter {
@@ -55,130 +169,301 @@ func New(args Args) Prompter {
 		args.HistoryCapacity = DefaultHistoryCapacity
 	}
 
+	if args.Model == "" && args.Provider != nil {
+		args.Model = args.Provider.DefaultModel()
+	}
+
+	if args.Tokenizer == nil {
+		args.Tokenizer = bot_infrastructure_tokenizer.ForModel(args.Model)
+	}
+
+	if args.ContextWindow == 0 {
+		args.ContextWindow = bot_infrastructure_tokenizer.ContextWindow(args.Model)
+	}
+
+	if args.ResponseTokens == 0 {
+		args.ResponseTokens = DefaultResponseTokens
+	}
+
 	return &prompter{
-		ctx:           args.Context,
-		queue:         make(chan *Prompt, args.PromptQueueBuffer),
-		workers:       NewWorkers(args.WorkersAmount),
-		promptTimeout: args.PromptTimeout,
+		ctx:             args.Context,
+		queue:           make(chan *Prompt, args.PromptQueueBuffer),
+		queueFullPolicy: args.QueueFullPolicy,
+		workers:         NewWorkers(args.WorkersAmount, args.Provider),
+		promptTimeout:   args.PromptTimeout,
+		model:           args.Model,
+		budget: Budget{
+			Tokenizer:      args.Tokenizer,
+			ContextWindow:  args.ContextWindow,
+			ResponseTokens: args.ResponseTokens,
+			HistoryTokens:  args.ContextTokenBudget,
+		},
+		jobs:  make(map[bot_chat.ChatId]map[*Prompt]struct{}),
+		chats: make(map[bot_chat.ChatId]*chatQueue),
 	}
 }
 
+// Start starts the workers, each one pulling prompts from the queue until the prompter's context is done
 func (p *prompter) Start() error {
-	go p.accept_prompts()
+	if len(p.workers) == 0 {
+		return ErrNoWorkers
+	}
+
+	for _, worker := range p.workers {
+		go p.work(worker)
+	}
 
 	return nil
 }
 
-func (p *prompter) accept_prompts() {
-outerloop:
+// work answers the prompts of the queue with the worker,
+// once a prompt is answered the worker goes on with the next prompt of the same chat, if any.
+func (p *prompter) work(worker *Worker) {
 	for {
 		select {
 		case prompt := <-p.queue:
-			answerChan := p.waitWorkerToPrompt(prompt)
-			timeoutTicker := time.NewTicker(p.promptTimeout)
-		answerLoop:
-			for {
-				select {
-				case <-timeoutTicker.C:
-					break answerLoop
-				case <-p.ctx.Done():
-					break outerloop
-				case answer := <-answerChan:
-					prompt.Chat.AppendAnswer(answer)
-				}
+			for prompt != nil {
+				p.answer(worker, prompt)
+				prompt = p.finish(prompt)
 			}
+		case <-p.ctx.Done():
+			return
 		}
 	}
 }
 
-// waitWorkerToPrompt sends the prompt to an available worker with round-robin,
-// and returns a channel through the worker will respond to.
+// answer records the prompt to the chat's history and compiles the answer with the worker,
+// streaming its deltas to the prompt's answer channel
+// and recording the whole answer to the chat's history once it's over.
 //
-// This approach may not scale well later, it would probably be better to have a completely separate executable for workers,
-// listening to a daemon or getting HTTP requests whenever there's work to do for a worker, it works for now, but to take care later.
-func (p *prompter) waitWorkerToPrompt(prompt *Prompt) <-chan []byte {
-	answerChan := make(chan []byte)
-
-	go func() {
-		// Select a worker (simple example, consider a more sophisticated method for production)
-		var selectedWorker *Worker
-		for _, worker := range p.workers {
-			if !worker.IsBusy() {
-				selectedWorker = worker
-				break
-			}
-		}
+// If the prompt is canceled or its deadline passes, the worker's answer is aborted
+// and the partial answer is not recorded.
+func (p *prompter) answer(worker *Worker, prompt *Prompt) {
+	defer close(prompt.answer)
+	defer p.done(prompt)
 
-		if selectedWorker == nil {
-			answerChan <- []byte("No available workers")
-			return
-		}
+	if prompt.ctx.Err() != nil {
+		return
+	}
 
-		// Use the selected worker to compile the response
-		response, err := selectedWorker.Compile(prompt.Msg)
-		if err != nil {
-			answerChan <- []byte(fmt.Sprintf("Error compiling prompt: %s", err))
-			return
+	err := prompt.Chat.AppendTurn(bot_chat.RoleUser, prompt.Msg)
+	if err != nil {
+		prompt.answer <- Delta{Err: fmt.Errorf("could not record prompt: %w", err)}
+		return
+	}
+
+	messages := p.budget.Fit(prompt.Chat.History())
+	// streamed is what the model answered, even if the answer is aborted
+	var streamed []byte
+	answer, reported, err := worker.Compile(prompt.ctx, bot_infrastructure_llm.Request{
+		Model:     p.model,
+		Messages:  messages,
+		MaxTokens: p.budget.ResponseTokens,
+	}, func(delta []byte) bool {
+		streamed = append(streamed, delta...)
+		select {
+		case prompt.answer <- Delta{Content: delta}:
+			return true
+		case <-prompt.ctx.Done():
+			return false
 		}
+	})
+	// an answer that failed before the model answered anything is not billed
+	if reported != nil || len(streamed) > 0 {
+		prompt.usage = p.usage(messages, streamed, reported)
+	}
+	if err != nil {
+		if prompt.ctx.Err() == nil {
+			prompt.answer <- Delta{Err: fmt.Errorf("could not compile prompt: %w", err)}
+		}
+		return
+	}
 
-		answerChan <- []byte(response)
-	}()
+	err = prompt.Chat.AppendAnswer(answer)
+	if err != nil {
+		fmt.Printf("could not record answer of chat %q: %s\n", prompt.Chat.Id(), err)
+	}
+}
 
-	return answerChan
+func (p *prompter) Prompt(prompt *Prompt) (answer <-chan Delta, err error) {
+	if prompt == nil || prompt.Chat == nil {
+		return nil, ErrPromptNoChat
+	}
+
+	parent := prompt.Context
+	if parent == nil {
+		parent = p.ctx
+	}
+	if p.promptTimeout > 0 {
+		prompt.ctx, prompt.cancel = context.WithTimeout(parent, p.promptTimeout)
+	} else {
+		prompt.ctx, prompt.cancel = context.WithCancel(parent)
+	}
+	prompt.answer = make(chan Delta, answerBuffer)
+	p.track(prompt)
+
+	err = p.admit(prompt)
+	if err != nil {
+		p.done(prompt)
+		return nil, err
+	}
+
+	// the prompt waits for the chat's earlier prompts to be answered first
+	if !p.line(prompt) {
+		return prompt.answer, nil
+	}
+
+	err = p.enqueue(prompt)
+	if err != nil {
+		p.done(prompt)
+		if next := p.finish(prompt); next != nil {
+			go p.dispatch(next)
+		}
+		return nil, err
+	}
+
+	return prompt.answer, nil
 }
 
-func (p *prompter) Prompt(prompt *Prompt) (answer <-chan []byte, err error) {
-	p.queue <- prompt
-	chatId := prompt.Chat.Id()
-	promptChan := make(chan []byte)
-	p.answersMapChan[chatId] = promptChan
-	return promptChan, err
+// enqueue puts the prompt in the queue, following the queue full policy if there's no room
+func (p *prompter) enqueue(prompt *Prompt) error {
+	switch {
+	case p.queueFullPolicy == QueueFullReject:
+		select {
+		case p.queue <- prompt:
+			return nil
+		default:
+			p.m.Lock()
+			p.rejected++
+			p.m.Unlock()
+			return ErrQueueFull
+		}
+	// an unbuffered queue has no oldest prompt to drop, it can only block
+	case p.queueFullPolicy == QueueFullDropOldest && cap(p.queue) > 0:
+		for {
+			select {
+			case p.queue <- prompt:
+				return nil
+			default:
+			}
+
+			// a worker may have picked the oldest prompt up in the meantime, then there's room to try again
+			select {
+			case oldest := <-p.queue:
+				p.drop(oldest)
+				if next := p.finish(oldest); next != nil {
+					go p.dispatch(next)
+				}
+			default:
+			}
+		}
+	default:
+		select {
+		case p.queue <- prompt:
+			return nil
+		case <-prompt.ctx.Done():
+			return fmt.Errorf("could not queue prompt: %w", prompt.ctx.Err())
+		}
+	}
 }
 
-type Worker struct {
-	id        uint
-	m         sync.Mutex
-	openaiKey string
-	isBusy    bool
+// drop ends a queued prompt without answering it
+func (p *prompter) drop(prompt *Prompt) {
+	p.m.Lock()
+	p.dropped++
+	p.m.Unlock()
+
+	prompt.answer <- Delta{Err: fmt.Errorf("%w, the prompt was dropped", ErrQueueFull)}
+	close(prompt.answer)
+	p.done(prompt)
 }
 
-type Workers []*Worker
+func (p *prompter) Cancel(chatId bot_chat.ChatId) error {
+	p.m.Lock()
+	defer p.m.Unlock()
 
-func NewWorkers(total_workers uint8) Workers {
-	w := make(Workers, total_workers)
-	return w
+	prompts, ok := p.jobs[chatId]
+	if !ok {
+		return fmt.Errorf("%w: chat %s", ErrPromptNotFound, chatId)
+	}
+	for prompt := range prompts {
+		prompt.cancel()
+	}
+
+	return nil
 }
 
-func (w *Worker) Id() uint {
-	return w.id
+func (p *prompter) Estimate(chat *bot_chat.Chat, msg string) int {
+	history := append(chat.History(), bot_chat.Turn{Role: bot_chat.RoleUser, Content: msg})
+	return bot_infrastructure_tokenizer.MessagesTokens(p.budget.Tokenizer, p.budget.Fit(history))
 }
 
-func (w *Worker) IsBusy() bool {
-	return w.isBusy
+// usage returns how many tokens the messages sent to the model and its answer cost,
+// as the provider reported them, or counted with the tokenizer if it did not
+func (p *prompter) usage(messages []bot_infrastructure_llm.Message, answer []byte, reported *bot_infrastructure_llm.Usage) Usage {
+	if reported != nil {
+		return Usage{Usage: *reported, Model: p.model}
+	}
+
+	usage := Usage{
+		Usage: bot_infrastructure_llm.Usage{
+			PromptTokens:     bot_infrastructure_tokenizer.MessagesTokens(p.budget.Tokenizer, messages),
+			CompletionTokens: p.budget.Tokenizer.Count(string(answer)),
+		},
+		Model:     p.model,
+		Estimated: true,
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+
+	return usage
 }
 
-func (w *Worker) Compile(prompt string) (string, error) {
-	w.m.Lock()
-	defer w.m.Unlock()
+func (p *prompter) Stats() Stats {
+	p.m.RLock()
+	stats := Stats{
+		Queued:        len(p.queue),
+		QueueCapacity: cap(p.queue),
+		Backlogged:    p.backlogged,
+		Rejected:      p.rejected,
+		Dropped:       p.dropped,
+		Workers:       make([]WorkerStats, 0, len(p.workers)),
+	}
+	p.m.RUnlock()
 
-	if w.isBusy {
-		return "", fmt.Errorf("worker %d is busy", w.id)
+	for _, worker := range p.workers {
+		stats.Workers = append(stats.Workers, worker.Stats())
 	}
-	w.isBusy = true
-	defer func() {
-		w.isBusy = false
-	}()
 
-	openAiAnswer, err := openai.Prompt(w.openaiKey, prompt)
-	if err != nil {
-		return "", err
+	return stats
+}
+
+// track keeps the prompt as a job of its chat until it's done
+func (p *prompter) track(prompt *Prompt) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	chatId := prompt.Chat.Id()
+	if p.jobs[chatId] == nil {
+		p.jobs[chatId] = make(map[*Prompt]struct{})
 	}
+	p.jobs[chatId][prompt] = struct{}{}
+}
 
-	if openAiAnswer == "" {
-		return "", fmt.Errorf("no response from GPT-4")
+// done releases the context of the prompt, tells what it cost and forgets it from the jobs of its chat
+func (p *prompter) done(prompt *Prompt) {
+	prompt.cancel()
+	if prompt.OnUsage != nil {
+		prompt.OnUsage(prompt.usage)
 	}
 
-	return openAiAnswer, nil
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	chatId := prompt.Chat.Id()
+	delete(p.jobs[chatId], prompt)
+	if len(p.jobs[chatId]) == 0 {
+		delete(p.jobs, chatId)
+	}
 }
 
 type PromptUser struct {
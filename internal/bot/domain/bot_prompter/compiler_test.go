@@ -0,0 +1,392 @@
+package bot_prompter
+
+import (
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"connectly-interview/internal/bot/infrastructure/llm"
+	"connectly-interview/internal/bot/infrastructure/llm/echo"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+var errUnreachable = fmt.Errorf("model is unreachable")
+
+// failingProvider is a provider whose answers fail before they reach the model
+type failingProvider struct {
+	bot_infrastructure_llm.Provider
+}
+
+func (f failingProvider) Stream(ctx context.Context, req bot_infrastructure_llm.Request) (<-chan bot_infrastructure_llm.Chunk, error) {
+	return nil, errUnreachable
+}
+
+type CompilerTestSuite struct {
+	suite.Suite
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (suite *CompilerTestSuite) SetupTest() {
+	suite.ctx, suite.cancel = context.WithCancel(context.Background())
+}
+
+func (suite *CompilerTestSuite) TearDownTest() {
+	suite.cancel()
+}
+
+// newPrompter returns a started prompter with a single worker,
+// that echoes the prompts back taking `delay` for each word
+func (suite *CompilerTestSuite) newPrompter(delay time.Duration, timeout time.Duration) Prompter {
+	return suite.newPool(Args{PromptTimeout: timeout, WorkersAmount: 1, PromptQueueBuffer: 4}, delay)
+}
+
+// newPool returns a started prompter with the args, that echoes the prompts back taking `delay` for each word
+func (suite *CompilerTestSuite) newPool(args Args, delay time.Duration) Prompter {
+	args.Context = suite.ctx
+	args.Provider = bot_infrastructure_llm_echo.New(bot_infrastructure_llm_echo.WithDelay(delay))
+	p := New(args)
+	suite.NoError(p.Start())
+	return p
+}
+
+// waitBusy waits until all the workers of the prompter are busy
+func (suite *CompilerTestSuite) waitBusy(p Prompter) {
+	suite.Eventually(func() bool {
+		for _, worker := range p.Stats().Workers {
+			if !worker.Busy {
+				return false
+			}
+		}
+		return true
+	}, time.Second*5, time.Millisecond)
+}
+
+// readAnswer reads the whole answer, failing if it does not end in time or if it fails
+func (suite *CompilerTestSuite) readAnswer(answer <-chan Delta) string {
+	content, err := suite.readResult(answer)
+	suite.NoError(err)
+	return content
+}
+
+// readResult reads the whole answer and the error it failed with, if any, failing if it does not end in time
+func (suite *CompilerTestSuite) readResult(answer <-chan Delta) (string, error) {
+	var b strings.Builder
+	var err error
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case delta, ok := <-answer:
+			if !ok {
+				return b.String(), err
+			}
+			b.Write(delta.Content)
+			if delta.Err != nil {
+				err = delta.Err
+			}
+		case <-timeout:
+			suite.FailNow("answer did not end")
+		}
+	}
+}
+
+func (suite *CompilerTestSuite) TestAnswer() {
+	p := suite.newPrompter(0, time.Second)
+	chat := bot_chat.New(bot_chat.Args{})
+
+	answer, err := p.Prompt(&Prompt{Chat: chat, Msg: "hello there"})
+	suite.NoError(err)
+	suite.Equal("hello there", suite.readAnswer(answer))
+
+	history := chat.History()
+	suite.Len(history, 2)
+	suite.Equal("hello there", history[1].Content)
+}
+
+func (suite *CompilerTestSuite) TestUsageIsReported() {
+	p := suite.newPrompter(0, time.Second)
+	chat := bot_chat.New(bot_chat.Args{SystemPrompt: "be nice"})
+	estimate := p.Estimate(chat, "hello there")
+	suite.Greater(estimate, 0)
+
+	usages := make(chan Usage, 1)
+	answer, err := p.Prompt(&Prompt{Chat: chat, Msg: "hello there", OnUsage: func(usage Usage) {
+		usages <- usage
+	}})
+	suite.NoError(err)
+	suite.readAnswer(answer)
+
+	// the echo provider counts every word as a token
+	suite.Equal(Usage{
+		Usage: bot_infrastructure_llm.Usage{PromptTokens: 4, CompletionTokens: 2, TotalTokens: 6},
+		Model: bot_infrastructure_llm_echo.DefaultModel,
+	}, <-usages)
+}
+
+func (suite *CompilerTestSuite) TestUsageOfAbortedAnswersIsEstimated() {
+	p := suite.newPrompter(time.Millisecond*50, time.Minute)
+	chat := bot_chat.New(bot_chat.Args{})
+
+	usages := make(chan Usage, 1)
+	answer, err := p.Prompt(&Prompt{Chat: chat, Msg: strings.Repeat("word ", 100), OnUsage: func(usage Usage) {
+		usages <- usage
+	}})
+	suite.NoError(err)
+	<-answer
+	suite.NoError(p.Cancel(chat.Id()))
+	suite.readAnswer(answer)
+
+	usage := <-usages
+	suite.True(usage.Estimated)
+	suite.Equal(p.Estimate(bot_chat.New(bot_chat.Args{}), strings.Repeat("word ", 100)), usage.PromptTokens)
+	suite.Greater(usage.CompletionTokens, 0)
+	suite.Equal(usage.PromptTokens+usage.CompletionTokens, usage.TotalTokens)
+}
+
+func (suite *CompilerTestSuite) TestCancelFreesTheWorker() {
+	p := suite.newPrompter(time.Millisecond*50, time.Minute)
+	chat := bot_chat.New(bot_chat.Args{})
+
+	answer, err := p.Prompt(&Prompt{Chat: chat, Msg: strings.Repeat("word ", 100)})
+	suite.NoError(err)
+	<-answer
+	suite.NoError(p.Cancel(chat.Id()))
+	suite.readAnswer(answer)
+
+	// the partial answer is not recorded
+	suite.Len(chat.History(), 1)
+	suite.ErrorIs(p.Cancel(chat.Id()), ErrPromptNotFound)
+
+	// the only worker is free to answer the next prompt
+	answer, err = p.Prompt(&Prompt{Chat: chat, Msg: "again"})
+	suite.NoError(err)
+	suite.Equal("again", suite.readAnswer(answer))
+}
+
+func (suite *CompilerTestSuite) TestClientGoesAway() {
+	p := suite.newPrompter(time.Millisecond*50, time.Minute)
+	chat := bot_chat.New(bot_chat.Args{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	answer, err := p.Prompt(&Prompt{Chat: chat, Msg: strings.Repeat("word ", 100), Context: ctx})
+	suite.NoError(err)
+	<-answer
+	cancel()
+
+	suite.Less(len(suite.readAnswer(answer)), len(strings.Repeat("word ", 100)))
+}
+
+func (suite *CompilerTestSuite) TestDeadline() {
+	p := suite.newPrompter(time.Millisecond*50, time.Millisecond*200)
+	chat := bot_chat.New(bot_chat.Args{})
+
+	answer, err := p.Prompt(&Prompt{Chat: chat, Msg: strings.Repeat("word ", 100)})
+	suite.NoError(err)
+
+	suite.Less(len(suite.readAnswer(answer)), len(strings.Repeat("word ", 100)))
+	suite.Len(chat.History(), 1)
+}
+
+func (suite *CompilerTestSuite) TestCanceledWhileQueued() {
+	p := suite.newPrompter(time.Millisecond*50, time.Minute)
+	chat := bot_chat.New(bot_chat.Args{})
+
+	first, err := p.Prompt(&Prompt{Chat: chat, Msg: strings.Repeat("word ", 100)})
+	suite.NoError(err)
+	second, err := p.Prompt(&Prompt{Chat: chat, Msg: "queued"})
+	suite.NoError(err)
+
+	suite.NoError(p.Cancel(chat.Id()))
+	suite.readAnswer(first)
+	suite.Empty(suite.readAnswer(second))
+}
+
+func (suite *CompilerTestSuite) TestWorkersAnswerInParallel() {
+	p := suite.newPool(Args{PromptTimeout: time.Minute, WorkersAmount: 2, PromptQueueBuffer: 4}, time.Millisecond*50)
+	first, err := p.Prompt(&Prompt{Chat: bot_chat.New(bot_chat.Args{}), Msg: "one two three"})
+	suite.NoError(err)
+	second, err := p.Prompt(&Prompt{Chat: bot_chat.New(bot_chat.Args{}), Msg: "four five six"})
+	suite.NoError(err)
+
+	suite.waitBusy(p)
+	suite.Equal("one two three", suite.readAnswer(first))
+	suite.Equal("four five six", suite.readAnswer(second))
+
+	stats := p.Stats()
+	suite.Len(stats.Workers, 2)
+	for _, worker := range stats.Workers {
+		suite.Equal(uint64(1), worker.Completed)
+		suite.False(worker.Busy)
+		suite.NotZero(worker.BusyTime)
+	}
+}
+
+func (suite *CompilerTestSuite) TestQueueFullReject() {
+	p := suite.newPool(Args{PromptTimeout: time.Minute, WorkersAmount: 1, PromptQueueBuffer: 1, QueueFullPolicy: QueueFullReject}, time.Millisecond*50)
+
+	_, err := p.Prompt(&Prompt{Chat: bot_chat.New(bot_chat.Args{}), Msg: strings.Repeat("word ", 100)})
+	suite.NoError(err)
+	suite.waitBusy(p)
+	_, err = p.Prompt(&Prompt{Chat: bot_chat.New(bot_chat.Args{}), Msg: "queued"})
+	suite.NoError(err)
+
+	_, err = p.Prompt(&Prompt{Chat: bot_chat.New(bot_chat.Args{}), Msg: "rejected"})
+	suite.ErrorIs(err, ErrQueueFull)
+	suite.Equal(uint64(1), p.Stats().Rejected)
+	suite.Equal(1, p.Stats().Queued)
+}
+
+func (suite *CompilerTestSuite) TestQueueFullDropOldest() {
+	p := suite.newPool(Args{PromptTimeout: time.Minute, WorkersAmount: 1, PromptQueueBuffer: 1, QueueFullPolicy: QueueFullDropOldest}, time.Millisecond*50)
+
+	first, err := p.Prompt(&Prompt{Chat: bot_chat.New(bot_chat.Args{}), Msg: "one two three"})
+	suite.NoError(err)
+	suite.waitBusy(p)
+	oldest, err := p.Prompt(&Prompt{Chat: bot_chat.New(bot_chat.Args{}), Msg: "dropped"})
+	suite.NoError(err)
+	newest, err := p.Prompt(&Prompt{Chat: bot_chat.New(bot_chat.Args{}), Msg: "newest"})
+	suite.NoError(err)
+
+	_, err = suite.readResult(oldest)
+	suite.ErrorIs(err, ErrQueueFull)
+	suite.Equal("one two three", suite.readAnswer(first))
+	suite.Equal("newest", suite.readAnswer(newest))
+	suite.Equal(uint64(1), p.Stats().Dropped)
+}
+
+func (suite *CompilerTestSuite) TestQueueFullBlockUntilCanceled() {
+	p := suite.newPool(Args{PromptTimeout: time.Minute, WorkersAmount: 1, PromptQueueBuffer: 1}, time.Millisecond*50)
+	chat := bot_chat.New(bot_chat.Args{})
+
+	_, err := p.Prompt(&Prompt{Chat: chat, Msg: strings.Repeat("word ", 100)})
+	suite.NoError(err)
+	suite.waitBusy(p)
+	_, err = p.Prompt(&Prompt{Chat: chat, Msg: "queued"})
+	suite.NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	_, err = p.Prompt(&Prompt{Chat: chat, Msg: "blocked", Context: ctx})
+	suite.ErrorIs(err, context.DeadlineExceeded)
+}
+
+func (suite *CompilerTestSuite) TestChatPromptsAreAnsweredInOrder() {
+	p := suite.newPool(Args{PromptTimeout: time.Minute, WorkersAmount: 2, PromptQueueBuffer: 4}, time.Millisecond*10)
+	chat := bot_chat.New(bot_chat.Args{})
+	other := bot_chat.New(bot_chat.Args{})
+
+	msgs := []string{"first message", "second message", "third message"}
+	answers := make([]<-chan Delta, 0, len(msgs))
+	for _, msg := range msgs {
+		answer, err := p.Prompt(&Prompt{Chat: chat, Msg: msg})
+		suite.NoError(err)
+		answers = append(answers, answer)
+	}
+	otherAnswer, err := p.Prompt(&Prompt{Chat: other, Msg: "in parallel"})
+	suite.NoError(err)
+
+	// the other chat does not wait for the first chat's prompts
+	suite.waitBusy(p)
+	suite.Equal("in parallel", suite.readAnswer(otherAnswer))
+	for i, answer := range answers {
+		suite.Equal(msgs[i], suite.readAnswer(answer))
+	}
+
+	history := chat.History()
+	suite.Len(history, 2*len(msgs))
+	for i, msg := range msgs {
+		suite.Equal(bot_chat.RoleUser, history[2*i].Role)
+		suite.Equal(msg, history[2*i].Content)
+		suite.Equal(bot_chat.RoleAssistant, history[2*i+1].Role)
+		suite.Equal(msg, history[2*i+1].Content)
+	}
+	suite.Zero(p.Stats().Backlogged)
+}
+
+func (suite *CompilerTestSuite) TestChatBacklogFullReject() {
+	p := suite.newPool(Args{PromptTimeout: time.Minute, WorkersAmount: 2, PromptQueueBuffer: 1, QueueFullPolicy: QueueFullReject}, time.Millisecond*50)
+	chat := bot_chat.New(bot_chat.Args{})
+
+	_, err := p.Prompt(&Prompt{Chat: chat, Msg: strings.Repeat("word ", 100)})
+	suite.NoError(err)
+	suite.Eventually(func() bool { return p.Stats().Queued == 0 }, time.Second*5, time.Millisecond)
+	_, err = p.Prompt(&Prompt{Chat: chat, Msg: "backlogged"})
+	suite.NoError(err)
+	suite.Equal(1, p.Stats().Backlogged)
+
+	_, err = p.Prompt(&Prompt{Chat: chat, Msg: "rejected"})
+	suite.ErrorIs(err, ErrQueueFull)
+
+	// other chats are not affected
+	answer, err := p.Prompt(&Prompt{Chat: bot_chat.New(bot_chat.Args{}), Msg: "other"})
+	suite.NoError(err)
+	suite.Equal("other", suite.readAnswer(answer))
+}
+
+func (suite *CompilerTestSuite) TestChatBacklogDropOldest() {
+	p := suite.newPool(Args{PromptTimeout: time.Minute, WorkersAmount: 1, PromptQueueBuffer: 1, QueueFullPolicy: QueueFullDropOldest}, time.Millisecond*10)
+	chat := bot_chat.New(bot_chat.Args{})
+
+	first, err := p.Prompt(&Prompt{Chat: chat, Msg: "one two three"})
+	suite.NoError(err)
+	oldest, err := p.Prompt(&Prompt{Chat: chat, Msg: "dropped"})
+	suite.NoError(err)
+	newest, err := p.Prompt(&Prompt{Chat: chat, Msg: "newest"})
+	suite.NoError(err)
+
+	_, err = suite.readResult(oldest)
+	suite.ErrorIs(err, ErrQueueFull)
+	suite.Equal("one two three", suite.readAnswer(first))
+	suite.Equal("newest", suite.readAnswer(newest))
+	suite.Len(chat.History(), 4)
+}
+
+func (suite *CompilerTestSuite) TestCanceledAnswersAreCounted() {
+	p := suite.newPrompter(time.Millisecond*50, time.Minute)
+	chat := bot_chat.New(bot_chat.Args{})
+
+	answer, err := p.Prompt(&Prompt{Chat: chat, Msg: strings.Repeat("word ", 100)})
+	suite.NoError(err)
+	<-answer
+	suite.NoError(p.Cancel(chat.Id()))
+	suite.readAnswer(answer)
+
+	suite.Equal(uint64(1), p.Stats().Workers[0].Canceled)
+}
+
+func (suite *CompilerTestSuite) TestFailedAnswer() {
+	p := New(Args{
+		Context:       suite.ctx,
+		PromptTimeout: time.Minute,
+		WorkersAmount: 1,
+		Provider:      failingProvider{Provider: bot_infrastructure_llm_echo.New()},
+	})
+	suite.NoError(p.Start())
+	chat := bot_chat.New(bot_chat.Args{})
+
+	usages := make(chan Usage, 1)
+	answer, err := p.Prompt(&Prompt{Chat: chat, Msg: "hello there", OnUsage: func(usage Usage) {
+		usages <- usage
+	}})
+	suite.NoError(err)
+	content, err := suite.readResult(answer)
+	suite.ErrorIs(err, errUnreachable)
+	suite.Empty(content)
+
+	// only the prompt is recorded, there's no answer
+	suite.Len(chat.History(), 1)
+	// and the model never answered, so nothing is billed
+	suite.Equal(Usage{}, <-usages)
+}
+
+func (suite *CompilerTestSuite) TestNoWorkers() {
+	p := New(Args{Context: suite.ctx, Provider: bot_infrastructure_llm_echo.New()})
+	suite.ErrorIs(p.Start(), ErrNoWorkers)
+}
+
+func TestCompilerTestSuite(t *testing.T) {
+	suite.Run(t, new(CompilerTestSuite))
+}
@@ -0,0 +1,100 @@
+package bot_prompter
+
+import (
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"connectly-interview/internal/bot/infrastructure/llm"
+	"connectly-interview/internal/bot/infrastructure/tokenizer"
+)
+
+const (
+	// DefaultResponseTokens is how many tokens of the model's context window are kept for the answer
+	DefaultResponseTokens = 1024
+)
+
+// Budget decides how much of a chat's history fits in the model's context window
+// while leaving room for the answer.
+type Budget struct {
+	Tokenizer bot_infrastructure_tokenizer.Tokenizer
+	// ContextWindow is how many tokens the model can handle, prompt and answer together
+	ContextWindow int
+	// ResponseTokens is how many tokens of the context window are kept for the answer
+	ResponseTokens int
+	// HistoryTokens, if not zero, limits how many tokens of the history are sent even if more would fit
+	HistoryTokens int
+}
+
+// PromptTokens is how many tokens the messages sent to the model can cost
+func (b Budget) PromptTokens() int {
+	tokens := b.ContextWindow - b.ResponseTokens
+	if b.HistoryTokens > 0 && b.HistoryTokens < tokens {
+		tokens = b.HistoryTokens
+	}
+
+	return tokens
+}
+
+// Fit builds the messages sent to the model from the chat's history so that they fit in the budget.
+//
+// The last turn (the prompt itself) is always sent, truncated if it alone doesn't fit,
+// then the system turns, and then the rest of the turns newest first until the budget is spent.
+func (b Budget) Fit(history []bot_chat.Turn) []bot_infrastructure_llm.Message {
+	if len(history) == 0 {
+		return nil
+	}
+
+	messages := make([]bot_infrastructure_llm.Message, len(history))
+	for i, turn := range history {
+		messages[i] = bot_infrastructure_llm.Message{
+			Role:    bot_infrastructure_llm.Role(turn.Role),
+			Content: turn.Content,
+		}
+	}
+
+	include := make([]bool, len(messages))
+	remaining := b.PromptTokens() - bot_infrastructure_tokenizer.TokensReplyPriming
+
+	last := len(messages) - 1
+	cost := bot_infrastructure_tokenizer.MessageTokens(b.Tokenizer, messages[last])
+	if cost > remaining {
+		overhead := cost - b.Tokenizer.Count(messages[last].Content)
+		messages[last].Content = b.Tokenizer.Truncate(messages[last].Content, remaining-overhead)
+		cost = bot_infrastructure_tokenizer.MessageTokens(b.Tokenizer, messages[last])
+	}
+	include[last] = true
+	remaining -= cost
+
+	for i := 0; i < last; i++ {
+		if messages[i].Role != bot_infrastructure_llm.RoleSystem {
+			continue
+		}
+
+		cost := bot_infrastructure_tokenizer.MessageTokens(b.Tokenizer, messages[i])
+		if cost > remaining {
+			continue
+		}
+		include[i] = true
+		remaining -= cost
+	}
+
+	for i := last - 1; i >= 0; i-- {
+		if messages[i].Role == bot_infrastructure_llm.RoleSystem {
+			continue
+		}
+
+		cost := bot_infrastructure_tokenizer.MessageTokens(b.Tokenizer, messages[i])
+		if cost > remaining {
+			break
+		}
+		include[i] = true
+		remaining -= cost
+	}
+
+	fitted := make([]bot_infrastructure_llm.Message, 0, len(messages))
+	for i, msg := range messages {
+		if include[i] {
+			fitted = append(fitted, msg)
+		}
+	}
+
+	return fitted
+}
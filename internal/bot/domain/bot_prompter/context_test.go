@@ -0,0 +1,105 @@
+package bot_prompter
+
+import (
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"connectly-interview/internal/bot/infrastructure/llm"
+	"connectly-interview/internal/bot/infrastructure/tokenizer"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ContextTestSuite struct {
+	suite.Suite
+	tokenizer bot_infrastructure_tokenizer.Tokenizer
+}
+
+func (suite *ContextTestSuite) SetupSuite() {
+	suite.tokenizer = bot_infrastructure_tokenizer.NewEstimator()
+}
+
+// budgetFor returns a budget that exactly fits the messages
+func (suite *ContextTestSuite) budgetFor(messages ...bot_infrastructure_llm.Message) Budget {
+	return Budget{
+		Tokenizer:      suite.tokenizer,
+		ContextWindow:  bot_infrastructure_tokenizer.MessagesTokens(suite.tokenizer, messages) + 10,
+		ResponseTokens: 10,
+	}
+}
+
+func (suite *ContextTestSuite) TestWholeHistoryFitsInBudget() {
+	chat := bot_chat.New(bot_chat.Args{SystemPrompt: "be nice"})
+	chat.AppendTurn(bot_chat.RoleUser, "hi")
+	chat.AppendTurn(bot_chat.RoleAssistant, "hello")
+	chat.AppendTurn(bot_chat.RoleUser, "how are you?")
+
+	budget := Budget{Tokenizer: suite.tokenizer, ContextWindow: 4096, ResponseTokens: DefaultResponseTokens}
+	suite.Equal([]bot_infrastructure_llm.Message{
+		{Role: bot_infrastructure_llm.RoleSystem, Content: "be nice"},
+		{Role: bot_infrastructure_llm.RoleUser, Content: "hi"},
+		{Role: bot_infrastructure_llm.RoleAssistant, Content: "hello"},
+		{Role: bot_infrastructure_llm.RoleUser, Content: "how are you?"},
+	}, budget.Fit(chat.History()))
+}
+
+func (suite *ContextTestSuite) TestOldestTurnsAreTrimmed() {
+	long := strings.Repeat("a", 400)
+	chat := bot_chat.New(bot_chat.Args{SystemPrompt: "be nice"})
+	chat.AppendTurn(bot_chat.RoleUser, long)
+	chat.AppendTurn(bot_chat.RoleAssistant, long)
+	chat.AppendTurn(bot_chat.RoleUser, "last")
+
+	expected := []bot_infrastructure_llm.Message{
+		{Role: bot_infrastructure_llm.RoleSystem, Content: "be nice"},
+		{Role: bot_infrastructure_llm.RoleAssistant, Content: long},
+		{Role: bot_infrastructure_llm.RoleUser, Content: "last"},
+	}
+	suite.Equal(expected, suite.budgetFor(expected...).Fit(chat.History()))
+}
+
+func (suite *ContextTestSuite) TestHistoryTokensLimit() {
+	chat := bot_chat.New(bot_chat.Args{})
+	chat.AppendTurn(bot_chat.RoleUser, "old")
+	chat.AppendTurn(bot_chat.RoleUser, "new")
+
+	expected := []bot_infrastructure_llm.Message{
+		{Role: bot_infrastructure_llm.RoleUser, Content: "new"},
+	}
+	budget := Budget{
+		Tokenizer:      suite.tokenizer,
+		ContextWindow:  4096,
+		ResponseTokens: DefaultResponseTokens,
+		HistoryTokens:  bot_infrastructure_tokenizer.MessagesTokens(suite.tokenizer, expected),
+	}
+	suite.Equal(expected, budget.Fit(chat.History()))
+}
+
+func (suite *ContextTestSuite) TestOverflowingPromptIsTruncated() {
+	chat := bot_chat.New(bot_chat.Args{})
+	chat.AppendTurn(bot_chat.RoleUser, "old")
+	chat.AppendTurn(bot_chat.RoleUser, strings.Repeat("a", 4000))
+
+	budget := suite.budgetFor(bot_infrastructure_llm.Message{Role: bot_infrastructure_llm.RoleUser, Content: strings.Repeat("a", 400)})
+	messages := budget.Fit(chat.History())
+	suite.Len(messages, 1)
+	suite.Equal(strings.Repeat("a", 400), messages[0].Content)
+	suite.LessOrEqual(bot_infrastructure_tokenizer.MessagesTokens(suite.tokenizer, messages), budget.PromptTokens())
+}
+
+func (suite *ContextTestSuite) TestHistoryCapacityKeepsSystemTurns() {
+	chat := bot_chat.New(bot_chat.Args{HistoryCapacity: 3, SystemPrompt: "be nice"})
+	chat.AppendTurn(bot_chat.RoleUser, "one")
+	chat.AppendTurn(bot_chat.RoleAssistant, "two")
+	chat.AppendTurn(bot_chat.RoleUser, "three")
+
+	history := chat.History()
+	suite.Len(history, 3)
+	suite.Equal(bot_chat.RoleSystem, history[0].Role)
+	suite.Equal("two", history[1].Content)
+	suite.Equal("three", history[2].Content)
+}
+
+func TestContextTestSuite(t *testing.T) {
+	suite.Run(t, new(ContextTestSuite))
+}
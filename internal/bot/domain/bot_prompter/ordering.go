@@ -0,0 +1,160 @@
+package bot_prompter
+
+import (
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"connectly-interview/internal/libs/lists"
+	"fmt"
+)
+
+// chatQueue keeps the prompts of a chat in order,
+// so that only one of them is answered at a time and each answer is recorded to the history before the next prompt.
+//
+// The first prompt of a chat goes through the prompter's queue to a worker,
+// the next ones wait in the chat's backlog and the worker that answers a prompt goes on with the next one of the chat.
+// Prompts of different chats are still answered in parallel by different workers.
+type chatQueue struct {
+	// active is whether a prompt of the chat is queued for or being answered by a worker
+	active bool
+	// backlog are the prompts that wait for the active one to be answered, in the order they came
+	backlog *lists.Queue[*Prompt]
+	// slots limits how many prompts of the chat can be active or in the backlog at the same time
+	slots chan struct{}
+	// prompts is how many prompts hold or wait for a slot, the chat's queue is forgotten when there's none
+	prompts int
+}
+
+// admit takes a slot for the prompt in its chat's queue, following the queue full policy if there's none left
+func (p *prompter) admit(prompt *Prompt) error {
+	chatId := prompt.Chat.Id()
+
+	p.m.Lock()
+	c, ok := p.chats[chatId]
+	if !ok {
+		c = &chatQueue{
+			backlog: lists.NewQueue[*Prompt](),
+			slots:   make(chan struct{}, cap(p.queue)+1),
+		}
+		p.chats[chatId] = c
+	}
+	c.prompts++
+	p.m.Unlock()
+
+	for {
+		select {
+		case c.slots <- struct{}{}:
+			return nil
+		default:
+		}
+
+		switch p.queueFullPolicy {
+		case QueueFullReject:
+			p.m.Lock()
+			p.rejected++
+			p.m.Unlock()
+			p.leave(chatId)
+			return ErrQueueFull
+		case QueueFullDropOldest:
+			p.m.Lock()
+			oldest, err := c.backlog.Dequeue()
+			if err == nil {
+				p.backlogged--
+			}
+			p.m.Unlock()
+			if err == nil {
+				p.drop(oldest)
+				p.release(oldest)
+				continue
+			}
+		}
+
+		// there's nothing to drop, as with QueueFullBlock wait for a slot
+		select {
+		case c.slots <- struct{}{}:
+			return nil
+		case <-prompt.ctx.Done():
+			p.leave(chatId)
+			return fmt.Errorf("could not queue prompt: %w", prompt.ctx.Err())
+		}
+	}
+}
+
+// line puts the prompt in its chat's backlog if another prompt of the chat is active,
+// otherwise the prompt becomes the active one and it's up to the caller to send it to a worker.
+func (p *prompter) line(prompt *Prompt) (active bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	c := p.chats[prompt.Chat.Id()]
+	if c.active {
+		c.backlog.Enqueue(prompt)
+		p.backlogged++
+		return false
+	}
+	c.active = true
+
+	return true
+}
+
+// finish releases the slot of the chat's active prompt and returns the next prompt of the chat, if any,
+// which becomes the active one.
+func (p *prompter) finish(prompt *Prompt) (next *Prompt) {
+	p.m.Lock()
+	c := p.chats[prompt.Chat.Id()]
+	next, err := c.backlog.Dequeue()
+	if err != nil {
+		next = nil
+		c.active = false
+	} else {
+		p.backlogged--
+	}
+	p.m.Unlock()
+
+	p.release(prompt)
+
+	return next
+}
+
+// dispatch sends the chat's active prompt to a worker,
+// if it can't, the prompt is ended and the chat goes on with its next prompt.
+func (p *prompter) dispatch(prompt *Prompt) {
+	for prompt != nil {
+		err := p.enqueue(prompt)
+		if err == nil {
+			return
+		}
+
+		prompt.answer <- Delta{Err: fmt.Errorf("could not compile prompt: %w", err)}
+		close(prompt.answer)
+		p.done(prompt)
+		prompt = p.finish(prompt)
+	}
+}
+
+// release gives the prompt's slot back to its chat's queue
+func (p *prompter) release(prompt *Prompt) {
+	chatId := prompt.Chat.Id()
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	c := p.chats[chatId]
+	<-c.slots
+	p.forget(chatId, c)
+}
+
+// leave is called by a prompt that did not get a slot in its chat's queue
+func (p *prompter) leave(chatId bot_chat.ChatId) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.forget(chatId, p.chats[chatId])
+}
+
+// forget forgets the chat's queue once no prompt holds or waits for a slot in it,
+// the caller must hold the lock
+func (p *prompter) forget(chatId bot_chat.ChatId, c *chatQueue) {
+	c.prompts--
+	if c.prompts == 0 && !c.active {
+		delete(p.chats, chatId)
+	}
+}
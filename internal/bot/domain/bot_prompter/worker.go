@@ -0,0 +1,137 @@
+package bot_prompter
+
+import (
+	"connectly-interview/internal/bot/infrastructure/llm"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WorkerStats are the statistics of a worker since the prompter started
+type WorkerStats struct {
+	Id   uint
+	Busy bool
+	// Completed is how many answers the worker compiled to the end
+	Completed uint64
+	// Failed is how many answers the provider failed to compile
+	Failed uint64
+	// Canceled is how many answers were aborted because their prompt was canceled or its deadline passed
+	Canceled uint64
+	// BusyTime is how long the worker has spent compiling answers
+	BusyTime time.Duration
+	// LastPromptAt is when the worker last picked a prompt up
+	LastPromptAt time.Time
+}
+
+type Worker struct {
+	id       uint
+	m        sync.Mutex
+	provider bot_infrastructure_llm.Provider
+	stats    WorkerStats
+}
+
+type Workers []*Worker
+
+func NewWorkers(total_workers uint8, provider bot_infrastructure_llm.Provider) Workers {
+	w := make(Workers, total_workers)
+	for i := range w {
+		w[i] = &Worker{
+			id:       uint(i),
+			provider: provider,
+			stats: WorkerStats{
+				Id: uint(i),
+			},
+		}
+	}
+	return w
+}
+
+func (w *Worker) Id() uint {
+	return w.id
+}
+
+func (w *Worker) IsBusy() bool {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	return w.stats.Busy
+}
+
+func (w *Worker) Stats() WorkerStats {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	return w.stats
+}
+
+// Compile streams the request to the provider, sending each delta of the answer as it comes,
+// and returns the whole answer once it's over, with its usage if the provider told it.
+// It stops as soon as the context is done or the delta could not be sent, returning the context's error.
+func (w *Worker) Compile(ctx context.Context, request bot_infrastructure_llm.Request, send func(delta []byte) bool) (answer []byte, usage *bot_infrastructure_llm.Usage, err error) {
+	startedAt := w.begin()
+	defer func() {
+		w.end(startedAt, ctx, err)
+	}()
+
+	chunks, err := w.provider.Stream(ctx, request)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case chunk, ok := <-chunks:
+			if !ok {
+				// the provider also stops when the context is done, that's not the end of the answer
+				if ctx.Err() != nil {
+					return nil, nil, ctx.Err()
+				}
+				return answer, usage, nil
+			}
+			if chunk.Err != nil {
+				return nil, nil, chunk.Err
+			}
+			if chunk.Usage != nil {
+				usage = chunk.Usage
+			}
+			if chunk.Content == "" {
+				continue
+			}
+
+			answer = append(answer, chunk.Content...)
+			if !send([]byte(chunk.Content)) {
+				return nil, nil, fmt.Errorf("could not send delta: %w", ctx.Err())
+			}
+		}
+	}
+}
+
+func (w *Worker) begin() time.Time {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	now := time.Now()
+	w.stats.Busy = true
+	w.stats.LastPromptAt = now
+
+	return now
+}
+
+func (w *Worker) end(startedAt time.Time, ctx context.Context, err error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	w.stats.Busy = false
+	w.stats.BusyTime += time.Since(startedAt)
+	switch {
+	case err == nil:
+		w.stats.Completed++
+	case ctx.Err() != nil:
+		w.stats.Canceled++
+	default:
+		w.stats.Failed++
+	}
+}
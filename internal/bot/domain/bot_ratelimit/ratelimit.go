@@ -0,0 +1,230 @@
+// Package bot_ratelimit keeps the clients of the bot from prompting the model more than they're allowed to.
+//
+// Every key (e.g. a user) has a token bucket of requests per minute and a token bucket of model tokens per day.
+// A prompt takes a request and its estimated tokens before it's queued, and once it's answered
+// the tokens it really cost are charged, so a client that goes over its tokens waits until they refill.
+package bot_ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRateLimited = fmt.Errorf("rate limited")
+)
+
+// Limit is which limit a client went over
+type Limit string
+
+const (
+	LimitRequests Limit = "requests"
+	LimitTokens   Limit = "tokens"
+)
+
+// RateLimitedError is returned when a client went over one of its limits,
+// it can retry once RetryAfter has passed
+type RateLimitedError struct {
+	Limit      Limit
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("%s: too many %s, retry after %s", ErrRateLimited, e.Limit, e.RetryAfter)
+}
+
+func (e *RateLimitedError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// RetryAfterSeconds is RetryAfter in whole seconds, rounded up so that the client does not retry too early
+func (e *RateLimitedError) RetryAfterSeconds() int {
+	return int(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+// sweepInterval is how often the buckets that are full again are forgotten,
+// a key without a bucket gets a full one
+const sweepInterval = time.Minute
+
+// Limiter is the interface that describes how much each key can prompt
+type Limiter interface {
+	// Take takes a request and the tokens of a prompt from the buckets of the key,
+	// or nothing and a *RateLimitedError if either bucket does not have enough
+	Take(key string, tokens int) error
+	// Charge takes more tokens from the bucket of the key, or gives them back if negative,
+	// once the real cost of a prompt is known. The bucket can go below empty.
+	Charge(key string, tokens int)
+}
+
+type limiter struct {
+	m         sync.Mutex
+	requests  rate
+	tokens    rate
+	buckets   map[string]*buckets
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type Args struct {
+	// RequestsPerMinute is how many prompts a key can send in a minute, unlimited if 0
+	RequestsPerMinute int
+	// TokensPerDay is how many model tokens the prompts of a key can cost in a day, unlimited if 0
+	TokensPerDay int
+}
+
+func New(args Args) Limiter {
+	return &limiter{
+		requests: newRate(args.RequestsPerMinute, time.Minute),
+		tokens:   newRate(args.TokensPerDay, time.Hour*24),
+		buckets:  make(map[string]*buckets),
+		now:      time.Now,
+	}
+}
+
+func (l *limiter) Take(key string, tokens int) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	b := l.bucketsOf(key, now)
+
+	// nothing is taken unless both buckets have enough
+	retryAfter := b.requests.wait(1, now)
+	if retryAfter > 0 {
+		return &RateLimitedError{Limit: LimitRequests, RetryAfter: retryAfter}
+	}
+	retryAfter = b.tokens.wait(float64(tokens), now)
+	if retryAfter > 0 {
+		return &RateLimitedError{Limit: LimitTokens, RetryAfter: retryAfter}
+	}
+
+	b.requests.take(1, now)
+	b.tokens.take(float64(tokens), now)
+
+	return nil
+}
+
+func (l *limiter) Charge(key string, tokens int) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := l.now()
+	l.bucketsOf(key, now).tokens.take(float64(tokens), now)
+}
+
+func (l *limiter) bucketsOf(key string, now time.Time) *buckets {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &buckets{
+			requests: newBucket(l.requests, now),
+			tokens:   newBucket(l.tokens, now),
+		}
+		l.buckets[key] = b
+	}
+
+	return b
+}
+
+// sweep forgets the buckets that are full again, the caller must hold the lock
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if b.requests.full(now) && b.tokens.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rate is how big a bucket is and how fast it refills
+type rate struct {
+	capacity float64
+	// perSecond is how much the bucket refills every second
+	perSecond float64
+}
+
+// newRate returns the rate of a bucket that refills completely every period, unlimited if the amount is 0
+func newRate(amount int, period time.Duration) rate {
+	if amount <= 0 {
+		return rate{}
+	}
+
+	return rate{
+		capacity:  float64(amount),
+		perSecond: float64(amount) / period.Seconds(),
+	}
+}
+
+func (r rate) unlimited() bool {
+	return r.capacity == 0
+}
+
+// buckets are the buckets of a key
+type buckets struct {
+	requests *bucket
+	tokens   *bucket
+}
+
+type bucket struct {
+	rate
+	// level is what the bucket had at updatedAt, it's negative when more was charged than the bucket had
+	level     float64
+	updatedAt time.Time
+}
+
+func newBucket(r rate, now time.Time) *bucket {
+	return &bucket{rate: r, level: r.capacity, updatedAt: now}
+}
+
+// refill adds what the bucket refilled since it was last updated
+func (b *bucket) refill(now time.Time) {
+	if b.unlimited() {
+		return
+	}
+
+	elapsed := now.Sub(b.updatedAt).Seconds()
+	if elapsed > 0 {
+		b.level = math.Min(b.capacity, b.level+elapsed*b.perSecond)
+		b.updatedAt = now
+	}
+}
+
+// wait returns how long until the bucket has the amount, 0 if it has it already.
+// An amount bigger than the bucket only needs a full bucket.
+func (b *bucket) wait(amount float64, now time.Time) time.Duration {
+	if b.unlimited() {
+		return 0
+	}
+	b.refill(now)
+
+	amount = math.Min(amount, b.capacity)
+	if b.level >= amount {
+		return 0
+	}
+
+	return time.Duration(math.Ceil((amount - b.level) / b.perSecond * float64(time.Second)))
+}
+
+func (b *bucket) take(amount float64, now time.Time) {
+	if b.unlimited() {
+		return
+	}
+	b.refill(now)
+
+	b.level = math.Min(b.capacity, b.level-amount)
+}
+
+func (b *bucket) full(now time.Time) bool {
+	if b.unlimited() {
+		return true
+	}
+	b.refill(now)
+
+	return b.level >= b.capacity
+}
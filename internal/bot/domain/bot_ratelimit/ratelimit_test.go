@@ -0,0 +1,112 @@
+package bot_ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RateLimitTestSuite struct {
+	suite.Suite
+	now time.Time
+}
+
+func (suite *RateLimitTestSuite) SetupTest() {
+	suite.now = time.Unix(1700000000, 0)
+}
+
+func (suite *RateLimitTestSuite) newLimiter(args Args) Limiter {
+	l := New(args).(*limiter)
+	l.now = func() time.Time { return suite.now }
+	return l
+}
+
+func (suite *RateLimitTestSuite) rateLimited(err error) *RateLimitedError {
+	suite.Require().ErrorIs(err, ErrRateLimited)
+	rateLimited, ok := err.(*RateLimitedError)
+	suite.Require().True(ok)
+	return rateLimited
+}
+
+func (suite *RateLimitTestSuite) TestRequestsPerMinute() {
+	l := suite.newLimiter(Args{RequestsPerMinute: 2})
+
+	suite.NoError(l.Take("alice", 0))
+	suite.NoError(l.Take("alice", 0))
+	rateLimited := suite.rateLimited(l.Take("alice", 0))
+	suite.Equal(LimitRequests, rateLimited.Limit)
+	suite.Equal(time.Second*30, rateLimited.RetryAfter)
+
+	// the keys have their own buckets
+	suite.NoError(l.Take("bob", 0))
+
+	suite.now = suite.now.Add(time.Second * 30)
+	suite.NoError(l.Take("alice", 0))
+	suite.Error(l.Take("alice", 0))
+}
+
+func (suite *RateLimitTestSuite) TestTokensPerDay() {
+	l := suite.newLimiter(Args{RequestsPerMinute: 100, TokensPerDay: 2400})
+
+	suite.NoError(l.Take("alice", 1000))
+	// the answer cost more than the estimate
+	l.Charge("alice", 1300)
+
+	rateLimited := suite.rateLimited(l.Take("alice", 200))
+	suite.Equal(LimitTokens, rateLimited.Limit)
+	// 100 tokens refill every hour
+	suite.Equal(time.Hour, rateLimited.RetryAfter)
+
+	// a rejected prompt takes no request
+	suite.now = suite.now.Add(time.Hour)
+	suite.NoError(l.Take("alice", 200))
+}
+
+func (suite *RateLimitTestSuite) TestPromptsBiggerThanTheBucketNeedAFullBucket() {
+	l := suite.newLimiter(Args{TokensPerDay: 2400})
+
+	suite.NoError(l.Take("alice", 5000))
+	rateLimited := suite.rateLimited(l.Take("alice", 1))
+	suite.Equal(LimitTokens, rateLimited.Limit)
+
+	// the bucket went 2600 tokens below empty, it takes 26 hours to be empty again
+	suite.now = suite.now.Add(time.Hour * 26)
+	suite.Error(l.Take("alice", 1))
+	suite.now = suite.now.Add(time.Minute)
+	suite.NoError(l.Take("alice", 1))
+}
+
+func (suite *RateLimitTestSuite) TestRefundsDoNotOverfillTheBucket() {
+	l := suite.newLimiter(Args{TokensPerDay: 1000})
+
+	suite.NoError(l.Take("alice", 500))
+	l.Charge("alice", -2000)
+
+	suite.NoError(l.Take("alice", 1000))
+	suite.Error(l.Take("alice", 1))
+}
+
+func (suite *RateLimitTestSuite) TestUnlimited() {
+	l := suite.newLimiter(Args{})
+
+	for i := 0; i < 1000; i++ {
+		suite.NoError(l.Take("alice", 1000000))
+	}
+}
+
+func (suite *RateLimitTestSuite) TestFullBucketsAreForgotten() {
+	l := suite.newLimiter(Args{RequestsPerMinute: 1}).(*limiter)
+
+	suite.NoError(l.Take("alice", 0))
+	suite.Len(l.buckets, 1)
+
+	suite.now = suite.now.Add(time.Minute * 2)
+	suite.NoError(l.Take("bob", 0))
+	suite.Len(l.buckets, 1)
+	suite.Contains(l.buckets, "bob")
+}
+
+func TestRateLimitTestSuite(t *testing.T) {
+	suite.Run(t, new(RateLimitTestSuite))
+}
@@ -0,0 +1,262 @@
+// Package bot_usage keeps account of what the prompts of the bot cost, so it can be charged back to its users.
+//
+// Every prompt that reached the model is recorded with its tokens, and priced with the price of its model.
+// The records are added up per chat, per user and per model.
+package bot_usage
+
+import (
+	"connectly-interview/internal/bot/domain/bot_auth"
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"connectly-interview/internal/bot/infrastructure/llm"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Price is what a model charges, in dollars per million tokens
+type Price struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// Prices are the prices of the models
+type Prices map[bot_infrastructure_llm.Model]Price
+
+// DefaultPrices are the list prices of the OpenAI models the bot is usually run with
+var DefaultPrices = Prices{
+	"gpt-3.5-turbo": {Prompt: 0.5, Completion: 1.5},
+	"gpt-4":         {Prompt: 30, Completion: 60},
+	"gpt-4-turbo":   {Prompt: 10, Completion: 30},
+	"gpt-4o":        {Prompt: 2.5, Completion: 10},
+	"gpt-4o-mini":   {Prompt: 0.15, Completion: 0.6},
+	"echo":          {},
+}
+
+// Of returns the price of the model, which is the price of the longest model name it starts with,
+// so that the snapshots of a model (e.g. gpt-4o-2024-08-06) cost like the model. It's false if the model has no price.
+func (prices Prices) Of(model bot_infrastructure_llm.Model) (Price, bool) {
+	price, ok := prices[model]
+	if ok {
+		return price, true
+	}
+
+	longest := ""
+	for name, p := range prices {
+		if len(name) > len(longest) && strings.HasPrefix(model.String(), name.String()+"-") {
+			longest = name.String()
+			price = p
+		}
+	}
+
+	return price, longest != ""
+}
+
+// Cost returns what the tokens cost with the price, in dollars
+func (price Price) Cost(usage bot_infrastructure_llm.Usage) float64 {
+	return (float64(usage.PromptTokens)*price.Prompt + float64(usage.CompletionTokens)*price.Completion) / 1_000_000
+}
+
+// Record is what a single prompt cost
+type Record struct {
+	ChatId bot_chat.ChatId
+	User   bot_auth.UserId
+	Model  bot_infrastructure_llm.Model
+	bot_infrastructure_llm.Usage
+	// Estimated is true when the provider did not tell the tokens, and they were counted by the bot instead
+	Estimated bool
+	// Cost is what the tokens cost in dollars, 0 if the model has no price
+	Cost float64
+	// Priced is false when the model has no price
+	Priced bool
+	At     time.Time
+}
+
+// Totals are the sums of many records
+type Totals struct {
+	// Requests is how many prompts reached the model
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+	// Cost is in dollars
+	Cost float64
+	// Unpriced is how many of the prompts were sent to models without a price, which are not part of the cost
+	Unpriced int
+}
+
+func (t *Totals) add(record Record) {
+	t.Requests++
+	t.PromptTokens += record.PromptTokens
+	t.CompletionTokens += record.CompletionTokens
+	t.TotalTokens += record.TotalTokens
+	t.Cost += record.Cost
+	if !record.Priced {
+		t.Unpriced++
+	}
+}
+
+// Report is the usage of a user, in total and broken down by model and by chat
+type Report struct {
+	User bot_auth.UserId
+	Totals
+	Models map[bot_infrastructure_llm.Model]Totals
+	Chats  map[bot_chat.ChatId]Totals
+}
+
+// Ledger is the interface that describes how the usage of the prompts is recorded and added up
+type Ledger interface {
+	// Record prices the usage of a prompt and adds it to the totals, it returns the priced record
+	Record(record Record) Record
+	// Chat returns the totals of a chat
+	Chat(chatId bot_chat.ChatId) Totals
+	// User returns the report of a user
+	User(user bot_auth.UserId) Report
+	// Users returns the totals of every user, e.g. to charge them back
+	Users() map[bot_auth.UserId]Totals
+	// Models returns the totals of every model
+	Models() map[bot_infrastructure_llm.Model]Totals
+	// ForgetChat forgets the totals of a deleted chat, what it cost is still part of its user's totals
+	ForgetChat(chatId bot_chat.ChatId)
+}
+
+type ledger struct {
+	m      sync.RWMutex
+	prices Prices
+	chats  map[bot_chat.ChatId]*Totals
+	users  map[bot_auth.UserId]*Report
+	models map[bot_infrastructure_llm.Model]*Totals
+	now    func() time.Time
+}
+
+type Args struct {
+	// Prices are the prices of the models, DefaultPrices if nil
+	Prices Prices
+}
+
+func New(args Args) Ledger {
+	if args.Prices == nil {
+		args.Prices = DefaultPrices
+	}
+
+	return &ledger{
+		prices: args.Prices,
+		chats:  make(map[bot_chat.ChatId]*Totals),
+		users:  make(map[bot_auth.UserId]*Report),
+		models: make(map[bot_infrastructure_llm.Model]*Totals),
+		now:    time.Now,
+	}
+}
+
+func (l *ledger) Record(record Record) Record {
+	price, ok := l.prices.Of(record.Model)
+	record.Priced = ok
+	record.Cost = price.Cost(record.Usage)
+	if record.At.IsZero() {
+		record.At = l.now()
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	chat, ok := l.chats[record.ChatId]
+	if !ok {
+		chat = &Totals{}
+		l.chats[record.ChatId] = chat
+	}
+	chat.add(record)
+
+	model, ok := l.models[record.Model]
+	if !ok {
+		model = &Totals{}
+		l.models[record.Model] = model
+	}
+	model.add(record)
+
+	user, ok := l.users[record.User]
+	if !ok {
+		user = &Report{
+			User:   record.User,
+			Models: make(map[bot_infrastructure_llm.Model]Totals),
+			Chats:  make(map[bot_chat.ChatId]Totals),
+		}
+		l.users[record.User] = user
+	}
+	user.add(record)
+	userModel := user.Models[record.Model]
+	userModel.add(record)
+	user.Models[record.Model] = userModel
+	user.Chats[record.ChatId] = *chat
+
+	return record
+}
+
+func (l *ledger) Chat(chatId bot_chat.ChatId) Totals {
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	chat, ok := l.chats[chatId]
+	if !ok {
+		return Totals{}
+	}
+
+	return *chat
+}
+
+func (l *ledger) User(user bot_auth.UserId) Report {
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	report := Report{
+		User:   user,
+		Models: make(map[bot_infrastructure_llm.Model]Totals),
+		Chats:  make(map[bot_chat.ChatId]Totals),
+	}
+	recorded, ok := l.users[user]
+	if !ok {
+		return report
+	}
+
+	report.Totals = recorded.Totals
+	for model, totals := range recorded.Models {
+		report.Models[model] = totals
+	}
+	for chatId, totals := range recorded.Chats {
+		report.Chats[chatId] = totals
+	}
+
+	return report
+}
+
+func (l *ledger) Users() map[bot_auth.UserId]Totals {
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	users := make(map[bot_auth.UserId]Totals, len(l.users))
+	for user, report := range l.users {
+		users[user] = report.Totals
+	}
+
+	return users
+}
+
+func (l *ledger) Models() map[bot_infrastructure_llm.Model]Totals {
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	models := make(map[bot_infrastructure_llm.Model]Totals, len(l.models))
+	for model, totals := range l.models {
+		models[model] = *totals
+	}
+
+	return models
+}
+
+func (l *ledger) ForgetChat(chatId bot_chat.ChatId) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	delete(l.chats, chatId)
+	for _, report := range l.users {
+		delete(report.Chats, chatId)
+	}
+}
@@ -0,0 +1,97 @@
+package bot_usage
+
+import (
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"connectly-interview/internal/bot/infrastructure/llm"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type UsageTestSuite struct {
+	suite.Suite
+}
+
+func usage(prompt int, completion int) bot_infrastructure_llm.Usage {
+	return bot_infrastructure_llm.Usage{PromptTokens: prompt, CompletionTokens: completion, TotalTokens: prompt + completion}
+}
+
+func (suite *UsageTestSuite) TestPrices() {
+	prices := Prices{
+		"gpt-4":  {Prompt: 30, Completion: 60},
+		"gpt-4o": {Prompt: 2.5, Completion: 10},
+	}
+
+	price, ok := prices.Of("gpt-4o")
+	suite.True(ok)
+	suite.Equal(Price{Prompt: 2.5, Completion: 10}, price)
+
+	// the snapshots cost like their model, not like the shorter model names they also start with
+	price, ok = prices.Of("gpt-4o-2024-08-06")
+	suite.True(ok)
+	suite.Equal(Price{Prompt: 2.5, Completion: 10}, price)
+
+	_, ok = prices.Of("gpt-4omni")
+	suite.False(ok)
+
+	suite.InDelta(0.09, Price{Prompt: 30, Completion: 60}.Cost(usage(1000, 1000)), 1e-9)
+}
+
+func (suite *UsageTestSuite) TestTotals() {
+	l := New(Args{Prices: Prices{"gpt-4": {Prompt: 30, Completion: 60}}})
+	chat := bot_chat.NewChatId()
+	other := bot_chat.NewChatId()
+
+	record := l.Record(Record{ChatId: chat, User: "team-a", Model: "gpt-4", Usage: usage(1000, 500)})
+	suite.True(record.Priced)
+	suite.InDelta(0.06, record.Cost, 1e-9)
+	suite.False(record.At.IsZero())
+
+	l.Record(Record{ChatId: chat, User: "team-a", Model: "gpt-4", Usage: usage(2000, 0)})
+	l.Record(Record{ChatId: other, User: "team-a", Model: "llama", Usage: usage(10, 10)})
+	l.Record(Record{ChatId: bot_chat.NewChatId(), User: "team-b", Model: "gpt-4", Usage: usage(1000, 0), At: time.Unix(1, 0)})
+
+	chatTotals := l.Chat(chat)
+	suite.Equal(2, chatTotals.Requests)
+	suite.Equal(3000, chatTotals.PromptTokens)
+	suite.InDelta(0.12, chatTotals.Cost, 1e-9)
+
+	report := l.User("team-a")
+	suite.Equal(3, report.Requests)
+	suite.Equal(3520, report.TotalTokens)
+	suite.Equal(1, report.Unpriced)
+	suite.InDelta(0.12, report.Cost, 1e-9)
+	suite.Equal(chatTotals, report.Chats[chat])
+	suite.Equal(1, report.Models["llama"].Requests)
+	suite.Len(report.Chats, 2)
+
+	users := l.Users()
+	suite.Len(users, 2)
+	suite.InDelta(0.03, users["team-b"].Cost, 1e-9)
+	suite.Equal(3, l.Models()["gpt-4"].Requests)
+
+	suite.Equal(Report{
+		User:   "nobody",
+		Models: map[bot_infrastructure_llm.Model]Totals{},
+		Chats:  map[bot_chat.ChatId]Totals{},
+	}, l.User("nobody"))
+}
+
+func (suite *UsageTestSuite) TestForgetChat() {
+	l := New(Args{})
+	chat := bot_chat.NewChatId()
+	l.Record(Record{ChatId: chat, User: "team-a", Model: "gpt-3.5-turbo", Usage: usage(1000, 1000)})
+
+	l.ForgetChat(chat)
+	suite.Equal(Totals{}, l.Chat(chat))
+	report := l.User("team-a")
+	suite.Empty(report.Chats)
+	// what the chat cost is still charged to its user
+	suite.Equal(1, report.Requests)
+	suite.InDelta(0.002, report.Cost, 1e-9)
+}
+
+func TestUsageTestSuite(t *testing.T) {
+	suite.Run(t, new(UsageTestSuite))
+}
@@ -0,0 +1,435 @@
+// Package bot_infrastructure_chatlog is a chat store that persists the chats to an append-only log file on the local disk,
+// so the chats survive restarts and deploys without needing any database.
+//
+// Every change to a chat is appended to the file as a line of JSON,
+// and the file is replayed on open to index where the lines of every chat are.
+// Only the index is kept in memory, the turns of a chat are read back from the file when the chat is needed.
+package bot_infrastructure_chatlog
+
+import (
+	"bufio"
+	"bytes"
+	"connectly-interview/internal/bot/domain/bot_auth"
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrClosed    = fmt.Errorf("chat log is closed")
+	ErrCorrupted = fmt.Errorf("chat log is corrupted")
+)
+
+type op string
+
+const (
+	opCreate op = "create"
+	opAppend op = "append"
+	opDelete op = "delete"
+)
+
+// entry is a line of the log
+type entry struct {
+	Op     op              `json:"op"`
+	ChatId bot_chat.ChatId `json:"chat_id"`
+	// Chat is the created chat, on create
+	Chat *bot_chat.ChatRecord `json:"chat,omitempty"`
+	// Turn is the appended turn, on append
+	Turn *bot_chat.Turn `json:"turn,omitempty"`
+}
+
+// span is where a line is in the log
+type span struct {
+	offset int64
+	length int64
+}
+
+// indexedChat is what's kept in memory of a chat
+type indexedChat struct {
+	// record is the chat without its turns
+	record bot_chat.ChatRecord
+	// lines are the lines of the chat in the log, its create entry first and the turns appended to it after
+	lines []span
+}
+
+type chatLog struct {
+	m     sync.RWMutex
+	path  string
+	file  *os.File
+	chats map[bot_chat.ChatId]*indexedChat
+	fsync bool
+	// size is where the next entry is written to the log
+	size int64
+	// liveEntries counts the entries of the log of the chats that still exist
+	liveEntries int
+	// staleEntries counts the entries of the log that are of no use anymore, e.g. of deleted chats
+	staleEntries int
+}
+
+type Option func(l *chatLog)
+
+// WithFsync makes every write wait until it's flushed to the disk,
+// so not even a crash of the machine loses a turn, at the cost of slower writes.
+func WithFsync() Option {
+	return func(l *chatLog) {
+		l.fsync = true
+	}
+}
+
+// Open opens the log at the path, creating it if it does not exist,
+// and replays it to index the stored chats.
+func Open(path string, opts ...Option) (bot_chat.ChatStore, error) {
+	l := &chatLog{
+		path:  path,
+		chats: make(map[bot_chat.ChatId]*indexedChat),
+	}
+
+	for _, o := range opts {
+		o(l)
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("could not create directory of chat log %q: %w", path, err)
+	}
+
+	l.file, err = os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open chat log %q: %w", path, err)
+	}
+
+	err = l.replay()
+	if err == nil && l.staleEntries > 0 {
+		err = l.compact()
+	}
+	if err != nil {
+		l.file.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// replay reads the whole log and indexes its entries.
+// A last line that is cut in half (e.g. the bot crashed while writing it) is dropped from the log.
+func (l *chatLog) replay() error {
+	reader := bufio.NewReader(l.file)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(bytes.TrimSpace(line)) > 0 {
+				fmt.Printf("dropping incomplete line %d of chat log %q\n", lineNumber, l.path)
+				err = l.file.Truncate(l.size)
+				if err != nil {
+					return fmt.Errorf("could not drop incomplete line of chat log %q: %w", l.path, err)
+				}
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read chat log %q: %w", l.path, err)
+		}
+
+		var e entry
+		err = json.Unmarshal(line, &e)
+		if err != nil {
+			return fmt.Errorf("%w: %q at line %d: %s", ErrCorrupted, l.path, lineNumber, err)
+		}
+		l.apply(e, span{offset: l.size, length: int64(len(line))})
+		l.size += int64(len(line))
+	}
+}
+
+// apply indexes the entry that is at the span of the log
+func (l *chatLog) apply(e entry, line span) {
+	switch e.Op {
+	case opCreate:
+		if e.Chat != nil {
+			record := *e.Chat
+			record.Turns = nil
+			l.chats[e.ChatId] = &indexedChat{record: record, lines: []span{line}}
+			l.liveEntries++
+		}
+	case opAppend:
+		chat, ok := l.chats[e.ChatId]
+		if !ok || e.Turn == nil {
+			l.staleEntries++
+			return
+		}
+		chat.lines = append(chat.lines, line)
+		l.liveEntries++
+	case opDelete:
+		// the deleted chat's entries are left behind in the log
+		chat, ok := l.chats[e.ChatId]
+		if ok {
+			l.liveEntries -= len(chat.lines)
+			l.staleEntries += len(chat.lines)
+		}
+		l.staleEntries++
+		delete(l.chats, e.ChatId)
+	}
+}
+
+// read reads the chat back from its lines in the log, the caller must hold the lock
+func (l *chatLog) read(chat *indexedChat) (*bot_chat.ChatRecord, error) {
+	if l.file == nil {
+		return nil, ErrClosed
+	}
+
+	var record *bot_chat.ChatRecord
+	for _, line := range chat.lines {
+		buf := make([]byte, line.length)
+		_, err := l.file.ReadAt(buf, line.offset)
+		if err != nil {
+			return nil, fmt.Errorf("could not read chat %q from chat log %q: %w", chat.record.Id, l.path, err)
+		}
+
+		var e entry
+		err = json.Unmarshal(buf, &e)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q at offset %d: %s", ErrCorrupted, l.path, line.offset, err)
+		}
+		switch {
+		case e.Op == opCreate && e.Chat != nil:
+			record = e.Chat
+		case e.Op == opAppend && e.Turn != nil && record != nil:
+			record.Turns = append(record.Turns, *e.Turn)
+		default:
+			return nil, fmt.Errorf("%w: %q has no %s entry of chat %q at offset %d", ErrCorrupted, l.path, e.Op, chat.record.Id, line.offset)
+		}
+	}
+	if record == nil {
+		return nil, fmt.Errorf("%w: %q has no create entry of chat %q", ErrCorrupted, l.path, chat.record.Id)
+	}
+
+	return record, nil
+}
+
+// compact rewrites the log with only the chats that still exist, each in a single line,
+// the caller must hold the lock
+func (l *chatLog) compact() error {
+	tmpPath := l.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("could not create compacted chat log %q: %w", tmpPath, err)
+	}
+	defer os.Remove(tmpPath)
+
+	writer := bufio.NewWriter(tmp)
+	lines := make(map[bot_chat.ChatId]span, len(l.chats))
+	var size int64
+	for _, chat := range l.sortedChats() {
+		record, err := l.read(chat)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		line, err := json.Marshal(entry{Op: opCreate, ChatId: record.Id, Chat: record})
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("could not marshal chat %q: %w", record.Id, err)
+		}
+		_, err = writer.Write(append(line, '\n'))
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("could not write compacted chat log %q: %w", tmpPath, err)
+		}
+		lines[record.Id] = span{offset: size, length: int64(len(line)) + 1}
+		size += int64(len(line)) + 1
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write compacted chat log %q: %w", tmpPath, err)
+	}
+
+	err = os.Rename(tmpPath, l.path)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not replace chat log %q with the compacted one: %w", l.path, err)
+	}
+
+	// the compacted log is written to from now on, it's at the path of the log since the rename
+	err = l.file.Close()
+	if err != nil {
+		fmt.Printf("could not close chat log %q that was compacted: %s\n", l.path, err)
+	}
+	l.file = tmp
+	l.size = size
+	for chatId, chat := range l.chats {
+		chat.lines = []span{lines[chatId]}
+	}
+	l.liveEntries = len(l.chats)
+	l.staleEntries = 0
+
+	return nil
+}
+
+// compactIfStale compacts the log once most of its entries are of no use anymore,
+// the caller must hold the lock
+func (l *chatLog) compactIfStale() {
+	if l.staleEntries <= l.liveEntries {
+		return
+	}
+
+	err := l.compact()
+	if err != nil {
+		fmt.Printf("could not compact chat log %q: %s\n", l.path, err)
+	}
+}
+
+// write appends the entry to the log and returns where it was written, the caller must hold the lock
+func (l *chatLog) write(e entry) (span, error) {
+	if l.file == nil {
+		return span{}, ErrClosed
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return span{}, fmt.Errorf("could not marshal %s entry of chat %q: %w", e.Op, e.ChatId, err)
+	}
+	line = append(line, '\n')
+
+	_, err = l.file.Write(line)
+	if err != nil {
+		// a line that was cut in half would be read as part of the next one
+		truncateErr := l.file.Truncate(l.size)
+		if truncateErr != nil {
+			fmt.Printf("could not drop incomplete line of chat log %q: %s\n", l.path, truncateErr)
+		}
+		return span{}, fmt.Errorf("could not write %s entry of chat %q: %w", e.Op, e.ChatId, err)
+	}
+	written := span{offset: l.size, length: int64(len(line))}
+	l.size += written.length
+
+	if l.fsync {
+		err = l.file.Sync()
+		if err != nil {
+			return written, fmt.Errorf("could not sync chat log: %w", err)
+		}
+	}
+
+	return written, nil
+}
+
+func (l *chatLog) Create(record bot_chat.ChatRecord) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if _, ok := l.chats[record.Id]; ok {
+		return fmt.Errorf("%w: %s", bot_chat.ErrChatExists, record.Id)
+	}
+
+	line, err := l.write(entry{Op: opCreate, ChatId: record.Id, Chat: &record})
+	if err != nil {
+		return err
+	}
+	record.Turns = nil
+	l.chats[record.Id] = &indexedChat{record: record, lines: []span{line}}
+	l.liveEntries++
+
+	return nil
+}
+
+func (l *chatLog) Get(chatId bot_chat.ChatId) (*bot_chat.ChatRecord, error) {
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	chat, ok := l.chats[chatId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", bot_chat.ErrChatNotFound, chatId)
+	}
+
+	return l.read(chat)
+}
+
+func (l *chatLog) Delete(chatId bot_chat.ChatId) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	chat, ok := l.chats[chatId]
+	if !ok {
+		return fmt.Errorf("%w: %s", bot_chat.ErrChatNotFound, chatId)
+	}
+
+	_, err := l.write(entry{Op: opDelete, ChatId: chatId})
+	if err != nil {
+		return err
+	}
+	delete(l.chats, chatId)
+	l.liveEntries -= len(chat.lines)
+	l.staleEntries += len(chat.lines) + 1
+	l.compactIfStale()
+
+	return nil
+}
+
+func (l *chatLog) AppendTurn(chatId bot_chat.ChatId, turn bot_chat.Turn) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	chat, ok := l.chats[chatId]
+	if !ok {
+		return fmt.Errorf("%w: %s", bot_chat.ErrChatNotFound, chatId)
+	}
+
+	line, err := l.write(entry{Op: opAppend, ChatId: chatId, Turn: &turn})
+	if err != nil {
+		return err
+	}
+	chat.lines = append(chat.lines, line)
+	l.liveEntries++
+
+	return nil
+}
+
+func (l *chatLog) List(owner bot_auth.UserId) ([]bot_chat.ChatId, error) {
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	chatIds := make([]bot_chat.ChatId, 0)
+	for _, chat := range l.sortedChats() {
+		if chat.record.OwnedBy(owner) {
+			chatIds = append(chatIds, chat.record.Id)
+		}
+	}
+
+	return chatIds, nil
+}
+
+// sortedChats returns the chats oldest first, the caller must hold the lock
+func (l *chatLog) sortedChats() []*indexedChat {
+	chats := make([]*indexedChat, 0, len(l.chats))
+	for _, chat := range l.chats {
+		chats = append(chats, chat)
+	}
+	sort.Slice(chats, func(i, j int) bool {
+		return chats[i].record.CreatedAt.Before(chats[j].record.CreatedAt)
+	})
+
+	return chats
+}
+
+func (l *chatLog) Close() error {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.file == nil {
+		return ErrClosed
+	}
+
+	err := l.file.Close()
+	l.file = nil
+
+	return err
+}
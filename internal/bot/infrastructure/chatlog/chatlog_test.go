@@ -0,0 +1,156 @@
+package bot_infrastructure_chatlog
+
+import (
+	"connectly-interview/internal/bot/domain/bot_auth"
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ChatLogTestSuite struct {
+	suite.Suite
+	path string
+}
+
+func (suite *ChatLogTestSuite) SetupTest() {
+	suite.path = filepath.Join(suite.T().TempDir(), "chats", "chats.log")
+}
+
+func (suite *ChatLogTestSuite) open() bot_chat.ChatStore {
+	store, err := Open(suite.path)
+	suite.Require().NoError(err)
+	return store
+}
+
+func (suite *ChatLogTestSuite) newRecord(owner bot_auth.UserId) bot_chat.ChatRecord {
+	return bot_chat.ChatRecord{
+		Id:        bot_chat.NewChatId(),
+		Owner:     owner,
+		CreatedAt: time.Now().UTC(),
+		Turns: []bot_chat.Turn{
+			{Role: bot_chat.RoleSystem, Content: "be nice", CreatedAt: time.Now().UTC()},
+		},
+	}
+}
+
+// lines counts the lines of the log
+func (suite *ChatLogTestSuite) lines() int {
+	contents, err := os.ReadFile(suite.path)
+	suite.Require().NoError(err)
+	return strings.Count(string(contents), "\n")
+}
+
+func (suite *ChatLogTestSuite) TestChatsSurviveReopening() {
+	store := suite.open()
+	first, second := suite.newRecord("alice"), suite.newRecord("alice")
+	// of another user, and of before the chats had owners
+	other, legacy := suite.newRecord("bob"), suite.newRecord("")
+	suite.NoError(store.Create(first))
+	suite.NoError(store.Create(second))
+	suite.NoError(store.Create(other))
+	suite.NoError(store.Create(legacy))
+	turn := bot_chat.Turn{Role: bot_chat.RoleUser, Content: "hi", CreatedAt: time.Now().UTC()}
+	suite.NoError(store.AppendTurn(first.Id, turn))
+	suite.ErrorIs(store.Create(first), bot_chat.ErrChatExists)
+	suite.NoError(store.Close())
+
+	store = suite.open()
+	defer store.Close()
+
+	record, err := store.Get(first.Id)
+	suite.NoError(err)
+	suite.Equal(append(first.Turns, turn), record.Turns)
+	suite.True(first.CreatedAt.Equal(record.CreatedAt))
+	suite.Equal(bot_auth.UserId("alice"), record.Owner)
+
+	chatIds, err := store.List("alice")
+	suite.NoError(err)
+	suite.Equal([]bot_chat.ChatId{first.Id, second.Id}, chatIds)
+	chatIds, err = store.List(bot_auth.AnonymousUser)
+	suite.NoError(err)
+	suite.Equal([]bot_chat.ChatId{legacy.Id}, chatIds)
+}
+
+func (suite *ChatLogTestSuite) TestDeletedChatsAreCompactedAway() {
+	store := suite.open()
+	deleted, kept := suite.newRecord("alice"), suite.newRecord("alice")
+	suite.NoError(store.Create(deleted))
+	suite.NoError(store.Create(kept))
+	suite.NoError(store.Delete(deleted.Id))
+	suite.ErrorIs(store.Delete(deleted.Id), bot_chat.ErrChatNotFound)
+	suite.ErrorIs(store.AppendTurn(deleted.Id, bot_chat.Turn{}), bot_chat.ErrChatNotFound)
+	suite.NoError(store.Close())
+
+	store = suite.open()
+	defer store.Close()
+
+	_, err := store.Get(deleted.Id)
+	suite.ErrorIs(err, bot_chat.ErrChatNotFound)
+	_, err = store.Get(kept.Id)
+	suite.NoError(err)
+
+	contents, err := os.ReadFile(suite.path)
+	suite.NoError(err)
+	suite.NotContains(string(contents), deleted.Id.String())
+}
+
+func (suite *ChatLogTestSuite) TestLogIsCompactedOnceMostOfItIsStale() {
+	store := suite.open()
+	records := []bot_chat.ChatRecord{suite.newRecord("alice"), suite.newRecord("alice"), suite.newRecord("alice")}
+	turn := bot_chat.Turn{Role: bot_chat.RoleUser, Content: "hi", CreatedAt: time.Now().UTC()}
+	for _, record := range records {
+		suite.NoError(store.Create(record))
+		suite.NoError(store.AppendTurn(record.Id, turn))
+	}
+
+	// the lines of the first deleted chat are still fewer than the ones of the chats that exist
+	suite.NoError(store.Delete(records[0].Id))
+	suite.Equal(7, suite.lines())
+	suite.NoError(store.Delete(records[1].Id))
+	suite.Equal(1, suite.lines())
+
+	kept := records[2]
+	record, err := store.Get(kept.Id)
+	suite.NoError(err)
+	suite.Equal(append(kept.Turns, turn), record.Turns)
+
+	// the compacted log is the one that's written to
+	suite.NoError(store.AppendTurn(kept.Id, turn))
+	suite.NoError(store.Close())
+
+	store = suite.open()
+	defer store.Close()
+	record, err = store.Get(kept.Id)
+	suite.NoError(err)
+	suite.Equal(append(kept.Turns, turn, turn), record.Turns)
+}
+
+func (suite *ChatLogTestSuite) TestIncompleteLastLineIsDropped() {
+	store := suite.open()
+	record := suite.newRecord("alice")
+	suite.NoError(store.Create(record))
+	suite.NoError(store.Close())
+
+	file, err := os.OpenFile(suite.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	suite.Require().NoError(err)
+	_, err = file.WriteString(`{"op":"append","chat_id":"` + record.Id.String() + `","tu`)
+	suite.NoError(err)
+	suite.NoError(file.Close())
+
+	store = suite.open()
+	defer store.Close()
+
+	got, err := store.Get(record.Id)
+	suite.NoError(err)
+	suite.Len(got.Turns, 1)
+	suite.NoError(store.AppendTurn(record.Id, bot_chat.Turn{Role: bot_chat.RoleUser, Content: "hi"}))
+}
+
+func TestChatLogTestSuite(t *testing.T) {
+	suite.Run(t, new(ChatLogTestSuite))
+}
@@ -0,0 +1,467 @@
+// Package bot_infrastructure_kafka_embedded is a message broker that runs inside the bot,
+// for the environments that have no Kafka, e.g. development and tests.
+//
+// Every topic is a log of messages, each one with its offset. Sending a message appends it to the log and never
+// waits for the subscribers, which read the log at their own pace. The subscribers that are named have their own
+// offsets, they commit the messages they handled and go on from the next one when they subscribe again.
+//
+// With a directory, the logs are appended to segment files and the committed offsets are kept next to them,
+// so the messages survive restarts. The oldest messages are dropped once they're out of the retention.
+// Only one broker at a time can have a directory open, the others fail with ErrLocked.
+package bot_infrastructure_kafka_embedded
+
+import (
+	"connectly-interview/internal/bot/infrastructure/kafka"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClosed       = fmt.Errorf("broker is closed")
+	ErrInvalidTopic = fmt.Errorf("invalid topic")
+	ErrTooBig       = fmt.Errorf("message is too big")
+	ErrSubscribed   = fmt.Errorf("subscriber is already subscribed")
+	ErrLocked       = fmt.Errorf("directory is used by another broker")
+)
+
+const (
+	// MaxMessageSize is the biggest message a topic accepts, with its key
+	MaxMessageSize = 16 * 1024 * 1024 // 16 MB
+	// DefaultSegmentSize is how big a segment file gets before the next one is started
+	DefaultSegmentSize = 16 * 1024 * 1024 // 16 MB
+
+	// lockFile is the file in the directory of the broker that is locked while the broker has the directory open
+	lockFile = "LOCK"
+)
+
+// DefaultRetention keeps the last messages of every topic
+var DefaultRetention = Retention{Messages: 100_000}
+
+// topicName is what a topic can be named, like in Kafka, so that it's also a valid directory name
+var topicName = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+// Retention is how many of the oldest messages of a topic are kept, every limit that is not zero applies
+type Retention struct {
+	// Messages is how many messages are kept
+	Messages int
+	// Bytes is how many bytes of messages are kept
+	Bytes int64
+	// Age is how long the messages are kept, they're dropped when a message is sent to their topic
+	Age time.Duration
+}
+
+// Message is a message of a topic, the topics of the broker have a single partition
+type Message = bot_infrastructure_kafka.Message
+
+// Broker is the interface of the embedded broker, which is a bot_infrastructure_kafka.Kafka
+// whose subscribers can also be named and have their own offsets
+type Broker interface {
+	bot_infrastructure_kafka.Kafka
+	// Subscribe subscribes the named subscriber to the topic, from the message after the last one it committed,
+	// or from the oldest message that is retained if it never committed any.
+	// A subscriber can only be subscribed once at a time.
+	Subscribe(topic bot_infrastructure_kafka.Topic, name string) (Subscription, error)
+	// Close closes the files of the topics and ends all the subscriptions, the messages that are sent afterwards fail
+	Close() error
+}
+
+// Subscription is a named subscriber that reads a topic
+type Subscription interface {
+	// Messages returns the messages of the topic in order,
+	// the channel is closed when the subscription or the broker is closed.
+	Messages() <-chan Message
+	// Commit marks the message at the offset and the ones before it as handled,
+	// the next time the subscriber subscribes it goes on from the message after it
+	Commit(offset int64) error
+	// Close ends the subscription, the messages that were not committed are read again on the next subscription
+	Close() error
+}
+
+type broker struct {
+	m   sync.Mutex
+	dir string
+	// lock is the lock file of the directory, nil if the broker has none
+	lock        *os.File
+	retention   Retention
+	segmentSize int64
+	fsync       bool
+	topics      map[bot_infrastructure_kafka.Topic]*topicLog
+	// closed is closed once the broker is closed, which ends all the subscriptions
+	closed   chan struct{}
+	isClosed bool
+	now      func() time.Time
+}
+
+type Option func(b *broker)
+
+// WithDir keeps the logs of the topics and the offsets of the subscribers in the directory,
+// by default they're only kept in memory
+func WithDir(dir string) Option {
+	return func(b *broker) {
+		b.dir = dir
+	}
+}
+
+// WithRetention sets how many of the oldest messages of every topic are kept, by default it's DefaultRetention
+func WithRetention(retention Retention) Option {
+	return func(b *broker) {
+		b.retention = retention
+	}
+}
+
+// WithSegmentSize sets how big a segment file gets before the next one is started,
+// the messages are deleted from the disk a segment at a time
+func WithSegmentSize(size int64) Option {
+	return func(b *broker) {
+		b.segmentSize = size
+	}
+}
+
+// WithFsync makes every message and commit wait until it's flushed to the disk,
+// so not even a crash of the machine loses them, at the cost of slower writes.
+func WithFsync() Option {
+	return func(b *broker) {
+		b.fsync = true
+	}
+}
+
+// New returns a running broker, with a directory it first reads the topics that are already in it
+func New(opts ...Option) (Broker, error) {
+	b := &broker{
+		retention:   DefaultRetention,
+		segmentSize: DefaultSegmentSize,
+		topics:      make(map[bot_infrastructure_kafka.Topic]*topicLog),
+		closed:      make(chan struct{}),
+		now:         time.Now,
+	}
+
+	for _, o := range opts {
+		o(b)
+	}
+
+	if b.dir == "" {
+		return b, nil
+	}
+
+	err := os.MkdirAll(b.dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("could not create directory of broker %q: %w", b.dir, err)
+	}
+
+	b.lock, err = lockDir(b.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		b.Close()
+		return nil, fmt.Errorf("could not read directory of broker %q: %w", b.dir, err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !topicName.MatchString(entry.Name()) {
+			continue
+		}
+		_, err = b.topic(bot_infrastructure_kafka.Topic(entry.Name()))
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// topic returns the log of the topic, creating it if it does not exist, the caller must hold the lock
+func (b *broker) topic(topic bot_infrastructure_kafka.Topic) (*topicLog, error) {
+	if b.isClosed {
+		return nil, ErrClosed
+	}
+
+	l, ok := b.topics[topic]
+	if ok {
+		return l, nil
+	}
+
+	if !topicName.MatchString(topic.String()) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidTopic, topic)
+	}
+
+	l = newTopicLog(topic)
+	if b.dir != "" {
+		err := l.open(filepath.Join(b.dir, topic.String()))
+		if err != nil {
+			l.close()
+			return nil, err
+		}
+		l.retain(b.retention, b.now())
+	}
+	b.topics[topic] = l
+
+	return l, nil
+}
+
+// Send appends the message to the topic, without waiting for anyone to read it.
+// The topics have a single partition, so all their messages are in order whatever their key.
+func (b *broker) Send(topic bot_infrastructure_kafka.Topic, key []byte, msg []byte) error {
+	if len(key)+len(msg) > MaxMessageSize {
+		return fmt.Errorf("%w: %d bytes", ErrTooBig, len(key)+len(msg))
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	l, err := b.topic(topic)
+	if err != nil {
+		return err
+	}
+
+	// the message is copied, the caller may reuse its slices
+	var k []byte
+	if len(key) > 0 {
+		k = append([]byte(nil), key...)
+	}
+	err = l.append(k, append([]byte(nil), msg...), b.now(), b.segmentSize, b.fsync)
+	if err != nil {
+		return err
+	}
+	l.retain(b.retention, b.now())
+
+	return nil
+}
+
+// Listen returns the messages that are sent to the topic from now on.
+// The channel is closed when the broker is closed.
+func (b *broker) Listen(topic bot_infrastructure_kafka.Topic) (<-chan []byte, error) {
+	b.m.Lock()
+	l, err := b.topic(topic)
+	if err != nil {
+		b.m.Unlock()
+		return nil, err
+	}
+	offset := l.next
+	b.m.Unlock()
+
+	values := make(chan []byte)
+	go func() {
+		defer close(values)
+
+		b.deliver(l, offset, nil, func(r record) bool {
+			select {
+			case values <- r.value:
+				return true
+			case <-b.closed:
+				return false
+			}
+		})
+	}()
+
+	return values, nil
+}
+
+func (b *broker) Subscribe(topic bot_infrastructure_kafka.Topic, name string) (Subscription, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	l, err := b.topic(topic)
+	if err != nil {
+		return nil, err
+	}
+	if l.subscribed[name] {
+		return nil, fmt.Errorf("%w: %q to topic %q", ErrSubscribed, name, topic)
+	}
+	l.subscribed[name] = true
+
+	offset, ok := l.offsets[name]
+	if !ok {
+		offset = l.first
+	}
+
+	s := &subscription{
+		broker:   b,
+		log:      l,
+		name:     name,
+		messages: make(chan Message),
+		closed:   make(chan struct{}),
+	}
+	go func() {
+		defer close(s.messages)
+
+		b.deliver(l, offset, s.closed, func(r record) bool {
+			select {
+			case s.messages <- Message{Topic: topic, Offset: r.offset, Key: r.key, Value: r.value, Time: r.at}:
+				return true
+			case <-s.closed:
+				return false
+			case <-b.closed:
+				return false
+			}
+		})
+	}()
+
+	return s, nil
+}
+
+// Consume consumes the topic as the subscriber named after the group,
+// so a group can only have a single member at a time
+func (b *broker) Consume(ctx context.Context, topic bot_infrastructure_kafka.Topic, group string, handler bot_infrastructure_kafka.Handler) error {
+	s, err := b.Subscribe(topic, group)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	for {
+		select {
+		case msg, ok := <-s.Messages():
+			if !ok {
+				return ErrClosed
+			}
+
+			err = bot_infrastructure_kafka.HandleUntilDone(ctx, handler, msg)
+			if err != nil {
+				return nil
+			}
+
+			err = s.Commit(msg.Offset)
+			if err != nil {
+				return fmt.Errorf("could not commit message %d of topic %q: %w", msg.Offset, topic, err)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (b *broker) Read(ctx context.Context, topic bot_infrastructure_kafka.Topic, handler bot_infrastructure_kafka.Handler) error {
+	b.m.Lock()
+	l, err := b.topic(topic)
+	if err != nil {
+		b.m.Unlock()
+		return err
+	}
+	records := l.from(l.first)
+	b.m.Unlock()
+
+	for _, r := range records {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = handler(ctx, Message{Topic: topic, Offset: r.offset, Key: r.key, Value: r.value, Time: r.at})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deliver sends the messages of the log from the offset on, waiting for new ones once it's caught up,
+// until the send fails, the stop channel is closed or the broker is closed.
+func (b *broker) deliver(l *topicLog, offset int64, stop <-chan struct{}, send func(r record) bool) {
+	for {
+		b.m.Lock()
+		if offset < l.first {
+			fmt.Printf("messages %d to %d of topic %q were dropped before they were read\n", offset, l.first-1, l.topic)
+			offset = l.first
+		}
+		// the records are never changed once appended, they're safe to read without the lock
+		records := l.from(offset)
+		appended := l.appended
+		b.m.Unlock()
+
+		if len(records) == 0 {
+			select {
+			case <-appended:
+				continue
+			case <-stop:
+				return
+			case <-b.closed:
+				return
+			}
+		}
+
+		for _, r := range records {
+			if !send(r) {
+				return
+			}
+			offset = r.offset + 1
+		}
+	}
+}
+
+func (b *broker) Close() error {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.isClosed {
+		return ErrClosed
+	}
+	b.isClosed = true
+	close(b.closed)
+
+	var err error
+	for _, l := range b.topics {
+		closeErr := l.close()
+		if closeErr != nil && err == nil {
+			err = fmt.Errorf("could not close topic %q: %w", l.topic, closeErr)
+		}
+	}
+
+	// the topics are closed before the directory is unlocked, so the next broker finds all their messages
+	if b.lock != nil {
+		closeErr := b.lock.Close()
+		if closeErr != nil && err == nil {
+			err = fmt.Errorf("could not unlock directory of broker %q: %w", b.dir, closeErr)
+		}
+	}
+
+	return err
+}
+
+type subscription struct {
+	broker *broker
+	log    *topicLog
+	name   string
+	// messages are the messages of the topic, closed when the subscription or the broker is closed
+	messages  chan Message
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *subscription) Messages() <-chan Message {
+	return s.messages
+}
+
+func (s *subscription) Commit(offset int64) error {
+	s.broker.m.Lock()
+	defer s.broker.m.Unlock()
+
+	if s.broker.isClosed {
+		return ErrClosed
+	}
+
+	s.log.offsets[s.name] = offset + 1
+	if s.log.dir == "" {
+		return nil
+	}
+
+	return s.log.writeOffsets(s.broker.fsync)
+}
+
+func (s *subscription) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+
+		s.broker.m.Lock()
+		delete(s.log.subscribed, s.name)
+		s.broker.m.Unlock()
+	})
+
+	return nil
+}
@@ -0,0 +1,349 @@
+package bot_infrastructure_kafka_embedded
+
+import (
+	"connectly-interview/internal/bot/infrastructure/kafka"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+const topic bot_infrastructure_kafka.Topic = "test-topic"
+
+type EmbeddedTestSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (suite *EmbeddedTestSuite) SetupTest() {
+	suite.dir = suite.T().TempDir()
+}
+
+func (suite *EmbeddedTestSuite) open(opts ...Option) Broker {
+	b, err := New(append([]Option{WithDir(suite.dir)}, opts...)...)
+	suite.Require().NoError(err)
+	return b
+}
+
+func (suite *EmbeddedTestSuite) send(b Broker, values ...string) {
+	for _, value := range values {
+		suite.Require().NoError(b.Send(topic, nil, []byte(value)))
+	}
+}
+
+// receive reads the next messages of the subscription, failing if they do not come in time
+func (suite *EmbeddedTestSuite) receive(s Subscription, amount int) []Message {
+	messages := make([]Message, 0, amount)
+	for len(messages) < amount {
+		select {
+		case message, ok := <-s.Messages():
+			suite.Require().True(ok, "subscription is closed")
+			messages = append(messages, message)
+		case <-time.After(time.Second * 5):
+			suite.FailNow("messages did not come")
+		}
+	}
+	return messages
+}
+
+func values(messages []Message) []string {
+	v := make([]string, 0, len(messages))
+	for _, message := range messages {
+		v = append(v, string(message.Value))
+	}
+	return v
+}
+
+func (suite *EmbeddedTestSuite) TestSendDoesNotWaitForSubscribers() {
+	b, err := New()
+	suite.Require().NoError(err)
+	defer b.Close()
+
+	// nobody listens to the topic
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			suite.NoError(b.Send(topic, nil, []byte("hi")))
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		suite.FailNow("send blocked")
+	}
+}
+
+func (suite *EmbeddedTestSuite) TestSubscribersHaveTheirOwnOffsets() {
+	b, err := New()
+	suite.Require().NoError(err)
+	defer b.Close()
+	suite.send(b, "one", "two", "three")
+
+	audit, err := b.Subscribe(topic, "audit")
+	suite.Require().NoError(err)
+	finance, err := b.Subscribe(topic, "finance")
+	suite.Require().NoError(err)
+
+	// a subscriber that never committed starts from the oldest message
+	suite.Equal([]string{"one", "two", "three"}, values(suite.receive(audit, 3)))
+	messages := suite.receive(finance, 1)
+	suite.Equal(int64(0), messages[0].Offset)
+	suite.NoError(finance.Commit(messages[0].Offset))
+
+	_, err = b.Subscribe(topic, "finance")
+	suite.ErrorIs(err, ErrSubscribed)
+
+	// what was not committed is read again
+	suite.NoError(finance.Close())
+	finance, err = b.Subscribe(topic, "finance")
+	suite.Require().NoError(err)
+	suite.Equal([]string{"two", "three"}, values(suite.receive(finance, 2)))
+
+	// the subscribers wait for the new messages
+	suite.send(b, "four")
+	suite.Equal([]string{"four"}, values(suite.receive(audit, 1)))
+	suite.Equal([]string{"four"}, values(suite.receive(finance, 1)))
+}
+
+func (suite *EmbeddedTestSuite) TestListenGetsTheNewMessages() {
+	b, err := New()
+	suite.Require().NoError(err)
+	suite.send(b, "old")
+
+	first, err := b.Listen(topic)
+	suite.Require().NoError(err)
+	second, err := b.Listen(topic)
+	suite.Require().NoError(err)
+	suite.send(b, "new")
+
+	suite.Equal("new", string(<-first))
+	suite.Equal("new", string(<-second))
+
+	suite.NoError(b.Close())
+	_, ok := <-first
+	suite.False(ok)
+	suite.ErrorIs(b.Send(topic, nil, []byte("late")), ErrClosed)
+}
+
+func (suite *EmbeddedTestSuite) TestConsumeCommitsHandledMessages() {
+	b, err := New()
+	suite.Require().NoError(err)
+	defer b.Close()
+	suite.send(b, "one", "two", "three")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handled := make(chan string)
+	failed := false
+	done := make(chan error)
+	go func() {
+		done <- b.Consume(ctx, topic, "finance", func(ctx context.Context, msg Message) error {
+			// the second message fails once and is handled again, before the third one
+			if string(msg.Value) == "two" && !failed {
+				failed = true
+				return fmt.Errorf("downstream is unavailable")
+			}
+			handled <- string(msg.Value)
+			if string(msg.Value) == "three" {
+				// stopped before the third message is committed
+				cancel()
+				return ctx.Err()
+			}
+			return nil
+		})
+	}()
+
+	for _, expected := range []string{"one", "two", "three"} {
+		select {
+		case value := <-handled:
+			suite.Equal(expected, value)
+		case <-time.After(time.Second * 5):
+			suite.FailNow("message was not handled")
+		}
+	}
+	suite.NoError(<-done)
+
+	// what was not committed is consumed again
+	s, err := b.Subscribe(topic, "finance")
+	suite.Require().NoError(err)
+	suite.Equal([]string{"three"}, values(suite.receive(s, 1)))
+}
+
+func (suite *EmbeddedTestSuite) TestReadDoesNotCommit() {
+	b, err := New()
+	suite.Require().NoError(err)
+	defer b.Close()
+	suite.send(b, "one", "two")
+
+	read := []string{}
+	err = b.Read(context.Background(), topic, func(ctx context.Context, msg Message) error {
+		read = append(read, string(msg.Value))
+		return nil
+	})
+	suite.Require().NoError(err)
+	suite.Equal([]string{"one", "two"}, read)
+
+	err = b.Read(context.Background(), topic, func(ctx context.Context, msg Message) error {
+		return fmt.Errorf("stop")
+	})
+	suite.EqualError(err, "stop")
+
+	s, err := b.Subscribe(topic, "finance")
+	suite.Require().NoError(err)
+	suite.Equal([]string{"one", "two"}, values(suite.receive(s, 2)))
+}
+
+func (suite *EmbeddedTestSuite) TestMessagesAndOffsetsSurviveReopening() {
+	b := suite.open()
+	suite.send(b, "one", "two", "three")
+	s, err := b.Subscribe(topic, "finance")
+	suite.Require().NoError(err)
+	messages := suite.receive(s, 2)
+	suite.NoError(s.Commit(messages[1].Offset))
+	suite.NoError(b.Close())
+
+	b = suite.open()
+	defer b.Close()
+	suite.send(b, "four")
+
+	s, err = b.Subscribe(topic, "finance")
+	suite.Require().NoError(err)
+	messages = suite.receive(s, 2)
+	suite.Equal([]string{"three", "four"}, values(messages))
+	suite.Equal([]int64{2, 3}, []int64{messages[0].Offset, messages[1].Offset})
+
+	audit, err := b.Subscribe(topic, "audit")
+	suite.Require().NoError(err)
+	suite.Equal([]string{"one", "two", "three", "four"}, values(suite.receive(audit, 4)))
+}
+
+func (suite *EmbeddedTestSuite) TestDirIsOpenedByOneBrokerAtATime() {
+	b := suite.open()
+	suite.send(b, "hello")
+
+	_, err := New(WithDir(suite.dir))
+	suite.ErrorIs(err, ErrLocked)
+
+	suite.NoError(b.Close())
+	b = suite.open()
+	defer b.Close()
+	s, err := b.Subscribe(topic, "finance")
+	suite.Require().NoError(err)
+	suite.Equal([]string{"hello"}, values(suite.receive(s, 1)))
+}
+
+func (suite *EmbeddedTestSuite) TestKeysSurviveReopening() {
+	b := suite.open()
+	suite.Require().NoError(b.Send(topic, []byte("chat-1"), []byte("one")))
+	suite.send(b, "two")
+	suite.NoError(b.Close())
+
+	b = suite.open()
+	defer b.Close()
+	s, err := b.Subscribe(topic, "finance")
+	suite.Require().NoError(err)
+	messages := suite.receive(s, 2)
+	suite.Equal([]string{"one", "two"}, values(messages))
+	suite.Equal([]byte("chat-1"), messages[0].Key)
+	suite.Nil(messages[1].Key)
+}
+
+func (suite *EmbeddedTestSuite) TestRetentionDeletesOldSegments() {
+	// every message fills its own segment
+	b := suite.open(WithRetention(Retention{Messages: 2}), WithSegmentSize(1))
+	for i := 0; i < 5; i++ {
+		suite.send(b, fmt.Sprintf("message %d", i))
+	}
+
+	s, err := b.Subscribe(topic, "late")
+	suite.Require().NoError(err)
+	suite.Equal([]string{"message 3", "message 4"}, values(suite.receive(s, 2)))
+	suite.NoError(b.Close())
+
+	segments, err := filepath.Glob(filepath.Join(suite.dir, string(topic), "*"+segmentExt))
+	suite.Require().NoError(err)
+	suite.Len(segments, 2)
+
+	b = suite.open(WithRetention(Retention{Messages: 2}), WithSegmentSize(1))
+	defer b.Close()
+	s, err = b.Subscribe(topic, "after-restart")
+	suite.Require().NoError(err)
+	suite.Equal([]string{"message 3", "message 4"}, values(suite.receive(s, 2)))
+}
+
+func (suite *EmbeddedTestSuite) TestRetainedMessagesAreCompacted() {
+	b, err := New(WithRetention(Retention{Messages: 10}))
+	suite.Require().NoError(err)
+	defer b.Close()
+
+	s, err := b.Subscribe(topic, "finance")
+	suite.Require().NoError(err)
+	for i := 0; i < 1000; i++ {
+		suite.send(b, fmt.Sprintf("message %d", i))
+		suite.Equal([]string{fmt.Sprintf("message %d", i)}, values(suite.receive(s, 1)))
+	}
+
+	l := b.(*broker).topics[topic]
+	suite.Len(l.records, 10)
+	suite.LessOrEqual(l.dropped, len(l.records))
+	suite.Equal(int64(990), l.first)
+
+	late, err := b.Subscribe(topic, "late")
+	suite.Require().NoError(err)
+	suite.Equal("message 990", string(suite.receive(late, 10)[0].Value))
+}
+
+func (suite *EmbeddedTestSuite) TestRetentionByAge() {
+	b, err := New(WithRetention(Retention{Age: time.Hour}))
+	suite.Require().NoError(err)
+	defer b.Close()
+	now := time.Now()
+	b.(*broker).now = func() time.Time { return now }
+
+	suite.send(b, "old")
+	now = now.Add(time.Hour * 2)
+	suite.send(b, "new")
+
+	s, err := b.Subscribe(topic, "finance")
+	suite.Require().NoError(err)
+	suite.Equal([]string{"new"}, values(suite.receive(s, 1)))
+}
+
+func (suite *EmbeddedTestSuite) TestIncompleteLastMessageIsDropped() {
+	b := suite.open()
+	suite.send(b, "one", "two")
+	suite.NoError(b.Close())
+
+	// the bot crashed while writing the last message
+	segment := filepath.Join(suite.dir, string(topic), fmt.Sprintf("%020d%s", 0, segmentExt))
+	info, err := os.Stat(segment)
+	suite.Require().NoError(err)
+	suite.Require().NoError(os.Truncate(segment, info.Size()-2))
+
+	b = suite.open()
+	defer b.Close()
+	suite.send(b, "three")
+
+	s, err := b.Subscribe(topic, "finance")
+	suite.Require().NoError(err)
+	messages := suite.receive(s, 2)
+	suite.Equal([]string{"one", "three"}, values(messages))
+	suite.Equal(int64(1), messages[1].Offset)
+}
+
+func (suite *EmbeddedTestSuite) TestInvalidTopic() {
+	b, err := New()
+	suite.Require().NoError(err)
+	defer b.Close()
+
+	suite.ErrorIs(b.Send("../escape", nil, []byte("hi")), ErrInvalidTopic)
+}
+
+func TestEmbeddedTestSuite(t *testing.T) {
+	suite.Run(t, new(EmbeddedTestSuite))
+}
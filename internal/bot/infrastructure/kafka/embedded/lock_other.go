@@ -0,0 +1,19 @@
+//go:build !unix
+
+package bot_infrastructure_kafka_embedded
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockDir only creates the lock file of the directory, the directories are only locked on unix systems
+func lockDir(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file of broker %q: %w", dir, err)
+	}
+
+	return f, nil
+}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package bot_infrastructure_kafka_embedded
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockDir locks the directory of the broker, so that no other broker opens it while this one has it open.
+// The lock is released when the file is closed, or when the process exits however it exits.
+func lockDir(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file of broker %q: %w", dir, err)
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %q", ErrLocked, dir)
+		}
+		return nil, fmt.Errorf("could not lock directory of broker %q: %w", dir, err)
+	}
+
+	return f, nil
+}
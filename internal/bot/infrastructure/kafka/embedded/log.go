@@ -0,0 +1,440 @@
+package bot_infrastructure_kafka_embedded
+
+import (
+	"bufio"
+	"connectly-interview/internal/bot/infrastructure/kafka"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// segmentExt is the extension of the segment files, which are named after the offset of their first message
+	segmentExt = ".log"
+	// offsetsFile is the file of a topic's directory with the committed offsets of its subscribers
+	offsetsFile = "subscribers.json"
+	// headerSize is the offset, the time, the lengths of the key and the value and the checksum of a message in a segment
+	headerSize = 8 + 8 + 4 + 4 + 4
+)
+
+var (
+	errCorrupted = fmt.Errorf("corrupted message")
+)
+
+// record is a message of a topic's log
+type record struct {
+	offset int64
+	at     time.Time
+	key    []byte
+	value  []byte
+}
+
+// size is how many bytes of the retention the message takes
+func (r record) size() int64 {
+	return int64(len(r.key) + len(r.value))
+}
+
+// segment is a file of a topic's log on the disk
+type segment struct {
+	base int64
+	// last is the offset of the last message of the segment, base-1 if it has none
+	last int64
+	path string
+	size int64
+}
+
+// topicLog is the log of a topic, the messages that are retained are kept in memory,
+// and if the broker has a directory they're also appended to the segment files of the topic
+type topicLog struct {
+	topic   bot_infrastructure_kafka.Topic
+	records []record
+	// dropped is how many of the messages before records are still kept by its array, they're freed once it's compacted
+	dropped int
+	// first is the offset of the oldest retained message, next when there's none
+	first int64
+	next  int64
+	bytes int64
+	// appended is closed when a message is appended, to wake the subscribers up, and replaced by a new one
+	appended chan struct{}
+	// offsets are the offsets the named subscribers go on from, the one after their last committed message
+	offsets map[string]int64
+	// subscribed are the named subscribers that are subscribed right now
+	subscribed map[string]bool
+
+	// dir is the directory of the topic, empty if the log is only kept in memory
+	dir      string
+	segments []*segment
+	// active is the file of the last segment, where the messages are appended
+	active *os.File
+}
+
+func newTopicLog(topic bot_infrastructure_kafka.Topic) *topicLog {
+	return &topicLog{
+		topic:      topic,
+		appended:   make(chan struct{}),
+		offsets:    make(map[string]int64),
+		subscribed: make(map[string]bool),
+	}
+}
+
+// from returns the retained messages from the offset on
+func (l *topicLog) from(offset int64) []record {
+	if offset < l.first {
+		offset = l.first
+	}
+	if offset >= l.next {
+		return nil
+	}
+
+	return l.records[offset-l.first:]
+}
+
+// append appends the message to the log, and to its active segment if it's on the disk
+func (l *topicLog) append(key []byte, value []byte, at time.Time, segmentSize int64, fsync bool) error {
+	r := record{offset: l.next, at: at, key: key, value: value}
+
+	if l.dir != "" {
+		err := l.write(r, segmentSize, fsync)
+		if err != nil {
+			return err
+		}
+	}
+
+	l.records = append(l.records, r)
+	l.next++
+	l.bytes += r.size()
+
+	close(l.appended)
+	l.appended = make(chan struct{})
+
+	return nil
+}
+
+// retain drops the oldest messages that are out of the retention, and the segments that only had those
+func (l *topicLog) retain(retention Retention, now time.Time) {
+	drop := 0
+	bytes := l.bytes
+	for drop < len(l.records) {
+		r := l.records[drop]
+		over := (retention.Messages > 0 && len(l.records)-drop > retention.Messages) ||
+			(retention.Bytes > 0 && bytes > retention.Bytes) ||
+			(retention.Age > 0 && now.Sub(r.at) > retention.Age)
+		if !over {
+			break
+		}
+		bytes -= r.size()
+		drop++
+	}
+	if drop == 0 {
+		return
+	}
+
+	// the subscribers read the records without the lock, so the dropped messages are not cleared in place,
+	// the retained ones are copied away from them once they're fewer than the dropped, so every message is copied once on average
+	l.records = l.records[drop:]
+	l.dropped += drop
+	if l.dropped > len(l.records) {
+		l.records = append([]record(nil), l.records...)
+		l.dropped = 0
+	}
+	l.bytes = bytes
+	l.first += int64(drop)
+
+	// the active segment is never deleted, even if all of its messages are dropped
+	for len(l.segments) > 1 && l.segments[0].last < l.first {
+		err := os.Remove(l.segments[0].path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("could not delete segment %q of topic %q: %s\n", l.segments[0].path, l.topic, err)
+			return
+		}
+		l.segments = l.segments[1:]
+	}
+}
+
+// write appends the message to the active segment, rolling a new one when it's full
+func (l *topicLog) write(r record, segmentSize int64, fsync bool) error {
+	last := l.segments[len(l.segments)-1]
+	if last.size > 0 && last.size >= segmentSize {
+		err := l.roll()
+		if err != nil {
+			return err
+		}
+		last = l.segments[len(l.segments)-1]
+	}
+
+	data := encode(r)
+	_, err := l.active.Write(data)
+	if err != nil {
+		return fmt.Errorf("could not write message %d of topic %q: %w", r.offset, l.topic, err)
+	}
+	if fsync {
+		err = l.active.Sync()
+		if err != nil {
+			return fmt.Errorf("could not sync segment %q: %w", last.path, err)
+		}
+	}
+	last.size += int64(len(data))
+	last.last = r.offset
+
+	return nil
+}
+
+// roll closes the active segment and starts a new one from the next offset
+func (l *topicLog) roll() error {
+	if l.active != nil {
+		err := l.active.Close()
+		if err != nil {
+			return fmt.Errorf("could not close segment of topic %q: %w", l.topic, err)
+		}
+		l.active = nil
+	}
+
+	s := &segment{
+		base: l.next,
+		last: l.next - 1,
+		path: filepath.Join(l.dir, fmt.Sprintf("%020d%s", l.next, segmentExt)),
+	}
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("could not create segment %q: %w", s.path, err)
+	}
+	l.active = file
+	l.segments = append(l.segments, s)
+
+	return nil
+}
+
+// open reads the segments and the committed offsets of the topic from its directory,
+// and opens the last segment to append to
+func (l *topicLog) open(dir string) error {
+	l.dir = dir
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return fmt.Errorf("could not create directory of topic %q: %w", l.topic, err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("could not read directory of topic %q: %w", l.topic, err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		base, err := strconv.ParseInt(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		l.segments = append(l.segments, &segment{base: base, last: base - 1, path: filepath.Join(dir, name)})
+	}
+	sort.Slice(l.segments, func(i, j int) bool {
+		return l.segments[i].base < l.segments[j].base
+	})
+
+	for i, s := range l.segments {
+		if i == 0 {
+			l.first = s.base
+			l.next = s.base
+		}
+		err = l.replay(s, i == len(l.segments)-1)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = l.readOffsets()
+	if err != nil {
+		return err
+	}
+
+	if len(l.segments) == 0 {
+		return l.roll()
+	}
+
+	last := l.segments[len(l.segments)-1]
+	l.active, err = os.OpenFile(last.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("could not open segment %q: %w", last.path, err)
+	}
+
+	return nil
+}
+
+// replay reads the messages of the segment to the log.
+// The last message of the last segment may be cut in half (e.g. the bot crashed while writing it), then it's dropped.
+func (l *topicLog) replay(s *segment, last bool) error {
+	file, err := os.OpenFile(s.path, os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("could not open segment %q: %w", s.path, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		r, size, err := decode(reader)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err == nil && r.offset != l.next {
+			err = fmt.Errorf("%w: expected offset %d, got %d", errCorrupted, l.next, r.offset)
+		}
+		if err != nil {
+			if !last {
+				return fmt.Errorf("segment %q of topic %q is corrupted at byte %d: %w", s.path, l.topic, s.size, err)
+			}
+
+			fmt.Printf("dropping incomplete message %d of segment %q\n", l.next, s.path)
+			err = file.Truncate(s.size)
+			if err != nil {
+				return fmt.Errorf("could not drop incomplete message of segment %q: %w", s.path, err)
+			}
+			return nil
+		}
+
+		l.records = append(l.records, r)
+		l.next++
+		l.bytes += r.size()
+		s.size += int64(size)
+		s.last = r.offset
+	}
+}
+
+func (l *topicLog) readOffsets() error {
+	data, err := os.ReadFile(filepath.Join(l.dir, offsetsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read subscribers of topic %q: %w", l.topic, err)
+	}
+
+	err = json.Unmarshal(data, &l.offsets)
+	if err != nil {
+		return fmt.Errorf("could not decode subscribers of topic %q: %w", l.topic, err)
+	}
+
+	return nil
+}
+
+// writeOffsets replaces the committed offsets of the subscribers on the disk,
+// through a temporary file so that a crash does not leave them half written
+func (l *topicLog) writeOffsets(fsync bool) error {
+	data, err := json.Marshal(l.offsets)
+	if err != nil {
+		return fmt.Errorf("could not encode subscribers of topic %q: %w", l.topic, err)
+	}
+
+	path := filepath.Join(l.dir, offsetsFile)
+	tmpPath := path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("could not create subscribers of topic %q: %w", l.topic, err)
+	}
+	defer os.Remove(tmpPath)
+
+	_, err = tmp.Write(data)
+	if err == nil && fsync {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write subscribers of topic %q: %w", l.topic, err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("could not close subscribers of topic %q: %w", l.topic, err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("could not replace subscribers of topic %q: %w", l.topic, err)
+	}
+
+	return nil
+}
+
+func (l *topicLog) close() error {
+	if l.active == nil {
+		return nil
+	}
+
+	err := l.active.Close()
+	l.active = nil
+
+	return err
+}
+
+// encode returns the message as it's written to a segment: its offset, its time in unix nanoseconds,
+// the lengths of its key and its value, the checksum of all of them and then its key and its value
+func encode(r record) []byte {
+	data := make([]byte, headerSize+len(r.key)+len(r.value))
+	binary.BigEndian.PutUint64(data[0:8], uint64(r.offset))
+	binary.BigEndian.PutUint64(data[8:16], uint64(r.at.UnixNano()))
+	binary.BigEndian.PutUint32(data[16:20], uint32(len(r.key)))
+	binary.BigEndian.PutUint32(data[20:24], uint32(len(r.value)))
+	copy(data[headerSize:], r.key)
+	copy(data[headerSize+len(r.key):], r.value)
+	binary.BigEndian.PutUint32(data[24:28], checksum(data))
+
+	return data
+}
+
+// decode reads the next message of a segment, and how many bytes it took.
+// It returns io.EOF if the segment is over, or an error if the message is incomplete or corrupted.
+func decode(reader *bufio.Reader) (record, int, error) {
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(reader, header)
+	if errors.Is(err, io.EOF) && n == 0 {
+		return record{}, 0, io.EOF
+	}
+	if err != nil {
+		return record{}, 0, fmt.Errorf("could not read message header: %w", err)
+	}
+
+	keyLength := binary.BigEndian.Uint32(header[16:20])
+	valueLength := binary.BigEndian.Uint32(header[20:24])
+	if keyLength > MaxMessageSize || valueLength > MaxMessageSize {
+		return record{}, 0, fmt.Errorf("%w: %d bytes long", errCorrupted, keyLength+valueLength)
+	}
+
+	data := make([]byte, headerSize+int(keyLength)+int(valueLength))
+	copy(data, header)
+	_, err = io.ReadFull(reader, data[headerSize:])
+	if err != nil {
+		return record{}, 0, fmt.Errorf("could not read message value: %w", err)
+	}
+	if checksum(data) != binary.BigEndian.Uint32(header[24:28]) {
+		return record{}, 0, fmt.Errorf("%w: checksum does not match", errCorrupted)
+	}
+
+	r := record{
+		offset: int64(binary.BigEndian.Uint64(header[0:8])),
+		at:     time.Unix(0, int64(binary.BigEndian.Uint64(header[8:16]))),
+		value:  data[headerSize+int(keyLength):],
+	}
+	if keyLength > 0 {
+		r.key = data[headerSize : headerSize+int(keyLength)]
+	}
+
+	return r, len(data), nil
+}
+
+// checksum is the checksum of an encoded message, without its own bytes
+func checksum(data []byte) uint32 {
+	hash := crc32.NewIEEE()
+	hash.Write(data[:24])
+	hash.Write(data[headerSize:])
+
+	return hash.Sum32()
+}
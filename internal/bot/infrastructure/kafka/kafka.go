@@ -1,16 +1,85 @@
 package bot_infrastructure_kafka
 
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
 type Topic string
 
 func (t Topic) String() string {
 	return string(t)
 }
 
+// Every kind of event of the bus has its own topic, so the consumers only read the events they need
 const (
-	TopicPrompt = "bot-prompt-message"
+	// TopicNewChat is where the chats that are created are sent
+	TopicNewChat = "bot-new-chat"
+	// TopicAnswer is where the whole answers of the chats are sent
+	TopicAnswer = "bot-answer"
+	// TopicAnswerChunk is where the answers are sent as they're streamed
+	TopicAnswerChunk = "bot-answer-chunk"
+	// TopicUsage is where what every prompt cost is sent, e.g. for finance to charge it back
+	TopicUsage = "bot-usage"
+	// TopicDeadLetter is where the messages that could not be sent or handled are kept, as DeadLetters
+	TopicDeadLetter = "bot-dead-letter"
+	// TopicDeadLetterReplayed is where the ids of the dead letters that were sent back to their topics are kept,
+	// next to TopicDeadLetter, so they're not replayed twice
+	TopicDeadLetterReplayed = "bot-dead-letter-replayed"
 )
 
+// RetryDelay is how long a consumer waits before it handles a message whose handler failed again
+const RetryDelay = time.Second
+
+// Message is a message of a topic, as it's consumed
+type Message struct {
+	Topic     Topic
+	Partition int
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	// Time is when the message was sent
+	Time time.Time
+}
+
+// Handler handles a message that's consumed, the message is committed once the handler returns nil
+type Handler func(ctx context.Context, msg Message) error
+
 type Kafka interface {
-	Send(topic Topic, msg []byte) error
+	// Send sends the message to the topic, the messages with the same key go to the same partition,
+	// so they're consumed in the order they were sent. Messages without a key can go to any partition.
+	Send(topic Topic, key []byte, msg []byte) error
+	// Listen returns the messages of the topic as they come, until the bus is stopped
 	Listen(topic Topic) (<-chan []byte, error)
+	// Consume consumes the topic as a member of the consumer group until the context is done,
+	// handling its messages in order and committing each one once its handler succeeds.
+	// A message whose handler fails is handled again every RetryDelay, so no message is skipped.
+	// It returns nil once the context is done, the messages that were not committed are consumed again later.
+	Consume(ctx context.Context, topic Topic, group string, handler Handler) error
+	// Read calls the handler with every message that is in the topic, from the oldest one that is retained,
+	// without a consumer group and without committing them. It returns once it read all of them,
+	// or with the first error of the handler.
+	Read(ctx context.Context, topic Topic, handler Handler) error
+}
+
+// HandleUntilDone calls the handler with the message until it succeeds, waiting RetryDelay after every failure,
+// it returns the error of the context if the context is done first
+func HandleUntilDone(ctx context.Context, handler Handler, msg Message) error {
+	for {
+		err := handler(ctx, msg)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		fmt.Printf("could not handle message %d of topic %q partition %d, retrying in %s: %s\n", msg.Offset, msg.Topic, msg.Partition, RetryDelay, err)
+
+		select {
+		case <-time.After(RetryDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
 }
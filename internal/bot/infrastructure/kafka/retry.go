@@ -0,0 +1,219 @@
+package bot_infrastructure_kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultRetryPolicy tries 5 times, waiting about 100ms, 200ms, 400ms and 800ms in between
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: time.Millisecond * 100,
+	MaxBackoff:     time.Second * 10,
+	Multiplier:     2,
+	Jitter:         0.2,
+}
+
+// RetryPolicy is how many times a message is sent or handled before it's given up on, and how long is waited in between
+type RetryPolicy struct {
+	// MaxAttempts is how many times it's tried, counting the first one
+	MaxAttempts int
+	// InitialBackoff is how long is waited after the first attempt fails
+	InitialBackoff time.Duration
+	// MaxBackoff is the longest that is waited between two attempts
+	MaxBackoff time.Duration
+	// Multiplier is how much longer is waited after every attempt that fails
+	Multiplier float64
+	// Jitter is the fraction of the backoff that is added or taken at random,
+	// so that the instances that failed together do not try again together
+	Jitter float64
+}
+
+// Backoff returns how long is waited after the attempt fails, attempts start at 1
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(attempt-1))
+	backoff = math.Min(backoff, float64(p.MaxBackoff))
+	backoff += backoff * p.Jitter * (rand.Float64()*2 - 1)
+
+	return time.Duration(backoff)
+}
+
+const (
+	// DeadLetterPublish is a message that could not be sent to its topic
+	DeadLetterPublish = "publish"
+	// DeadLetterConsume is a message whose handler kept failing
+	DeadLetterConsume = "consume"
+)
+
+// DeadLetter is a message that was given up on, with why, as it's sent to TopicDeadLetter
+type DeadLetter struct {
+	Id string `json:"id"`
+	// Stage is DeadLetterPublish or DeadLetterConsume
+	Stage string `json:"stage"`
+	Topic Topic  `json:"topic"`
+	Key   []byte `json:"key,omitempty"`
+	// Value is the original message
+	Value []byte `json:"value"`
+	// Group, Partition and Offset are where the message was consumed from, for the messages that were consumed
+	Group     string `json:"group,omitempty"`
+	Partition int    `json:"partition,omitempty"`
+	Offset    int64  `json:"offset,omitempty"`
+	// Error is the error of the last attempt
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// DecodeDeadLetter reads a dead letter from TopicDeadLetter
+func DecodeDeadLetter(data []byte) (DeadLetter, error) {
+	letter := DeadLetter{}
+	err := json.Unmarshal(data, &letter)
+	if err != nil {
+		return DeadLetter{}, fmt.Errorf("invalid dead letter: %w", err)
+	}
+
+	return letter, nil
+}
+
+type RetryArgs struct {
+	// Bus is what the messages are sent to and consumed from
+	Bus Kafka
+	// Policy is DefaultRetryPolicy if zero
+	Policy RetryPolicy
+	// DeadLetters is where the dead letters are sent, Bus if nil,
+	// e.g. an embedded broker on the disk that keeps them while Kafka is down
+	DeadLetters Kafka
+}
+
+type retrying struct {
+	Kafka
+	policy      RetryPolicy
+	deadLetters Kafka
+}
+
+// NewRetrying returns the bus with every send and every handler of its consumers retried with the policy.
+// The messages that still fail are sent to TopicDeadLetter, the consumed ones are then committed.
+// A dead letter that can not be sent either is printed whole, so it can still be recovered from the logs.
+func NewRetrying(args RetryArgs) Kafka {
+	if args.Policy == (RetryPolicy{}) {
+		args.Policy = DefaultRetryPolicy
+	}
+	if args.DeadLetters == nil {
+		args.DeadLetters = args.Bus
+	}
+
+	return &retrying{
+		Kafka:       args.Bus,
+		policy:      args.Policy,
+		deadLetters: args.DeadLetters,
+	}
+}
+
+func (r *retrying) Send(topic Topic, key []byte, msg []byte) error {
+	attempts, err := r.retry(context.Background(), func() error {
+		return r.Kafka.Send(topic, key, msg)
+	})
+	if err == nil {
+		return nil
+	}
+
+	deadErr := r.deadLetter(DeadLetter{
+		Stage:    DeadLetterPublish,
+		Topic:    topic,
+		Key:      key,
+		Value:    msg,
+		Error:    err.Error(),
+		Attempts: attempts,
+	})
+	if deadErr != nil {
+		return errors.Join(err, deadErr)
+	}
+
+	return fmt.Errorf("sent to %s after %d attempts: %w", TopicDeadLetter, attempts, err)
+}
+
+func (r *retrying) Consume(ctx context.Context, topic Topic, group string, handler Handler) error {
+	return r.Kafka.Consume(ctx, topic, group, func(ctx context.Context, msg Message) error {
+		attempts, err := r.retry(ctx, func() error {
+			return handler(ctx, msg)
+		})
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+
+		// the message is committed once it's a dead letter, it's handled again if it can't be one
+		return r.deadLetter(DeadLetter{
+			Stage:     DeadLetterConsume,
+			Topic:     msg.Topic,
+			Key:       msg.Key,
+			Value:     msg.Value,
+			Group:     group,
+			Partition: msg.Partition,
+			Offset:    msg.Offset,
+			Error:     err.Error(),
+			Attempts:  attempts,
+		})
+	})
+}
+
+// retry calls the function until it succeeds, it runs out of attempts or the context is done,
+// it returns how many times it was called and its last error
+func (r *retrying) retry(ctx context.Context, f func() error) (int, error) {
+	attempt := 1
+	for {
+		err := f()
+		if err == nil || attempt >= r.policy.MaxAttempts {
+			return attempt, err
+		}
+
+		select {
+		case <-time.After(r.policy.Backoff(attempt)):
+			attempt++
+		case <-ctx.Done():
+			return attempt, ctx.Err()
+		}
+	}
+}
+
+func (r *retrying) deadLetter(letter DeadLetter) error {
+	letter.Id = uuid.NewString()
+	letter.FailedAt = time.Now().UTC()
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("could not marshal dead letter: %w", err)
+	}
+
+	fmt.Printf("giving up on message of topic %q after %d attempts, sending it to %s as %s: %s\n", letter.Topic, letter.Attempts, TopicDeadLetter, letter.Id, letter.Error)
+	err = r.deadLetters.Send(TopicDeadLetter, letter.Key, data)
+	if err != nil {
+		fmt.Printf("could not send dead letter %s: %s\n%s\n", letter.Id, err, data)
+		return fmt.Errorf("could not send dead letter %s: %w", letter.Id, err)
+	}
+
+	return nil
+}
+
+// Close closes the bus and the one of the dead letters, if they have to be closed
+func (r *retrying) Close() error {
+	var err error
+	for _, bus := range []Kafka{r.Kafka, r.deadLetters} {
+		closer, ok := bus.(io.Closer)
+		if !ok {
+			continue
+		}
+		err = errors.Join(err, closer.Close())
+		if r.deadLetters == r.Kafka {
+			break
+		}
+	}
+
+	return err
+}
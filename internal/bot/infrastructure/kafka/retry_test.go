@@ -0,0 +1,164 @@
+package bot_infrastructure_kafka
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+var errUnavailable = fmt.Errorf("broker is unavailable")
+
+// fakeBus fails the first sends to the topics, and consumes its messages once, committing the ones that were handled
+type fakeBus struct {
+	m         sync.Mutex
+	failures  map[Topic]int
+	attempts  map[Topic]int
+	sent      map[Topic][][]byte
+	messages  []Message
+	committed []int64
+}
+
+func newFakeBus() *fakeBus {
+	return &fakeBus{
+		failures: make(map[Topic]int),
+		attempts: make(map[Topic]int),
+		sent:     make(map[Topic][][]byte),
+	}
+}
+
+func (f *fakeBus) Send(topic Topic, key []byte, msg []byte) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	f.attempts[topic]++
+	if f.failures[topic] != 0 {
+		f.failures[topic]--
+		return errUnavailable
+	}
+	f.sent[topic] = append(f.sent[topic], msg)
+
+	return nil
+}
+
+func (f *fakeBus) Listen(topic Topic) (<-chan []byte, error) {
+	return nil, errUnavailable
+}
+
+func (f *fakeBus) Consume(ctx context.Context, topic Topic, group string, handler Handler) error {
+	for _, msg := range f.messages {
+		err := handler(ctx, msg)
+		if err != nil {
+			return err
+		}
+		f.committed = append(f.committed, msg.Offset)
+	}
+
+	return nil
+}
+
+func (f *fakeBus) Read(ctx context.Context, topic Topic, handler Handler) error {
+	return nil
+}
+
+type RetryTestSuite struct {
+	suite.Suite
+	bus    *fakeBus
+	policy RetryPolicy
+}
+
+func (suite *RetryTestSuite) SetupTest() {
+	suite.bus = newFakeBus()
+	suite.policy = RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond * 4, Multiplier: 2}
+}
+
+func (suite *RetryTestSuite) TestBackoff() {
+	policy := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: time.Second * 5, Multiplier: 2, Jitter: 0.5}
+
+	for attempt, expected := range []time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 5, time.Second * 5} {
+		backoff := policy.Backoff(attempt + 1)
+		suite.GreaterOrEqual(backoff, expected/2)
+		suite.LessOrEqual(backoff, expected*3/2)
+	}
+}
+
+func (suite *RetryTestSuite) TestSendIsRetried() {
+	suite.bus.failures[TopicAnswer] = 2
+	bus := NewRetrying(RetryArgs{Bus: suite.bus, Policy: suite.policy})
+
+	suite.NoError(bus.Send(TopicAnswer, nil, []byte("hello")))
+	suite.Equal(3, suite.bus.attempts[TopicAnswer])
+	suite.Equal([][]byte{[]byte("hello")}, suite.bus.sent[TopicAnswer])
+	suite.Empty(suite.bus.sent[TopicDeadLetter])
+}
+
+func (suite *RetryTestSuite) TestSendThatKeepsFailingIsADeadLetter() {
+	suite.bus.failures[TopicAnswer] = 10
+	deadLetters := newFakeBus()
+	bus := NewRetrying(RetryArgs{Bus: suite.bus, Policy: suite.policy, DeadLetters: deadLetters})
+
+	err := bus.Send(TopicAnswer, []byte("chat"), []byte("hello"))
+	suite.ErrorIs(err, errUnavailable)
+	suite.Equal(3, suite.bus.attempts[TopicAnswer])
+
+	suite.Require().Len(deadLetters.sent[TopicDeadLetter], 1)
+	letter, err := DecodeDeadLetter(deadLetters.sent[TopicDeadLetter][0])
+	suite.Require().NoError(err)
+	suite.NotEmpty(letter.Id)
+	suite.Equal(DeadLetterPublish, letter.Stage)
+	suite.Equal(Topic(TopicAnswer), letter.Topic)
+	suite.Equal([]byte("chat"), letter.Key)
+	suite.Equal([]byte("hello"), letter.Value)
+	suite.Equal(errUnavailable.Error(), letter.Error)
+	suite.Equal(3, letter.Attempts)
+	suite.False(letter.FailedAt.IsZero())
+}
+
+func (suite *RetryTestSuite) TestHandlerThatKeepsFailingIsADeadLetter() {
+	suite.bus.messages = []Message{
+		{Topic: TopicAnswer, Offset: 0, Value: []byte("fails once")},
+		{Topic: TopicAnswer, Offset: 1, Value: []byte("always fails")},
+		{Topic: TopicAnswer, Offset: 2, Value: []byte("fine")},
+	}
+	bus := NewRetrying(RetryArgs{Bus: suite.bus, Policy: suite.policy})
+
+	attempts := make(map[string]int)
+	err := bus.Consume(context.Background(), TopicAnswer, "support", func(ctx context.Context, msg Message) error {
+		attempts[string(msg.Value)]++
+		if string(msg.Value) == "always fails" || (string(msg.Value) == "fails once" && attempts["fails once"] == 1) {
+			return errUnavailable
+		}
+		return nil
+	})
+	suite.NoError(err)
+	suite.Equal(map[string]int{"fails once": 2, "always fails": 3, "fine": 1}, attempts)
+	// the dead letter is committed, so the consumer goes on with the next messages
+	suite.Equal([]int64{0, 1, 2}, suite.bus.committed)
+
+	suite.Require().Len(suite.bus.sent[TopicDeadLetter], 1)
+	letter, err := DecodeDeadLetter(suite.bus.sent[TopicDeadLetter][0])
+	suite.Require().NoError(err)
+	suite.Equal(DeadLetterConsume, letter.Stage)
+	suite.Equal("support", letter.Group)
+	suite.Equal(int64(1), letter.Offset)
+	suite.Equal([]byte("always fails"), letter.Value)
+}
+
+func (suite *RetryTestSuite) TestHandlerIsNotCommittedWithoutItsDeadLetter() {
+	suite.bus.messages = []Message{{Topic: TopicAnswer, Offset: 0, Value: []byte("always fails")}}
+	suite.bus.failures[TopicDeadLetter] = 1
+	bus := NewRetrying(RetryArgs{Bus: suite.bus, Policy: suite.policy})
+
+	err := bus.Consume(context.Background(), TopicAnswer, "support", func(ctx context.Context, msg Message) error {
+		return errUnavailable
+	})
+	suite.ErrorIs(err, errUnavailable)
+	suite.Empty(suite.bus.committed)
+}
+
+func TestRetryTestSuite(t *testing.T) {
+	suite.Run(t, new(RetryTestSuite))
+}
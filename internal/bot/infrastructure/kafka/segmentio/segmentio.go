@@ -3,6 +3,7 @@ package bot_infastructure_kafka_segmentio
 import (
 	"connectly-interview/internal/bot/infrastructure/kafka"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/segmentio/kafka-go"
 	"time"
@@ -11,12 +12,44 @@ import (
 const (
 	DefaultWriteTimeDuration = time.Second * 10
 	DefaultMaxReadBytes      = 1024 * 1024 // 1 MB
+	// DefaultBatchSize is how many messages of a partition are sent together at most
+	DefaultBatchSize = 100
+	// DefaultBatchBytes is how many bytes of messages of a partition are sent together at most
+	DefaultBatchBytes = 1024 * 1024 // 1 MB
+	// DefaultBatchTimeout is how long a batch that is not full waits for more messages before it's sent,
+	// Send waits for it, so it's short
+	DefaultBatchTimeout = time.Millisecond * 10
+	// DefaultRequiredAcks waits for all the in-sync replicas, so a message that was sent is not lost with its leader
+	DefaultRequiredAcks = kafka.RequireAll
+	// DefaultGroupId is the consumer group that Listen consumes as
+	DefaultGroupId = "bot"
+	// DefaultSessionTimeout is how long the group waits for a member that stopped sending heartbeats
+	// before it assigns its partitions to the others
+	DefaultSessionTimeout = time.Second * 30
+	// DefaultRebalanceTimeout is how long the group waits for its members to join it again when it's rebalanced
+	DefaultRebalanceTimeout = time.Second * 30
+	DefaultCommitTimeout    = time.Second * 10
 )
 
+// SegmentioDialer is the Kafka of segmentio/kafka-go.
+// It sends every message through a single writer, which keeps its connections to the brokers open
+// and sends the messages of each partition in batches, so it must be closed to send the last ones.
 type SegmentioDialer struct {
-	ctx           context.Context
-	addr          string
+	ctx    context.Context
+	addr   string
+	writer *kafka.Writer
+	// writeDeadline, batchSize, batchBytes, batchTimeout, requiredAcks and compression are of the writer
 	writeDeadline time.Duration
+	batchSize     int
+	batchBytes    int64
+	batchTimeout  time.Duration
+	requiredAcks  kafka.RequiredAcks
+	compression   kafka.Compression
+	groupId       string
+	// sessionTimeout, rebalanceTimeout and commitTimeout are of the consumers
+	sessionTimeout   time.Duration
+	rebalanceTimeout time.Duration
+	commitTimeout    time.Duration
 }
 
 type Option func(dialer *SegmentioDialer)
@@ -27,71 +60,269 @@ func WithWriteDeadline(duration time.Duration) Option {
 	}
 }
 
+// WithBatch sets how many messages and bytes of a partition are sent together at most,
+// and how long a batch that is not full waits for more messages. By default they're
+// DefaultBatchSize, DefaultBatchBytes and DefaultBatchTimeout.
+func WithBatch(size int, bytes int64, timeout time.Duration) Option {
+	return func(dialer *SegmentioDialer) {
+		dialer.batchSize = size
+		dialer.batchBytes = bytes
+		dialer.batchTimeout = timeout
+	}
+}
+
+// WithRequiredAcks sets how many replicas must have a message before it's sent, by default it's DefaultRequiredAcks
+func WithRequiredAcks(acks kafka.RequiredAcks) Option {
+	return func(dialer *SegmentioDialer) {
+		dialer.requiredAcks = acks
+	}
+}
+
+// WithCompression compresses the batches with the codec, by default they're not compressed
+func WithCompression(compression kafka.Compression) Option {
+	return func(dialer *SegmentioDialer) {
+		dialer.compression = compression
+	}
+}
+
+// WithGroupId sets the consumer group that Listen consumes as, by default it's DefaultGroupId.
+// The instances of the bot with the same group share the messages of a topic, every group gets all of them.
+func WithGroupId(groupId string) Option {
+	return func(dialer *SegmentioDialer) {
+		dialer.groupId = groupId
+	}
+}
+
+// WithSessionTimeout sets how long the group waits for a consumer that stopped sending heartbeats,
+// by default it's DefaultSessionTimeout
+func WithSessionTimeout(duration time.Duration) Option {
+	return func(dialer *SegmentioDialer) {
+		dialer.sessionTimeout = duration
+	}
+}
+
+// WithRebalanceTimeout sets how long the group waits for its consumers to join it again when it's rebalanced,
+// by default it's DefaultRebalanceTimeout
+func WithRebalanceTimeout(duration time.Duration) Option {
+	return func(dialer *SegmentioDialer) {
+		dialer.rebalanceTimeout = duration
+	}
+}
+
 func New(ctx context.Context, addr string, opts ...Option) bot_infrastructure_kafka.Kafka {
 	d := &SegmentioDialer{
-		ctx:           ctx,
-		addr:          addr,
-		writeDeadline: time.Second * 10,
+		ctx:              ctx,
+		addr:             addr,
+		writeDeadline:    DefaultWriteTimeDuration,
+		batchSize:        DefaultBatchSize,
+		batchBytes:       DefaultBatchBytes,
+		batchTimeout:     DefaultBatchTimeout,
+		requiredAcks:     DefaultRequiredAcks,
+		groupId:          DefaultGroupId,
+		sessionTimeout:   DefaultSessionTimeout,
+		rebalanceTimeout: DefaultRebalanceTimeout,
+		commitTimeout:    DefaultCommitTimeout,
 	}
 
 	for _, o := range opts {
 		o(d)
 	}
 
+	d.writer = &kafka.Writer{
+		Addr: kafka.TCP(addr),
+		// the messages with the same key go to the same partition, like with the Java clients,
+		// the messages without a key are spread over the partitions
+		Balancer:     &kafka.Murmur2Balancer{},
+		BatchSize:    d.batchSize,
+		BatchBytes:   d.batchBytes,
+		BatchTimeout: d.batchTimeout,
+		WriteTimeout: d.writeDeadline,
+		RequiredAcks: d.requiredAcks,
+		Compression:  d.compression,
+		ErrorLogger: kafka.LoggerFunc(func(msg string, args ...interface{}) {
+			fmt.Printf("kafka writer: %s\n", fmt.Sprintf(msg, args...))
+		}),
+	}
+
 	return d
 }
 
-func (s *SegmentioDialer) Send(topic bot_infrastructure_kafka.Topic, msg []byte) error {
-	var err error
+// Send waits until the message is sent with the batch of its partition
+func (s *SegmentioDialer) Send(topic bot_infrastructure_kafka.Topic, key []byte, msg []byte) error {
+	err := s.writer.WriteMessages(s.ctx, kafka.Message{Topic: topic.String(), Key: key, Value: msg})
+	if err != nil {
+		return fmt.Errorf("could not write message to topic %q: %w", topic, err)
+	}
 
-	partition := 0
+	return nil
+}
 
-	conn, err := kafka.DialLeader(s.ctx, "tcp", s.addr, topic.String(), partition)
+// Close sends the messages that are waiting for their batch and closes the connections of the writer
+func (s *SegmentioDialer) Close() error {
+	err := s.writer.Close()
 	if err != nil {
-		return fmt.Errorf("could not dial kafka: %w", err)
+		return fmt.Errorf("could not close kafka writer: %w", err)
 	}
 
-	err = conn.SetWriteDeadline(time.Now().Add(s.writeDeadline))
-	if err != nil {
-		return fmt.Errorf("could not set write deadline: %w", err)
+	return nil
+}
+
+// Listen consumes the topic as a member of the group of the dialer until the context of the dialer is done,
+// each message is committed once it's read from the channel, which is closed afterwards
+func (s *SegmentioDialer) Listen(topic bot_infrastructure_kafka.Topic) (<-chan []byte, error) {
+	values := make(chan []byte)
+
+	go func() {
+		defer close(values)
+
+		err := s.Consume(s.ctx, topic, s.groupId, func(ctx context.Context, msg bot_infrastructure_kafka.Message) error {
+			select {
+			case values <- msg.Value:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if err != nil {
+			fmt.Printf("stopped listening to topic %q: %s\n", topic, err)
+		}
+	}()
+
+	return values, nil
+}
+
+// Consume reads the partitions of the topic that the group assigns to this member, committing every message
+// once the handler succeeds. When the group is rebalanced the reader joins it again and goes on from the
+// committed offsets of its new partitions. When the context is done the reader leaves the group,
+// so that its partitions are assigned to the other members right away.
+func (s *SegmentioDialer) Consume(ctx context.Context, topic bot_infrastructure_kafka.Topic, group string, handler bot_infrastructure_kafka.Handler) error {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  []string{s.addr},
+		GroupID:  group,
+		Topic:    topic.String(),
+		MaxBytes: DefaultMaxReadBytes,
+		// commits are sent when they're asked for, not in the background, so a commit that fails is known
+		CommitInterval:        0,
+		WatchPartitionChanges: true,
+		SessionTimeout:        s.sessionTimeout,
+		RebalanceTimeout:      s.rebalanceTimeout,
+		// a group that never committed starts from the oldest message, so nothing sent before it joined is lost
+		StartOffset: kafka.FirstOffset,
+		ErrorLogger: kafka.LoggerFunc(func(msg string, args ...interface{}) {
+			fmt.Printf("kafka reader of topic %q group %q: %s\n", topic, group, fmt.Sprintf(msg, args...))
+		}),
+	})
+	defer func() {
+		err := reader.Close()
+		if err != nil {
+			fmt.Printf("could not close kafka reader of topic %q group %q: %s\n", topic, group, err)
+		}
+	}()
+
+	for {
+		m, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("could not fetch message of topic %q: %w", topic, err)
+		}
+
+		err = bot_infrastructure_kafka.HandleUntilDone(ctx, handler, toMessage(m))
+		if err != nil {
+			// the message is not committed, it's consumed again by whoever gets its partition
+			return nil
+		}
+
+		// the handled message is committed even if the context is done meanwhile
+		commitCtx, cancel := context.WithTimeout(context.Background(), s.commitTimeout)
+		err = reader.CommitMessages(commitCtx, m)
+		cancel()
+		if err != nil {
+			// e.g. the group was rebalanced and the partition belongs to another member now, which handles it again
+			fmt.Printf("could not commit message %d of topic %q partition %d, it will be handled again: %s\n", m.Offset, topic, m.Partition, err)
+		}
 	}
+}
 
-	_, err = conn.WriteMessages(kafka.Message{Value: msg})
+// Read reads every partition of the topic in turn, up to the last message it had when it was read,
+// a topic that does not exist yet has no messages
+func (s *SegmentioDialer) Read(ctx context.Context, topic bot_infrastructure_kafka.Topic, handler bot_infrastructure_kafka.Handler) error {
+	conn, err := kafka.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("could not dial kafka: %w", err)
+	}
+	partitions, err := conn.ReadPartitions(topic.String())
+	conn.Close()
+	if errors.Is(err, kafka.UnknownTopicOrPartition) {
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("could not write message %q: %s", msg, err)
+		return fmt.Errorf("could not read partitions of topic %q: %w", topic, err)
 	}
 
-	if err = conn.Close(); err != nil {
-		return fmt.Errorf("could not close kafka dial connection")
+	for _, partition := range partitions {
+		err = s.readPartition(ctx, topic, partition.ID, handler)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (s *SegmentioDialer) Listen(topic bot_infrastructure_kafka.Topic) (<-chan []byte, error) {
-	var err error
-	var outChan chan []byte = make(chan []byte)
-
-	partition := 0
-
-	conn, err := kafka.DialLeader(s.ctx, "tcp", s.addr, topic.String(), partition)
+func (s *SegmentioDialer) readPartition(ctx context.Context, topic bot_infrastructure_kafka.Topic, partition int, handler bot_infrastructure_kafka.Handler) error {
+	conn, err := kafka.DialLeader(ctx, "tcp", s.addr, topic.String(), partition)
 	if err != nil {
-		return nil, fmt.Errorf("could not dial kafka: %w", err)
+		return fmt.Errorf("could not dial leader of topic %q partition %d: %w", topic, partition, err)
 	}
-
-	err = conn.SetReadDeadline(time.Now().Add(s.writeDeadline))
+	first, last, err := conn.ReadOffsets()
+	conn.Close()
 	if err != nil {
-		return nil, fmt.Errorf("could not set write deadline: %w", err)
+		return fmt.Errorf("could not read offsets of topic %q partition %d: %w", topic, partition, err)
+	}
+	if first >= last {
+		return nil
 	}
 
-	message, err := conn.ReadMessage(DefaultMaxReadBytes)
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   []string{s.addr},
+		Topic:     topic.String(),
+		Partition: partition,
+		MaxBytes:  DefaultMaxReadBytes,
+	})
+	defer reader.Close()
+
+	err = reader.SetOffset(first)
 	if err != nil {
-		return nil, fmt.Errorf("could not read message")
+		return fmt.Errorf("could not read topic %q partition %d from offset %d: %w", topic, partition, first, err)
 	}
 
-	go func() {
-		outChan <- message.Value
-	}()
+	for {
+		m, err := reader.ReadMessage(ctx)
+		if err != nil {
+			return fmt.Errorf("could not read message of topic %q partition %d: %w", topic, partition, err)
+		}
+
+		err = handler(ctx, toMessage(m))
+		if err != nil {
+			return err
+		}
 
-	return outChan, nil
+		// last is the offset of the next message that will be sent
+		if m.Offset >= last-1 {
+			return nil
+		}
+	}
+}
+
+func toMessage(m kafka.Message) bot_infrastructure_kafka.Message {
+	return bot_infrastructure_kafka.Message{
+		Topic:     bot_infrastructure_kafka.Topic(m.Topic),
+		Partition: m.Partition,
+		Offset:    m.Offset,
+		Key:       m.Key,
+		Value:     m.Value,
+		Time:      m.Time,
+	}
 }
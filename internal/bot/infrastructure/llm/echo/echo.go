@@ -0,0 +1,160 @@
+// Package bot_infrastructure_llm_echo is a local provider that does not need any network or API key.
+// It either echoes the last user message back or replies with a script of answers, in order,
+// so the bot can run and be tested deterministically.
+package bot_infrastructure_llm_echo
+
+import (
+	"connectly-interview/internal/bot/infrastructure/llm"
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultModel bot_infrastructure_llm.Model = "echo"
+)
+
+type echo struct {
+	m      sync.Mutex
+	script []string
+	next   int
+	// delay is how long each word of a streamed answer takes, like a real model compiling it
+	delay time.Duration
+}
+
+type Option func(e *echo)
+
+// WithScript makes the provider reply with the given answers in order, starting over when they run out
+func WithScript(answers ...string) Option {
+	return func(e *echo) {
+		e.script = answers
+	}
+}
+
+// WithDelay makes streaming each word of the answer take that long
+func WithDelay(delay time.Duration) Option {
+	return func(e *echo) {
+		e.delay = delay
+	}
+}
+
+func New(opts ...Option) bot_infrastructure_llm.Provider {
+	e := &echo{}
+
+	for _, o := range opts {
+		o(e)
+	}
+
+	return e
+}
+
+func (e *echo) Complete(ctx context.Context, req bot_infrastructure_llm.Request) (*bot_infrastructure_llm.Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	answer, err := e.answer(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bot_infrastructure_llm.Response{
+		Model:        DefaultModel,
+		Content:      answer,
+		FinishReason: "stop",
+		Usage:        usage(req, answer),
+	}, nil
+}
+
+// usage counts every word as a token
+func usage(req bot_infrastructure_llm.Request, answer string) bot_infrastructure_llm.Usage {
+	promptTokens := 0
+	for _, msg := range req.Messages {
+		promptTokens += len(strings.Fields(msg.Content))
+	}
+	completionTokens := len(strings.Fields(answer))
+
+	return bot_infrastructure_llm.Usage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+}
+
+// Stream streams the answer back word by word, until the answer is over or the context is done,
+// the last word comes with the usage of the whole answer
+func (e *echo) Stream(ctx context.Context, req bot_infrastructure_llm.Request) (<-chan bot_infrastructure_llm.Chunk, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	answer, err := e.answer(req)
+	if err != nil {
+		return nil, err
+	}
+
+	words := strings.SplitAfter(answer, " ")
+	chunks := make(chan bot_infrastructure_llm.Chunk)
+	go func() {
+		defer close(chunks)
+
+		for i, word := range words {
+			if e.delay > 0 {
+				select {
+				case <-time.After(e.delay):
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			chunk := bot_infrastructure_llm.Chunk{
+				Content: word,
+			}
+			if i == len(words)-1 {
+				chunk.FinishReason = "stop"
+				u := usage(req, answer)
+				chunk.Usage = &u
+			}
+			select {
+			case chunks <- chunk:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return chunks, nil
+}
+
+// answer picks the next scripted answer, or the last user message if there's no script
+func (e *echo) answer(req bot_infrastructure_llm.Request) (string, error) {
+	e.m.Lock()
+	defer e.m.Unlock()
+
+	if len(e.script) > 0 {
+		answer := e.script[e.next%len(e.script)]
+		e.next++
+		return answer, nil
+	}
+
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		if req.Messages[i].Role == bot_infrastructure_llm.RoleUser {
+			return req.Messages[i].Content, nil
+		}
+	}
+
+	return "", bot_infrastructure_llm.ErrNoResponse
+}
+
+func (e *echo) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (e *echo) DefaultModel() bot_infrastructure_llm.Model {
+	return DefaultModel
+}
+
+func (e *echo) ListModels(ctx context.Context) ([]bot_infrastructure_llm.Model, error) {
+	return []bot_infrastructure_llm.Model{DefaultModel}, nil
+}
@@ -0,0 +1,93 @@
+package bot_infrastructure_llm_echo
+
+import (
+	"connectly-interview/internal/bot/infrastructure/llm"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type EchoTestSuite struct {
+	suite.Suite
+}
+
+func userRequest(content string) bot_infrastructure_llm.Request {
+	return bot_infrastructure_llm.Request{
+		Messages: []bot_infrastructure_llm.Message{
+			{Role: bot_infrastructure_llm.RoleSystem, Content: "you are a bot"},
+			{Role: bot_infrastructure_llm.RoleUser, Content: content},
+		},
+	}
+}
+
+func (suite *EchoTestSuite) TestEchoesLastUserMessage() {
+	p := New()
+	resp, err := p.Complete(context.Background(), userRequest("hello there"))
+	suite.NoError(err)
+	suite.Equal("hello there", resp.Content)
+	suite.Equal(DefaultModel, resp.Model)
+	suite.Equal(2, resp.Usage.CompletionTokens)
+}
+
+func (suite *EchoTestSuite) TestNoUserMessage() {
+	p := New()
+	_, err := p.Complete(context.Background(), bot_infrastructure_llm.Request{})
+	suite.ErrorIs(err, bot_infrastructure_llm.ErrNoResponse)
+}
+
+func (suite *EchoTestSuite) TestScriptIsRepliedInOrder() {
+	p := New(WithScript("one", "two"))
+	for _, expected := range []string{"one", "two", "one"} {
+		resp, err := p.Complete(context.Background(), userRequest("anything"))
+		suite.NoError(err)
+		suite.Equal(expected, resp.Content)
+	}
+}
+
+func (suite *EchoTestSuite) TestStreamsWordByWord() {
+	p := New()
+	chunks, err := p.Stream(context.Background(), userRequest("hello there bot"))
+	suite.NoError(err)
+
+	var contents []string
+	var last bot_infrastructure_llm.Chunk
+	for chunk := range chunks {
+		suite.NoError(chunk.Err)
+		contents = append(contents, chunk.Content)
+		last = chunk
+	}
+	suite.Equal([]string{"hello ", "there ", "bot"}, contents)
+	suite.Equal("stop", last.FinishReason)
+	suite.Equal(&bot_infrastructure_llm.Usage{PromptTokens: 7, CompletionTokens: 3, TotalTokens: 10}, last.Usage)
+}
+
+func (suite *EchoTestSuite) TestStreamStopsWhenCanceled() {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := New(WithDelay(time.Millisecond * 10))
+	chunks, err := p.Stream(ctx, userRequest("hello there bot"))
+	suite.NoError(err)
+
+	suite.Equal("hello ", (<-chunks).Content)
+	cancel()
+
+	// at most the word that was racing with the cancel makes it through
+	rest := 0
+	for range chunks {
+		rest++
+	}
+	suite.LessOrEqual(rest, 1)
+}
+
+func (suite *EchoTestSuite) TestPingAndListModels() {
+	p := New()
+	suite.NoError(p.Ping(context.Background()))
+	models, err := p.ListModels(context.Background())
+	suite.NoError(err)
+	suite.Equal([]bot_infrastructure_llm.Model{DefaultModel}, models)
+}
+
+func TestEchoTestSuite(t *testing.T) {
+	suite.Run(t, new(EchoTestSuite))
+}
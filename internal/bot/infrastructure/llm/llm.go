@@ -0,0 +1,87 @@
+// Package bot_infrastructure_llm describes what a large language model provider (e.g. OpenAI) should be able to do
+// so the bot can compile answers without knowing which vendor is behind them.
+package bot_infrastructure_llm
+
+import (
+	"context"
+	"fmt"
+)
+
+var (
+	ErrNoResponse = fmt.Errorf("no response")
+)
+
+type Model string
+
+func (m Model) String() string {
+	return string(m)
+}
+
+// Role is who a message in a conversation is coming from
+type Role string
+
+func (r Role) String() string {
+	return string(r)
+}
+
+const (
+	RoleSystem    Role = "system"
+	RoleUser      Role = "user"
+	RoleAssistant Role = "assistant"
+)
+
+type Message struct {
+	Role    Role
+	Content string
+}
+
+type Request struct {
+	// Model is the model to complete with, if empty the provider's default model is used
+	Model       Model
+	Messages    []Message
+	Temperature float32
+	// MaxTokens is the most tokens the answer can have, if zero it's up to the provider
+	MaxTokens int
+}
+
+// Usage is how many tokens a request cost, as the provider counted them
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+}
+
+type Response struct {
+	Model        Model
+	Content      string
+	FinishReason string
+	Usage        Usage
+}
+
+// Chunk is a part of an answer while it's being streamed by the provider.
+// A chunk with an error is always the last one to be sent.
+type Chunk struct {
+	Content      string
+	FinishReason string
+	// Usage, if not nil, is what the whole request cost, the providers that tell it send it with the last chunks
+	Usage *Usage
+	Err   error
+}
+
+// Provider is the interface that describes
+// which functions a large language model vendor should be compatible with.
+//
+// Cancelling the context aborts the call to the vendor, even while an answer is being streamed.
+type Provider interface {
+	// Complete sends the messages to the model and returns the whole answer
+	Complete(ctx context.Context, req Request) (*Response, error)
+	// Stream sends the messages to the model and streams the answer back as it's being compiled,
+	// the channel is closed when the answer is over or the context is done
+	Stream(ctx context.Context, req Request) (<-chan Chunk, error)
+	// Ping checks that the provider is reachable and that it accepts our credentials
+	Ping(ctx context.Context) error
+	// ListModels lists the models the provider can complete with
+	ListModels(ctx context.Context) ([]Model, error)
+	// DefaultModel is the model the provider completes with when the request doesn't specify one
+	DefaultModel() Model
+}
@@ -1,35 +1,36 @@
 package openai
 
 import (
+	"bufio"
 	"bytes"
+	"connectly-interview/internal/bot/infrastructure/llm"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 )
 
-var (
-	ErrNoResponse = fmt.Errorf("no response")
+const (
+	DefaultBaseUrl     = "https://api.openai.com/v1"
+	DefaultTemperature = 0.7
+	// streamDoneData is the data of the last server-sent event of a stream
+	streamDoneData = "[DONE]"
+	// maxStreamEventSize is the biggest server-sent event line we accept from the stream
+	maxStreamEventSize = 1024 * 1024 // 1 MB
 )
 
-type Model string
-
-func (m Model) String() string {
-	return string(m)
-}
+type Model = bot_infrastructure_llm.Model
 
 const (
 	Model35 Model = "gpt-3.5-turbo"
 )
 
-type GptRole string
-
-func (m GptRole) String() string {
-	return string(m)
-}
+type GptRole = bot_infrastructure_llm.Role
 
 const (
-	GptRoleUser = "user"
+	GptRoleUser = bot_infrastructure_llm.RoleUser
 )
 
 type GPTRequestMessage struct {
@@ -38,20 +39,39 @@ type GPTRequestMessage struct {
 }
 
 type GPTRequest struct {
-	Model    Model `json:"model"`
-	Messages []GPTRequestMessage
+	Model       Model               `json:"model"`
+	Messages    []GPTRequestMessage `json:"messages"`
+	Temperature float32             `json:"temperature,omitempty"`
+	MaxTokens   int                 `json:"max_tokens,omitempty"`
+	Stream      bool                `json:"stream,omitempty"`
+	// StreamOptions asks for the usage of a streamed completion, which is otherwise not sent
+	StreamOptions *GPTStreamOptions `json:"stream_options,omitempty"`
+}
+
+type GPTStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type GPTUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+func (u GPTUsage) usage() *bot_infrastructure_llm.Usage {
+	return &bot_infrastructure_llm.Usage{
+		PromptTokens:     u.PromptTokens,
+		CompletionTokens: u.CompletionTokens,
+		TotalTokens:      u.TotalTokens,
+	}
 }
 
 type GPTResponse struct {
-	Id      string `json:"id"`
-	Object  string `json:"object"`
-	Created int    `json:"created"`
-	Model   string `json:"model"`
-	Usage   struct {
-		PromptTokens     int `json:"prompt_tokens"`
-		CompletionTokens int `json:"completion_tokens"`
-		TotalTokens      int `json:"total_tokens"`
-	} `json:"usage"`
+	Id      string   `json:"id"`
+	Object  string   `json:"object"`
+	Created int      `json:"created"`
+	Model   string   `json:"model"`
+	Usage   GPTUsage `json:"usage"`
 	Choices []struct {
 		Message struct {
 			Role    string `json:"role"`
@@ -62,104 +82,344 @@ type GPTResponse struct {
 	} `json:"choices"`
 }
 
-func Ping(key string) error {
-	// Prepare the request body
-	requestBody, err := json.Marshal(GPTRequest{
-		Model: Model35,
-		Messages: []GPTRequestMessage{
-			{
-				Role:    GptRoleUser,
-				Content: "testing",
-			},
-		},
-	})
-	if err != nil {
-		return err
+// GPTStreamResponse is the data of each server-sent event when streaming a completion
+type GPTStreamResponse struct {
+	Id      string `json:"id"`
+	Object  string `json:"object"`
+	Created int    `json:"created"`
+	Model   string `json:"model"`
+	// Usage is only sent with the last event, which has no choices
+	Usage   *GPTUsage `json:"usage"`
+	Choices []struct {
+		Delta struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+		Index        int     `json:"index"`
+	} `json:"choices"`
+	// Error is set instead of the rest when the completion fails after the stream started
+	Error *GPTError `json:"error"`
+}
+
+// GPTError is the error that OpenAI sends in the body
+type GPTError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
+
+func (e GPTError) Error() string {
+	return fmt.Sprintf("openai %s: %s", e.Type, e.Message)
+}
+
+type GPTModelsResponse struct {
+	Data []struct {
+		Id      string `json:"id"`
+		Object  string `json:"object"`
+		OwnedBy string `json:"owned_by"`
+	} `json:"data"`
+}
+
+// provider is the OpenAI implementation of a large language model provider
+type provider struct {
+	apiKey  string
+	baseUrl string
+	model   Model
+	client  *http.Client
+}
+
+type Option func(p *provider)
+
+func WithBaseUrl(url string) Option {
+	return func(p *provider) {
+		p.baseUrl = url
+	}
+}
+
+func WithModel(model Model) Option {
+	return func(p *provider) {
+		p.model = model
+	}
+}
+
+func WithHttpClient(client *http.Client) Option {
+	return func(p *provider) {
+		p.client = client
+	}
+}
+
+func New(apiKey string, opts ...Option) bot_infrastructure_llm.Provider {
+	p := &provider{
+		apiKey:  apiKey,
+		baseUrl: DefaultBaseUrl,
+		model:   Model35,
+		client:  &http.Client{},
 	}
 
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/chat/completions", bytes.NewBuffer(requestBody))
+	for _, o := range opts {
+		o(p)
+	}
+
+	return p
+}
+
+func (p *provider) newRequest(ctx context.Context, method string, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, p.baseUrl+path, body)
 	if err != nil {
-		return fmt.Errorf("could not create request: %w", err)
+		return nil, fmt.Errorf("could not create request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+key)
+	req.Header.Set("Authorization", "Bearer "+p.apiKey)
+
+	return req, nil
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+func (p *provider) Ping(ctx context.Context) error {
+	req, err := p.newRequest(ctx, "GET", "/models", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("could not send request: %w", err)
 	}
 	defer resp.Body.Close()
 
-	// Ping accepts an authorized "bad-request", but if it's not an "Okay" or a "Bad request"
-	// there's an issue
-	if resp.StatusCode != 200 && resp.StatusCode != 400 {
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return fmt.Errorf("got %q response status code", resp.Status)
-		}
-
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		body, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("Probably you did not insert the `OPENAI_API_KEY` key - got %q response, body: \n%s\n", resp.Status, string(body))
+	case http.StatusTooManyRequests:
+		// Too many requests - no quota
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("Probably not a paid plan - got %q response, body: \n%s\n", resp.Status, string(body))
+	default:
+		return fmt.Errorf("got %q response status code", resp.Status)
+	}
+}
+
+func (p *provider) DefaultModel() Model {
+	return p.model
+}
+
+func (p *provider) ListModels(ctx context.Context) ([]Model, error) {
+	req, err := p.newRequest(ctx, "GET", "/models", nil)
+	if err != nil {
+		return nil, err
 	}
 
-	// Too many requests - no quota
-	if resp.StatusCode != 433 {
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return fmt.Errorf("got %q response status code", resp.Status)
-		}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not send request: %w", err)
+	}
+	defer resp.Body.Close()
 
-		return fmt.Errorf("Probably not a paid plan - got %q response, body: \n%s\n", resp.Status, string(body))
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got %q response status code", resp.Status)
 	}
 
-	return nil
+	var modelsResponse GPTModelsResponse
+	err = json.NewDecoder(resp.Body).Decode(&modelsResponse)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode models: %w", err)
+	}
+
+	models := make([]Model, 0, len(modelsResponse.Data))
+	for _, m := range modelsResponse.Data {
+		models = append(models, Model(m.Id))
+	}
+
+	return models, nil
 }
 
-func Prompt(apikey string, prompt string) (response string, err error) {
-	requestBody, err := json.Marshal(map[string]interface{}{
-		"model": "gpt-3.5-turbo",
-		"messages": []interface{}{
-			map[string]string{
-				"role":    "user",
-				"content": prompt,
-			},
-		},
-		"temperature": 0.7,
-	})
+func (p *provider) gptRequest(request bot_infrastructure_llm.Request) GPTRequest {
+	gptRequest := GPTRequest{
+		Model:       request.Model,
+		Messages:    make([]GPTRequestMessage, 0, len(request.Messages)),
+		Temperature: request.Temperature,
+		MaxTokens:   request.MaxTokens,
+	}
+	if gptRequest.Model == "" {
+		gptRequest.Model = p.model
+	}
+	if gptRequest.Temperature == 0 {
+		gptRequest.Temperature = DefaultTemperature
+	}
+	for _, msg := range request.Messages {
+		gptRequest.Messages = append(gptRequest.Messages, GPTRequestMessage{
+			Role:    msg.Role,
+			Content: msg.Content,
+		})
+	}
+
+	return gptRequest
+}
 
+func (p *provider) Complete(ctx context.Context, request bot_infrastructure_llm.Request) (*bot_infrastructure_llm.Response, error) {
+	requestBody, err := json.Marshal(p.gptRequest(request))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(requestBody))
+
+	req, err := p.newRequest(ctx, "POST", "/chat/completions", bytes.NewBuffer(requestBody))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apikey)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := p.client.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	// Read the response
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got %q response, body: \n%s\n", resp.Status, string(body))
 	}
 
 	var gptResponse GPTResponse
 	err = json.Unmarshal(body, &gptResponse)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	// Assuming the first choice is the one we need
-	if len(gptResponse.Choices) > 0 {
-		return gptResponse.Choices[0].Message.Content, nil
+	if len(gptResponse.Choices) == 0 {
+		return nil, bot_infrastructure_llm.ErrNoResponse
+	}
+
+	return &bot_infrastructure_llm.Response{
+		Model:        Model(gptResponse.Model),
+		Content:      gptResponse.Choices[0].Message.Content,
+		FinishReason: gptResponse.Choices[0].FinishReason,
+		Usage:        *gptResponse.Usage.usage(),
+	}, nil
+}
+
+// Stream requests the completion with `stream: true`
+// and reads the server-sent events of the response, sending the content deltas down the channel.
+func (p *provider) Stream(ctx context.Context, request bot_infrastructure_llm.Request) (<-chan bot_infrastructure_llm.Chunk, error) {
+	gptRequest := p.gptRequest(request)
+	gptRequest.Stream = true
+	gptRequest.StreamOptions = &GPTStreamOptions{IncludeUsage: true}
+
+	requestBody, err := json.Marshal(gptRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := p.newRequest(ctx, "POST", "/chat/completions", bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
 	}
 
-	return "", ErrNoResponse
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("got %q response status code", resp.Status)
+		}
+
+		return nil, fmt.Errorf("got %q response, body: \n%s\n", resp.Status, string(body))
+	}
+
+	chunks := make(chan bot_infrastructure_llm.Chunk)
+	send := func(chunk bot_infrastructure_llm.Chunk) bool {
+		select {
+		case chunks <- chunk:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	go func() {
+		defer close(chunks)
+		defer resp.Body.Close()
+
+		// the stream ends either with [DONE] or after the choice finished,
+		// if it ends before that the connection was cut and the answer is incomplete
+		finished := false
+
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 0, 4096), maxStreamEventSize)
+		for scanner.Scan() {
+			line := scanner.Text()
+			// every event we care about is a `data: ...` line, the rest are blank separators or comments
+			if !strings.HasPrefix(line, "data:") {
+				continue
+			}
+
+			data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			if data == streamDoneData {
+				return
+			}
+
+			var streamResponse GPTStreamResponse
+			err := json.Unmarshal([]byte(data), &streamResponse)
+			if err != nil {
+				send(bot_infrastructure_llm.Chunk{Err: fmt.Errorf("could not decode stream event %q: %w", data, err)})
+				return
+			}
+			if streamResponse.Error != nil {
+				send(bot_infrastructure_llm.Chunk{Err: *streamResponse.Error})
+				return
+			}
+
+			if streamResponse.Usage != nil {
+				if !send(bot_infrastructure_llm.Chunk{Usage: streamResponse.Usage.usage()}) {
+					return
+				}
+			}
+
+			// Assuming the first choice is the one we need
+			if len(streamResponse.Choices) == 0 {
+				continue
+			}
+
+			choice := streamResponse.Choices[0]
+			chunk := bot_infrastructure_llm.Chunk{
+				Content: choice.Delta.Content,
+			}
+			if choice.FinishReason != nil {
+				chunk.FinishReason = *choice.FinishReason
+				finished = chunk.FinishReason != ""
+			}
+			if chunk.Content == "" && chunk.FinishReason == "" {
+				continue
+			}
+
+			if !send(chunk) {
+				return
+			}
+		}
+
+		// a cancelled context aborts reading the body, that's not an error of the stream
+		if ctx.Err() != nil {
+			return
+		}
+		if err := scanner.Err(); err != nil {
+			send(bot_infrastructure_llm.Chunk{Err: fmt.Errorf("could not read stream: %w", err)})
+			return
+		}
+		if !finished {
+			send(bot_infrastructure_llm.Chunk{Err: io.ErrUnexpectedEOF})
+		}
+	}()
+
+	return chunks, nil
 }
@@ -0,0 +1,139 @@
+package openai
+
+import (
+	"connectly-interview/internal/bot/infrastructure/llm"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type OpenAiTestSuite struct {
+	suite.Suite
+}
+
+func (suite *OpenAiTestSuite) TestStream() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var gptRequest GPTRequest
+		suite.NoError(json.NewDecoder(r.Body).Decode(&gptRequest))
+		suite.True(gptRequest.Stream)
+		suite.True(gptRequest.StreamOptions.IncludeUsage)
+		suite.Equal(Model35, gptRequest.Model)
+		suite.Equal("Bearer key", r.Header.Get("Authorization"))
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"role\":\"assistant\"},\"finish_reason\":null}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"},\"finish_reason\":null}]}\n\n")
+		fmt.Fprint(w, ": keep-alive comment\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\" world\"},\"finish_reason\":null}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":8,\"completion_tokens\":2,\"total_tokens\":10}}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	p := New("key", WithBaseUrl(server.URL))
+	chunks, err := p.Stream(context.Background(), bot_infrastructure_llm.Request{
+		Messages: []bot_infrastructure_llm.Message{{Role: bot_infrastructure_llm.RoleUser, Content: "hi"}},
+	})
+	suite.NoError(err)
+
+	var received []bot_infrastructure_llm.Chunk
+	for chunk := range chunks {
+		received = append(received, chunk)
+	}
+	suite.Equal([]bot_infrastructure_llm.Chunk{
+		{Content: "Hello"},
+		{Content: " world"},
+		{FinishReason: "stop"},
+		{Usage: &bot_infrastructure_llm.Usage{PromptTokens: 8, CompletionTokens: 2, TotalTokens: 10}},
+	}, received)
+}
+
+func (suite *OpenAiTestSuite) TestStreamBadStatus() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	p := New("key", WithBaseUrl(server.URL))
+	_, err := p.Stream(context.Background(), bot_infrastructure_llm.Request{})
+	suite.Error(err)
+}
+
+func (suite *OpenAiTestSuite) TestStreamTruncated() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"},\"finish_reason\":null}]}\n\n")
+	}))
+	defer server.Close()
+
+	p := New("key", WithBaseUrl(server.URL))
+	chunks, err := p.Stream(context.Background(), bot_infrastructure_llm.Request{})
+	suite.NoError(err)
+
+	suite.Equal(bot_infrastructure_llm.Chunk{Content: "Hello"}, <-chunks)
+	chunk := <-chunks
+	suite.ErrorIs(chunk.Err, io.ErrUnexpectedEOF)
+	_, ok := <-chunks
+	suite.False(ok)
+}
+
+func (suite *OpenAiTestSuite) TestStreamError() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"},\"finish_reason\":null}]}\n\n")
+		fmt.Fprint(w, "data: {\"error\":{\"message\":\"The server had an error\",\"type\":\"server_error\"}}\n\n")
+	}))
+	defer server.Close()
+
+	p := New("key", WithBaseUrl(server.URL))
+	chunks, err := p.Stream(context.Background(), bot_infrastructure_llm.Request{})
+	suite.NoError(err)
+
+	suite.Equal(bot_infrastructure_llm.Chunk{Content: "Hello"}, <-chunks)
+	chunk := <-chunks
+	suite.Equal(GPTError{Message: "The server had an error", Type: "server_error"}, chunk.Err)
+	_, ok := <-chunks
+	suite.False(ok)
+}
+
+func (suite *OpenAiTestSuite) TestStreamCanceled() {
+	aborted := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"},\"finish_reason\":null}]}\n\n")
+		w.(http.Flusher).Flush()
+		// keep compiling until the client goes away
+		<-r.Context().Done()
+		close(aborted)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := New("key", WithBaseUrl(server.URL))
+	chunks, err := p.Stream(ctx, bot_infrastructure_llm.Request{})
+	suite.NoError(err)
+
+	suite.Equal(bot_infrastructure_llm.Chunk{Content: "Hello"}, <-chunks)
+	cancel()
+
+	for chunk := range chunks {
+		suite.NoError(chunk.Err)
+	}
+	select {
+	case <-aborted:
+	case <-time.After(time.Second * 5):
+		suite.Fail("upstream request was not aborted")
+	}
+}
+
+func TestOpenAiTestSuite(t *testing.T) {
+	suite.Run(t, new(OpenAiTestSuite))
+}
@@ -0,0 +1,182 @@
+// Package bot_infrastructure_tokenizer counts how many tokens a text costs on a model,
+// so we know how much of a chat fits in the model's context window before we send it.
+//
+// The BPE ranks of the OpenAI encodings are bundled in the binary, no network is needed to load them.
+package bot_infrastructure_tokenizer
+
+import (
+	"connectly-interview/internal/bot/infrastructure/llm"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+const (
+	EncodingCl100kBase = "cl100k_base"
+
+	// DefaultContextWindow is the context window of models we don't know about
+	DefaultContextWindow = 4096
+	// TokensPerMessage is how many tokens the model spends on the role and separators of each message
+	TokensPerMessage = 3
+	// TokensReplyPriming is how many tokens every reply is primed with
+	TokensReplyPriming = 3
+
+	// charsPerToken is roughly how many characters of english text make a token
+	charsPerToken = 4
+)
+
+// contextWindows are the context windows of the models we know about, by model prefix,
+// more specific prefixes first
+var contextWindows = []struct {
+	prefix string
+	tokens int
+}{
+	{"gpt-4o", 128000},
+	{"gpt-4-1106", 128000},
+	{"gpt-4-turbo", 128000},
+	{"gpt-4-32k", 32768},
+	{"gpt-4", 8192},
+	{"gpt-3.5-turbo-1106", 16385},
+	{"gpt-3.5-turbo-16k", 16385},
+	{"gpt-3.5-turbo", 16385},
+}
+
+// Tokenizer counts the tokens of texts
+type Tokenizer interface {
+	// Count returns how many tokens the text costs
+	Count(text string) int
+	// Truncate cuts the text down to at most maxTokens tokens
+	Truncate(text string, maxTokens int) string
+}
+
+// ForModel returns the tokenizer of the model's encoding,
+// or an estimator if the model's encoding is unknown.
+func ForModel(model bot_infrastructure_llm.Model) Tokenizer {
+	encodingName := encodingForModel(model)
+	if encodingName == "" {
+		return NewEstimator()
+	}
+
+	t, err := NewBpe(encodingName)
+	if err != nil {
+		fmt.Printf("could not load %q encoding, falling back to estimating tokens: %s\n", encodingName, err)
+		return NewEstimator()
+	}
+
+	return t
+}
+
+// ContextWindow returns how many tokens the model can handle, prompt and answer together
+func ContextWindow(model bot_infrastructure_llm.Model) int {
+	for _, w := range contextWindows {
+		if strings.HasPrefix(model.String(), w.prefix) {
+			return w.tokens
+		}
+	}
+
+	return DefaultContextWindow
+}
+
+// encodingForModel returns the bundled encoding the model's tokens are counted with.
+// The gpt-4o models use o200k_base, which is not bundled, so they're counted with cl100k_base that's close enough.
+func encodingForModel(model bot_infrastructure_llm.Model) string {
+	if strings.HasPrefix(model.String(), "gpt-4") ||
+		strings.HasPrefix(model.String(), "gpt-3.5") ||
+		strings.HasPrefix(model.String(), "text-embedding-ada-002") {
+		return EncodingCl100kBase
+	}
+
+	return ""
+}
+
+// MessageTokens returns how many tokens a message costs, overhead included
+func MessageTokens(t Tokenizer, msg bot_infrastructure_llm.Message) int {
+	return TokensPerMessage + t.Count(msg.Role.String()) + t.Count(msg.Content)
+}
+
+// MessagesTokens returns how many tokens a whole request's messages cost, reply priming included
+func MessagesTokens(t Tokenizer, messages []bot_infrastructure_llm.Message) int {
+	tokens := TokensReplyPriming
+	for _, msg := range messages {
+		tokens += MessageTokens(t, msg)
+	}
+
+	return tokens
+}
+
+var (
+	encodingsMutex sync.Mutex
+	encodings      = map[string]*tiktoken.Tiktoken{}
+)
+
+// bpe is a byte pair encoding tokenizer, compatible with OpenAI's tiktoken
+type bpe struct {
+	encoding *tiktoken.Tiktoken
+}
+
+// NewBpe loads the bundled encoding, the first time it's called for each encoding it takes a while
+func NewBpe(encodingName string) (Tokenizer, error) {
+	encodingsMutex.Lock()
+	defer encodingsMutex.Unlock()
+
+	encoding, ok := encodings[encodingName]
+	if !ok {
+		tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+
+		var err error
+		encoding, err = tiktoken.GetEncoding(encodingName)
+		if err != nil {
+			return nil, fmt.Errorf("could not load encoding %q: %w", encodingName, err)
+		}
+		encodings[encodingName] = encoding
+	}
+
+	return &bpe{
+		encoding: encoding,
+	}, nil
+}
+
+func (b *bpe) Count(text string) int {
+	return len(b.encoding.EncodeOrdinary(text))
+}
+
+func (b *bpe) Truncate(text string, maxTokens int) string {
+	if maxTokens <= 0 {
+		return ""
+	}
+
+	tokens := b.encoding.EncodeOrdinary(text)
+	if len(tokens) <= maxTokens {
+		return text
+	}
+
+	// a token may be only a part of a multi-byte character, drop it if it's cut in half
+	return strings.ToValidUTF8(b.encoding.Decode(tokens[:maxTokens]), "")
+}
+
+// estimator roughly estimates the tokens of english text, for models whose encoding we don't have
+type estimator struct{}
+
+func NewEstimator() Tokenizer {
+	return &estimator{}
+}
+
+func (e *estimator) Count(text string) int {
+	return (len(text) + charsPerToken - 1) / charsPerToken
+}
+
+func (e *estimator) Truncate(text string, maxTokens int) string {
+	if maxTokens <= 0 {
+		return ""
+	}
+
+	maxChars := maxTokens * charsPerToken
+	if len(text) <= maxChars {
+		return text
+	}
+
+	return strings.ToValidUTF8(text[:maxChars], "")
+}
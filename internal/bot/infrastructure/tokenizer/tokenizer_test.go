@@ -0,0 +1,71 @@
+package bot_infrastructure_tokenizer
+
+import (
+	"connectly-interview/internal/bot/infrastructure/llm"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TokenizerTestSuite struct {
+	suite.Suite
+}
+
+func (suite *TokenizerTestSuite) TestCl100kBase() {
+	t := ForModel("gpt-3.5-turbo")
+	suite.IsType(&bpe{}, t)
+
+	// counts as tiktoken's cl100k_base does
+	suite.Equal(3, t.Count("hello world!"))
+	suite.Equal(0, t.Count(""))
+}
+
+func (suite *TokenizerTestSuite) TestGpt4oIsNotEstimated() {
+	t := ForModel("gpt-4o")
+	suite.IsType(&bpe{}, t)
+	suite.Equal(3, t.Count("hello world!"))
+}
+
+func (suite *TokenizerTestSuite) TestBpeTruncate() {
+	t := ForModel("gpt-4")
+	suite.Equal("hello world", t.Truncate("hello world!", 2))
+	suite.Equal("hello world!", t.Truncate("hello world!", 10))
+	suite.Equal("", t.Truncate("hello world!", 0))
+}
+
+func (suite *TokenizerTestSuite) TestUnknownModelIsEstimated() {
+	t := ForModel("echo")
+	suite.IsType(&estimator{}, t)
+	suite.Equal(3, t.Count("hello world!"))
+	suite.Equal("hello wo", t.Truncate("hello world!", 2))
+}
+
+func (suite *TokenizerTestSuite) TestMessagesTokens() {
+	t := ForModel("gpt-3.5-turbo")
+	messages := []bot_infrastructure_llm.Message{
+		{Role: bot_infrastructure_llm.RoleUser, Content: "hello world!"},
+	}
+	// 3 for the reply priming, 3 for the message, 1 for the role and 3 for the content
+	suite.Equal(10, MessagesTokens(t, messages))
+}
+
+func (suite *TokenizerTestSuite) TestEncodingForModel() {
+	suite.Equal(EncodingCl100kBase, encodingForModel("gpt-4o-mini"))
+	suite.Equal(EncodingCl100kBase, encodingForModel("gpt-4-turbo"))
+	suite.Equal(EncodingCl100kBase, encodingForModel("gpt-3.5-turbo"))
+	suite.Equal("", encodingForModel("echo"))
+}
+
+func (suite *TokenizerTestSuite) TestContextWindow() {
+	suite.Equal(16385, ContextWindow("gpt-3.5-turbo"))
+	suite.Equal(16385, ContextWindow("gpt-3.5-turbo-16k"))
+	suite.Equal(8192, ContextWindow("gpt-4"))
+	suite.Equal(128000, ContextWindow("gpt-4o"))
+	suite.Equal(128000, ContextWindow("gpt-4o-mini-2024-07-18"))
+	suite.Equal(32768, ContextWindow("gpt-4-32k-0613"))
+	suite.Equal(DefaultContextWindow, ContextWindow("echo"))
+}
+
+func TestTokenizerTestSuite(t *testing.T) {
+	suite.Run(t, new(TokenizerTestSuite))
+}
@@ -1,35 +1,602 @@
+// Package bot_interface_daemon is a communication interface over a unix domain socket,
+// for local clients (e.g. command line tools) to talk to the bot.
+//
+// Clients write one JSON command per line and read one JSON reply per line,
+// the answers of the chats the client uses are streamed back on the same connection as they are compiled.
+//
+// A connection is authenticated with the authenticate command and its token,
+// and it can only use the chats of its user. When the bot has no authenticator, every connection is the anonymous user.
 package bot_interface_daemon
 
 import (
+	"bufio"
+	"bytes"
+	"connectly-interview/internal/bot/domain/bot_auth"
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"connectly-interview/internal/bot/domain/bot_ratelimit"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"os"
+	"sync"
 )
 
+var (
+	ErrSocketInUse = fmt.Errorf("socket is used by another daemon")
+)
+
+const (
+	// MaxCommandSize is the biggest command line the daemon accepts
+	MaxCommandSize = 1024 * 1024 // 1 MB
+	// connectionBuffer is how many replies can wait for a slow client before the answers of its chats are dropped
+	connectionBuffer = 128
+)
+
+// Command is what the client asks the daemon to do
+type Command string
+
+const (
+	CommandNewChat     Command = "new_chat"
+	CommandSendMessage Command = "send_message"
+	CommandListChats   Command = "list_chats"
+	CommandCloseChat   Command = "close_chat"
+	// CommandCancelAnswer cancels the answers of a chat that are still being compiled
+	CommandCancelAnswer Command = "cancel_answer"
+	// CommandAuthenticate authenticates the connection with the token of the request,
+	// the other commands are refused until it's authenticated
+	CommandAuthenticate Command = "authenticate"
+)
+
+// ReplyType is what a line the daemon writes back is about
+type ReplyType string
+
+const (
+	ReplyTypeChatCreated ReplyType = "chat_created"
+	ReplyTypeChats       ReplyType = "chats"
+	// ReplyTypeOk acknowledges a command that has nothing else to reply
+	ReplyTypeOk    ReplyType = "ok"
+	ReplyTypeError ReplyType = "error"
+	// ReplyTypeRateLimited is the error of a message of a user that sent too many messages or spent too many tokens,
+	// the client should retry after its RetryAfter
+	ReplyTypeRateLimited ReplyType = "rate_limited"
+	// ReplyTypePartialAnswer is a part of an answer while it's still being compiled
+	ReplyTypePartialAnswer ReplyType = "partial_answer"
+	// ReplyTypeAnswerEnd marks that the answer is over and carries the whole answer
+	ReplyTypeAnswerEnd ReplyType = "answer_end"
+)
+
+// Request is a line the client writes, Id is echoed back on the reply so the client can match them
+type Request struct {
+	Id      string          `json:"id,omitempty"`
+	Command Command         `json:"cmd"`
+	ChatId  bot_chat.ChatId `json:"chat_id,omitempty"`
+	Message string          `json:"message,omitempty"`
+	Token   string          `json:"token,omitempty"`
+}
+
+// Reply is a line the daemon writes back, either the reply to a request or a part of an answer
+type Reply struct {
+	Id     string            `json:"id,omitempty"`
+	Type   ReplyType         `json:"type"`
+	ChatId *bot_chat.ChatId  `json:"chat_id,omitempty"`
+	Chats  []bot_chat.ChatId `json:"chats,omitempty"`
+	Delta  string            `json:"delta,omitempty"`
+	Answer string            `json:"answer,omitempty"`
+	Error  string            `json:"error,omitempty"`
+	// User is who the connection is authenticated as, replied to the authenticate command
+	User bot_auth.UserId `json:"user,omitempty"`
+	// RetryAfter is how many seconds the client should wait before it retries a rate limited message
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
 type Daemon interface {
 	Start() <-chan error
 	Listen() <-chan []byte
+	Stop() error
+	// Answer sends a delta of a chat's answer to the clients that use the chat, or the whole answer if it's done
+	Answer(chatId bot_chat.ChatId, promptId bot_chat.PromptId, answer []byte, done bool) error
+	// Fail ends a chat's answer with the error it failed with, for the clients that use the chat
+	Fail(chatId bot_chat.ChatId, promptId bot_chat.PromptId, err error) error
 }
 
 type daemon struct {
-	ctx  context.Context
-	File *os.File
+	ctx        context.Context
+	socketPath string
+	listener   net.Listener
+	prompts    chan []byte
+
+	m sync.Mutex
+	// conns are the open client connections
+	conns map[*conn]struct{}
+	// subscribers are the connections that get the answers of each chat
+	subscribers map[bot_chat.ChatId]map[*conn]struct{}
+	stopped     bool
+
+	authenticateHandler   func(token string) (bot_auth.UserId, error)
+	newChatHandler        func(ctx context.Context) (bot_chat.ChatId, error)
+	newChatMessageHandler func(ctx context.Context, chatId bot_chat.ChatId, msg []byte) error
+	cancelAnswerHandler   func(ctx context.Context, chatId bot_chat.ChatId) error
+	listChatsHandler      func(ctx context.Context) ([]bot_chat.ChatId, error)
+	deleteChatHandler     func(ctx context.Context, chatId bot_chat.ChatId) error
+	getChatHandler        func(ctx context.Context, chatId bot_chat.ChatId) (*bot_chat.Chat, error)
 }
 
-type NewAndRunArgs struct {
+type Args struct {
 	Context context.Context
+	// SocketPath is where the unix domain socket is created
+	SocketPath string
+	// AuthenticateHandler returns the user of a token. A connection starts as the user of no token,
+	// which is the bot_auth.AnonymousUser if it's not provided
+	AuthenticateHandler func(token string) (bot_auth.UserId, error)
+	// The handlers are called with the context of the connection, which carries the user it's authenticated as
+	NewChatHandler func(ctx context.Context) (bot_chat.ChatId, error)
+	// NewChatMessageHandler is called with the context of the connection the message came from,
+	// which is done when the connection closes
+	NewChatMessageHandler func(ctx context.Context, chatId bot_chat.ChatId, msg []byte) error
+	CancelAnswerHandler   func(ctx context.Context, chatId bot_chat.ChatId) error
+	ListChatsHandler      func(ctx context.Context) ([]bot_chat.ChatId, error)
+	DeleteChatHandler     func(ctx context.Context, chatId bot_chat.ChatId) error
+	// GetChatHandler checks that a chat exists and is the user's before the connection gets its answers,
+	// the connections can't send messages to chats without it
+	GetChatHandler func(ctx context.Context, chatId bot_chat.ChatId) (*bot_chat.Chat, error)
 }
 
-func NewAndRun(args NewAndRunArgs) Daemon {
-	daemon := &daemon{
-		ctx: args.Context,
+func New(args Args) Daemon {
+	if args.Context == nil {
+		args.Context = context.Background()
+	}
+	if args.AuthenticateHandler == nil {
+		args.AuthenticateHandler = bot_auth.NewAnonymous().Authenticate
+	}
+
+	return &daemon{
+		ctx:                   args.Context,
+		socketPath:            args.SocketPath,
+		prompts:               make(chan []byte),
+		conns:                 make(map[*conn]struct{}),
+		subscribers:           make(map[bot_chat.ChatId]map[*conn]struct{}),
+		authenticateHandler:   args.AuthenticateHandler,
+		newChatHandler:        args.NewChatHandler,
+		newChatMessageHandler: args.NewChatMessageHandler,
+		cancelAnswerHandler:   args.CancelAnswerHandler,
+		listChatsHandler:      args.ListChatsHandler,
+		deleteChatHandler:     args.DeleteChatHandler,
+		getChatHandler:        args.GetChatHandler,
 	}
-	return daemon
 }
 
+// Start listens on the socket and serves the clients until the daemon is stopped
 func (d *daemon) Start() <-chan error {
-	return nil
+	errChan := make(chan error, 1)
+
+	listener, err := d.listen()
+	if err != nil {
+		errChan <- err
+		close(errChan)
+		return errChan
+	}
+	d.m.Lock()
+	d.listener = listener
+	d.m.Unlock()
+	fmt.Printf("listening daemon socket at %q\n", d.socketPath)
+
+	go func() {
+		defer close(errChan)
+
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				errChan <- fmt.Errorf("could not accept connection: %w", err)
+				return
+			}
+
+			go d.serve(netConn)
+		}
+	}()
+
+	if d.ctx.Done() != nil {
+		go func() {
+			<-d.ctx.Done()
+			d.Stop()
+		}()
+	}
+
+	return errChan
 }
 
+// listen creates the socket, removing the socket file that a daemon which did not stop gracefully left behind
+func (d *daemon) listen() (net.Listener, error) {
+	if _, err := os.Stat(d.socketPath); err == nil {
+		if c, err := net.Dial("unix", d.socketPath); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%w: %q", ErrSocketInUse, d.socketPath)
+		}
+		err := os.Remove(d.socketPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not remove stale socket %q: %w", d.socketPath, err)
+		}
+	}
+
+	listener, err := net.Listen("unix", d.socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not listen on socket %q: %w", d.socketPath, err)
+	}
+
+	// only the user that runs the bot can talk to it
+	err = os.Chmod(d.socketPath, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("could not restrict socket %q: %w", d.socketPath, err)
+	}
+
+	return listener, nil
+}
+
+// Listen returns the prompts of the daemon, the messages of the chats are sent straight to the handlers instead
 func (d *daemon) Listen() <-chan []byte {
+	return d.prompts
+}
+
+// Stop stops accepting clients, closes the open connections and removes the socket
+func (d *daemon) Stop() error {
+	d.m.Lock()
+	if d.stopped {
+		d.m.Unlock()
+		return nil
+	}
+	d.stopped = true
+	listener := d.listener
+	conns := make([]*conn, 0, len(d.conns))
+	for c := range d.conns {
+		conns = append(conns, c)
+	}
+	d.m.Unlock()
+
+	for _, c := range conns {
+		c.close()
+	}
+
+	if listener == nil {
+		return nil
+	}
+	// closing a unix listener removes its socket file too
+	err := listener.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("could not close daemon socket: %w", err)
+	}
+
 	return nil
 }
+
+func (d *daemon) Answer(chatId bot_chat.ChatId, promptId bot_chat.PromptId, answer []byte, done bool) error {
+	reply := Reply{
+		Type:   ReplyTypePartialAnswer,
+		ChatId: &chatId,
+		Delta:  string(answer),
+	}
+	if done {
+		reply = Reply{
+			Type:   ReplyTypeAnswerEnd,
+			ChatId: &chatId,
+			Answer: string(answer),
+		}
+	}
+	d.publish(chatId, reply)
+
+	return nil
+}
+
+func (d *daemon) Fail(chatId bot_chat.ChatId, promptId bot_chat.PromptId, err error) error {
+	d.publish(chatId, Reply{
+		Type:   ReplyTypeError,
+		ChatId: &chatId,
+		Error:  fmt.Sprintf("could not answer: %s", err),
+	})
+
+	return nil
+}
+
+// publish writes the reply to the clients that are subscribed to the chat
+func (d *daemon) publish(chatId bot_chat.ChatId, reply Reply) {
+	d.m.Lock()
+	subscribers := make([]*conn, 0, len(d.subscribers[chatId]))
+	for c := range d.subscribers[chatId] {
+		subscribers = append(subscribers, c)
+	}
+	d.m.Unlock()
+
+	for _, c := range subscribers {
+		if !c.tryWrite(reply) {
+			fmt.Printf("daemon client is too slow, dropped answer of chat %q\n", chatId)
+		}
+	}
+}
+
+// conn is a connection of a client to the daemon
+type conn struct {
+	netConn net.Conn
+	// ctx carries the user the connection is authenticated as, it's only used by the goroutine that serves the connection
+	ctx     context.Context
+	cancel  context.CancelFunc
+	replies chan Reply
+	// closed is closed once the connection is closed
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		close(c.closed)
+		c.netConn.Close()
+	})
+}
+
+// write queues the reply for the client, waiting if the client is slow
+func (c *conn) write(reply Reply) {
+	select {
+	case c.replies <- reply:
+	case <-c.closed:
+	}
+}
+
+// tryWrite queues the reply for the client, unless the client is too slow to keep up
+func (c *conn) tryWrite(reply Reply) bool {
+	select {
+	case c.replies <- reply:
+		return true
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *daemon) serve(netConn net.Conn) {
+	ctx, cancel := context.WithCancel(d.ctx)
+	c := &conn{
+		netConn: netConn,
+		ctx:     ctx,
+		cancel:  cancel,
+		replies: make(chan Reply, connectionBuffer),
+		closed:  make(chan struct{}),
+	}
+
+	d.m.Lock()
+	if d.stopped {
+		d.m.Unlock()
+		c.close()
+		return
+	}
+	d.conns[c] = struct{}{}
+	d.m.Unlock()
+
+	defer d.forget(c)
+	defer c.close()
+
+	// the connection is the user of no token until it authenticates, if there's one
+	user, err := d.authenticateHandler("")
+	if err == nil {
+		c.ctx = bot_auth.WithUser(ctx, user)
+	}
+
+	go d.writeReplies(c)
+
+	scanner := bufio.NewScanner(netConn)
+	scanner.Buffer(make([]byte, 0, 4096), MaxCommandSize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var request Request
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&request)
+		if err != nil {
+			c.write(Reply{Type: ReplyTypeError, Error: fmt.Sprintf("invalid command: %s", err)})
+			continue
+		}
+
+		c.write(d.handle(c, request))
+	}
+}
+
+func (d *daemon) writeReplies(c *conn) {
+	encoder := json.NewEncoder(c.netConn)
+	for {
+		select {
+		case reply := <-c.replies:
+			err := encoder.Encode(reply)
+			if err != nil {
+				c.close()
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// handle runs the request's command and returns the reply to it
+func (d *daemon) handle(c *conn, request Request) Reply {
+	reply, err := d.run(c, request)
+	var rateLimited *bot_ratelimit.RateLimitedError
+	switch {
+	case errors.As(err, &rateLimited):
+		reply = Reply{Type: ReplyTypeRateLimited, Error: err.Error(), RetryAfter: rateLimited.RetryAfterSeconds()}
+	case err != nil:
+		reply = Reply{Type: ReplyTypeError, Error: err.Error()}
+	}
+	reply.Id = request.Id
+
+	return reply
+}
+
+func (d *daemon) run(c *conn, request Request) (Reply, error) {
+	if request.Command == CommandAuthenticate {
+		return d.authenticate(c, request.Token)
+	}
+	if _, err := bot_auth.UserFrom(c.ctx); err != nil {
+		return Reply{}, fmt.Errorf("%w: the connection has to be authenticated first", err)
+	}
+
+	switch request.Command {
+	case CommandNewChat:
+		if d.newChatHandler == nil {
+			return Reply{}, fmt.Errorf("no new chat handler provided")
+		}
+
+		chatId, err := d.newChatHandler(c.ctx)
+		if err != nil {
+			return Reply{}, fmt.Errorf("could not create new chat: %w", err)
+		}
+		d.subscribe(c, chatId)
+
+		return Reply{Type: ReplyTypeChatCreated, ChatId: &chatId}, nil
+	case CommandSendMessage:
+		if d.newChatMessageHandler == nil {
+			return Reply{}, fmt.Errorf("no chat message handler provided")
+		}
+
+		// the chat may not be the user's, its answers are none of the connection's business
+		if d.getChatHandler == nil {
+			return Reply{}, fmt.Errorf("no get chat handler provided")
+		}
+		_, err := d.getChatHandler(c.ctx, request.ChatId)
+		if err != nil {
+			return Reply{}, fmt.Errorf("could not process new chat message: %w", err)
+		}
+
+		// subscribe before prompting, so that no part of the answer is missed
+		subscribed := d.subscribe(c, request.ChatId)
+		err = d.newChatMessageHandler(c.ctx, request.ChatId, []byte(request.Message))
+		if err != nil {
+			if subscribed {
+				d.unsubscribeConn(c, request.ChatId)
+			}
+			return Reply{}, fmt.Errorf("could not process new chat message: %w", err)
+		}
+
+		return Reply{Type: ReplyTypeOk, ChatId: &request.ChatId}, nil
+	case CommandListChats:
+		if d.listChatsHandler == nil {
+			return Reply{}, fmt.Errorf("no list chats handler provided")
+		}
+
+		chats, err := d.listChatsHandler(c.ctx)
+		if err != nil {
+			return Reply{}, fmt.Errorf("could not list chats: %w", err)
+		}
+
+		return Reply{Type: ReplyTypeChats, Chats: chats}, nil
+	case CommandCloseChat:
+		if d.deleteChatHandler == nil {
+			return Reply{}, fmt.Errorf("no delete chat handler provided")
+		}
+
+		err := d.deleteChatHandler(c.ctx, request.ChatId)
+		if err != nil {
+			return Reply{}, fmt.Errorf("could not close chat: %w", err)
+		}
+		d.unsubscribe(request.ChatId)
+
+		return Reply{Type: ReplyTypeOk, ChatId: &request.ChatId}, nil
+	case CommandCancelAnswer:
+		if d.cancelAnswerHandler == nil {
+			return Reply{}, fmt.Errorf("no cancel answer handler provided")
+		}
+
+		err := d.cancelAnswerHandler(c.ctx, request.ChatId)
+		if err != nil {
+			return Reply{}, fmt.Errorf("could not cancel answer: %w", err)
+		}
+
+		return Reply{Type: ReplyTypeOk, ChatId: &request.ChatId}, nil
+	default:
+		return Reply{}, fmt.Errorf("unknown command %q", request.Command)
+	}
+}
+
+// authenticate authenticates the connection as the user of the token,
+// a connection that fails to authenticate is not authenticated anymore
+func (d *daemon) authenticate(c *conn, token string) (Reply, error) {
+	previous, _ := bot_auth.UserFrom(c.ctx)
+	user, err := d.authenticateHandler(token)
+	if err != nil {
+		user = ""
+	}
+	if user != previous {
+		// the answers of the chats of the previous user are not the new user's
+		d.forgetSubscriptions(c)
+		c.ctx = bot_auth.WithUser(c.ctx, user)
+	}
+	if err != nil {
+		return Reply{}, fmt.Errorf("could not authenticate: %w", err)
+	}
+
+	return Reply{Type: ReplyTypeOk, User: user}, nil
+}
+
+// subscribe sends the answers of the chat to the connection, it returns whether the connection was not subscribed already
+func (d *daemon) subscribe(c *conn, chatId bot_chat.ChatId) bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if d.subscribers[chatId] == nil {
+		d.subscribers[chatId] = make(map[*conn]struct{})
+	}
+	if _, ok := d.subscribers[chatId][c]; ok {
+		return false
+	}
+	d.subscribers[chatId][c] = struct{}{}
+
+	return true
+}
+
+// unsubscribeConn stops sending the answers of the chat to the connection
+func (d *daemon) unsubscribeConn(c *conn, chatId bot_chat.ChatId) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	delete(d.subscribers[chatId], c)
+	if len(d.subscribers[chatId]) == 0 {
+		delete(d.subscribers, chatId)
+	}
+}
+
+// unsubscribe stops sending the answers of the chat to any connection
+func (d *daemon) unsubscribe(chatId bot_chat.ChatId) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	delete(d.subscribers, chatId)
+}
+
+// forget drops the closed connection and its subscriptions
+func (d *daemon) forget(c *conn) {
+	d.m.Lock()
+	delete(d.conns, c)
+	d.m.Unlock()
+
+	d.forgetSubscriptions(c)
+}
+
+// forgetSubscriptions stops sending the answers of any chat to the connection
+func (d *daemon) forgetSubscriptions(c *conn) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	for chatId, conns := range d.subscribers {
+		delete(conns, c)
+		if len(conns) == 0 {
+			delete(d.subscribers, chatId)
+		}
+	}
+}
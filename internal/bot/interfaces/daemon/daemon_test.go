@@ -0,0 +1,345 @@
+package bot_interface_daemon
+
+import (
+	"bufio"
+	"connectly-interview/internal/bot/domain/bot_auth"
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"connectly-interview/internal/bot/domain/bot_ratelimit"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type DaemonTestSuite struct {
+	suite.Suite
+	socketPath string
+	daemon     Daemon
+	m          sync.Mutex
+	chats      []bot_chat.ChatId
+	// messageCtxs are the contexts the messages were handled with
+	messageCtxs []context.Context
+	// authenticator is who authenticates the connections, every connection is anonymous by default
+	authenticator bot_auth.Authenticator
+}
+
+func (suite *DaemonTestSuite) SetupTest() {
+	suite.socketPath = filepath.Join(suite.T().TempDir(), "bot.sock")
+	suite.chats = nil
+	suite.messageCtxs = nil
+	suite.authenticator = bot_auth.NewAnonymous()
+	suite.daemon = New(Args{
+		SocketPath: suite.socketPath,
+		AuthenticateHandler: func(token string) (bot_auth.UserId, error) {
+			suite.m.Lock()
+			defer suite.m.Unlock()
+
+			return suite.authenticator.Authenticate(token)
+		},
+		NewChatHandler: func(ctx context.Context) (bot_chat.ChatId, error) {
+			suite.m.Lock()
+			defer suite.m.Unlock()
+
+			chatId := bot_chat.NewChatId()
+			suite.chats = append(suite.chats, chatId)
+			return chatId, nil
+		},
+		NewChatMessageHandler: func(ctx context.Context, chatId bot_chat.ChatId, msg []byte) error {
+			suite.m.Lock()
+			defer suite.m.Unlock()
+
+			suite.messageCtxs = append(suite.messageCtxs, ctx)
+			if string(msg) == "too often" {
+				return &bot_ratelimit.RateLimitedError{Limit: bot_ratelimit.LimitTokens, RetryAfter: time.Minute}
+			}
+			return nil
+		},
+		ListChatsHandler: func(ctx context.Context) ([]bot_chat.ChatId, error) {
+			suite.m.Lock()
+			defer suite.m.Unlock()
+
+			return append([]bot_chat.ChatId(nil), suite.chats...), nil
+		},
+		DeleteChatHandler: func(ctx context.Context, chatId bot_chat.ChatId) error {
+			suite.m.Lock()
+			defer suite.m.Unlock()
+
+			for i, id := range suite.chats {
+				if id == chatId {
+					suite.chats = append(suite.chats[:i], suite.chats[i+1:]...)
+					return nil
+				}
+			}
+			return bot_chat.ErrChatNotFound
+		},
+		GetChatHandler: func(ctx context.Context, chatId bot_chat.ChatId) (*bot_chat.Chat, error) {
+			suite.m.Lock()
+			defer suite.m.Unlock()
+
+			for _, id := range suite.chats {
+				if id == chatId {
+					return &bot_chat.Chat{}, nil
+				}
+			}
+			return nil, bot_chat.ErrChatNotFound
+		},
+	})
+
+	errs := suite.daemon.Start()
+	select {
+	case err := <-errs:
+		suite.FailNow("could not start daemon", err)
+	default:
+	}
+}
+
+func (suite *DaemonTestSuite) TearDownTest() {
+	suite.NoError(suite.daemon.Stop())
+}
+
+// client is a connection to the daemon that writes commands and reads replies line by line
+type client struct {
+	conn    net.Conn
+	replies *bufio.Scanner
+}
+
+func (suite *DaemonTestSuite) dial() *client {
+	conn, err := net.Dial("unix", suite.socketPath)
+	suite.Require().NoError(err)
+	suite.T().Cleanup(func() { conn.Close() })
+
+	return &client{conn: conn, replies: bufio.NewScanner(conn)}
+}
+
+func (suite *DaemonTestSuite) send(c *client, line string) {
+	_, err := fmt.Fprintln(c.conn, line)
+	suite.Require().NoError(err)
+}
+
+func (suite *DaemonTestSuite) read(c *client) Reply {
+	c.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	suite.Require().True(c.replies.Scan(), "no reply")
+
+	var reply Reply
+	suite.Require().NoError(json.Unmarshal(c.replies.Bytes(), &reply))
+	return reply
+}
+
+// newChat creates a chat of the connection's user
+func (suite *DaemonTestSuite) newChat(c *client) bot_chat.ChatId {
+	suite.send(c, `{"cmd":"new_chat"}`)
+	reply := suite.read(c)
+	suite.Require().Equal(ReplyTypeChatCreated, reply.Type)
+	return *reply.ChatId
+}
+
+func (suite *DaemonTestSuite) TestNewChatStreamsAnswersBack() {
+	c := suite.dial()
+	suite.send(c, `{"id":"1","cmd":"new_chat"}`)
+
+	reply := suite.read(c)
+	suite.Equal(ReplyTypeChatCreated, reply.Type)
+	suite.Equal("1", reply.Id)
+	suite.Require().NotNil(reply.ChatId)
+	chatId := *reply.ChatId
+
+	suite.send(c, fmt.Sprintf(`{"id":"2","cmd":"send_message","chat_id":%q,"message":"hi"}`, chatId))
+	suite.Equal(ReplyTypeOk, suite.read(c).Type)
+
+	suite.NoError(suite.daemon.Answer(chatId, "", []byte("hel"), false))
+	suite.NoError(suite.daemon.Answer(chatId, "", []byte("hello"), true))
+
+	reply = suite.read(c)
+	suite.Equal(ReplyTypePartialAnswer, reply.Type)
+	suite.Equal(chatId, *reply.ChatId)
+	suite.Equal("hel", reply.Delta)
+
+	reply = suite.read(c)
+	suite.Equal(ReplyTypeAnswerEnd, reply.Type)
+	suite.Equal("hello", reply.Answer)
+}
+
+func (suite *DaemonTestSuite) TestFailedAnswersEndWithAnError() {
+	c := suite.dial()
+	chatId := suite.newChat(c)
+
+	suite.NoError(suite.daemon.Answer(chatId, "", []byte("hel"), false))
+	suite.NoError(suite.daemon.Fail(chatId, "", fmt.Errorf("model is unreachable")))
+
+	suite.Equal(ReplyTypePartialAnswer, suite.read(c).Type)
+	reply := suite.read(c)
+	suite.Equal(ReplyTypeError, reply.Type)
+	suite.Empty(reply.Id)
+	suite.Require().NotNil(reply.ChatId)
+	suite.Equal(chatId, *reply.ChatId)
+	suite.Contains(reply.Error, "model is unreachable")
+}
+
+func (suite *DaemonTestSuite) TestAnswersGoOnlyToTheChatsClients() {
+	first := suite.dial()
+	second := suite.dial()
+
+	suite.send(first, `{"cmd":"new_chat"}`)
+	firstChat := *suite.read(first).ChatId
+	suite.send(second, `{"cmd":"new_chat"}`)
+	secondChat := *suite.read(second).ChatId
+
+	suite.NoError(suite.daemon.Answer(firstChat, "", []byte("for first"), true))
+	suite.NoError(suite.daemon.Answer(secondChat, "", []byte("for second"), true))
+
+	suite.Equal("for first", suite.read(first).Answer)
+	suite.Equal("for second", suite.read(second).Answer)
+}
+
+func (suite *DaemonTestSuite) TestMessagesToOtherChatsGetNoAnswers() {
+	c := suite.dial()
+	other := bot_chat.NewChatId()
+	suite.send(c, fmt.Sprintf(`{"cmd":"send_message","chat_id":%q,"message":"hi"}`, other))
+	reply := suite.read(c)
+	suite.Equal(ReplyTypeError, reply.Type)
+	suite.Contains(reply.Error, bot_chat.ErrChatNotFound.Error())
+
+	chatId := suite.newChat(c)
+	suite.NoError(suite.daemon.Answer(other, "", []byte("not yours"), false))
+	suite.NoError(suite.daemon.Answer(chatId, "", []byte("yours"), true))
+	suite.Equal("yours", suite.read(c).Answer)
+
+	suite.m.Lock()
+	suite.Empty(suite.messageCtxs)
+	suite.m.Unlock()
+}
+
+func (suite *DaemonTestSuite) TestListAndCloseChats() {
+	c := suite.dial()
+	suite.send(c, `{"cmd":"new_chat"}`)
+	chatId := *suite.read(c).ChatId
+
+	suite.send(c, `{"cmd":"list_chats"}`)
+	suite.Equal([]bot_chat.ChatId{chatId}, suite.read(c).Chats)
+
+	suite.send(c, fmt.Sprintf(`{"cmd":"close_chat","chat_id":%q}`, chatId))
+	suite.Equal(ReplyTypeOk, suite.read(c).Type)
+
+	suite.send(c, fmt.Sprintf(`{"cmd":"close_chat","chat_id":%q}`, chatId))
+	reply := suite.read(c)
+	suite.Equal(ReplyTypeError, reply.Type)
+	suite.Contains(reply.Error, bot_chat.ErrChatNotFound.Error())
+}
+
+func (suite *DaemonTestSuite) TestInvalidCommands() {
+	c := suite.dial()
+
+	suite.send(c, `{"cmd":"new_chat","unknown":true}`)
+	suite.Equal(ReplyTypeError, suite.read(c).Type)
+
+	suite.send(c, `not json`)
+	suite.Equal(ReplyTypeError, suite.read(c).Type)
+
+	suite.send(c, `{"id":"3","cmd":"dance"}`)
+	reply := suite.read(c)
+	suite.Equal(ReplyTypeError, reply.Type)
+	suite.Equal("3", reply.Id)
+
+	// the connection is still usable
+	suite.send(c, `{"cmd":"list_chats"}`)
+	suite.Equal(ReplyTypeChats, suite.read(c).Type)
+}
+
+func (suite *DaemonTestSuite) TestMessagesAreCanceledWhenTheClientGoesAway() {
+	c := suite.dial()
+	suite.send(c, fmt.Sprintf(`{"cmd":"send_message","chat_id":%q,"message":"hi"}`, suite.newChat(c)))
+	suite.read(c)
+	c.conn.Close()
+
+	suite.m.Lock()
+	ctx := suite.messageCtxs[0]
+	suite.m.Unlock()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second * 5):
+		suite.Fail("message context was not canceled")
+	}
+}
+
+func (suite *DaemonTestSuite) TestConnectionsAuthenticate() {
+	suite.m.Lock()
+	suite.authenticator = bot_auth.NewStaticKeys(map[string]bot_auth.UserId{"key-a": "alice"})
+	suite.m.Unlock()
+	c := suite.dial()
+
+	suite.send(c, fmt.Sprintf(`{"cmd":"send_message","chat_id":%q,"message":"hi"}`, bot_chat.NewChatId()))
+	reply := suite.read(c)
+	suite.Equal(ReplyTypeError, reply.Type)
+	suite.Contains(reply.Error, bot_auth.ErrUnauthenticated.Error())
+
+	suite.send(c, `{"cmd":"authenticate","token":"key-b"}`)
+	suite.Equal(ReplyTypeError, suite.read(c).Type)
+
+	suite.send(c, `{"id":"1","cmd":"authenticate","token":"key-a"}`)
+	reply = suite.read(c)
+	suite.Equal(ReplyTypeOk, reply.Type)
+	suite.Equal(bot_auth.UserId("alice"), reply.User)
+
+	suite.send(c, fmt.Sprintf(`{"cmd":"send_message","chat_id":%q,"message":"hi"}`, suite.newChat(c)))
+	suite.Equal(ReplyTypeOk, suite.read(c).Type)
+
+	suite.m.Lock()
+	suite.Require().Len(suite.messageCtxs, 1)
+	user, err := bot_auth.UserFrom(suite.messageCtxs[0])
+	suite.m.Unlock()
+	suite.NoError(err)
+	suite.Equal(bot_auth.UserId("alice"), user)
+}
+
+func (suite *DaemonTestSuite) TestRateLimitedMessages() {
+	c := suite.dial()
+	suite.send(c, fmt.Sprintf(`{"id":"1","cmd":"send_message","chat_id":%q,"message":"too often"}`, suite.newChat(c)))
+
+	reply := suite.read(c)
+	suite.Equal(ReplyTypeRateLimited, reply.Type)
+	suite.Equal("1", reply.Id)
+	suite.Equal(60, reply.RetryAfter)
+	suite.NotEmpty(reply.Error)
+}
+
+func (suite *DaemonTestSuite) TestSocketInUse() {
+	other := New(Args{SocketPath: suite.socketPath})
+	suite.ErrorIs(<-other.Start(), ErrSocketInUse)
+}
+
+func (suite *DaemonTestSuite) TestStaleSocketIsReplaced() {
+	suite.NoError(suite.daemon.Stop())
+
+	// a socket file that nobody listens to, like the one of a daemon that crashed
+	listener, err := net.Listen("unix", suite.socketPath)
+	suite.Require().NoError(err)
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	_, err = os.Stat(suite.socketPath)
+	suite.Require().NoError(err)
+
+	suite.daemon = New(Args{SocketPath: suite.socketPath, ListChatsHandler: func(ctx context.Context) ([]bot_chat.ChatId, error) {
+		return nil, nil
+	}})
+	errs := suite.daemon.Start()
+	select {
+	case err := <-errs:
+		suite.FailNow("could not start daemon", err)
+	default:
+	}
+
+	c := suite.dial()
+	suite.send(c, `{"cmd":"list_chats"}`)
+	suite.Equal(ReplyTypeChats, suite.read(c).Type)
+}
+
+func TestDaemonTestSuite(t *testing.T) {
+	suite.Run(t, new(DaemonTestSuite))
+}
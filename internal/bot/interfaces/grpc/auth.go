@@ -0,0 +1,64 @@
+package bot_interface_grpc
+
+import (
+	"connectly-interview/internal/bot/domain/bot_auth"
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// authenticate returns a copy of the context of the call that carries its user,
+// the token is the "authorization: Bearer <token>" metadata of the call
+func (s *server) authenticate(ctx context.Context) (context.Context, error) {
+	token := ""
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, authorization := range md.Get("authorization") {
+		scheme, t, ok := strings.Cut(authorization, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			token = strings.TrimSpace(t)
+			break
+		}
+	}
+
+	user, err := s.authenticateHandler(token)
+	if err != nil {
+		fmt.Printf("could not authenticate grpc call: %s\n", err)
+		// the client is not told why its token was not accepted
+		return nil, status.Error(codes.Unauthenticated, bot_auth.ErrUnauthenticated.Error())
+	}
+
+	return bot_auth.WithUser(ctx, user), nil
+}
+
+func (s *server) unaryAuthInterceptor(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, request)
+}
+
+func (s *server) streamAuthInterceptor(srv interface{}, grpcStream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(grpcStream.Context())
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, &authenticatedStream{ServerStream: grpcStream, ctx: ctx})
+}
+
+// authenticatedStream is a stream whose context carries its user
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
@@ -1 +1,593 @@
+// Package bot_interface_grpc is a communication interface for backend services to talk to the bot over gRPC,
+// serving the ChatService defined in pb/chat.proto.
+//
+// Chats are created, read and deleted with unary calls,
+// their messages are sent through the bidirectional Converse stream which streams the answers back as they are compiled.
+//
+// Every call is authenticated with its "authorization: Bearer <token>" metadata,
+// and a client can only use the chats of its user.
 package bot_interface_grpc
+
+import (
+	"connectly-interview/internal/bot/domain/bot_auth"
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"connectly-interview/internal/bot/domain/bot_prompter"
+	"connectly-interview/internal/bot/domain/bot_ratelimit"
+	pb "connectly-interview/internal/bot/interfaces/grpc/pb"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// ShutdownTimeout is how long the server waits for the calls in flight to finish when stopped
+	ShutdownTimeout = time.Second * 10
+	// streamBuffer is how many responses can wait for a slow stream before the answers of its chats are dropped
+	streamBuffer = 128
+)
+
+type Server interface {
+	Start() <-chan error
+	Listen() <-chan []byte
+	Stop() error
+	// Answer sends a delta of a chat's answer to the streams that sent messages to the chat, or the whole answer if it's done
+	Answer(chatId bot_chat.ChatId, promptId bot_chat.PromptId, answer []byte, done bool) error
+	// Fail ends a chat's answer with the error it failed with, for the streams that sent messages to the chat
+	Fail(chatId bot_chat.ChatId, promptId bot_chat.PromptId, err error) error
+}
+
+type server struct {
+	pb.UnimplementedChatServiceServer
+
+	ctx        context.Context
+	address    string
+	listener   net.Listener
+	grpcServer *grpc.Server
+	prompts    chan []byte
+
+	m sync.Mutex
+	// streams are the open Converse streams
+	streams map[*stream]struct{}
+	// subscribers are the streams that get the answers of each chat
+	subscribers map[bot_chat.ChatId]map[*stream]struct{}
+	stopped     bool
+
+	authenticateHandler   func(token string) (bot_auth.UserId, error)
+	newChatHandler        func(ctx context.Context) (bot_chat.ChatId, error)
+	newChatMessageHandler func(ctx context.Context, chatId bot_chat.ChatId, msg []byte) error
+	cancelAnswerHandler   func(ctx context.Context, chatId bot_chat.ChatId) error
+	getHistoryHandler     func(ctx context.Context, chatId bot_chat.ChatId) ([]bot_chat.Turn, error)
+	deleteChatHandler     func(ctx context.Context, chatId bot_chat.ChatId) error
+	getChatHandler        func(ctx context.Context, chatId bot_chat.ChatId) (*bot_chat.Chat, error)
+}
+
+type Args struct {
+	Context context.Context
+	// Address is the tcp address the server listens on
+	Address string
+	// Listener is used instead of listening on the address, if provided
+	Listener net.Listener
+	// AuthenticateHandler returns the user of the token of each call,
+	// every call is the bot_auth.AnonymousUser if it's not provided
+	AuthenticateHandler func(token string) (bot_auth.UserId, error)
+	// The handlers are called with the context of the call, which carries the user it was authenticated as
+	NewChatHandler func(ctx context.Context) (bot_chat.ChatId, error)
+	// NewChatMessageHandler is called with the context of the stream the message came from,
+	// which is done when the stream ends
+	NewChatMessageHandler func(ctx context.Context, chatId bot_chat.ChatId, msg []byte) error
+	CancelAnswerHandler   func(ctx context.Context, chatId bot_chat.ChatId) error
+	GetHistoryHandler     func(ctx context.Context, chatId bot_chat.ChatId) ([]bot_chat.Turn, error)
+	DeleteChatHandler     func(ctx context.Context, chatId bot_chat.ChatId) error
+	// GetChatHandler checks that a chat exists and is the user's before the stream gets its answers,
+	// the streams can't send messages to chats without it
+	GetChatHandler func(ctx context.Context, chatId bot_chat.ChatId) (*bot_chat.Chat, error)
+}
+
+func New(args Args) Server {
+	if args.Context == nil {
+		args.Context = context.Background()
+	}
+	if args.AuthenticateHandler == nil {
+		args.AuthenticateHandler = bot_auth.NewAnonymous().Authenticate
+	}
+
+	s := &server{
+		ctx:                   args.Context,
+		address:               args.Address,
+		listener:              args.Listener,
+		prompts:               make(chan []byte),
+		streams:               make(map[*stream]struct{}),
+		subscribers:           make(map[bot_chat.ChatId]map[*stream]struct{}),
+		authenticateHandler:   args.AuthenticateHandler,
+		newChatHandler:        args.NewChatHandler,
+		newChatMessageHandler: args.NewChatMessageHandler,
+		cancelAnswerHandler:   args.CancelAnswerHandler,
+		getHistoryHandler:     args.GetHistoryHandler,
+		deleteChatHandler:     args.DeleteChatHandler,
+		getChatHandler:        args.GetChatHandler,
+	}
+	s.grpcServer = grpc.NewServer(
+		grpc.UnaryInterceptor(s.unaryAuthInterceptor),
+		grpc.StreamInterceptor(s.streamAuthInterceptor),
+	)
+	pb.RegisterChatServiceServer(s.grpcServer, s)
+
+	return s
+}
+
+// Start serves the gRPC calls until the server is stopped
+func (s *server) Start() <-chan error {
+	errChan := make(chan error, 1)
+
+	listener := s.listener
+	if listener == nil {
+		var err error
+		listener, err = net.Listen("tcp", s.address)
+		if err != nil {
+			errChan <- fmt.Errorf("could not listen on %q: %w", s.address, err)
+			close(errChan)
+			return errChan
+		}
+	}
+	fmt.Printf("listening grpc server at %q\n", listener.Addr())
+
+	go func() {
+		defer close(errChan)
+
+		err := s.grpcServer.Serve(listener)
+		if err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			errChan <- fmt.Errorf("could not serve grpc: %w", err)
+		}
+	}()
+
+	if s.ctx.Done() != nil {
+		go func() {
+			<-s.ctx.Done()
+			s.Stop()
+		}()
+	}
+
+	return errChan
+}
+
+// Listen returns the prompts of the server, the messages of the chats are sent straight to the handlers instead
+func (s *server) Listen() <-chan []byte {
+	return s.prompts
+}
+
+// Stop ends the open streams and waits for the unary calls in flight to finish, up to the ShutdownTimeout
+func (s *server) Stop() error {
+	s.m.Lock()
+	if s.stopped {
+		s.m.Unlock()
+		return nil
+	}
+	s.stopped = true
+	streams := make([]*stream, 0, len(s.streams))
+	for c := range s.streams {
+		streams = append(streams, c)
+	}
+	s.m.Unlock()
+
+	for _, c := range streams {
+		c.close()
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(ShutdownTimeout):
+		s.grpcServer.Stop()
+		return fmt.Errorf("could not stop grpc server gracefully within %s", ShutdownTimeout)
+	}
+
+	return nil
+}
+
+func (s *server) Answer(chatId bot_chat.ChatId, promptId bot_chat.PromptId, answer []byte, done bool) error {
+	response := &pb.ConverseResponse{
+		Response: &pb.ConverseResponse_PartialAnswer{PartialAnswer: &pb.PartialAnswer{
+			ChatId: chatId.String(),
+			Delta:  string(answer),
+		}},
+	}
+	if done {
+		response = &pb.ConverseResponse{
+			Response: &pb.ConverseResponse_AnswerEnd{AnswerEnd: &pb.AnswerEnd{
+				ChatId: chatId.String(),
+				Answer: string(answer),
+			}},
+		}
+	}
+	s.publish(chatId, response)
+
+	return nil
+}
+
+func (s *server) Fail(chatId bot_chat.ChatId, promptId bot_chat.PromptId, err error) error {
+	s.publish(chatId, &pb.ConverseResponse{
+		Response: &pb.ConverseResponse_Error{Error: converseError(chatId.String(), fmt.Errorf("could not answer: %w", err))},
+	})
+
+	return nil
+}
+
+// publish writes the response to the streams that converse in the chat
+func (s *server) publish(chatId bot_chat.ChatId, response *pb.ConverseResponse) {
+	s.m.Lock()
+	subscribers := make([]*stream, 0, len(s.subscribers[chatId]))
+	for c := range s.subscribers[chatId] {
+		subscribers = append(subscribers, c)
+	}
+	s.m.Unlock()
+
+	for _, c := range subscribers {
+		if !c.tryWrite(response) {
+			fmt.Printf("grpc stream is too slow, dropped answer of chat %q\n", chatId)
+		}
+	}
+}
+
+func (s *server) CreateChat(ctx context.Context, request *pb.CreateChatRequest) (*pb.CreateChatResponse, error) {
+	if s.newChatHandler == nil {
+		return nil, status.Error(codes.Unimplemented, "no new chat handler provided")
+	}
+
+	chatId, err := s.newChatHandler(ctx)
+	if err != nil {
+		return nil, toStatus(fmt.Errorf("could not create new chat: %w", err))
+	}
+
+	return &pb.CreateChatResponse{ChatId: chatId.String()}, nil
+}
+
+func (s *server) GetHistory(ctx context.Context, request *pb.GetHistoryRequest) (*pb.GetHistoryResponse, error) {
+	if s.getHistoryHandler == nil {
+		return nil, status.Error(codes.Unimplemented, "no get history handler provided")
+	}
+
+	chatId, err := parseChatId(request.GetChatId())
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := s.getHistoryHandler(ctx, chatId)
+	if err != nil {
+		return nil, toStatus(fmt.Errorf("could not get chat history: %w", err))
+	}
+
+	turns := make([]*pb.Turn, 0, len(history))
+	for _, turn := range history {
+		turns = append(turns, &pb.Turn{
+			Role:      toRole(turn.Role),
+			Content:   turn.Content,
+			CreatedAt: timestamppb.New(turn.CreatedAt),
+		})
+	}
+
+	return &pb.GetHistoryResponse{ChatId: chatId.String(), Turns: turns}, nil
+}
+
+func (s *server) DeleteChat(ctx context.Context, request *pb.DeleteChatRequest) (*pb.DeleteChatResponse, error) {
+	if s.deleteChatHandler == nil {
+		return nil, status.Error(codes.Unimplemented, "no delete chat handler provided")
+	}
+
+	chatId, err := parseChatId(request.GetChatId())
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.deleteChatHandler(ctx, chatId)
+	if err != nil {
+		return nil, toStatus(fmt.Errorf("could not delete chat: %w", err))
+	}
+	s.unsubscribe(chatId)
+
+	return &pb.DeleteChatResponse{}, nil
+}
+
+// Converse handles the requests of the stream until the client closes its side of the stream,
+// the answers of the chats the client sent messages to are streamed back meanwhile.
+func (s *server) Converse(grpcStream pb.ChatService_ConverseServer) error {
+	ctx, cancel := context.WithCancel(grpcStream.Context())
+	c := &stream{
+		ctx:       ctx,
+		cancel:    cancel,
+		responses: make(chan *pb.ConverseResponse, streamBuffer),
+		closed:    make(chan struct{}),
+	}
+
+	s.m.Lock()
+	if s.stopped {
+		s.m.Unlock()
+		c.close()
+		return status.Error(codes.Unavailable, "grpc server is stopping")
+	}
+	s.streams[c] = struct{}{}
+	s.m.Unlock()
+
+	defer s.forget(c)
+	defer c.close()
+
+	// only this goroutine sends on the stream, the requests are received on another one
+	go s.receive(c, grpcStream)
+
+	for {
+		select {
+		case response := <-c.responses:
+			err := grpcStream.Send(response)
+			if err != nil {
+				return err
+			}
+		case <-c.closed:
+			return c.err
+		}
+	}
+}
+
+// receive handles the requests of the stream as they come and closes the stream once the client is done with it
+func (s *server) receive(c *stream, grpcStream pb.ChatService_ConverseServer) {
+	for {
+		request, err := grpcStream.Recv()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			c.closeWith(err)
+			return
+		}
+
+		err = s.handle(c, request)
+		if err != nil {
+			c.write(&pb.ConverseResponse{
+				Response: &pb.ConverseResponse_Error{Error: converseError(chatIdOf(request), err)},
+			})
+		}
+	}
+}
+
+func (s *server) handle(c *stream, request *pb.ConverseRequest) error {
+	switch r := request.GetRequest().(type) {
+	case *pb.ConverseRequest_SendMessage:
+		if s.newChatMessageHandler == nil {
+			return fmt.Errorf("no chat message handler provided")
+		}
+
+		chatId, err := parseChatId(r.SendMessage.GetChatId())
+		if err != nil {
+			return err
+		}
+
+		// the chat may not be the user's, its answers are none of the stream's business
+		if s.getChatHandler == nil {
+			return fmt.Errorf("no get chat handler provided")
+		}
+		_, err = s.getChatHandler(c.ctx, chatId)
+		if err != nil {
+			return fmt.Errorf("could not process new chat message: %w", err)
+		}
+
+		// subscribe before prompting, so that no part of the answer is missed
+		subscribed := s.subscribe(c, chatId)
+		err = s.newChatMessageHandler(c.ctx, chatId, []byte(r.SendMessage.GetContent()))
+		if err != nil {
+			if subscribed {
+				s.unsubscribeStream(c, chatId)
+			}
+			return fmt.Errorf("could not process new chat message: %w", err)
+		}
+
+		return nil
+	case *pb.ConverseRequest_CancelAnswer:
+		if s.cancelAnswerHandler == nil {
+			return fmt.Errorf("no cancel answer handler provided")
+		}
+
+		chatId, err := parseChatId(r.CancelAnswer.GetChatId())
+		if err != nil {
+			return err
+		}
+
+		err = s.cancelAnswerHandler(c.ctx, chatId)
+		if err != nil {
+			return fmt.Errorf("could not cancel answer: %w", err)
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("empty request")
+	}
+}
+
+// subscribe sends the answers of the chat to the stream, it returns whether the stream was not subscribed already
+func (s *server) subscribe(c *stream, chatId bot_chat.ChatId) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.subscribers[chatId] == nil {
+		s.subscribers[chatId] = make(map[*stream]struct{})
+	}
+	if _, ok := s.subscribers[chatId][c]; ok {
+		return false
+	}
+	s.subscribers[chatId][c] = struct{}{}
+
+	return true
+}
+
+// unsubscribeStream stops sending the answers of the chat to the stream
+func (s *server) unsubscribeStream(c *stream, chatId bot_chat.ChatId) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	delete(s.subscribers[chatId], c)
+	if len(s.subscribers[chatId]) == 0 {
+		delete(s.subscribers, chatId)
+	}
+}
+
+// unsubscribe stops sending the answers of the chat to any stream
+func (s *server) unsubscribe(chatId bot_chat.ChatId) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	delete(s.subscribers, chatId)
+}
+
+// forget drops the ended stream and its subscriptions
+func (s *server) forget(c *stream) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	delete(s.streams, c)
+	for chatId, streams := range s.subscribers {
+		delete(streams, c)
+		if len(streams) == 0 {
+			delete(s.subscribers, chatId)
+		}
+	}
+}
+
+// stream is a Converse stream of a client
+type stream struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	responses chan *pb.ConverseResponse
+	// closed is closed once the stream is closed
+	closed    chan struct{}
+	closeOnce sync.Once
+	// err is why the stream was closed, if the client did not close it
+	err error
+}
+
+func (c *stream) close() {
+	c.closeWith(nil)
+}
+
+// closeWith closes the stream because of the error
+func (c *stream) closeWith(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		c.cancel()
+		close(c.closed)
+	})
+}
+
+// write queues the response for the client, waiting if the client is slow
+func (c *stream) write(response *pb.ConverseResponse) {
+	select {
+	case c.responses <- response:
+	case <-c.closed:
+	}
+}
+
+// tryWrite queues the response for the client, unless the client is too slow to keep up
+func (c *stream) tryWrite(response *pb.ConverseResponse) bool {
+	select {
+	case c.responses <- response:
+		return true
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func parseChatId(id string) (bot_chat.ChatId, error) {
+	var chatId bot_chat.ChatId
+	err := chatId.UnmarshalText([]byte(id))
+	if err != nil {
+		return bot_chat.ChatId{}, status.Errorf(codes.InvalidArgument, "invalid chat id %q: %s", id, err)
+	}
+
+	return chatId, nil
+}
+
+// chatIdOf returns the chat id the request is about, if any
+func chatIdOf(request *pb.ConverseRequest) string {
+	switch r := request.GetRequest().(type) {
+	case *pb.ConverseRequest_SendMessage:
+		return r.SendMessage.GetChatId()
+	case *pb.ConverseRequest_CancelAnswer:
+		return r.CancelAnswer.GetChatId()
+	default:
+		return ""
+	}
+}
+
+// converseError returns the error of a request of the stream, with the status code its own call would have failed with
+func converseError(chatId string, err error) *pb.ConverseError {
+	converseErr := &pb.ConverseError{
+		ChatId:  chatId,
+		Message: err.Error(),
+		Code:    uint32(status.Code(toStatus(err))),
+	}
+	var rateLimited *bot_ratelimit.RateLimitedError
+	if errors.As(err, &rateLimited) {
+		converseErr.RetryAfter = durationpb.New(rateLimited.RetryAfter)
+	}
+
+	return converseErr
+}
+
+// toStatus maps the errors of the handlers to the gRPC status codes
+func toStatus(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	var rateLimited *bot_ratelimit.RateLimitedError
+	switch {
+	case errors.As(err, &rateLimited):
+		// the clients that retry by the book read when to retry from the RetryInfo
+		st, detailsErr := status.New(codes.ResourceExhausted, err.Error()).WithDetails(&errdetails.RetryInfo{
+			RetryDelay: durationpb.New(rateLimited.RetryAfter),
+		})
+		if detailsErr != nil {
+			return status.Error(codes.ResourceExhausted, err.Error())
+		}
+		return st.Err()
+	case errors.Is(err, bot_auth.ErrUnauthenticated):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, bot_chat.ErrChatNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, bot_prompter.ErrQueueFull):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func toRole(role bot_chat.Role) pb.Role {
+	switch role {
+	case bot_chat.RoleSystem:
+		return pb.Role_ROLE_SYSTEM
+	case bot_chat.RoleUser:
+		return pb.Role_ROLE_USER
+	case bot_chat.RoleAssistant:
+		return pb.Role_ROLE_ASSISTANT
+	default:
+		return pb.Role_ROLE_UNSPECIFIED
+	}
+}
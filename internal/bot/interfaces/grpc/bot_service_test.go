@@ -0,0 +1,334 @@
+package bot_interface_grpc
+
+import (
+	"connectly-interview/internal/bot/domain/bot_auth"
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"connectly-interview/internal/bot/domain/bot_prompter"
+	"connectly-interview/internal/bot/domain/bot_ratelimit"
+	pb "connectly-interview/internal/bot/interfaces/grpc/pb"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type GrpcServerTestSuite struct {
+	suite.Suite
+	server Server
+	client pb.ChatServiceClient
+	m      sync.Mutex
+	chats  map[bot_chat.ChatId][]bot_chat.Turn
+	// messageCtxs are the contexts the messages were handled with
+	messageCtxs []context.Context
+	canceled    []bot_chat.ChatId
+	// authenticator is who authenticates the calls, every call is anonymous by default
+	authenticator bot_auth.Authenticator
+}
+
+func (suite *GrpcServerTestSuite) SetupTest() {
+	suite.chats = make(map[bot_chat.ChatId][]bot_chat.Turn)
+	suite.messageCtxs = nil
+	suite.canceled = nil
+	suite.authenticator = bot_auth.NewAnonymous()
+
+	listener := bufconn.Listen(1024 * 1024)
+	suite.server = New(Args{
+		Listener: listener,
+		AuthenticateHandler: func(token string) (bot_auth.UserId, error) {
+			suite.m.Lock()
+			defer suite.m.Unlock()
+
+			return suite.authenticator.Authenticate(token)
+		},
+		NewChatHandler: func(ctx context.Context) (bot_chat.ChatId, error) {
+			suite.m.Lock()
+			defer suite.m.Unlock()
+
+			chatId := bot_chat.NewChatId()
+			suite.chats[chatId] = []bot_chat.Turn{{Role: bot_chat.RoleSystem, Content: "be nice", CreatedAt: time.Now()}}
+			return chatId, nil
+		},
+		NewChatMessageHandler: func(ctx context.Context, chatId bot_chat.ChatId, msg []byte) error {
+			suite.m.Lock()
+			defer suite.m.Unlock()
+
+			if _, ok := suite.chats[chatId]; !ok {
+				return bot_chat.ErrChatNotFound
+			}
+			if string(msg) == "too often" {
+				return &bot_ratelimit.RateLimitedError{Limit: bot_ratelimit.LimitRequests, RetryAfter: time.Second * 20}
+			}
+			suite.messageCtxs = append(suite.messageCtxs, ctx)
+			return nil
+		},
+		CancelAnswerHandler: func(ctx context.Context, chatId bot_chat.ChatId) error {
+			suite.m.Lock()
+			defer suite.m.Unlock()
+
+			suite.canceled = append(suite.canceled, chatId)
+			return nil
+		},
+		GetHistoryHandler: func(ctx context.Context, chatId bot_chat.ChatId) ([]bot_chat.Turn, error) {
+			suite.m.Lock()
+			defer suite.m.Unlock()
+
+			history, ok := suite.chats[chatId]
+			if !ok {
+				return nil, bot_chat.ErrChatNotFound
+			}
+			return history, nil
+		},
+		DeleteChatHandler: func(ctx context.Context, chatId bot_chat.ChatId) error {
+			suite.m.Lock()
+			defer suite.m.Unlock()
+
+			if _, ok := suite.chats[chatId]; !ok {
+				return bot_chat.ErrChatNotFound
+			}
+			delete(suite.chats, chatId)
+			return nil
+		},
+		GetChatHandler: func(ctx context.Context, chatId bot_chat.ChatId) (*bot_chat.Chat, error) {
+			suite.m.Lock()
+			defer suite.m.Unlock()
+
+			if _, ok := suite.chats[chatId]; !ok {
+				return nil, bot_chat.ErrChatNotFound
+			}
+			return &bot_chat.Chat{}, nil
+		},
+	})
+
+	errs := suite.server.Start()
+	select {
+	case err := <-errs:
+		suite.FailNow("could not start grpc server", err)
+	default:
+	}
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	suite.Require().NoError(err)
+	suite.T().Cleanup(func() { conn.Close() })
+	suite.client = pb.NewChatServiceClient(conn)
+}
+
+func (suite *GrpcServerTestSuite) TearDownTest() {
+	suite.NoError(suite.server.Stop())
+}
+
+func (suite *GrpcServerTestSuite) createChat() string {
+	response, err := suite.client.CreateChat(context.Background(), &pb.CreateChatRequest{})
+	suite.Require().NoError(err)
+	return response.GetChatId()
+}
+
+func (suite *GrpcServerTestSuite) recv(stream pb.ChatService_ConverseClient) *pb.ConverseResponse {
+	responses := make(chan *pb.ConverseResponse, 1)
+	go func() {
+		response, err := stream.Recv()
+		suite.NoError(err)
+		responses <- response
+	}()
+
+	select {
+	case response := <-responses:
+		return response
+	case <-time.After(time.Second * 5):
+		suite.FailNow("no response on the stream")
+		return nil
+	}
+}
+
+func (suite *GrpcServerTestSuite) TestCreateChatAndGetHistory() {
+	chatId := suite.createChat()
+
+	response, err := suite.client.GetHistory(context.Background(), &pb.GetHistoryRequest{ChatId: chatId})
+	suite.Require().NoError(err)
+	suite.Equal(chatId, response.GetChatId())
+	suite.Require().Len(response.GetTurns(), 1)
+	suite.Equal(pb.Role_ROLE_SYSTEM, response.GetTurns()[0].GetRole())
+	suite.Equal("be nice", response.GetTurns()[0].GetContent())
+	suite.NotNil(response.GetTurns()[0].GetCreatedAt())
+}
+
+func (suite *GrpcServerTestSuite) TestErrorCodes() {
+	_, err := suite.client.GetHistory(context.Background(), &pb.GetHistoryRequest{ChatId: "not a uuid"})
+	suite.Equal(codes.InvalidArgument, status.Code(err))
+
+	_, err = suite.client.GetHistory(context.Background(), &pb.GetHistoryRequest{ChatId: bot_chat.NewChatId().String()})
+	suite.Equal(codes.NotFound, status.Code(err))
+
+	chatId := suite.createChat()
+	_, err = suite.client.DeleteChat(context.Background(), &pb.DeleteChatRequest{ChatId: chatId})
+	suite.NoError(err)
+	_, err = suite.client.DeleteChat(context.Background(), &pb.DeleteChatRequest{ChatId: chatId})
+	suite.Equal(codes.NotFound, status.Code(err))
+}
+
+func (suite *GrpcServerTestSuite) TestConverseStreamsAnswersBack() {
+	chatId := suite.createChat()
+	stream, err := suite.client.Converse(context.Background())
+	suite.Require().NoError(err)
+
+	suite.Require().NoError(stream.Send(&pb.ConverseRequest{
+		Request: &pb.ConverseRequest_SendMessage{SendMessage: &pb.SendMessage{ChatId: chatId, Content: "hi"}},
+	}))
+	suite.Eventually(func() bool {
+		suite.m.Lock()
+		defer suite.m.Unlock()
+		return len(suite.messageCtxs) == 1
+	}, time.Second*5, time.Millisecond*10)
+
+	var id bot_chat.ChatId
+	suite.Require().NoError(id.UnmarshalText([]byte(chatId)))
+	suite.NoError(suite.server.Answer(id, "", []byte("hel"), false))
+	suite.NoError(suite.server.Answer(id, "", []byte("hello"), true))
+
+	response := suite.recv(stream)
+	suite.Equal(chatId, response.GetPartialAnswer().GetChatId())
+	suite.Equal("hel", response.GetPartialAnswer().GetDelta())
+
+	response = suite.recv(stream)
+	suite.Equal(chatId, response.GetAnswerEnd().GetChatId())
+	suite.Equal("hello", response.GetAnswerEnd().GetAnswer())
+}
+
+func (suite *GrpcServerTestSuite) TestFailedAnswersEndWithAnError() {
+	chatId := suite.createChat()
+	stream, err := suite.client.Converse(context.Background())
+	suite.Require().NoError(err)
+
+	suite.Require().NoError(stream.Send(&pb.ConverseRequest{
+		Request: &pb.ConverseRequest_SendMessage{SendMessage: &pb.SendMessage{ChatId: chatId, Content: "hi"}},
+	}))
+	suite.Eventually(func() bool {
+		suite.m.Lock()
+		defer suite.m.Unlock()
+		return len(suite.messageCtxs) == 1
+	}, time.Second*5, time.Millisecond*10)
+
+	var id bot_chat.ChatId
+	suite.Require().NoError(id.UnmarshalText([]byte(chatId)))
+	suite.NoError(suite.server.Fail(id, "", bot_prompter.ErrQueueFull))
+
+	response := suite.recv(stream)
+	suite.Require().NotNil(response.GetError())
+	suite.Equal(chatId, response.GetError().GetChatId())
+	suite.Equal(uint32(codes.Unavailable), response.GetError().GetCode())
+}
+
+func (suite *GrpcServerTestSuite) TestConverseErrorsKeepTheStreamOpen() {
+	stream, err := suite.client.Converse(context.Background())
+	suite.Require().NoError(err)
+
+	missing := bot_chat.NewChatId().String()
+	suite.Require().NoError(stream.Send(&pb.ConverseRequest{
+		Request: &pb.ConverseRequest_SendMessage{SendMessage: &pb.SendMessage{ChatId: missing, Content: "hi"}},
+	}))
+	response := suite.recv(stream)
+	suite.Equal(missing, response.GetError().GetChatId())
+	suite.Contains(response.GetError().GetMessage(), bot_chat.ErrChatNotFound.Error())
+	suite.Equal(uint32(codes.NotFound), response.GetError().GetCode())
+
+	chatId := suite.createChat()
+	suite.Require().NoError(stream.Send(&pb.ConverseRequest{
+		Request: &pb.ConverseRequest_SendMessage{SendMessage: &pb.SendMessage{ChatId: chatId, Content: "too often"}},
+	}))
+	response = suite.recv(stream)
+	suite.Equal(uint32(codes.ResourceExhausted), response.GetError().GetCode())
+	suite.Equal(time.Second*20, response.GetError().GetRetryAfter().AsDuration())
+
+	suite.Require().NoError(stream.Send(&pb.ConverseRequest{}))
+	suite.NotNil(suite.recv(stream).GetError())
+
+	suite.Require().NoError(stream.Send(&pb.ConverseRequest{
+		Request: &pb.ConverseRequest_CancelAnswer{CancelAnswer: &pb.CancelAnswer{ChatId: chatId}},
+	}))
+	suite.Eventually(func() bool {
+		suite.m.Lock()
+		defer suite.m.Unlock()
+		return len(suite.canceled) == 1 && suite.canceled[0].String() == chatId
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func (suite *GrpcServerTestSuite) TestMessagesAreCanceledWhenTheStreamEnds() {
+	chatId := suite.createChat()
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := suite.client.Converse(ctx)
+	suite.Require().NoError(err)
+
+	suite.Require().NoError(stream.Send(&pb.ConverseRequest{
+		Request: &pb.ConverseRequest_SendMessage{SendMessage: &pb.SendMessage{ChatId: chatId, Content: "hi"}},
+	}))
+	suite.Eventually(func() bool {
+		suite.m.Lock()
+		defer suite.m.Unlock()
+		return len(suite.messageCtxs) == 1
+	}, time.Second*5, time.Millisecond*10)
+	cancel()
+
+	suite.m.Lock()
+	messageCtx := suite.messageCtxs[0]
+	suite.m.Unlock()
+	select {
+	case <-messageCtx.Done():
+	case <-time.After(time.Second * 5):
+		suite.Fail(fmt.Sprintf("message context of chat %s was not canceled", chatId))
+	}
+}
+
+func (suite *GrpcServerTestSuite) TestCallsAreAuthenticated() {
+	suite.m.Lock()
+	suite.authenticator = bot_auth.NewStaticKeys(map[string]bot_auth.UserId{"key-a": "alice"})
+	suite.m.Unlock()
+
+	_, err := suite.client.CreateChat(context.Background(), &pb.CreateChatRequest{})
+	suite.Equal(codes.Unauthenticated, status.Code(err))
+	_, err = suite.client.CreateChat(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer key-b"), &pb.CreateChatRequest{})
+	suite.Equal(codes.Unauthenticated, status.Code(err))
+
+	stream, err := suite.client.Converse(context.Background())
+	suite.Require().NoError(err)
+	_, err = stream.Recv()
+	suite.Equal(codes.Unauthenticated, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer key-a")
+	response, err := suite.client.CreateChat(ctx, &pb.CreateChatRequest{})
+	suite.Require().NoError(err)
+
+	stream, err = suite.client.Converse(ctx)
+	suite.Require().NoError(err)
+	suite.Require().NoError(stream.Send(&pb.ConverseRequest{
+		Request: &pb.ConverseRequest_SendMessage{SendMessage: &pb.SendMessage{ChatId: response.GetChatId(), Content: "hi"}},
+	}))
+	suite.Eventually(func() bool {
+		suite.m.Lock()
+		defer suite.m.Unlock()
+		return len(suite.messageCtxs) == 1
+	}, time.Second*5, time.Millisecond*10)
+
+	suite.m.Lock()
+	user, err := bot_auth.UserFrom(suite.messageCtxs[0])
+	suite.m.Unlock()
+	suite.NoError(err)
+	suite.Equal(bot_auth.UserId("alice"), user)
+}
+
+func TestGrpcServerTestSuite(t *testing.T) {
+	suite.Run(t, new(GrpcServerTestSuite))
+}
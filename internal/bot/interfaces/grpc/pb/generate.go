@@ -0,0 +1,4 @@
+// Package bot_interface_grpc_pb is the generated code of the bot's gRPC chat service, defined in chat.proto
+package bot_interface_grpc_pb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative chat.proto
@@ -0,0 +1,65 @@
+package bot_interface_http
+
+import (
+	"connectly-interview/internal/bot/domain/bot_auth"
+	bot_interfaces_http_rest "connectly-interview/internal/bot/interfaces/http_server/rest"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// unauthenticatedPaths are the endpoints anyone can read
+var unauthenticatedPaths = map[string]bool{
+	"/ws/schema.json": true,
+}
+
+// authenticate is the middleware that authenticates every request before it reaches the endpoints,
+// and puts the user of the request in its context.
+//
+// The token is the "Authorization: Bearer <token>" header, or the access_token query parameter
+// for the browsers, which can't set headers on websockets and event streams.
+func authenticate(next http.Handler, authenticateHandler func(token string) (bot_auth.UserId, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unauthenticatedPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := authenticateHandler(requestToken(r))
+		if err != nil {
+			fmt.Printf("could not authenticate request %s %s: %s\n", r.Method, r.URL.Path, err)
+			writeUnauthenticated(w)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(bot_auth.WithUser(r.Context(), user)))
+	})
+}
+
+func requestToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+
+	return r.URL.Query().Get("access_token")
+}
+
+// writeUnauthenticated replies with the same error body as the REST API,
+// without telling why the token was not accepted
+func writeUnauthenticated(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+
+	err := json.NewEncoder(w).Encode(bot_interfaces_http_rest.ErrorReply{
+		Error: bot_interfaces_http_rest.Error{
+			Code:    bot_interfaces_http_rest.ErrorCodeUnauthenticated,
+			Message: bot_auth.ErrUnauthenticated.Error(),
+		},
+	})
+	if err != nil {
+		fmt.Printf("could not write unauthenticated reply: %s\n", err)
+	}
+}
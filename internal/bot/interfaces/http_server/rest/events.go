@@ -0,0 +1,353 @@
+package bot_interfaces_http_rest
+
+import (
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// EventLogCapacity is how many of the latest events of a chat are kept for the clients that resume with Last-Event-ID
+	EventLogCapacity = 256
+	// EventRetention is how long the events of a chat nobody listens to are kept
+	EventRetention = time.Minute * 10
+	// EventsHeartbeat is how often a comment is sent on an idle event stream, so that proxies do not close it
+	EventsHeartbeat = time.Second * 15
+	// EventsRetry is how long the clients wait before they reconnect to a closed event stream
+	EventsRetry = time.Second * 3
+	// subscriberBuffer is how many events can wait for a slow client before its stream is closed,
+	// the client then reconnects and resumes from the last event it got
+	subscriberBuffer = 128
+)
+
+// EventType is the type of a server-sent event of a chat
+type EventType string
+
+const (
+	// EventTypeStatus tells what the chat is doing, its data is a StatusEvent
+	EventTypeStatus EventType = "status"
+	// EventTypePartialAnswer is a part of an answer while it's still being compiled, its data is a PartialAnswerEvent
+	EventTypePartialAnswer EventType = "partial_answer"
+	// EventTypeAnswerEnd marks that the answer is over and carries the whole answer, its data is an AnswerEndEvent
+	EventTypeAnswerEnd EventType = "answer_end"
+	// EventTypeAnswerError marks that the answer failed instead of being over, its data is an AnswerErrorEvent
+	EventTypeAnswerError EventType = "answer_error"
+)
+
+type Status string
+
+const (
+	// StatusQueued is sent when a message of the chat is accepted and waits to be answered
+	StatusQueued Status = "queued"
+	// StatusAnswering is sent when the first part of an answer is compiled
+	StatusAnswering Status = "answering"
+	// StatusDone is sent when an answer is over
+	StatusDone Status = "done"
+	// StatusFailed is sent when an answer failed
+	StatusFailed Status = "failed"
+	// StatusEventsLost is sent to a resuming client when some of the events it missed are not kept anymore,
+	// it should read the chat's messages to catch up
+	StatusEventsLost Status = "events_lost"
+)
+
+type StatusEvent struct {
+	ChatId bot_chat.ChatId `json:"chat_id"`
+	Status Status          `json:"status"`
+}
+
+type PartialAnswerEvent struct {
+	ChatId bot_chat.ChatId `json:"chat_id"`
+	Delta  string          `json:"delta"`
+}
+
+type AnswerEndEvent struct {
+	ChatId bot_chat.ChatId `json:"chat_id"`
+	Answer string          `json:"answer"`
+}
+
+type AnswerErrorEvent struct {
+	ChatId bot_chat.ChatId `json:"chat_id"`
+	Error  string          `json:"error"`
+}
+
+type event struct {
+	// id is the position of the event in its chat's events, starting from 1
+	id        uint64
+	eventType EventType
+	data      []byte
+}
+
+// chatEvents are the latest events of a chat and the clients that listen to them
+type chatEvents struct {
+	log         []event
+	nextId      uint64
+	answering   bool
+	subscribers map[*subscriber]struct{}
+	lastEventAt time.Time
+}
+
+type subscriber struct {
+	// events is closed when the client is too slow to keep up or the chat's events are closed
+	events chan event
+}
+
+// events keeps the latest events of each chat and streams them to the clients that listen to them
+type events struct {
+	m     sync.Mutex
+	chats map[bot_chat.ChatId]*chatEvents
+}
+
+func newEvents() *events {
+	return &events{
+		chats: make(map[bot_chat.ChatId]*chatEvents),
+	}
+}
+
+// answer turns a delta of a chat's answer, or the whole answer if it's done, into the chat's events
+func (es *events) answer(chatId bot_chat.ChatId, answer []byte, done bool) {
+	es.m.Lock()
+	defer es.m.Unlock()
+
+	c := es.chat(chatId)
+	if !done {
+		if !c.answering {
+			c.answering = true
+			es.publish(c, EventTypeStatus, StatusEvent{ChatId: chatId, Status: StatusAnswering})
+		}
+		es.publish(c, EventTypePartialAnswer, PartialAnswerEvent{ChatId: chatId, Delta: string(answer)})
+		return
+	}
+
+	c.answering = false
+	es.publish(c, EventTypeAnswerEnd, AnswerEndEvent{ChatId: chatId, Answer: string(answer)})
+	es.publish(c, EventTypeStatus, StatusEvent{ChatId: chatId, Status: StatusDone})
+}
+
+// fail turns the error of a chat's answer that failed into the chat's events
+func (es *events) fail(chatId bot_chat.ChatId, err error) {
+	es.m.Lock()
+	defer es.m.Unlock()
+
+	c := es.chat(chatId)
+	c.answering = false
+	es.publish(c, EventTypeAnswerError, AnswerErrorEvent{ChatId: chatId, Error: err.Error()})
+	es.publish(c, EventTypeStatus, StatusEvent{ChatId: chatId, Status: StatusFailed})
+}
+
+// status sends a status event of the chat
+func (es *events) status(chatId bot_chat.ChatId, status Status) {
+	es.m.Lock()
+	defer es.m.Unlock()
+
+	es.publish(es.chat(chatId), EventTypeStatus, StatusEvent{ChatId: chatId, Status: status})
+}
+
+// subscribe listens to the events of the chat that come after the lastId,
+// replaying the ones that are still kept. Lost is whether some of the events after the lastId are not kept anymore.
+func (es *events) subscribe(chatId bot_chat.ChatId, lastId uint64) (sub *subscriber, replay []event, lost bool) {
+	es.m.Lock()
+	defer es.m.Unlock()
+
+	c := es.chat(chatId)
+	sub = &subscriber{events: make(chan event, subscriberBuffer)}
+	c.subscribers[sub] = struct{}{}
+
+	if lastId == 0 {
+		return sub, nil, false
+	}
+
+	// the ids start over when the bot restarts
+	if lastId >= c.nextId {
+		return sub, append([]event(nil), c.log...), true
+	}
+
+	for _, e := range c.log {
+		if e.id > lastId {
+			replay = append(replay, e)
+		}
+	}
+	oldest := c.nextId
+	if len(c.log) > 0 {
+		oldest = c.log[0].id
+	}
+
+	return sub, replay, oldest > lastId+1
+}
+
+func (es *events) unsubscribe(chatId bot_chat.ChatId, sub *subscriber) {
+	es.m.Lock()
+	defer es.m.Unlock()
+
+	c, ok := es.chats[chatId]
+	if !ok {
+		return
+	}
+	if _, ok := c.subscribers[sub]; ok {
+		delete(c.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// close ends the event streams of the chat and forgets its events, e.g. when the chat is deleted
+func (es *events) close(chatId bot_chat.ChatId) {
+	es.m.Lock()
+	defer es.m.Unlock()
+
+	c, ok := es.chats[chatId]
+	if !ok {
+		return
+	}
+	for sub := range c.subscribers {
+		close(sub.events)
+	}
+	delete(es.chats, chatId)
+}
+
+// closeAll ends all the event streams, e.g. when the server shuts down
+func (es *events) closeAll() {
+	es.m.Lock()
+	chatIds := make([]bot_chat.ChatId, 0, len(es.chats))
+	for chatId := range es.chats {
+		chatIds = append(chatIds, chatId)
+	}
+	es.m.Unlock()
+
+	for _, chatId := range chatIds {
+		es.close(chatId)
+	}
+}
+
+// chat returns the events of the chat, the caller must hold the lock
+func (es *events) chat(chatId bot_chat.ChatId) *chatEvents {
+	c, ok := es.chats[chatId]
+	if !ok {
+		es.sweep()
+		c = &chatEvents{
+			nextId:      1,
+			subscribers: make(map[*subscriber]struct{}),
+			lastEventAt: time.Now(),
+		}
+		es.chats[chatId] = c
+	}
+
+	return c
+}
+
+// publish records the event to the chat's log and sends it to the chat's subscribers,
+// closing the streams of the ones that are too slow to keep up. The caller must hold the lock.
+func (es *events) publish(c *chatEvents, eventType EventType, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		fmt.Printf("could not marshal %s event: %s\n", eventType, err)
+		return
+	}
+
+	e := event{id: c.nextId, eventType: eventType, data: data}
+	c.nextId++
+	c.lastEventAt = time.Now()
+	c.log = append(c.log, e)
+	if len(c.log) > EventLogCapacity {
+		c.log = c.log[len(c.log)-EventLogCapacity:]
+	}
+
+	for sub := range c.subscribers {
+		select {
+		case sub.events <- e:
+		default:
+			delete(c.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// sweep forgets the events of the chats nobody listened to for EventRetention, the caller must hold the lock
+func (es *events) sweep() {
+	idleSince := time.Now().Add(-EventRetention)
+	for chatId, c := range es.chats {
+		if len(c.subscribers) == 0 && c.lastEventAt.Before(idleSince) {
+			delete(es.chats, chatId)
+		}
+	}
+}
+
+// streamEvents serves /chats/{id}/events, streaming the chat's events as server-sent events.
+//
+// A client that reconnects with the Last-Event-ID header, or the last_event_id query parameter,
+// gets the events it missed first, as long as they're still kept.
+func (rest *Rest) streamEvents(w http.ResponseWriter, r *http.Request, chatId bot_chat.ChatId) {
+	if rest.getChatHandler != nil {
+		_, err := rest.getChatHandler(r.Context(), chatId)
+		if err != nil {
+			writeHandlerError(w, fmt.Errorf("could not get chat: %w", err))
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("last_event_id")
+	}
+	var lastId uint64
+	if lastEventId != "" {
+		var err error
+		lastId, err = strconv.ParseUint(lastEventId, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, fmt.Errorf("invalid last event id %q", lastEventId))
+			return
+		}
+	}
+
+	sub, replay, lost := rest.events.subscribe(chatId, lastId)
+	defer rest.events.unsubscribe(chatId, sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// proxies like nginx should not buffer the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", EventsRetry.Milliseconds())
+	if lost {
+		// without an id, so that the client still resumes from the last event it got
+		data, _ := json.Marshal(StatusEvent{ChatId: chatId, Status: StatusEventsLost})
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", EventTypeStatus, data)
+	}
+	for _, e := range replay {
+		writeEvent(w, e)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(EventsHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case e, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			writeEvent(w, e)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprintf(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e event) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.id, e.eventType, e.data)
+}
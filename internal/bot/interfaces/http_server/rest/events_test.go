@@ -0,0 +1,202 @@
+package bot_interfaces_http_rest
+
+import (
+	"bufio"
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"connectly-interview/internal/bot/domain/bot_prompter"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sseEvent is an event read from an event stream
+type sseEvent struct {
+	id        string
+	eventType EventType
+	data      string
+}
+
+// listen opens the event stream of the chat, resuming after the lastEventId if it's not empty
+func (suite *RestTestSuite) listen(chatId bot_chat.ChatId, lastEventId string) *bufio.Reader {
+	ctx, cancel := context.WithCancel(context.Background())
+	suite.T().Cleanup(cancel)
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/chats/%s/events", suite.server.URL, chatId), nil)
+	suite.Require().NoError(err)
+	if lastEventId != "" {
+		request.Header.Set("Last-Event-ID", lastEventId)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	suite.Require().NoError(err)
+	suite.Require().Equal(http.StatusOK, response.StatusCode)
+	suite.Equal("text/event-stream", response.Header.Get("Content-Type"))
+	suite.T().Cleanup(func() { response.Body.Close() })
+
+	return bufio.NewReader(response.Body)
+}
+
+// next reads the next event of the stream, skipping the retry field and the comments
+func (suite *RestTestSuite) next(stream *bufio.Reader) sseEvent {
+	events := make(chan sseEvent, 1)
+	go func() {
+		var e sseEvent
+		for {
+			line, err := stream.ReadString('\n')
+			if err != nil {
+				close(events)
+				return
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" {
+				if e.eventType != "" {
+					events <- e
+					return
+				}
+				continue
+			}
+
+			field, value, _ := strings.Cut(line, ": ")
+			switch field {
+			case "id":
+				e.id = value
+			case "event":
+				e.eventType = EventType(value)
+			case "data":
+				e.data = value
+			}
+		}
+	}()
+
+	select {
+	case e, ok := <-events:
+		suite.Require().True(ok, "event stream is closed")
+		return e
+	case <-time.After(time.Second * 5):
+		suite.FailNow("no event on the stream")
+		return sseEvent{}
+	}
+}
+
+func (suite *RestTestSuite) status(e sseEvent) Status {
+	suite.Require().Equal(EventTypeStatus, e.eventType)
+	var status StatusEvent
+	suite.Require().NoError(json.Unmarshal([]byte(e.data), &status))
+	return status.Status
+}
+
+func (suite *RestTestSuite) TestEventsStreamTheAnswers() {
+	chatId := suite.createChat()
+	stream := suite.listen(chatId, "")
+
+	suite.Equal(http.StatusOK, suite.do(http.MethodPost, fmt.Sprintf("/chats/%s/messages", chatId), `{"content":"hello"}`, nil))
+
+	suite.Equal(StatusQueued, suite.status(suite.next(stream)))
+	suite.Equal(StatusAnswering, suite.status(suite.next(stream)))
+
+	e := suite.next(stream)
+	suite.Equal(EventTypePartialAnswer, e.eventType)
+	var partial PartialAnswerEvent
+	suite.NoError(json.Unmarshal([]byte(e.data), &partial))
+	suite.Equal("h", partial.Delta)
+
+	e = suite.next(stream)
+	suite.Equal(EventTypeAnswerEnd, e.eventType)
+	var end AnswerEndEvent
+	suite.NoError(json.Unmarshal([]byte(e.data), &end))
+	suite.Equal(chatId, end.ChatId)
+	suite.Equal("hello", end.Answer)
+
+	e = suite.next(stream)
+	suite.Equal(StatusDone, suite.status(e))
+	suite.Equal("5", e.id)
+}
+
+func (suite *RestTestSuite) TestEventsOfFailedAnswers() {
+	chatId := suite.createChat()
+	suite.answer = func(promptId bot_chat.PromptId, chatId bot_chat.ChatId, msg []byte) error {
+		go suite.rest.Fail(chatId, promptId, bot_prompter.ErrQueueFull)
+		return nil
+	}
+	stream := suite.listen(chatId, "")
+
+	suite.Equal(http.StatusServiceUnavailable, suite.do(http.MethodPost, fmt.Sprintf("/chats/%s/messages", chatId), `{"content":"hello"}`, nil))
+
+	suite.Equal(StatusQueued, suite.status(suite.next(stream)))
+
+	e := suite.next(stream)
+	suite.Equal(EventTypeAnswerError, e.eventType)
+	var answerErr AnswerErrorEvent
+	suite.NoError(json.Unmarshal([]byte(e.data), &answerErr))
+	suite.Equal(chatId, answerErr.ChatId)
+	suite.Contains(answerErr.Error, bot_prompter.ErrQueueFull.Error())
+
+	suite.Equal(StatusFailed, suite.status(suite.next(stream)))
+}
+
+func (suite *RestTestSuite) TestEventsResumeAfterTheLastEventId() {
+	chatId := suite.createChat()
+	// queued, answering, partial answer, answer end and done
+	suite.Equal(http.StatusOK, suite.do(http.MethodPost, fmt.Sprintf("/chats/%s/messages", chatId), `{"content":"hello"}`, nil))
+	suite.Eventually(func() bool {
+		suite.rest.events.m.Lock()
+		defer suite.rest.events.m.Unlock()
+		return suite.rest.events.chats[chatId].nextId == 6
+	}, time.Second*5, time.Millisecond*10)
+
+	stream := suite.listen(chatId, "3")
+	e := suite.next(stream)
+	suite.Equal("4", e.id)
+	suite.Equal(EventTypeAnswerEnd, e.eventType)
+	suite.Equal("5", suite.next(stream).id)
+}
+
+func (suite *RestTestSuite) TestEventsLostAreReported() {
+	chatId := suite.createChat()
+	suite.rest.Queued(chatId)
+
+	// an id the bot does not know of, e.g. from before it restarted
+	stream := suite.listen(chatId, "100")
+	e := suite.next(stream)
+	suite.Equal(StatusEventsLost, suite.status(e))
+	suite.Empty(e.id)
+
+	e = suite.next(stream)
+	suite.Equal("1", e.id)
+	suite.Equal(StatusQueued, suite.status(e))
+}
+
+func (suite *RestTestSuite) TestEventsOfUnknownChat() {
+	var reply ErrorReply
+	suite.Equal(http.StatusNotFound, suite.do(http.MethodGet, fmt.Sprintf("/chats/%s/events", bot_chat.NewChatId()), "", &reply))
+	suite.Equal(ErrorCodeNotFound, reply.Error.Code)
+
+	suite.Equal(http.StatusBadRequest, suite.do(http.MethodGet, fmt.Sprintf("/chats/%s/events?last_event_id=x", suite.createChat()), "", &reply))
+	suite.Equal(ErrorCodeInvalidRequest, reply.Error.Code)
+}
+
+func (suite *RestTestSuite) TestEventStreamsEndWhenTheChatIsDeleted() {
+	chatId := suite.createChat()
+	stream := suite.listen(chatId, "")
+
+	suite.Equal(http.StatusNoContent, suite.do(http.MethodDelete, "/chats/"+chatId.String(), "", nil))
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			_, err := stream.ReadString('\n')
+			if err != nil {
+				close(done)
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		suite.Fail("event stream was not closed")
+	}
+}
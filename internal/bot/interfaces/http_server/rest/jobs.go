@@ -0,0 +1,194 @@
+package bot_interfaces_http_rest
+
+import (
+	"connectly-interview/internal/bot/domain/bot_auth"
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// JobRetention is how long a finished job can still be read before it's forgotten
+const JobRetention = time.Minute * 10
+
+type JobStatus string
+
+const (
+	// JobStatusQueued is a message that waits for a worker to answer it
+	JobStatusQueued JobStatus = "queued"
+	// JobStatusRunning is a message whose answer is being compiled
+	JobStatusRunning JobStatus = "running"
+	// JobStatusDone is a message that has been answered
+	JobStatusDone JobStatus = "done"
+	// JobStatusCanceled is a message whose answer was canceled before it was over, the answer is what was compiled until then
+	JobStatusCanceled JobStatus = "canceled"
+	// JobStatusFailed is a message whose answer could not be compiled, its error says why
+	JobStatusFailed JobStatus = "failed"
+)
+
+// job is a message sent to a chat through the API, until it's answered
+type job struct {
+	id     string
+	chatId bot_chat.ChatId
+	// promptId is the id the message is sent with, its answer comes back with it
+	promptId bot_chat.PromptId
+	// owner is the user that sent the message, the only one that can read the job
+	owner bot_auth.UserId
+	// ctx is the context the message was handled with
+	ctx        context.Context
+	createdAt  time.Time
+	status     JobStatus
+	answer     string
+	finishedAt time.Time
+	// done is closed once the message is answered
+	done chan struct{}
+	// err is why the answer failed, it's set before done is closed and never changes afterwards
+	err error
+}
+
+func newJob(ctx context.Context, owner bot_auth.UserId, chatId bot_chat.ChatId) *job {
+	return &job{
+		id:        uuid.NewString(),
+		chatId:    chatId,
+		promptId:  bot_chat.NewPromptId(),
+		owner:     owner,
+		ctx:       ctx,
+		createdAt: time.Now(),
+		status:    JobStatusQueued,
+		done:      make(chan struct{}),
+	}
+}
+
+// view returns what the client sees of the job, the caller must hold the jobs lock
+func (j *job) view() Job {
+	view := Job{
+		Id:        j.id,
+		ChatId:    j.chatId,
+		Status:    j.status,
+		Answer:    j.answer,
+		CreatedAt: j.createdAt,
+	}
+	if !j.finishedAt.IsZero() {
+		finishedAt := j.finishedAt
+		view.FinishedAt = &finishedAt
+	}
+	if j.err != nil {
+		view.Error = j.err.Error()
+	}
+
+	return view
+}
+
+// jobs keeps the messages sent through the API and matches them with their answers by the id of their prompt,
+// since the other interfaces can send messages to the same chats
+type jobs struct {
+	m    sync.Mutex
+	byId map[string]*job
+	// pending are the jobs that wait for their answer
+	pending map[bot_chat.PromptId]*job
+}
+
+func newJobs() *jobs {
+	return &jobs{
+		byId:    make(map[string]*job),
+		pending: make(map[bot_chat.PromptId]*job),
+	}
+}
+
+// send creates a job for the message of the chat and sends the message with the handler,
+// with the id of the job's prompt in the context. The job is dropped if the message could not be sent.
+func (js *jobs) send(ctx context.Context, owner bot_auth.UserId, chatId bot_chat.ChatId, handler func(ctx context.Context) error) (*job, error) {
+	j := newJob(ctx, owner, chatId)
+	js.m.Lock()
+	js.sweep()
+	js.byId[j.id] = j
+	js.pending[j.promptId] = j
+	js.m.Unlock()
+
+	err := handler(bot_chat.WithPromptId(ctx, j.promptId))
+	if err != nil {
+		js.m.Lock()
+		delete(js.byId, j.id)
+		delete(js.pending, j.promptId)
+		js.m.Unlock()
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// answer hands a delta of an answer, or the whole answer if it's done, to the job of its prompt, if there's one
+func (js *jobs) answer(promptId bot_chat.PromptId, answer []byte, done bool) {
+	js.m.Lock()
+	defer js.m.Unlock()
+
+	j, ok := js.pending[promptId]
+	if !ok {
+		return
+	}
+
+	if !done {
+		j.status = JobStatusRunning
+		return
+	}
+
+	delete(js.pending, promptId)
+
+	j.status = JobStatusDone
+	if j.ctx.Err() != nil {
+		j.status = JobStatusCanceled
+	}
+	j.answer = string(answer)
+	j.finishedAt = time.Now()
+	close(j.done)
+}
+
+// fail ends the job of the prompt with the error its answer failed with, if there's one
+func (js *jobs) fail(promptId bot_chat.PromptId, err error) {
+	js.m.Lock()
+	defer js.m.Unlock()
+
+	j, ok := js.pending[promptId]
+	if !ok {
+		return
+	}
+	delete(js.pending, promptId)
+
+	j.status = JobStatusFailed
+	j.err = err
+	j.finishedAt = time.Now()
+	close(j.done)
+}
+
+// get returns what the client sees of the job, if the job belongs to the user
+func (js *jobs) get(id string, user bot_auth.UserId) (Job, bool) {
+	js.m.Lock()
+	defer js.m.Unlock()
+
+	j, ok := js.byId[id]
+	if !ok || j.owner != user {
+		return Job{}, false
+	}
+
+	return j.view(), true
+}
+
+// view returns what the client sees of the job
+func (js *jobs) view(j *job) Job {
+	js.m.Lock()
+	defer js.m.Unlock()
+
+	return j.view()
+}
+
+// sweep forgets the jobs that finished more than JobRetention ago, the caller must hold the lock
+func (js *jobs) sweep() {
+	finishedSince := time.Now().Add(-JobRetention)
+	for id, j := range js.byId {
+		if !j.finishedAt.IsZero() && j.finishedAt.Before(finishedSince) {
+			delete(js.byId, id)
+		}
+	}
+}
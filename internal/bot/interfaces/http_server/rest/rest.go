@@ -0,0 +1,680 @@
+// Package bot_interfaces_http_rest is a JSON REST API handler for the http mux,
+// for the clients that talk to the bot with plain requests instead of holding a websocket open.
+//
+//	POST   /chats                    creates a chat
+//	GET    /chats                    lists the chats
+//	GET    /chats/{id}               returns a chat
+//	DELETE /chats/{id}               deletes a chat
+//	GET    /chats/{id}/messages      returns the messages of a chat, paginated with ?offset= and ?limit=
+//	POST   /chats/{id}/messages      sends a message and waits for its answer, or with ?async=true returns a job right away
+//	GET    /chats/{id}/events        streams the answers and the status of a chat as server-sent events
+//	GET    /chats/{id}/usage         returns what the messages of a chat cost
+//	GET    /jobs/{id}                returns a job, with the answer once it's done
+//	GET    /usage                    returns what the messages of the user cost, by model and by chat
+//
+// The requests have to be authenticated before they reach the API, with bot_auth.WithUser on their context,
+// and a job can only be read by the user that sent its message.
+//
+// Every error is replied with an ErrorReply body.
+package bot_interfaces_http_rest
+
+import (
+	"connectly-interview/internal/bot/domain/bot_auth"
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"connectly-interview/internal/bot/domain/bot_prompter"
+	"connectly-interview/internal/bot/domain/bot_ratelimit"
+	"connectly-interview/internal/bot/domain/bot_usage"
+	"connectly-interview/internal/bot/infrastructure/llm"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MaxRequestSize is the biggest request body the API accepts
+	MaxRequestSize = 1024 * 1024 // 1 MB
+	// DefaultPageLimit is how many messages are returned when the client does not ask for a limit
+	DefaultPageLimit = 50
+	// MaxPageLimit is the most messages that are returned at once
+	MaxPageLimit = 200
+)
+
+// ErrorCode is a machine readable code of an ErrorReply
+type ErrorCode string
+
+const (
+	ErrorCodeInvalidRequest   ErrorCode = "invalid_request"
+	ErrorCodeNotFound         ErrorCode = "not_found"
+	ErrorCodeMethodNotAllowed ErrorCode = "method_not_allowed"
+	// ErrorCodeOverloaded is replied when the bot is too busy to take the message, the client should retry later
+	ErrorCodeOverloaded ErrorCode = "overloaded"
+	// ErrorCodeCanceled is replied when the message was canceled before it was answered
+	ErrorCodeCanceled ErrorCode = "canceled"
+	// ErrorCodeRateLimited is replied when the user sent too many messages or spent too many tokens,
+	// the client should retry after the RetryAfter of the error
+	ErrorCodeRateLimited ErrorCode = "rate_limited"
+	// ErrorCodeUnauthenticated is replied when the request has no token, or one that's not accepted
+	ErrorCodeUnauthenticated ErrorCode = "unauthenticated"
+	ErrorCodeInternal        ErrorCode = "internal"
+)
+
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// RetryAfter is how many seconds the client should wait before it retries, when it's rate limited
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// ErrorReply is the body of every error of the API
+type ErrorReply struct {
+	Error Error `json:"error"`
+}
+
+type Chat struct {
+	ChatId     bot_chat.ChatId `json:"chat_id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	LastUsedAt time.Time       `json:"last_used_at"`
+	// Messages is how many messages the chat has
+	Messages int `json:"messages"`
+}
+
+type Chats struct {
+	Chats []bot_chat.ChatId `json:"chats"`
+}
+
+type Message struct {
+	Role      bot_chat.Role `json:"role"`
+	Content   string        `json:"content"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+// Messages is a page of the messages of a chat, oldest first
+type Messages struct {
+	ChatId   bot_chat.ChatId `json:"chat_id"`
+	Messages []Message       `json:"messages"`
+	// Total is how many messages the chat has
+	Total  int `json:"total"`
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+	// NextOffset is the offset of the next page, if there is one
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+// NewMessage is the body of a message sent to a chat
+type NewMessage struct {
+	Content string `json:"content"`
+}
+
+// Job is a message sent to a chat, with its answer once it's done
+type Job struct {
+	Id         string          `json:"job_id"`
+	ChatId     bot_chat.ChatId `json:"chat_id"`
+	Status     JobStatus       `json:"status"`
+	Answer     string          `json:"answer,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+	// Error is why the answer failed, when the job failed
+	Error string `json:"error,omitempty"`
+}
+
+// Usage is what the messages sent to the model cost
+type Usage struct {
+	Requests         int `json:"requests"`
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+	// Cost is in dollars
+	Cost float64 `json:"cost"`
+	// Unpriced is how many of the messages were sent to models without a price, which are not part of the cost
+	Unpriced int `json:"unpriced"`
+}
+
+// ChatUsage is what the messages of a chat cost
+type ChatUsage struct {
+	ChatId bot_chat.ChatId `json:"chat_id"`
+	Usage
+}
+
+// UsageReport is what the messages of the user cost, in total and broken down by model and by chat
+type UsageReport struct {
+	User bot_auth.UserId `json:"user"`
+	Usage
+	Models map[bot_infrastructure_llm.Model]Usage `json:"models"`
+	Chats  map[bot_chat.ChatId]Usage              `json:"chats"`
+}
+
+type Rest struct {
+	ctx    context.Context
+	jobs   *jobs
+	events *events
+
+	newChatHandler        func(ctx context.Context) (bot_chat.ChatId, error)
+	newChatMessageHandler func(ctx context.Context, chatId bot_chat.ChatId, msg []byte) error
+	getChatHandler        func(ctx context.Context, chatId bot_chat.ChatId) (*bot_chat.Chat, error)
+	getHistoryHandler     func(ctx context.Context, chatId bot_chat.ChatId) ([]bot_chat.Turn, error)
+	listChatsHandler      func(ctx context.Context) ([]bot_chat.ChatId, error)
+	deleteChatHandler     func(ctx context.Context, chatId bot_chat.ChatId) error
+	getUsageHandler       func(ctx context.Context) (bot_usage.Report, error)
+	getChatUsageHandler   func(ctx context.Context, chatId bot_chat.ChatId) (bot_usage.Totals, error)
+}
+
+type Args struct {
+	// Context is what the messages sent with ?async=true are handled with, since they outlive their requests
+	Context context.Context
+	// The handlers are called with the context of the request, which carries the user the request was authenticated as
+	NewChatHandler func(ctx context.Context) (bot_chat.ChatId, error)
+	// NewChatMessageHandler is called with the context of the request the message came from,
+	// which is done when the client goes away, unless the message is sent with ?async=true
+	NewChatMessageHandler func(ctx context.Context, chatId bot_chat.ChatId, msg []byte) error
+	GetChatHandler        func(ctx context.Context, chatId bot_chat.ChatId) (*bot_chat.Chat, error)
+	GetHistoryHandler     func(ctx context.Context, chatId bot_chat.ChatId) ([]bot_chat.Turn, error)
+	ListChatsHandler      func(ctx context.Context) ([]bot_chat.ChatId, error)
+	DeleteChatHandler     func(ctx context.Context, chatId bot_chat.ChatId) error
+	GetUsageHandler       func(ctx context.Context) (bot_usage.Report, error)
+	GetChatUsageHandler   func(ctx context.Context, chatId bot_chat.ChatId) (bot_usage.Totals, error)
+}
+
+func New(args Args) *Rest {
+	if args.Context == nil {
+		args.Context = context.Background()
+	}
+
+	return &Rest{
+		ctx:                   args.Context,
+		jobs:                  newJobs(),
+		events:                newEvents(),
+		newChatHandler:        args.NewChatHandler,
+		newChatMessageHandler: args.NewChatMessageHandler,
+		getChatHandler:        args.GetChatHandler,
+		getHistoryHandler:     args.GetHistoryHandler,
+		listChatsHandler:      args.ListChatsHandler,
+		deleteChatHandler:     args.DeleteChatHandler,
+		getUsageHandler:       args.GetUsageHandler,
+		getChatUsageHandler:   args.GetChatUsageHandler,
+	}
+}
+
+// Register adds the endpoints of the API to the mux
+func (rest *Rest) Register(m *http.ServeMux) {
+	m.HandleFunc("/chats", rest.handleChats)
+	m.HandleFunc("/chats/", rest.handleChat)
+	m.HandleFunc("/jobs/", rest.handleJob)
+	m.HandleFunc("/usage", rest.handleUsage)
+}
+
+// Answer hands a delta of a chat's answer, or the whole answer if it's done, to the message that waits for it
+// and to the clients that listen to the chat's events
+func (rest *Rest) Answer(chatId bot_chat.ChatId, promptId bot_chat.PromptId, answer []byte, done bool) error {
+	rest.jobs.answer(promptId, answer, done)
+	rest.events.answer(chatId, answer, done)
+	return nil
+}
+
+// Fail fails the message that waits for a chat's answer that failed with the error,
+// and tells the clients that listen to the chat's events
+func (rest *Rest) Fail(chatId bot_chat.ChatId, promptId bot_chat.PromptId, err error) error {
+	rest.jobs.fail(promptId, err)
+	rest.events.fail(chatId, err)
+	return nil
+}
+
+// Queued tells the clients that listen to the chat's events that a message of the chat is waiting to be answered,
+// whichever interface the message came through
+func (rest *Rest) Queued(chatId bot_chat.ChatId) {
+	rest.events.status(chatId, StatusQueued)
+}
+
+// Close ends the event streams, which would otherwise keep the server from shutting down
+func (rest *Rest) Close() {
+	rest.events.closeAll()
+}
+
+// handleChats serves /chats
+func (rest *Rest) handleChats(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		rest.createChat(w, r)
+	case http.MethodGet:
+		rest.listChats(w, r)
+	default:
+		writeMethodNotAllowed(w, http.MethodPost, http.MethodGet)
+	}
+}
+
+// handleChat serves /chats/{id}, /chats/{id}/messages, /chats/{id}/events and /chats/{id}/usage
+func (rest *Rest) handleChat(w http.ResponseWriter, r *http.Request) {
+	id, resource, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/chats/"), "/")
+	chatId, err := parseChatId(id)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err)
+		return
+	}
+
+	switch resource {
+	case "":
+		switch r.Method {
+		case http.MethodGet:
+			rest.getChat(w, r, chatId)
+		case http.MethodDelete:
+			rest.deleteChat(w, r, chatId)
+		default:
+			writeMethodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		}
+	case "messages":
+		switch r.Method {
+		case http.MethodGet:
+			rest.getMessages(w, r, chatId)
+		case http.MethodPost:
+			rest.sendMessage(w, r, chatId)
+		default:
+			writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+	case "events":
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		rest.streamEvents(w, r, chatId)
+	case "usage":
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		rest.getChatUsage(w, r, chatId)
+	default:
+		writeError(w, http.StatusNotFound, ErrorCodeNotFound, fmt.Errorf("unknown resource %q", r.URL.Path))
+	}
+}
+
+// handleJob serves /jobs/{id}
+func (rest *Rest) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	user, err := bot_auth.UserFrom(r.Context())
+	if err != nil {
+		writeHandlerError(w, err)
+		return
+	}
+
+	// the jobs of the other users are not found, like their chats
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	job, ok := rest.jobs.get(id, user)
+	if !ok {
+		writeError(w, http.StatusNotFound, ErrorCodeNotFound, fmt.Errorf("job %q not found", id))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
+
+// handleUsage serves /usage
+func (rest *Rest) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	if rest.getUsageHandler == nil {
+		writeHandlerError(w, fmt.Errorf("no get usage handler provided"))
+		return
+	}
+
+	report, err := rest.getUsageHandler(r.Context())
+	if err != nil {
+		writeHandlerError(w, fmt.Errorf("could not get usage: %w", err))
+		return
+	}
+
+	usageReport := UsageReport{
+		User:   report.User,
+		Usage:  toUsage(report.Totals),
+		Models: make(map[bot_infrastructure_llm.Model]Usage, len(report.Models)),
+		Chats:  make(map[bot_chat.ChatId]Usage, len(report.Chats)),
+	}
+	for model, totals := range report.Models {
+		usageReport.Models[model] = toUsage(totals)
+	}
+	for chatId, totals := range report.Chats {
+		usageReport.Chats[chatId] = toUsage(totals)
+	}
+
+	writeJSON(w, http.StatusOK, usageReport)
+}
+
+func (rest *Rest) createChat(w http.ResponseWriter, r *http.Request) {
+	if rest.newChatHandler == nil {
+		writeHandlerError(w, fmt.Errorf("no new chat handler provided"))
+		return
+	}
+
+	chatId, err := rest.newChatHandler(r.Context())
+	if err != nil {
+		writeHandlerError(w, fmt.Errorf("could not create new chat: %w", err))
+		return
+	}
+
+	chat := Chat{ChatId: chatId}
+	if rest.getChatHandler != nil {
+		c, err := rest.getChatHandler(r.Context(), chatId)
+		if err == nil {
+			chat = toChat(c)
+		}
+	}
+
+	w.Header().Set("Location", "/chats/"+chatId.String())
+	writeJSON(w, http.StatusCreated, chat)
+}
+
+func (rest *Rest) listChats(w http.ResponseWriter, r *http.Request) {
+	if rest.listChatsHandler == nil {
+		writeHandlerError(w, fmt.Errorf("no list chats handler provided"))
+		return
+	}
+
+	chats, err := rest.listChatsHandler(r.Context())
+	if err != nil {
+		writeHandlerError(w, fmt.Errorf("could not list chats: %w", err))
+		return
+	}
+	if chats == nil {
+		chats = []bot_chat.ChatId{}
+	}
+
+	writeJSON(w, http.StatusOK, Chats{Chats: chats})
+}
+
+func (rest *Rest) getChat(w http.ResponseWriter, r *http.Request, chatId bot_chat.ChatId) {
+	if rest.getChatHandler == nil {
+		writeHandlerError(w, fmt.Errorf("no get chat handler provided"))
+		return
+	}
+
+	chat, err := rest.getChatHandler(r.Context(), chatId)
+	if err != nil {
+		writeHandlerError(w, fmt.Errorf("could not get chat: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, toChat(chat))
+}
+
+func (rest *Rest) deleteChat(w http.ResponseWriter, r *http.Request, chatId bot_chat.ChatId) {
+	if rest.deleteChatHandler == nil {
+		writeHandlerError(w, fmt.Errorf("no delete chat handler provided"))
+		return
+	}
+
+	err := rest.deleteChatHandler(r.Context(), chatId)
+	if err != nil {
+		writeHandlerError(w, fmt.Errorf("could not delete chat: %w", err))
+		return
+	}
+	rest.events.close(chatId)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rest *Rest) getMessages(w http.ResponseWriter, r *http.Request, chatId bot_chat.ChatId) {
+	if rest.getHistoryHandler == nil {
+		writeHandlerError(w, fmt.Errorf("no get history handler provided"))
+		return
+	}
+
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err)
+		return
+	}
+	limit, err := queryInt(r, "limit", DefaultPageLimit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err)
+		return
+	}
+	if limit == 0 || limit > MaxPageLimit {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, fmt.Errorf("limit should be between 1 and %d", MaxPageLimit))
+		return
+	}
+
+	history, err := rest.getHistoryHandler(r.Context(), chatId)
+	if err != nil {
+		writeHandlerError(w, fmt.Errorf("could not get chat history: %w", err))
+		return
+	}
+
+	page := Messages{
+		ChatId:   chatId,
+		Messages: []Message{},
+		Total:    len(history),
+		Offset:   offset,
+		Limit:    limit,
+	}
+	if offset < len(history) {
+		end := min(offset+limit, len(history))
+		for _, turn := range history[offset:end] {
+			page.Messages = append(page.Messages, Message{
+				Role:      turn.Role,
+				Content:   turn.Content,
+				CreatedAt: turn.CreatedAt,
+			})
+		}
+		if end < len(history) {
+			page.NextOffset = &end
+		}
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// sendMessage sends the message to the chat and replies with its job once it's answered,
+// or right away if the message is sent with ?async=true
+func (rest *Rest) sendMessage(w http.ResponseWriter, r *http.Request, chatId bot_chat.ChatId) {
+	if rest.newChatMessageHandler == nil {
+		writeHandlerError(w, fmt.Errorf("no chat message handler provided"))
+		return
+	}
+
+	async, err := queryBool(r, "async")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err)
+		return
+	}
+
+	var msg NewMessage
+	err = decodeJSON(w, r, &msg)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, err)
+		return
+	}
+	if msg.Content == "" {
+		writeError(w, http.StatusBadRequest, ErrorCodeInvalidRequest, fmt.Errorf("message content is empty"))
+		return
+	}
+
+	user, err := bot_auth.UserFrom(r.Context())
+	if err != nil {
+		writeHandlerError(w, err)
+		return
+	}
+
+	// the answer of an async message outlives the request, but it's still sent as the request's user
+	ctx := r.Context()
+	if async {
+		ctx = bot_auth.WithUser(rest.ctx, user)
+	}
+
+	job, err := rest.jobs.send(ctx, user, chatId, func(ctx context.Context) error {
+		return rest.newChatMessageHandler(ctx, chatId, []byte(msg.Content))
+	})
+	if err != nil {
+		writeHandlerError(w, fmt.Errorf("could not process new chat message: %w", err))
+		return
+	}
+
+	if async {
+		w.Header().Set("Location", "/jobs/"+job.id)
+		writeJSON(w, http.StatusAccepted, rest.jobs.view(job))
+		return
+	}
+
+	select {
+	case <-job.done:
+	case <-r.Context().Done():
+		// the client went away, the message is canceled with the request's context
+		return
+	}
+
+	view := rest.jobs.view(job)
+	if view.Status == JobStatusFailed {
+		writeHandlerError(w, fmt.Errorf("could not answer message: %w", job.err))
+		return
+	}
+	if view.Status == JobStatusCanceled {
+		writeError(w, http.StatusServiceUnavailable, ErrorCodeCanceled, fmt.Errorf("the answer was canceled before it was over"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, view)
+}
+
+func (rest *Rest) getChatUsage(w http.ResponseWriter, r *http.Request, chatId bot_chat.ChatId) {
+	if rest.getChatUsageHandler == nil {
+		writeHandlerError(w, fmt.Errorf("no get chat usage handler provided"))
+		return
+	}
+
+	totals, err := rest.getChatUsageHandler(r.Context(), chatId)
+	if err != nil {
+		writeHandlerError(w, fmt.Errorf("could not get chat usage: %w", err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ChatUsage{ChatId: chatId, Usage: toUsage(totals)})
+}
+
+func toUsage(totals bot_usage.Totals) Usage {
+	return Usage{
+		Requests:         totals.Requests,
+		PromptTokens:     totals.PromptTokens,
+		CompletionTokens: totals.CompletionTokens,
+		TotalTokens:      totals.TotalTokens,
+		Cost:             totals.Cost,
+		Unpriced:         totals.Unpriced,
+	}
+}
+
+func toChat(chat *bot_chat.Chat) Chat {
+	return Chat{
+		ChatId:     chat.Id(),
+		CreatedAt:  chat.CreatedAt(),
+		LastUsedAt: chat.LastUsedAt(),
+		Messages:   len(chat.History()),
+	}
+}
+
+func parseChatId(id string) (bot_chat.ChatId, error) {
+	var chatId bot_chat.ChatId
+	err := chatId.UnmarshalText([]byte(id))
+	if err != nil {
+		return bot_chat.ChatId{}, fmt.Errorf("invalid chat id %q: %w", id, err)
+	}
+
+	return chatId, nil
+}
+
+// queryInt returns the non negative integer of the query parameter, or the default value if there's none
+func queryInt(r *http.Request, name string, defaultValue int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("%s should be a non negative integer, got %q", name, value)
+	}
+
+	return i, nil
+}
+
+func queryBool(r *http.Request, name string) (bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s should be a boolean, got %q", name, value)
+	}
+
+	return b, nil
+}
+
+// decodeJSON decodes the request's body strictly, rejecting unknown fields and trailing data
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxRequestSize))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(v)
+	if err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	if decoder.More() {
+		return fmt.Errorf("invalid request body: more than one json value")
+	}
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		fmt.Printf("could not write rest reply: %s\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code ErrorCode, err error) {
+	writeJSON(w, status, ErrorReply{Error: Error{Code: code, Message: err.Error()}})
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, ErrorCodeMethodNotAllowed, fmt.Errorf("method not allowed, use one of %s", strings.Join(allowed, ", ")))
+}
+
+// writeHandlerError replies with the status of the handler's error
+func writeHandlerError(w http.ResponseWriter, err error) {
+	var rateLimited *bot_ratelimit.RateLimitedError
+	switch {
+	case errors.Is(err, bot_auth.ErrUnauthenticated):
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, ErrorCodeUnauthenticated, err)
+	case errors.Is(err, bot_chat.ErrChatNotFound):
+		writeError(w, http.StatusNotFound, ErrorCodeNotFound, err)
+	case errors.Is(err, bot_prompter.ErrQueueFull):
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusServiceUnavailable, ErrorCodeOverloaded, err)
+	case errors.As(err, &rateLimited):
+		retryAfter := rateLimited.RetryAfterSeconds()
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeJSON(w, http.StatusTooManyRequests, ErrorReply{Error: Error{
+			Code:       ErrorCodeRateLimited,
+			Message:    err.Error(),
+			RetryAfter: retryAfter,
+		}})
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		writeError(w, http.StatusServiceUnavailable, ErrorCodeCanceled, err)
+	default:
+		writeError(w, http.StatusInternalServerError, ErrorCodeInternal, err)
+	}
+}
@@ -0,0 +1,421 @@
+package bot_interfaces_http_rest
+
+import (
+	"bytes"
+	"connectly-interview/internal/bot/domain/bot_auth"
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"connectly-interview/internal/bot/domain/bot_prompter"
+	"connectly-interview/internal/bot/domain/bot_ratelimit"
+	"connectly-interview/internal/bot/domain/bot_usage"
+	"connectly-interview/internal/bot/infrastructure/llm"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RestTestSuite struct {
+	suite.Suite
+	server *httptest.Server
+	rest   *Rest
+	m      sync.Mutex
+	chats  map[bot_chat.ChatId]*bot_chat.Chat
+	// answer is how the handler answers each message, by default it echoes it back
+	answer func(promptId bot_chat.PromptId, chatId bot_chat.ChatId, msg []byte) error
+	// user is who the requests are authenticated as
+	user bot_auth.UserId
+	// sentBy are the users the messages were handled as
+	sentBy []bot_auth.UserId
+	ledger bot_usage.Ledger
+}
+
+func (suite *RestTestSuite) SetupTest() {
+	suite.chats = make(map[bot_chat.ChatId]*bot_chat.Chat)
+	suite.user = "alice"
+	suite.sentBy = nil
+	suite.ledger = bot_usage.New(bot_usage.Args{Prices: bot_usage.Prices{"gpt-4": {Prompt: 30, Completion: 60}}})
+	suite.answer = func(promptId bot_chat.PromptId, chatId bot_chat.ChatId, msg []byte) error {
+		go func() {
+			suite.rest.Answer(chatId, promptId, msg[:1], false)
+			suite.rest.Answer(chatId, promptId, msg, true)
+		}()
+		return nil
+	}
+
+	suite.rest = New(Args{
+		NewChatHandler: func(ctx context.Context) (bot_chat.ChatId, error) {
+			suite.m.Lock()
+			defer suite.m.Unlock()
+
+			chat := bot_chat.New(bot_chat.Args{SystemPrompt: "be nice"})
+			suite.chats[chat.Id()] = chat
+			return chat.Id(), nil
+		},
+		NewChatMessageHandler: func(ctx context.Context, chatId bot_chat.ChatId, msg []byte) error {
+			user, err := bot_auth.UserFrom(ctx)
+			suite.NoError(err)
+
+			suite.m.Lock()
+			chat, ok := suite.chats[chatId]
+			suite.sentBy = append(suite.sentBy, user)
+			suite.m.Unlock()
+			if !ok {
+				return bot_chat.ErrChatNotFound
+			}
+
+			suite.NoError(chat.AppendTurn(bot_chat.RoleUser, string(msg)))
+			// the bot tells the clients the message is queued before it starts answering it
+			suite.rest.Queued(chatId)
+			return suite.answer(bot_chat.PromptIdFrom(ctx), chatId, msg)
+		},
+		GetChatHandler: func(ctx context.Context, chatId bot_chat.ChatId) (*bot_chat.Chat, error) {
+			suite.m.Lock()
+			defer suite.m.Unlock()
+
+			chat, ok := suite.chats[chatId]
+			if !ok {
+				return nil, bot_chat.ErrChatNotFound
+			}
+			return chat, nil
+		},
+		GetHistoryHandler: func(ctx context.Context, chatId bot_chat.ChatId) ([]bot_chat.Turn, error) {
+			suite.m.Lock()
+			defer suite.m.Unlock()
+
+			chat, ok := suite.chats[chatId]
+			if !ok {
+				return nil, bot_chat.ErrChatNotFound
+			}
+			return chat.History(), nil
+		},
+		DeleteChatHandler: func(ctx context.Context, chatId bot_chat.ChatId) error {
+			suite.m.Lock()
+			defer suite.m.Unlock()
+
+			if _, ok := suite.chats[chatId]; !ok {
+				return bot_chat.ErrChatNotFound
+			}
+			delete(suite.chats, chatId)
+			return nil
+		},
+		GetUsageHandler: func(ctx context.Context) (bot_usage.Report, error) {
+			user, err := bot_auth.UserFrom(ctx)
+			if err != nil {
+				return bot_usage.Report{}, err
+			}
+			return suite.ledger.User(user), nil
+		},
+		GetChatUsageHandler: func(ctx context.Context, chatId bot_chat.ChatId) (bot_usage.Totals, error) {
+			suite.m.Lock()
+			defer suite.m.Unlock()
+
+			if _, ok := suite.chats[chatId]; !ok {
+				return bot_usage.Totals{}, bot_chat.ErrChatNotFound
+			}
+			return suite.ledger.Chat(chatId), nil
+		},
+	})
+
+	m := http.NewServeMux()
+	suite.rest.Register(m)
+	suite.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.m.Lock()
+		user := suite.user
+		suite.m.Unlock()
+
+		m.ServeHTTP(w, r.WithContext(bot_auth.WithUser(r.Context(), user)))
+	}))
+}
+
+func (suite *RestTestSuite) TearDownTest() {
+	// the server waits for the open event streams when it closes
+	suite.rest.Close()
+	suite.server.Close()
+}
+
+// do sends the request and decodes the reply's body to v, returning the reply's status
+func (suite *RestTestSuite) do(method string, path string, body string, v interface{}) int {
+	request, err := http.NewRequest(method, suite.server.URL+path, bytes.NewBufferString(body))
+	suite.Require().NoError(err)
+
+	response, err := http.DefaultClient.Do(request)
+	suite.Require().NoError(err)
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(response.Body)
+	suite.Require().NoError(err)
+	if v != nil && len(data) > 0 {
+		suite.Require().NoError(json.Unmarshal(data, v), string(data))
+	}
+
+	return response.StatusCode
+}
+
+func (suite *RestTestSuite) createChat() bot_chat.ChatId {
+	var chat Chat
+	suite.Require().Equal(http.StatusCreated, suite.do(http.MethodPost, "/chats", "", &chat))
+	return chat.ChatId
+}
+
+func (suite *RestTestSuite) TestChatLifecycle() {
+	chatId := suite.createChat()
+
+	var chat Chat
+	suite.Equal(http.StatusOK, suite.do(http.MethodGet, "/chats/"+chatId.String(), "", &chat))
+	suite.Equal(chatId, chat.ChatId)
+	suite.Equal(1, chat.Messages)
+
+	suite.Equal(http.StatusNoContent, suite.do(http.MethodDelete, "/chats/"+chatId.String(), "", nil))
+
+	var reply ErrorReply
+	suite.Equal(http.StatusNotFound, suite.do(http.MethodGet, "/chats/"+chatId.String(), "", &reply))
+	suite.Equal(ErrorCodeNotFound, reply.Error.Code)
+}
+
+func (suite *RestTestSuite) TestSendMessageWaitsForTheAnswer() {
+	chatId := suite.createChat()
+
+	var job Job
+	path := fmt.Sprintf("/chats/%s/messages", chatId)
+	suite.Equal(http.StatusOK, suite.do(http.MethodPost, path, `{"content":"hello"}`, &job))
+	suite.Equal(JobStatusDone, job.Status)
+	suite.Equal("hello", job.Answer)
+	suite.Equal(chatId, job.ChatId)
+	suite.NotNil(job.FinishedAt)
+}
+
+func (suite *RestTestSuite) TestAnswersOfOtherMessagesAreNotTheJobs() {
+	chatId := suite.createChat()
+	suite.answer = func(promptId bot_chat.PromptId, chatId bot_chat.ChatId, msg []byte) error {
+		suite.NotEmpty(promptId)
+		go func() {
+			// a message of the same chat that was sent through another interface is answered first
+			suite.rest.Answer(chatId, bot_chat.NewPromptId(), []byte("someone else's answer"), true)
+			suite.rest.Answer(chatId, promptId, msg, true)
+		}()
+		return nil
+	}
+
+	var job Job
+	path := fmt.Sprintf("/chats/%s/messages", chatId)
+	suite.Equal(http.StatusOK, suite.do(http.MethodPost, path, `{"content":"hello"}`, &job))
+	suite.Equal(JobStatusDone, job.Status)
+	suite.Equal("hello", job.Answer)
+}
+
+func (suite *RestTestSuite) TestSendMessageAsync() {
+	chatId := suite.createChat()
+	release := make(chan struct{})
+	suite.answer = func(promptId bot_chat.PromptId, chatId bot_chat.ChatId, msg []byte) error {
+		go func() {
+			<-release
+			suite.rest.Answer(chatId, promptId, msg, true)
+		}()
+		return nil
+	}
+
+	var job Job
+	path := fmt.Sprintf("/chats/%s/messages?async=true", chatId)
+	suite.Equal(http.StatusAccepted, suite.do(http.MethodPost, path, `{"content":"hello"}`, &job))
+	suite.Equal(JobStatusQueued, job.Status)
+	suite.NotEmpty(job.Id)
+
+	close(release)
+	suite.Eventually(func() bool {
+		suite.Equal(http.StatusOK, suite.do(http.MethodGet, "/jobs/"+job.Id, "", &job))
+		return job.Status == JobStatusDone
+	}, time.Second*5, time.Millisecond*10)
+	suite.Equal("hello", job.Answer)
+
+	// the message outlives its request, but it's still sent as its user
+	suite.m.Lock()
+	suite.Equal([]bot_auth.UserId{"alice"}, suite.sentBy)
+	suite.m.Unlock()
+
+	var reply ErrorReply
+	suite.Equal(http.StatusNotFound, suite.do(http.MethodGet, "/jobs/unknown", "", &reply))
+	suite.Equal(ErrorCodeNotFound, reply.Error.Code)
+
+	// nor can another user read the job
+	suite.m.Lock()
+	suite.user = "bob"
+	suite.m.Unlock()
+	suite.Equal(http.StatusNotFound, suite.do(http.MethodGet, "/jobs/"+job.Id, "", &reply))
+	suite.Equal(ErrorCodeNotFound, reply.Error.Code)
+}
+
+func (suite *RestTestSuite) TestFailedAnswersAreErrors() {
+	chatId := suite.createChat()
+	suite.answer = func(promptId bot_chat.PromptId, chatId bot_chat.ChatId, msg []byte) error {
+		go func() {
+			suite.rest.Answer(chatId, promptId, msg[:1], false)
+			suite.rest.Fail(chatId, promptId, bot_prompter.ErrQueueFull)
+		}()
+		return nil
+	}
+
+	var reply ErrorReply
+	path := fmt.Sprintf("/chats/%s/messages", chatId)
+	suite.Equal(http.StatusServiceUnavailable, suite.do(http.MethodPost, path, `{"content":"hello"}`, &reply))
+	suite.Equal(ErrorCodeOverloaded, reply.Error.Code)
+
+	var job Job
+	suite.Equal(http.StatusAccepted, suite.do(http.MethodPost, path+"?async=true", `{"content":"hello"}`, &job))
+	suite.Eventually(func() bool {
+		suite.Equal(http.StatusOK, suite.do(http.MethodGet, "/jobs/"+job.Id, "", &job))
+		return job.Status == JobStatusFailed
+	}, time.Second*5, time.Millisecond*10)
+	// what was streamed before the error is not the answer
+	suite.Empty(job.Answer)
+	suite.Contains(job.Error, bot_prompter.ErrQueueFull.Error())
+	suite.NotNil(job.FinishedAt)
+}
+
+func (suite *RestTestSuite) TestAnswersGoToTheMessagesInOrder() {
+	chatId := suite.createChat()
+	path := fmt.Sprintf("/chats/%s/messages?async=true", chatId)
+
+	var first, second Job
+	suite.Equal(http.StatusAccepted, suite.do(http.MethodPost, path, `{"content":"first"}`, &first))
+	suite.Equal(http.StatusAccepted, suite.do(http.MethodPost, path, `{"content":"second"}`, &second))
+
+	suite.Eventually(func() bool {
+		suite.do(http.MethodGet, "/jobs/"+second.Id, "", &second)
+		return second.Status == JobStatusDone
+	}, time.Second*5, time.Millisecond*10)
+	suite.do(http.MethodGet, "/jobs/"+first.Id, "", &first)
+	suite.Equal("first", first.Answer)
+	suite.Equal("second", second.Answer)
+}
+
+func (suite *RestTestSuite) TestMessagesArePaginated() {
+	chatId := suite.createChat()
+	path := fmt.Sprintf("/chats/%s/messages", chatId)
+	for i := 0; i < 2; i++ {
+		suite.Require().Equal(http.StatusOK, suite.do(http.MethodPost, path, fmt.Sprintf(`{"content":"message %d"}`, i), nil))
+	}
+
+	// the system prompt and the two messages, the fake handler does not record the answers
+	var page Messages
+	suite.Equal(http.StatusOK, suite.do(http.MethodGet, path+"?limit=2", "", &page))
+	suite.Equal(3, page.Total)
+	suite.Len(page.Messages, 2)
+	suite.Equal(bot_chat.RoleSystem, page.Messages[0].Role)
+	suite.Require().NotNil(page.NextOffset)
+	suite.Equal(2, *page.NextOffset)
+
+	var last Messages
+	suite.Equal(http.StatusOK, suite.do(http.MethodGet, fmt.Sprintf("%s?limit=2&offset=%d", path, *page.NextOffset), "", &last))
+	suite.Len(last.Messages, 1)
+	suite.Equal("message 1", last.Messages[0].Content)
+	suite.Nil(last.NextOffset)
+
+	var reply ErrorReply
+	suite.Equal(http.StatusBadRequest, suite.do(http.MethodGet, path+"?limit=0", "", &reply))
+	suite.Equal(ErrorCodeInvalidRequest, reply.Error.Code)
+}
+
+func (suite *RestTestSuite) TestErrorBodies() {
+	chatId := suite.createChat()
+	path := fmt.Sprintf("/chats/%s/messages", chatId)
+
+	for _, test := range []struct {
+		method string
+		path   string
+		body   string
+		status int
+		code   ErrorCode
+	}{
+		{http.MethodGet, "/chats/not-a-uuid", "", http.StatusBadRequest, ErrorCodeInvalidRequest},
+		{http.MethodPut, "/chats/" + chatId.String(), "", http.StatusMethodNotAllowed, ErrorCodeMethodNotAllowed},
+		{http.MethodGet, "/chats/" + chatId.String() + "/unknown", "", http.StatusNotFound, ErrorCodeNotFound},
+		{http.MethodPost, path, `{"content":""}`, http.StatusBadRequest, ErrorCodeInvalidRequest},
+		{http.MethodPost, path, `{"content":"hi","unknown":1}`, http.StatusBadRequest, ErrorCodeInvalidRequest},
+		{http.MethodPost, path, `not json`, http.StatusBadRequest, ErrorCodeInvalidRequest},
+		{http.MethodPost, path + "?async=maybe", `{"content":"hi"}`, http.StatusBadRequest, ErrorCodeInvalidRequest},
+		{http.MethodPost, "/chats/" + bot_chat.NewChatId().String() + "/messages", `{"content":"hi"}`, http.StatusNotFound, ErrorCodeNotFound},
+	} {
+		var reply ErrorReply
+		suite.Equal(test.status, suite.do(test.method, test.path, test.body, &reply), test.path)
+		suite.Equal(test.code, reply.Error.Code, test.path)
+		suite.NotEmpty(reply.Error.Message, test.path)
+	}
+}
+
+func (suite *RestTestSuite) TestQueueFullIsRetriable() {
+	chatId := suite.createChat()
+	suite.answer = func(promptId bot_chat.PromptId, chatId bot_chat.ChatId, msg []byte) error {
+		return bot_prompter.ErrQueueFull
+	}
+
+	request, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/chats/%s/messages", suite.server.URL, chatId), bytes.NewBufferString(`{"content":"hi"}`))
+	suite.Require().NoError(err)
+	response, err := http.DefaultClient.Do(request)
+	suite.Require().NoError(err)
+	defer response.Body.Close()
+
+	suite.Equal(http.StatusServiceUnavailable, response.StatusCode)
+	suite.NotEmpty(response.Header.Get("Retry-After"))
+	var reply ErrorReply
+	suite.NoError(json.NewDecoder(response.Body).Decode(&reply))
+	suite.Equal(ErrorCodeOverloaded, reply.Error.Code)
+}
+
+func (suite *RestTestSuite) TestRateLimitedIsRetriableLater() {
+	chatId := suite.createChat()
+	suite.answer = func(promptId bot_chat.PromptId, chatId bot_chat.ChatId, msg []byte) error {
+		return &bot_ratelimit.RateLimitedError{Limit: bot_ratelimit.LimitRequests, RetryAfter: time.Millisecond * 1500}
+	}
+
+	request, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/chats/%s/messages", suite.server.URL, chatId), bytes.NewBufferString(`{"content":"hi"}`))
+	suite.Require().NoError(err)
+	response, err := http.DefaultClient.Do(request)
+	suite.Require().NoError(err)
+	defer response.Body.Close()
+
+	suite.Equal(http.StatusTooManyRequests, response.StatusCode)
+	suite.Equal("2", response.Header.Get("Retry-After"))
+	var reply ErrorReply
+	suite.NoError(json.NewDecoder(response.Body).Decode(&reply))
+	suite.Equal(ErrorCodeRateLimited, reply.Error.Code)
+	suite.Equal(2, reply.Error.RetryAfter)
+}
+
+func (suite *RestTestSuite) TestUsage() {
+	chatId := suite.createChat()
+	suite.ledger.Record(bot_usage.Record{
+		ChatId: chatId,
+		User:   "alice",
+		Model:  "gpt-4",
+		Usage:  bot_infrastructure_llm.Usage{PromptTokens: 1000, CompletionTokens: 500, TotalTokens: 1500},
+	})
+
+	var chatUsage ChatUsage
+	suite.Equal(http.StatusOK, suite.do(http.MethodGet, fmt.Sprintf("/chats/%s/usage", chatId), "", &chatUsage))
+	suite.Equal(chatId, chatUsage.ChatId)
+	suite.Equal(1, chatUsage.Requests)
+	suite.Equal(1500, chatUsage.TotalTokens)
+	suite.InDelta(0.06, chatUsage.Cost, 1e-9)
+
+	var report UsageReport
+	suite.Equal(http.StatusOK, suite.do(http.MethodGet, "/usage", "", &report))
+	suite.Equal(bot_auth.UserId("alice"), report.User)
+	suite.Equal(chatUsage.Usage, report.Usage)
+	suite.Equal(chatUsage.Usage, report.Models["gpt-4"])
+	suite.Equal(chatUsage.Usage, report.Chats[chatId])
+
+	var reply ErrorReply
+	suite.Equal(http.StatusNotFound, suite.do(http.MethodGet, fmt.Sprintf("/chats/%s/usage", bot_chat.NewChatId()), "", &reply))
+	suite.Equal(http.StatusMethodNotAllowed, suite.do(http.MethodPost, "/usage", "", &reply))
+}
+
+func TestRestTestSuite(t *testing.T) {
+	suite.Run(t, new(RestTestSuite))
+}
@@ -1,13 +1,21 @@
 package bot_interface_http
 
 import (
+	"connectly-interview/internal/bot/domain/bot_auth"
 	"connectly-interview/internal/bot/domain/bot_chat"
+	"connectly-interview/internal/bot/domain/bot_usage"
+	bot_interfaces_http_rest "connectly-interview/internal/bot/interfaces/http_server/rest"
 	bot_interfaces_http_ws "connectly-interview/internal/bot/interfaces/http_server/ws"
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"time"
 )
 
+// ShutdownTimeout is how long the server waits for its connections to close when it stops
+const ShutdownTimeout = time.Second * 10
+
 func NewErrRunBotServer(err error) *ErrRunBotServer {
 	return &ErrRunBotServer{
 		err: err,
@@ -19,11 +27,27 @@ type ErrRunBotServer struct {
 }
 
 func (e ErrRunBotServer) Error() string {
-	return "could not run bot http_server"
+	return fmt.Sprintf("could not run bot http_server: %s", e.err)
+}
+
+func (e ErrRunBotServer) Unwrap() error {
+	return e.err
 }
 
+// Server is the http server communication interface
 type Server interface {
-	Listen() (<-chan []byte, <-chan error)
+	// Start starts serving, any error of the server is sent down the channel
+	Start() <-chan error
+	// Listen listens to the prompts of the server
+	Listen() <-chan []byte
+	// Stop gracefully shuts the server down
+	Stop() error
+	// Answer sends a delta of a chat's answer to the clients, or the whole answer if it's done
+	Answer(chatId bot_chat.ChatId, promptId bot_chat.PromptId, answer []byte, done bool) error
+	// Fail ends a chat's answer with the error it failed with, for the clients
+	Fail(chatId bot_chat.ChatId, promptId bot_chat.PromptId, err error) error
+	// Queued tells the clients that a message of the chat is waiting to be answered
+	Queued(chatId bot_chat.ChatId)
 }
 
 type server struct {
@@ -33,17 +57,31 @@ type server struct {
 	keyFile            *string
 	address            string
 	ws                 *bot_interfaces_http_ws.Websockets
+	rest               *bot_interfaces_http_rest.Rest
 	wsIncomingMsgsChan chan []byte
 }
 
 type Server_Args struct {
-	Context               context.Context
-	Address               string
-	CertFile              *string
-	KeyFile               *string
-	ExtraMiddlewares      []http.Handler
-	NewChatHandler        func()
-	NewChatMessageHandler func(chatId bot_chat.ChatId, msg []byte) error
+	Context          context.Context
+	Address          string
+	CertFile         *string
+	KeyFile          *string
+	ExtraMiddlewares []http.Handler
+	// AuthenticateHandler returns the user of the token of each request,
+	// every request is the bot_auth.AnonymousUser if it's not provided
+	AuthenticateHandler   func(token string) (bot_auth.UserId, error)
+	NewChatHandler        func(ctx context.Context) (bot_chat.ChatId, error)
+	NewChatMessageHandler func(ctx context.Context, chatId bot_chat.ChatId, msg []byte) error
+	CancelAnswerHandler   func(ctx context.Context, chatId bot_chat.ChatId) error
+	GetChatHandler        func(ctx context.Context, chatId bot_chat.ChatId) (*bot_chat.Chat, error)
+	GetHistoryHandler     func(ctx context.Context, chatId bot_chat.ChatId) ([]bot_chat.Turn, error)
+	ListChatsHandler      func(ctx context.Context) ([]bot_chat.ChatId, error)
+	DeleteChatHandler     func(ctx context.Context, chatId bot_chat.ChatId) error
+	GetUsageHandler       func(ctx context.Context) (bot_usage.Report, error)
+	GetChatUsageHandler   func(ctx context.Context, chatId bot_chat.ChatId) (bot_usage.Totals, error)
+	// WebsocketIdleTimeout is how long a websocket client may stay silent before it's disconnected,
+	// bot_interfaces_http_ws.DefaultIdleTimeout if 0
+	WebsocketIdleTimeout time.Duration
 }
 
 func New(args Server_Args) Server {
@@ -60,25 +98,44 @@ func New(args Server_Args) Server {
 	if args.NewChatMessageHandler == nil {
 		panic("no chat message handler provided to http server")
 	}
+	if args.AuthenticateHandler == nil {
+		args.AuthenticateHandler = bot_auth.NewAnonymous().Authenticate
+	}
+
+	wsIncomingMsgsChan := make(chan []byte)
+	ws := bot_interfaces_http_ws.New(bot_interfaces_http_ws.Args{
+		ReceiveChan:           wsIncomingMsgsChan,
+		NewChatHandler:        args.NewChatHandler,
+		NewChatMessageHandler: args.NewChatMessageHandler,
+		CancelAnswerHandler:   args.CancelAnswerHandler,
+		GetChatHandler:        args.GetChatHandler,
+		IdleTimeout:           args.WebsocketIdleTimeout,
+	})
+	m.HandleFunc("/ws/", ws.Handler)
+	m.HandleFunc("/ws/schema.json", ws.SchemaHandler)
 
-	wsReceiveChan := make(chan []byte)
-	server.ws = bot_interfaces_http_ws.New(bot_interfaces_http_ws.Args{
-		ReceiveChan:           wsReceiveChan,
+	rest := bot_interfaces_http_rest.New(bot_interfaces_http_rest.Args{
+		Context:               args.Context,
 		NewChatHandler:        args.NewChatHandler,
 		NewChatMessageHandler: args.NewChatMessageHandler,
+		GetChatHandler:        args.GetChatHandler,
+		GetHistoryHandler:     args.GetHistoryHandler,
+		ListChatsHandler:      args.ListChatsHandler,
+		DeleteChatHandler:     args.DeleteChatHandler,
+		GetUsageHandler:       args.GetUsageHandler,
+		GetChatUsageHandler:   args.GetChatUsageHandler,
 	})
-	m.HandleFunc("/ws/", server.ws.Handler)
+	rest.Register(m)
 
 	// endregion
 
-	wsIncomingMsgsChan := make(chan []byte)
-	ws := bot_interfaces_http_ws.New(bot_interfaces_http_ws.Args{
-		ReceiveChan: wsIncomingMsgsChan,
-	})
 	http_server := &http.Server{
 		Addr:    args.Address,
-		Handler: m,
+		Handler: authenticate(m, args.AuthenticateHandler),
 	}
+	http_server.RegisterOnShutdown(rest.Close)
+	// the websockets are hijacked connections, which the http server does not close by itself
+	http_server.RegisterOnShutdown(ws.Close)
 
 	// endregion
 
@@ -90,6 +147,7 @@ func New(args Server_Args) Server {
 	server.keyFile = args.KeyFile
 	server.address = args.Address
 	server.ws = ws
+	server.rest = rest
 	server.wsIncomingMsgsChan = wsIncomingMsgsChan
 
 	// endregion
@@ -97,39 +155,69 @@ func New(args Server_Args) Server {
 	return server
 }
 
-func (s *server) Listen() (reqsChan <-chan []byte, errChan <-chan error) {
-	errChan = make(chan error)
-	reqsChan = make(chan []byte)
-	var err error
+func (s *server) Answer(chatId bot_chat.ChatId, promptId bot_chat.PromptId, answer []byte, done bool) error {
+	return errors.Join(
+		s.rest.Answer(chatId, promptId, answer, done),
+		s.ws.Answer(chatId, promptId, answer, done),
+	)
+}
+
+func (s *server) Queued(chatId bot_chat.ChatId) {
+	s.rest.Queued(chatId)
+}
+
+func (s *server) Fail(chatId bot_chat.ChatId, promptId bot_chat.PromptId, err error) error {
+	return errors.Join(
+		s.rest.Fail(chatId, promptId, err),
+		s.ws.Fail(chatId, promptId, err),
+	)
+}
+
+func (s *server) Start() <-chan error {
+	errChan := make(chan error, 1)
 
 	go func() {
+		defer close(errChan)
+
+		var err error
 		if s.certFile != nil && s.keyFile != nil {
 			fmt.Printf("listening http tls server at %q\n", s.address)
 			err = s.http_server.ListenAndServeTLS(*s.certFile, *s.keyFile)
-			if err != nil {
-				panic(NewErrRunBotServer(err))
-				return
-			}
 		} else {
 			fmt.Printf("listening http server at %q\n", s.address)
 			err = s.http_server.ListenAndServe()
-			if err != nil {
-				panic(NewErrRunBotServer(err))
-				return
-			}
 		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errChan <- NewErrRunBotServer(err)
+		}
+	}()
 
-		for {
-			select {
-			case <-s.ctx.Done():
-				err := s.http_server.Shutdown(s.ctx)
-				if err != nil {
-					panic("error shutting down bot http_server")
-					return
-				}
-			}
+	if s.ctx.Done() == nil {
+		return errChan
+	}
+	go func() {
+		<-s.ctx.Done()
+		err := s.Stop()
+		if err != nil {
+			fmt.Printf("error shutting down bot http_server: %s\n", err)
 		}
 	}()
 
-	return reqsChan, errChan
+	return errChan
+}
+
+func (s *server) Listen() <-chan []byte {
+	return s.wsIncomingMsgsChan
+}
+
+func (s *server) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+
+	err := s.http_server.Shutdown(ctx)
+	if err != nil {
+		return fmt.Errorf("could not shut down http server: %w", err)
+	}
+
+	return nil
 }
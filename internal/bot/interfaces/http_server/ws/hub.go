@@ -0,0 +1,247 @@
+package bot_interfaces_http_ws
+
+import (
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// connectionBuffer is how many messages can wait for a slow connection before the answers of its chats are dropped
+const connectionBuffer = 128
+
+// WriteTimeout is how long a write to a connection may take before the client is considered gone
+const WriteTimeout = 10 * time.Second
+
+// CloseCode is the status code of a websocket close frame, see RFC 6455 section 7.4
+type CloseCode uint16
+
+const (
+	// CloseNormal answers the client closing the connection
+	CloseNormal CloseCode = 1000
+	// CloseGoingAway closes a connection that has been idle for too long or when the server shuts down
+	CloseGoingAway CloseCode = 1001
+)
+
+// conn is a websocket connection of a client
+type conn struct {
+	ws *websocket.Conn
+	// send are the messages that wait to be written to the connection, only the connection's writer writes to it
+	send chan []byte
+	// closed is closed once the connection is closed
+	closed    chan struct{}
+	closeOnce sync.Once
+	// closeCode and closeReason are sent to the client by the writer once the connection is closed,
+	// no close frame is sent if closeCode is 0, e.g. when the connection is already broken
+	closeCode   CloseCode
+	closeReason string
+	// done is closed once the writer has returned
+	done chan struct{}
+}
+
+func newConn(ws *websocket.Conn) *conn {
+	return &conn{
+		ws:     ws,
+		send:   make(chan []byte, connectionBuffer),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// close closes the connection with the close code and reason, only the first close of a connection counts.
+//
+// The connection itself is closed by the websocket server once the handler of the connection returns,
+// the pending read of the handler fails right away so that it returns.
+func (c *conn) close(code CloseCode, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+		close(c.closed)
+		c.ws.SetReadDeadline(time.Now())
+	})
+}
+
+func (c *conn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// write queues the message for the client, waiting if the client is slow
+func (c *conn) write(msg []byte) {
+	select {
+	case c.send <- msg:
+	case <-c.closed:
+	}
+}
+
+// tryWrite queues the message for the client, unless the client is too slow to keep up
+func (c *conn) tryWrite(msg []byte) bool {
+	select {
+	case c.send <- msg:
+		return true
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeMessages writes the queued messages to the connection and pings the client every pingInterval,
+// until the connection is closed. It's the only one that writes to the connection, besides the pongs.
+func (c *conn) writeMessages(pingInterval time.Duration) {
+	defer close(c.done)
+
+	pings := time.NewTicker(pingInterval)
+	defer pings.Stop()
+
+	for {
+		var err error
+		select {
+		case msg := <-c.send:
+			c.ws.SetWriteDeadline(time.Now().Add(WriteTimeout))
+			err = websocket.Message.Send(c.ws, string(msg))
+		case <-pings.C:
+			err = c.writeFrame(websocket.PingFrame, nil)
+		case <-c.closed:
+			if c.closeCode != 0 {
+				payload := make([]byte, 2+len(c.closeReason))
+				binary.BigEndian.PutUint16(payload, uint16(c.closeCode))
+				copy(payload[2:], c.closeReason)
+				c.writeFrame(websocket.CloseFrame, payload)
+			}
+			return
+		}
+		if err != nil {
+			// the client is gone, there's nobody to send a close frame to
+			c.close(0, "")
+			return
+		}
+	}
+}
+
+func (c *conn) writeFrame(payloadType byte, payload []byte) error {
+	c.ws.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	c.ws.PayloadType = payloadType
+	defer func() { c.ws.PayloadType = websocket.TextFrame }()
+
+	_, err := c.ws.Write(payload)
+	return err
+}
+
+// Hub keeps track of the connections that subscribe to each chat, and delivers the answers of a chat only to them.
+// A chat can have many subscribers, e.g. the same chat open in many tabs.
+type Hub struct {
+	m           sync.RWMutex
+	conns       map[*conn]struct{}
+	subscribers map[bot_chat.ChatId]map[*conn]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		conns:       make(map[*conn]struct{}),
+		subscribers: make(map[bot_chat.ChatId]map[*conn]struct{}),
+	}
+}
+
+func (h *Hub) register(c *conn) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	h.conns[c] = struct{}{}
+}
+
+// unregister drops the closed connection and its subscriptions
+func (h *Hub) unregister(c *conn) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	delete(h.conns, c)
+	for chatId, conns := range h.subscribers {
+		delete(conns, c)
+		if len(conns) == 0 {
+			delete(h.subscribers, chatId)
+		}
+	}
+}
+
+// subscribe sends the answers of the chat to the connection, and tells if the connection was not subscribed already
+func (h *Hub) subscribe(c *conn, chatId bot_chat.ChatId) bool {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if h.subscribers[chatId] == nil {
+		h.subscribers[chatId] = make(map[*conn]struct{})
+	}
+	if _, ok := h.subscribers[chatId][c]; ok {
+		return false
+	}
+	h.subscribers[chatId][c] = struct{}{}
+
+	return true
+}
+
+// unsubscribe stops sending the answers of the chat to the connection
+func (h *Hub) unsubscribe(c *conn, chatId bot_chat.ChatId) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	delete(h.subscribers[chatId], c)
+	if len(h.subscribers[chatId]) == 0 {
+		delete(h.subscribers, chatId)
+	}
+}
+
+// publish sends the message to the connections that subscribe to the chat,
+// and returns how many of them were too slow to take it
+func (h *Hub) publish(chatId bot_chat.ChatId, msg []byte) (dropped int) {
+	h.m.RLock()
+	subscribers := make([]*conn, 0, len(h.subscribers[chatId]))
+	for c := range h.subscribers[chatId] {
+		subscribers = append(subscribers, c)
+	}
+	h.m.RUnlock()
+
+	for _, c := range subscribers {
+		if !c.tryWrite(msg) {
+			dropped++
+		}
+	}
+
+	return dropped
+}
+
+// Subscribers returns how many connections subscribe to the chat
+func (h *Hub) Subscribers(chatId bot_chat.ChatId) int {
+	h.m.RLock()
+	defer h.m.RUnlock()
+
+	return len(h.subscribers[chatId])
+}
+
+// Close closes all the connections with CloseGoingAway, e.g. when the server shuts down
+func (h *Hub) Close() {
+	h.m.RLock()
+	conns := make([]*conn, 0, len(h.conns))
+	for c := range h.conns {
+		conns = append(conns, c)
+	}
+	h.m.RUnlock()
+
+	for _, c := range conns {
+		c.close(CloseGoingAway, "server is shutting down")
+	}
+}
+
+// Connections returns how many connections are open
+func (h *Hub) Connections() int {
+	h.m.RLock()
+	defer h.m.RUnlock()
+
+	return len(h.conns)
+}
@@ -0,0 +1,316 @@
+package bot_interfaces_http_ws
+
+import (
+	"bytes"
+	"connectly-interview/internal/bot/domain/bot_chat"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+)
+
+// ProtocolVersion is the version of the messages the websockets speak, a message of any other version is rejected
+const ProtocolVersion = 1
+
+// Schema is the JSON Schema of the messages of the protocol, it's served at /ws/schema.json
+//
+//go:embed schema.json
+var Schema []byte
+
+// MsgType is the type of a message, which decides the type of its payload
+type MsgType string
+
+// The messages the clients send
+const (
+	// MsgTypeNewChat creates a new chat, its payload is a NewChat
+	MsgTypeNewChat MsgType = "new_chat"
+	// MsgTypeSendMessage sends a message to a chat, its payload is a SendMessage
+	MsgTypeSendMessage MsgType = "send_message"
+	// MsgTypeCancelAnswer cancels the answers of a chat that are still being compiled, its payload is a CancelAnswer
+	MsgTypeCancelAnswer MsgType = "cancel_answer"
+	// MsgTypeSubscribe gets the answers of a chat on the connection, e.g. when the chat is opened in another tab,
+	// its payload is a Subscribe. Creating a chat or sending a message to it subscribes to it too.
+	MsgTypeSubscribe MsgType = "subscribe"
+	// MsgTypeUnsubscribe stops getting the answers of a chat on the connection, its payload is an Unsubscribe
+	MsgTypeUnsubscribe MsgType = "unsubscribe"
+	// MsgTypePing keeps an idle connection open, its payload is a Ping
+	MsgTypePing MsgType = "ping"
+)
+
+// The messages the server sends
+const (
+	// MsgTypeChatCreated replies to a MsgTypeNewChat, its payload is a ChatCreated
+	MsgTypeChatCreated MsgType = "chat_created"
+	// MsgTypeMessageAccepted replies to a MsgTypeSendMessage, its payload is a MessageAccepted.
+	// The answer follows as MsgTypePartialAnswer messages and a MsgTypeAnswerEnd,
+	// or a MsgTypeError with the chat's id if the answer fails.
+	MsgTypeMessageAccepted MsgType = "message_accepted"
+	// MsgTypeAnswerCanceled replies to a MsgTypeCancelAnswer, its payload is an AnswerCanceled
+	MsgTypeAnswerCanceled MsgType = "answer_canceled"
+	// MsgTypeSubscribed replies to a MsgTypeSubscribe, its payload is a Subscribed
+	MsgTypeSubscribed MsgType = "subscribed"
+	// MsgTypeUnsubscribed replies to a MsgTypeUnsubscribe, its payload is an Unsubscribed
+	MsgTypeUnsubscribed MsgType = "unsubscribed"
+	// MsgTypePong replies to a MsgTypePing, its payload is a Pong
+	MsgTypePong MsgType = "pong"
+	// MsgTypePartialAnswer is a part of an answer while it's still being compiled, its payload is a PartialAnswer
+	MsgTypePartialAnswer MsgType = "partial_answer"
+	// MsgTypeAnswerEnd marks that the answer is over and carries the whole answer, its payload is an AnswerEnd
+	MsgTypeAnswerEnd MsgType = "answer_end"
+	// MsgTypeError replies to a message that failed, or ends an answer of a chat that failed, its payload is an Error
+	MsgTypeError MsgType = "error"
+)
+
+// Envelope is every message of the protocol, in both directions.
+//
+// Id is chosen by the client and echoed back on the reply to the message, including its error,
+// so the client can match them. The messages the server sends on its own, like the answers, have no id.
+type Envelope struct {
+	V       int             `json:"v"`
+	Type    MsgType         `json:"type"`
+	Id      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type NewChat struct{}
+
+type SendMessage struct {
+	ChatId  bot_chat.ChatId `json:"chat_id"`
+	Content string          `json:"content"`
+}
+
+type CancelAnswer struct {
+	ChatId bot_chat.ChatId `json:"chat_id"`
+}
+
+type Subscribe struct {
+	ChatId bot_chat.ChatId `json:"chat_id"`
+}
+
+type Unsubscribe struct {
+	ChatId bot_chat.ChatId `json:"chat_id"`
+}
+
+type Ping struct{}
+
+type ChatCreated struct {
+	ChatId bot_chat.ChatId `json:"chat_id"`
+}
+
+type MessageAccepted struct {
+	ChatId bot_chat.ChatId `json:"chat_id"`
+}
+
+type AnswerCanceled struct {
+	ChatId bot_chat.ChatId `json:"chat_id"`
+}
+
+type Subscribed struct {
+	ChatId bot_chat.ChatId `json:"chat_id"`
+}
+
+type Unsubscribed struct {
+	ChatId bot_chat.ChatId `json:"chat_id"`
+}
+
+type Pong struct{}
+
+type PartialAnswer struct {
+	ChatId bot_chat.ChatId `json:"chat_id"`
+	Delta  string          `json:"delta"`
+}
+
+type AnswerEnd struct {
+	ChatId bot_chat.ChatId `json:"chat_id"`
+	Answer string          `json:"answer"`
+}
+
+// ErrorCode is a machine readable code of an Error
+type ErrorCode string
+
+const (
+	// ErrorCodeInvalidMessage is a message that's not valid JSON, misses a required field or has an unknown one
+	ErrorCodeInvalidMessage     ErrorCode = "invalid_message"
+	ErrorCodeUnsupportedVersion ErrorCode = "unsupported_version"
+	ErrorCodeUnknownType        ErrorCode = "unknown_type"
+	ErrorCodeNotFound           ErrorCode = "not_found"
+	// ErrorCodeOverloaded is a message the bot is too busy to take, the client should retry later
+	ErrorCodeOverloaded ErrorCode = "overloaded"
+	// ErrorCodeRateLimited is a message of a user that sent too many messages or spent too many tokens,
+	// the client should retry after the retry_after of the error
+	ErrorCodeRateLimited ErrorCode = "rate_limited"
+	ErrorCodeInternal    ErrorCode = "internal"
+)
+
+type Error struct {
+	// ChatId is the chat whose answer failed, for the errors that end an answer rather than reply to a message
+	ChatId  *bot_chat.ChatId `json:"chat_id,omitempty"`
+	Code    ErrorCode        `json:"code"`
+	Message string           `json:"message"`
+	// RetryAfter is how many seconds the client should wait before it retries, when it's rate limited
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+// ProtocolError is an error that's sent back to the client as a MsgTypeError message
+type ProtocolError struct {
+	Code       ErrorCode
+	Err        error
+	RetryAfter int
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Err)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+func newProtocolError(code ErrorCode, format string, a ...interface{}) *ProtocolError {
+	return &ProtocolError{Code: code, Err: fmt.Errorf(format, a...)}
+}
+
+// NewEnvelope returns a message of the type with the payload
+func NewEnvelope(msgType MsgType, id string, payload interface{}) (*Envelope, error) {
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal %s payload: %w", msgType, err)
+	}
+
+	return &Envelope{
+		V:       ProtocolVersion,
+		Type:    msgType,
+		Id:      id,
+		Payload: jsonPayload,
+	}, nil
+}
+
+// NewErrorEnvelope returns the error message that replies to the message with the id
+func NewErrorEnvelope(id string, err *ProtocolError) *Envelope {
+	envelope, _ := NewEnvelope(MsgTypeError, id, Error{Code: err.Code, Message: err.Err.Error(), RetryAfter: err.RetryAfter})
+	return envelope
+}
+
+// DecodeEnvelope decodes a message strictly, rejecting unknown fields and any version other than ProtocolVersion.
+// The payload is left to DecodePayload.
+//
+// The id of the message is returned even if the message is not valid, as long as it can be read,
+// so that the error can be echoed back with it.
+func DecodeEnvelope(data []byte) (*Envelope, error) {
+	var envelope Envelope
+	err := strictUnmarshal(data, &envelope)
+	if err != nil {
+		// the id, if it can be read at all
+		var lenient struct {
+			Id string `json:"id"`
+		}
+		_ = json.Unmarshal(data, &lenient)
+		return &Envelope{Id: lenient.Id}, newProtocolError(ErrorCodeInvalidMessage, "invalid message: %s", err)
+	}
+
+	if envelope.V != ProtocolVersion {
+		return &envelope, newProtocolError(ErrorCodeUnsupportedVersion, "unsupported protocol version %d, the server speaks version %d", envelope.V, ProtocolVersion)
+	}
+	if envelope.Type == "" {
+		return &envelope, newProtocolError(ErrorCodeInvalidMessage, "invalid message: missing type")
+	}
+
+	return &envelope, nil
+}
+
+// DecodePayload decodes the payload of the message strictly to the payload type of the message's type
+func DecodePayload(envelope *Envelope) (interface{}, error) {
+	var payload interface {
+		validate() error
+	}
+	switch envelope.Type {
+	case MsgTypeNewChat:
+		payload = &NewChat{}
+	case MsgTypeSendMessage:
+		payload = &SendMessage{}
+	case MsgTypeCancelAnswer:
+		payload = &CancelAnswer{}
+	case MsgTypeSubscribe:
+		payload = &Subscribe{}
+	case MsgTypeUnsubscribe:
+		payload = &Unsubscribe{}
+	case MsgTypePing:
+		payload = &Ping{}
+	default:
+		return nil, newProtocolError(ErrorCodeUnknownType, "unknown message type %q", envelope.Type)
+	}
+
+	data := envelope.Payload
+	if len(data) == 0 {
+		data = []byte("{}")
+	}
+	err := strictUnmarshal(data, payload)
+	if err != nil {
+		return nil, newProtocolError(ErrorCodeInvalidMessage, "invalid %s payload: %s", envelope.Type, err)
+	}
+
+	err = payload.validate()
+	if err != nil {
+		return nil, newProtocolError(ErrorCodeInvalidMessage, "invalid %s payload: %s", envelope.Type, err)
+	}
+
+	return payload, nil
+}
+
+func (p *NewChat) validate() error {
+	return nil
+}
+
+func (p *SendMessage) validate() error {
+	if p.ChatId == (bot_chat.ChatId{}) {
+		return fmt.Errorf("missing chat_id")
+	}
+	if p.Content == "" {
+		return fmt.Errorf("missing content")
+	}
+
+	return nil
+}
+
+func (p *CancelAnswer) validate() error {
+	if p.ChatId == (bot_chat.ChatId{}) {
+		return fmt.Errorf("missing chat_id")
+	}
+
+	return nil
+}
+
+func (p *Subscribe) validate() error {
+	if p.ChatId == (bot_chat.ChatId{}) {
+		return fmt.Errorf("missing chat_id")
+	}
+
+	return nil
+}
+
+func (p *Unsubscribe) validate() error {
+	if p.ChatId == (bot_chat.ChatId{}) {
+		return fmt.Errorf("missing chat_id")
+	}
+
+	return nil
+}
+
+func (p *Ping) validate() error {
+	return nil
+}
+
+// strictUnmarshal unmarshals a single json value, rejecting unknown fields and trailing data
+func strictUnmarshal(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(v)
+	if err != nil {
+		return err
+	}
+	if decoder.More() {
+		return fmt.Errorf("more than one json value")
+	}
+
+	return nil
+}
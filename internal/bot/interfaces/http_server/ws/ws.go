@@ -1,27 +1,65 @@
-// Package bot_interfaces_http_ws is a websocket handler for the http mux
+// Package bot_interfaces_http_ws is a websocket handler for the http mux,
+// speaking the versioned protocol of protocol.go whose JSON Schema is schema.json
 package bot_interfaces_http_ws
 
 import (
 	"connectly-interview/internal/bot/domain/bot_chat"
+	"connectly-interview/internal/bot/domain/bot_prompter"
+	"connectly-interview/internal/bot/domain/bot_ratelimit"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/google/uuid"
 	"golang.org/x/net/websocket"
-	"log"
+	"io"
+	"net"
 	"net/http"
+	"time"
+)
+
+// MaxMessageSize is the biggest message the websockets accept
+const MaxMessageSize = 1024 * 1024 // 1 MB
+
+const (
+	// DefaultIdleTimeout is how long a client may stay silent before its connection is closed,
+	// unless Args.IdleTimeout says otherwise
+	DefaultIdleTimeout = 2 * time.Minute
+	// DefaultPingInterval is how often the clients are pinged, unless Args.PingInterval says otherwise.
+	// The pings keep the connections open through proxies and load balancers, and find the clients that are gone.
+	DefaultPingInterval = 30 * time.Second
 )
 
 type Websockets struct {
-	ws                    *websocket.Server
-	sendChan              chan []byte
+	ws *websocket.Server
+	// hub routes the answers of each chat to the connections that subscribe to it
+	hub                   *Hub
 	receiveChan           chan<- []byte
-	newChatHandler        func()
-	newChatMessageHandler func(chatId bot_chat.ChatId, msg []byte) error
+	newChatHandler        func(ctx context.Context) (bot_chat.ChatId, error)
+	getChatHandler        func(ctx context.Context, chatId bot_chat.ChatId) (*bot_chat.Chat, error)
+	newChatMessageHandler func(ctx context.Context, chatId bot_chat.ChatId, msg []byte) error
+	cancelAnswerHandler   func(ctx context.Context, chatId bot_chat.ChatId) error
+	idleTimeout           time.Duration
+	pingInterval          time.Duration
 }
 
+// Args are the handlers of the websockets, which are called with the context of the connection's upgrade request,
+// so the user the request was authenticated as comes along
 type Args struct {
-	ReceiveChan           chan<- []byte
-	NewChatHandler        func()
-	NewChatMessageHandler func(chatId bot_chat.ChatId, msg []byte) error
+	ReceiveChan    chan<- []byte
+	NewChatHandler func(ctx context.Context) (bot_chat.ChatId, error)
+	// NewChatMessageHandler is called with the context of the connection the message came from,
+	// which is done when the connection closes
+	NewChatMessageHandler func(ctx context.Context, chatId bot_chat.ChatId, msg []byte) error
+	CancelAnswerHandler   func(ctx context.Context, chatId bot_chat.ChatId) error
+	// GetChatHandler checks that a chat exists and is the user's before a connection subscribes to it,
+	// the connections can't subscribe to chats nor send messages to them without it
+	GetChatHandler func(ctx context.Context, chatId bot_chat.ChatId) (*bot_chat.Chat, error)
+	// IdleTimeout is how long a client may send no message before its connection is closed, DefaultIdleTimeout if 0.
+	// The pongs to the server's pings are not seen by the server, so the clients that idle keep
+	// their connection open by sending a MsgTypePing every now and then.
+	IdleTimeout time.Duration
+	// PingInterval is how often the clients are pinged, DefaultPingInterval if 0
+	PingInterval time.Duration
 }
 
 func New(args Args) *Websockets {
@@ -30,154 +68,295 @@ func New(args Args) *Websockets {
 	wsServer := &websocket.Server{}
 	w.ws = wsServer
 
-	sendChan := make(chan []byte, 128) // 128 to make hiccups "less visible"
-	w.sendChan = sendChan
+	w.hub = NewHub()
 	w.receiveChan = args.ReceiveChan
 	w.newChatHandler = args.NewChatHandler
 	w.newChatMessageHandler = args.NewChatMessageHandler
+	w.cancelAnswerHandler = args.CancelAnswerHandler
+	w.getChatHandler = args.GetChatHandler
+	w.idleTimeout = args.IdleTimeout
+	if w.idleTimeout == 0 {
+		w.idleTimeout = DefaultIdleTimeout
+	}
+	w.pingInterval = args.PingInterval
+	if w.pingInterval == 0 {
+		w.pingInterval = DefaultPingInterval
+	}
 
 	return w
 }
 
-type MsgType uint8
-
-const (
-	MsgTypeOutcomingReply = iota + 1
-	MsgTypeIncomingReply
-	MsgTypeNewChat
-)
-
-type IncomingReply struct {
-	ChatId bot_chat.ChatId `json:"chat_id"`
-	Reply  []byte          `json:"reply"`
+// Close closes all the connections, telling the clients that the server is going away
+func (websockets *Websockets) Close() {
+	websockets.hub.Close()
 }
 
-type NewChatMsg struct {
-	Username string
+// Hub returns the hub of the websockets' connections
+func (websockets *Websockets) Hub() *Hub {
+	return websockets.hub
 }
 
-type OutMsg struct {
-	MsgType MsgType `json:"msg_type"`
-	Msg     []byte  `json:"msg"`
+func (websockets *Websockets) Handler(w http.ResponseWriter, r *http.Request) {
+	if websockets == nil {
+		panic("websockets is nil")
+	}
+
+	s := websocket.Server{Handler: websocket.Handler(websockets.handleWebSocket)}
+	s.ServeHTTP(w, r)
 }
 
-func (msg *OutMsg) IsEmpty() bool {
-	return msg == nil || msg.MsgType == 0 || len(msg.Msg) == 0
+// SchemaHandler serves the JSON Schema of the protocol
+func (websockets *Websockets) SchemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(Schema)
 }
 
-type InMsg struct {
-	MsgType MsgType     `json:"msg_type"`
-	Msg     interface{} `json:"msg"`
+// Answer sends a delta of a chat's answer to the connections that subscribe to the chat,
+// or, if done, the end of the answer along with the whole answer.
+func (websockets *Websockets) Answer(chatId bot_chat.ChatId, promptId bot_chat.PromptId, answer []byte, done bool) error {
+	var envelope *Envelope
+	var err error
+	if done {
+		envelope, err = NewEnvelope(MsgTypeAnswerEnd, "", AnswerEnd{ChatId: chatId, Answer: string(answer)})
+	} else {
+		envelope, err = NewEnvelope(MsgTypePartialAnswer, "", PartialAnswer{ChatId: chatId, Delta: string(answer)})
+	}
+	if err != nil {
+		return err
+	}
+
+	return websockets.publish(chatId, envelope)
 }
 
-func (msg *InMsg) IsEmpty() bool {
-	return msg == nil || msg.MsgType == 0 || msg.Msg == nil
+// Fail sends the error of a chat's answer that failed to the connections that subscribe to the chat,
+// it ends the answer instead of the end of the answer.
+func (websockets *Websockets) Fail(chatId bot_chat.ChatId, promptId bot_chat.PromptId, err error) error {
+	protocolErr := toProtocolError(err)
+	envelope, err := NewEnvelope(MsgTypeError, "", Error{
+		ChatId:     &chatId,
+		Code:       protocolErr.Code,
+		Message:    protocolErr.Err.Error(),
+		RetryAfter: protocolErr.RetryAfter,
+	})
+	if err != nil {
+		return err
+	}
+
+	return websockets.publish(chatId, envelope)
 }
 
-func (websockets *Websockets) Handler(w http.ResponseWriter, r *http.Request) {
-	if websockets == nil {
-		panic("websockets is nil")
+// publish sends the message to the connections that subscribe to the chat
+func (websockets *Websockets) publish(chatId bot_chat.ChatId, envelope *Envelope) error {
+	jsonMsg, err := json.Marshal(envelope)
+	if err != nil {
+		return fmt.Errorf("could not marshal answer: %w", err)
 	}
 
-	s := websocket.Server{Handler: websocket.Handler(websockets.handleWebSocket)}
-	s.ServeHTTP(w, r)
+	dropped := websockets.hub.publish(chatId, jsonMsg)
+	if dropped > 0 {
+		fmt.Printf("%d websockets are too slow, dropped answer of chat %q\n", dropped, chatId)
+	}
+
+	return nil
 }
 
 func (websockets *Websockets) handleWebSocket(ws *websocket.Conn) {
 	if websockets == nil {
 		panic("websockets is nil")
 	}
+	ws.MaxPayloadBytes = MaxMessageSize
 
-	defer ws.Close()
-	fmt.Printf("debug: opened ws connection\n")
-	go func() {
-		for {
-			select {
-			case r := <-websockets.sendChan:
-				err := websocket.Message.Send(ws, r)
-				if err != nil {
-					return
-				}
-			}
-		}
+	// the prompts of the connection are canceled once the client goes away
+	ctx, cancel := context.WithCancel(ws.Request().Context())
+	defer cancel()
+
+	c := newConn(ws)
+	websockets.hub.register(c)
+	defer func() {
+		websockets.hub.unregister(c)
+		// nothing is written after the close frame, and the writer is gone before the connection closes
+		c.close(CloseNormal, "")
+		<-c.done
 	}()
+
+	go c.writeMessages(websockets.pingInterval)
 	for {
-		var err error
-		var inMsg InMsg
-		if err = websocket.JSON.Receive(ws, &inMsg); err != nil {
-			if err2 := websocket.Message.Send(ws, `{ "msgType": 3 "msg": "error: "`+err.Error()+`"}'`); err2 != nil {
-				log.Printf("incoming message: %q,\ncan't send error: %s\n", err2, err)
+		ws.SetReadDeadline(time.Now().Add(websockets.idleTimeout))
+		// a connection closed by the server must not wait for the idle timeout
+		if c.isClosed() {
+			return
+		}
+
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			var netErr net.Error
+			switch {
+			case errors.Is(err, websocket.ErrFrameTooLarge):
+				// the rest of the message is skipped on the next receive
+				websockets.send(c, NewErrorEnvelope("", newProtocolError(ErrorCodeInvalidMessage, "message is bigger than %d bytes", MaxMessageSize)))
+				continue
+			case errors.Is(err, io.EOF):
+				// the client closed the connection, the close frame is answered on the way out
+			case errors.As(err, &netErr) && netErr.Timeout() && !c.isClosed():
+				c.close(CloseGoingAway, "idle timeout")
+			default:
+				if !c.isClosed() {
+					fmt.Printf("could not receive websocket message: %s\n", err)
+					// the connection is broken, there's nobody to send a close frame to
+					c.close(0, "")
+				}
 			}
-			continue
+			return
 		}
 
-		outMsg, err := websockets.processMessage(inMsg)
+		reply, err := websockets.processMessage(ctx, c, data)
 		if err != nil {
 			fmt.Printf("could not process websocket message: %q\n", err)
 		}
 
-		// Send a response back - if any
-		if outMsg.IsEmpty() {
-			continue
-		}
+		websockets.send(c, reply)
+	}
+}
 
-		if err := websocket.JSON.Send(ws, outMsg); err != nil {
-			log.Println("can't send: ", err)
-			if err2 := websocket.Message.Send(ws, `{ "msgType": 3 "msg": "error: "`+err.Error()+`"}'`); err2 != nil {
-				log.Printf("incoming message: %q,\ncan't send error: %s\n", err2, err)
-			}
-			continue
-		}
+// send queues the message for the connection's writer
+func (websockets *Websockets) send(c *conn, envelope *Envelope) {
+	if envelope == nil {
+		return
+	}
+
+	msg, err := json.Marshal(envelope)
+	if err != nil {
+		fmt.Printf("could not marshal %s message: %s\n", envelope.Type, err)
+		return
 	}
+
+	c.write(msg)
 }
 
-func (websockets *Websockets) processMessage(inMsg InMsg) (*OutMsg, error) {
+// processMessage handles a message of the client and returns the reply to it,
+// which is an error message if the message failed.
+func (websockets *Websockets) processMessage(ctx context.Context, c *conn, data []byte) (*Envelope, error) {
 	if websockets == nil {
 		panic("websockets is nil")
 	}
 
-	switch inMsg.Msg.(type) {
-	case map[string]interface{}:
-		break
-	default:
-		return nil, fmt.Errorf("inMsg.msg is not a valid type")
+	envelope, err := DecodeEnvelope(data)
+	if err != nil {
+		return errorReply(envelope.Id, err), err
 	}
-	//var err error
-	switch inMsg.MsgType {
-	case MsgTypeIncomingReply:
-		var jsonMsg IncomingReply
 
-		msg := inMsg.Msg.(map[string]interface{})
+	payload, err := DecodePayload(envelope)
+	if err != nil {
+		return errorReply(envelope.Id, err), err
+	}
 
-		// get chat uuid
-		chatId := msg["chat_id"].(string)
-		chatUuid, err := uuid.Parse(chatId)
-		if err != nil {
-			return nil, fmt.Errorf("invalid chat uuid, not a proper uuid")
-		}
+	reply, err := websockets.handle(ctx, c, envelope, payload)
+	if err != nil {
+		return errorReply(envelope.Id, err), err
+	}
 
-		// get reply
-		reply := msg["reply"].(string)
+	return reply, nil
+}
 
-		// assign to json message
-		jsonMsg.ChatId = bot_chat.ChatId(chatUuid)
-		jsonMsg.Reply = []byte(reply)
+// checkChat returns an error if the chat does not exist or is not the user's
+func (websockets *Websockets) checkChat(ctx context.Context, chatId bot_chat.ChatId) error {
+	if websockets.getChatHandler == nil {
+		return fmt.Errorf("no get chat handler provided")
+	}
 
-		// send to handler
-		if websockets == nil {
-			return nil, fmt.Errorf("wtf, websockets is nil?")
+	_, err := websockets.getChatHandler(ctx, chatId)
+	return err
+}
+
+func (websockets *Websockets) handle(ctx context.Context, c *conn, envelope *Envelope, payload interface{}) (*Envelope, error) {
+	switch p := payload.(type) {
+	case *NewChat:
+		if websockets.newChatHandler == nil {
+			return nil, fmt.Errorf("no new chat handler provided")
+		}
+
+		chatId, err := websockets.newChatHandler(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not create new chat: %w", err)
 		}
+		websockets.hub.subscribe(c, chatId)
+
+		return NewEnvelope(MsgTypeChatCreated, envelope.Id, ChatCreated{ChatId: chatId})
+	case *SendMessage:
 		if websockets.newChatMessageHandler == nil {
 			return nil, fmt.Errorf("no chat message handler provided")
 		}
 
-		err = websockets.newChatMessageHandler(jsonMsg.ChatId, jsonMsg.Reply)
+		// the chat may not be the user's, its answers are none of the connection's business
+		err := websockets.checkChat(ctx, p.ChatId)
 		if err != nil {
 			return nil, fmt.Errorf("could not process new chat message: %w", err)
 		}
-	case MsgTypeNewChat:
-		websockets.newChatHandler()
+
+		// subscribe before prompting, so that no part of the answer is missed
+		subscribed := websockets.hub.subscribe(c, p.ChatId)
+		err = websockets.newChatMessageHandler(ctx, p.ChatId, []byte(p.Content))
+		if err != nil {
+			if subscribed {
+				websockets.hub.unsubscribe(c, p.ChatId)
+			}
+			return nil, fmt.Errorf("could not process new chat message: %w", err)
+		}
+
+		return NewEnvelope(MsgTypeMessageAccepted, envelope.Id, MessageAccepted{ChatId: p.ChatId})
+	case *CancelAnswer:
+		if websockets.cancelAnswerHandler == nil {
+			return nil, fmt.Errorf("no cancel answer handler provided")
+		}
+
+		err := websockets.cancelAnswerHandler(ctx, p.ChatId)
+		if err != nil {
+			return nil, fmt.Errorf("could not cancel answer: %w", err)
+		}
+
+		return NewEnvelope(MsgTypeAnswerCanceled, envelope.Id, AnswerCanceled{ChatId: p.ChatId})
+	case *Subscribe:
+		err := websockets.checkChat(ctx, p.ChatId)
+		if err != nil {
+			return nil, fmt.Errorf("could not subscribe to chat: %w", err)
+		}
+		websockets.hub.subscribe(c, p.ChatId)
+
+		return NewEnvelope(MsgTypeSubscribed, envelope.Id, Subscribed{ChatId: p.ChatId})
+	case *Unsubscribe:
+		websockets.hub.unsubscribe(c, p.ChatId)
+
+		return NewEnvelope(MsgTypeUnsubscribed, envelope.Id, Unsubscribed{ChatId: p.ChatId})
+	case *Ping:
+		return NewEnvelope(MsgTypePong, envelope.Id, Pong{})
+	default:
+		return nil, newProtocolError(ErrorCodeUnknownType, "unknown message type %q", envelope.Type)
+	}
+}
+
+// errorReply returns the error message that replies to the message with the id
+func errorReply(id string, err error) *Envelope {
+	return NewErrorEnvelope(id, toProtocolError(err))
+}
+
+// toProtocolError returns the error with the code the client should see it with
+func toProtocolError(err error) *ProtocolError {
+	var protocolErr *ProtocolError
+	if errors.As(err, &protocolErr) {
+		return protocolErr
 	}
-	// Implement your request processing logic here
-	return nil, nil
+
+	protocolErr = &ProtocolError{Code: ErrorCodeInternal, Err: err}
+	var rateLimited *bot_ratelimit.RateLimitedError
+	switch {
+	case errors.Is(err, bot_chat.ErrChatNotFound):
+		protocolErr.Code = ErrorCodeNotFound
+	case errors.Is(err, bot_prompter.ErrQueueFull):
+		protocolErr.Code = ErrorCodeOverloaded
+	case errors.As(err, &rateLimited):
+		protocolErr.Code = ErrorCodeRateLimited
+		protocolErr.RetryAfter = rateLimited.RetryAfterSeconds()
+	}
+
+	return protocolErr
 }
@@ -0,0 +1,367 @@
+package bot_interfaces_http_ws
+
+import (
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"connectly-interview/internal/bot/domain/bot_prompter"
+	"connectly-interview/internal/bot/domain/bot_ratelimit"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/websocket"
+)
+
+type WebsocketsTestSuite struct {
+	suite.Suite
+	server     *httptest.Server
+	websockets *Websockets
+	chatId     bot_chat.ChatId
+	// otherChatId exists, but it's not the chat the websockets create
+	otherChatId bot_chat.ChatId
+}
+
+func (suite *WebsocketsTestSuite) SetupTest() {
+	suite.chatId = bot_chat.NewChatId()
+	suite.otherChatId = bot_chat.NewChatId()
+	suite.serve(0, 0)
+}
+
+// serve serves the websockets with the idle timeout and ping interval, replacing any server of the test
+func (suite *WebsocketsTestSuite) serve(idleTimeout time.Duration, pingInterval time.Duration) {
+	if suite.server != nil {
+		suite.server.Close()
+	}
+
+	suite.websockets = New(Args{
+		NewChatHandler: func(ctx context.Context) (bot_chat.ChatId, error) {
+			return suite.chatId, nil
+		},
+		NewChatMessageHandler: func(ctx context.Context, chatId bot_chat.ChatId, msg []byte) error {
+			if chatId != suite.chatId {
+				return fmt.Errorf("%w: %s", bot_chat.ErrChatNotFound, chatId)
+			}
+			if string(msg) == "too much" {
+				return bot_prompter.ErrQueueFull
+			}
+			if string(msg) == "too often" {
+				return &bot_ratelimit.RateLimitedError{Limit: bot_ratelimit.LimitRequests, RetryAfter: time.Second * 20}
+			}
+			return nil
+		},
+		CancelAnswerHandler: func(ctx context.Context, chatId bot_chat.ChatId) error {
+			return nil
+		},
+		GetChatHandler: func(ctx context.Context, chatId bot_chat.ChatId) (*bot_chat.Chat, error) {
+			if chatId != suite.chatId && chatId != suite.otherChatId {
+				return nil, fmt.Errorf("%w: %s", bot_chat.ErrChatNotFound, chatId)
+			}
+			return &bot_chat.Chat{}, nil
+		},
+		IdleTimeout:  idleTimeout,
+		PingInterval: pingInterval,
+	})
+
+	m := http.NewServeMux()
+	m.HandleFunc("/ws/", suite.websockets.Handler)
+	m.HandleFunc("/ws/schema.json", suite.websockets.SchemaHandler)
+	suite.server = httptest.NewServer(m)
+}
+
+func (suite *WebsocketsTestSuite) TearDownTest() {
+	suite.websockets.Close()
+	suite.server.Close()
+	suite.server = nil
+}
+
+func (suite *WebsocketsTestSuite) dial() *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(suite.server.URL, "http") + "/ws/"
+	conn, err := websocket.Dial(url, "", suite.server.URL)
+	suite.Require().NoError(err)
+	suite.T().Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// roundTrip sends the message and returns the reply to it
+func (suite *WebsocketsTestSuite) roundTrip(conn *websocket.Conn, msg string) *Envelope {
+	suite.Require().NoError(websocket.Message.Send(conn, msg))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	var data []byte
+	suite.Require().NoError(websocket.Message.Receive(conn, &data))
+
+	var envelope Envelope
+	suite.Require().NoError(strictUnmarshal(data, &envelope), string(data))
+	suite.Equal(ProtocolVersion, envelope.V)
+	return &envelope
+}
+
+// answerEnd returns the next answer of the connection
+func (suite *WebsocketsTestSuite) answerEnd(conn *websocket.Conn) AnswerEnd {
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	var answer Envelope
+	suite.Require().NoError(websocket.JSON.Receive(conn, &answer))
+	suite.Require().Equal(MsgTypeAnswerEnd, answer.Type)
+	var end AnswerEnd
+	suite.Require().NoError(strictUnmarshal(answer.Payload, &end))
+	return end
+}
+
+func (suite *WebsocketsTestSuite) errorOf(envelope *Envelope) Error {
+	suite.Require().Equal(MsgTypeError, envelope.Type)
+	var e Error
+	suite.Require().NoError(strictUnmarshal(envelope.Payload, &e))
+	suite.NotEmpty(e.Message)
+	return e
+}
+
+func (suite *WebsocketsTestSuite) TestConversation() {
+	conn := suite.dial()
+
+	reply := suite.roundTrip(conn, `{"v":1,"type":"new_chat","id":"1"}`)
+	suite.Equal(MsgTypeChatCreated, reply.Type)
+	suite.Equal("1", reply.Id)
+	var created ChatCreated
+	suite.NoError(strictUnmarshal(reply.Payload, &created))
+	suite.Equal(suite.chatId, created.ChatId)
+
+	reply = suite.roundTrip(conn, fmt.Sprintf(`{"v":1,"type":"send_message","id":"2","payload":{"chat_id":%q,"content":"hi"}}`, suite.chatId))
+	suite.Equal(MsgTypeMessageAccepted, reply.Type)
+	suite.Equal("2", reply.Id)
+
+	suite.NoError(suite.websockets.Answer(suite.chatId, "", []byte("hello"), true))
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	var answer Envelope
+	suite.Require().NoError(websocket.JSON.Receive(conn, &answer))
+	suite.Equal(MsgTypeAnswerEnd, answer.Type)
+	suite.Empty(answer.Id)
+	var end AnswerEnd
+	suite.NoError(strictUnmarshal(answer.Payload, &end))
+	suite.Equal("hello", end.Answer)
+
+	reply = suite.roundTrip(conn, fmt.Sprintf(`{"v":1,"type":"cancel_answer","id":"3","payload":{"chat_id":%q}}`, suite.chatId))
+	suite.Equal(MsgTypeAnswerCanceled, reply.Type)
+	suite.Equal("3", reply.Id)
+}
+
+func (suite *WebsocketsTestSuite) TestErrorsEchoTheRequestId() {
+	conn := suite.dial()
+	missing := bot_chat.NewChatId()
+
+	for _, test := range []struct {
+		msg  string
+		id   string
+		code ErrorCode
+	}{
+		{`not json`, "", ErrorCodeInvalidMessage},
+		{`{"v":1,"type":"new_chat","id":"a","extra":true}`, "a", ErrorCodeInvalidMessage},
+		{`{"v":2,"type":"new_chat","id":"b"}`, "b", ErrorCodeUnsupportedVersion},
+		{`{"v":1,"type":"dance","id":"c"}`, "c", ErrorCodeUnknownType},
+		{`{"v":1,"id":"d"}`, "d", ErrorCodeInvalidMessage},
+		{`{"v":1,"type":"send_message","id":"e","payload":{"chat_id":"not a uuid","content":"hi"}}`, "e", ErrorCodeInvalidMessage},
+		{`{"v":1,"type":"send_message","id":"f","payload":{"chat_id":"` + suite.chatId.String() + `"}}`, "f", ErrorCodeInvalidMessage},
+		{`{"v":1,"type":"send_message","id":"g","payload":{"chat_id":"` + suite.chatId.String() + `","content":"hi","to":"x"}}`, "g", ErrorCodeInvalidMessage},
+		{`{"v":1,"type":"cancel_answer","id":"h"}`, "h", ErrorCodeInvalidMessage},
+		{`{"v":1,"type":"send_message","id":"i","payload":{"chat_id":"` + missing.String() + `","content":"hi"}}`, "i", ErrorCodeNotFound},
+		{`{"v":1,"type":"send_message","id":"j","payload":{"chat_id":"` + suite.chatId.String() + `","content":"too much"}}`, "j", ErrorCodeOverloaded},
+		{`{"v":1,"type":"send_message","id":"m","payload":{"chat_id":"` + suite.chatId.String() + `","content":"too often"}}`, "m", ErrorCodeRateLimited},
+		{`{"v":1,"type":"subscribe","id":"k"}`, "k", ErrorCodeInvalidMessage},
+		{`{"v":1,"type":"subscribe","id":"l","payload":{"chat_id":"` + missing.String() + `"}}`, "l", ErrorCodeNotFound},
+	} {
+		reply := suite.roundTrip(conn, test.msg)
+		suite.Equal(test.id, reply.Id, test.msg)
+		suite.Equal(test.code, suite.errorOf(reply).Code, test.msg)
+	}
+
+	// the messages to chats that are not found do not subscribe to them
+	suite.Equal(0, suite.websockets.Hub().Subscribers(missing))
+
+	// the rate limited messages tell when to retry
+	rateLimited := suite.errorOf(suite.roundTrip(conn, `{"v":1,"type":"send_message","payload":{"chat_id":"`+suite.chatId.String()+`","content":"too often"}}`))
+	suite.Equal(20, rateLimited.RetryAfter)
+
+	// the connection is still usable
+	suite.Equal(MsgTypeChatCreated, suite.roundTrip(conn, `{"v":1,"type":"new_chat"}`).Type)
+}
+
+func (suite *WebsocketsTestSuite) TestMessagesTooBig() {
+	conn := suite.dial()
+
+	big := fmt.Sprintf(`{"v":1,"type":"send_message","id":"1","payload":{"chat_id":%q,"content":%q}}`, suite.chatId, strings.Repeat("a", MaxMessageSize))
+	suite.Equal(ErrorCodeInvalidMessage, suite.errorOf(suite.roundTrip(conn, big)).Code)
+}
+
+func (suite *WebsocketsTestSuite) TestAnswersGoOnlyToTheChatsSubscribers() {
+	sender := suite.dial()
+	other := suite.dial()
+
+	suite.Equal(MsgTypeMessageAccepted, suite.roundTrip(sender, fmt.Sprintf(`{"v":1,"type":"send_message","payload":{"chat_id":%q,"content":"hi"}}`, suite.chatId)).Type)
+	suite.Equal(MsgTypeSubscribed, suite.roundTrip(other, fmt.Sprintf(`{"v":1,"type":"subscribe","payload":{"chat_id":%q}}`, suite.otherChatId)).Type)
+
+	suite.NoError(suite.websockets.Answer(suite.chatId, "", []byte("to sender"), true))
+	suite.NoError(suite.websockets.Answer(suite.otherChatId, "", []byte("to other"), true))
+
+	// each connection gets only the answer of its own chat, in its turn
+	suite.Equal(AnswerEnd{ChatId: suite.chatId, Answer: "to sender"}, suite.answerEnd(sender))
+	suite.Equal(AnswerEnd{ChatId: suite.otherChatId, Answer: "to other"}, suite.answerEnd(other))
+}
+
+func (suite *WebsocketsTestSuite) TestFailedAnswersEndWithAnError() {
+	conn := suite.dial()
+	suite.Equal(MsgTypeMessageAccepted, suite.roundTrip(conn, fmt.Sprintf(`{"v":1,"type":"send_message","payload":{"chat_id":%q,"content":"hi"}}`, suite.chatId)).Type)
+
+	suite.NoError(suite.websockets.Answer(suite.chatId, "", []byte("hel"), false))
+	suite.NoError(suite.websockets.Fail(suite.chatId, "", fmt.Errorf("could not compile prompt: %w", bot_prompter.ErrQueueFull)))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	var partial Envelope
+	suite.Require().NoError(websocket.JSON.Receive(conn, &partial))
+	suite.Equal(MsgTypePartialAnswer, partial.Type)
+
+	var failed Envelope
+	suite.Require().NoError(websocket.JSON.Receive(conn, &failed))
+	e := suite.errorOf(&failed)
+	suite.Empty(failed.Id)
+	suite.Equal(&suite.chatId, e.ChatId)
+	suite.Equal(ErrorCodeOverloaded, e.Code)
+}
+
+func (suite *WebsocketsTestSuite) TestNoSubscriptionsWithoutOwnershipCheck() {
+	suite.websockets.getChatHandler = nil
+	conn := suite.dial()
+
+	suite.errorOf(suite.roundTrip(conn, fmt.Sprintf(`{"v":1,"type":"subscribe","payload":{"chat_id":%q}}`, suite.chatId)))
+	suite.errorOf(suite.roundTrip(conn, fmt.Sprintf(`{"v":1,"type":"send_message","payload":{"chat_id":%q,"content":"hi"}}`, suite.chatId)))
+}
+
+func (suite *WebsocketsTestSuite) TestManyTabsOnOneChat() {
+	first := suite.dial()
+	second := suite.dial()
+
+	suite.Equal(MsgTypeChatCreated, suite.roundTrip(first, `{"v":1,"type":"new_chat"}`).Type)
+	suite.Equal(MsgTypeSubscribed, suite.roundTrip(second, fmt.Sprintf(`{"v":1,"type":"subscribe","payload":{"chat_id":%q}}`, suite.chatId)).Type)
+	suite.Equal(2, suite.websockets.Hub().Subscribers(suite.chatId))
+
+	suite.NoError(suite.websockets.Answer(suite.chatId, "", []byte("hello"), true))
+	suite.Equal("hello", suite.answerEnd(first).Answer)
+	suite.Equal("hello", suite.answerEnd(second).Answer)
+
+	suite.Equal(MsgTypeUnsubscribed, suite.roundTrip(second, fmt.Sprintf(`{"v":1,"type":"unsubscribe","payload":{"chat_id":%q}}`, suite.chatId)).Type)
+	suite.Equal(1, suite.websockets.Hub().Subscribers(suite.chatId))
+
+	// a closed tab drops its subscriptions
+	first.Close()
+	suite.Eventually(func() bool {
+		return suite.websockets.Hub().Subscribers(suite.chatId) == 0 && suite.websockets.Hub().Connections() == 1
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func (suite *WebsocketsTestSuite) TestAnswersWithoutSubscribers() {
+	for i := 0; i < connectionBuffer*2; i++ {
+		suite.NoError(suite.websockets.Answer(suite.chatId, "", []byte("nobody listens"), false))
+	}
+}
+
+// closed waits for the server to close the connection
+func (suite *WebsocketsTestSuite) closed(conn *websocket.Conn) {
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	var data []byte
+	suite.ErrorIs(websocket.Message.Receive(conn, &data), io.EOF)
+	suite.Eventually(func() bool {
+		return suite.websockets.Hub().Connections() == 0
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func (suite *WebsocketsTestSuite) TestIdleConnectionsAreClosed() {
+	suite.serve(time.Millisecond*200, 0)
+	conn := suite.dial()
+
+	// pings keep the connection open past the idle timeout
+	for i := 0; i < 5; i++ {
+		reply := suite.roundTrip(conn, fmt.Sprintf(`{"v":1,"type":"ping","id":"%d"}`, i))
+		suite.Equal(MsgTypePong, reply.Type)
+		suite.Equal(fmt.Sprint(i), reply.Id)
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	suite.closed(conn)
+}
+
+func (suite *WebsocketsTestSuite) TestPingedConnectionsStayUsable() {
+	suite.serve(0, time.Millisecond*10)
+	conn := suite.dial()
+
+	time.Sleep(time.Millisecond * 100)
+	suite.Equal(MsgTypeChatCreated, suite.roundTrip(conn, `{"v":1,"type":"new_chat"}`).Type)
+}
+
+func (suite *WebsocketsTestSuite) TestCloseDisconnectsTheClients() {
+	first := suite.dial()
+	second := suite.dial()
+	suite.Equal(MsgTypeChatCreated, suite.roundTrip(first, `{"v":1,"type":"new_chat"}`).Type)
+	suite.Equal(MsgTypePong, suite.roundTrip(second, `{"v":1,"type":"ping"}`).Type)
+	suite.Equal(2, suite.websockets.Hub().Connections())
+
+	suite.websockets.Close()
+
+	suite.closed(first)
+	suite.closed(second)
+	suite.Equal(0, suite.websockets.Hub().Subscribers(suite.chatId))
+}
+
+// TestSchemaCoversTheProtocol keeps the published schema in line with the message types and error codes
+func (suite *WebsocketsTestSuite) TestSchemaCoversTheProtocol() {
+	response, err := http.Get(suite.server.URL + "/ws/schema.json")
+	suite.Require().NoError(err)
+	defer response.Body.Close()
+	suite.Equal(http.StatusOK, response.StatusCode)
+
+	var schema struct {
+		Properties struct {
+			V struct {
+				Const int `json:"const"`
+			} `json:"v"`
+			Type struct {
+				Enum []MsgType `json:"enum"`
+			} `json:"type"`
+		} `json:"properties"`
+		Defs struct {
+			Envelopes map[MsgType]json.RawMessage `json:"envelopes"`
+			Payloads  map[MsgType]struct {
+				Properties struct {
+					Code struct {
+						Enum []ErrorCode `json:"enum"`
+					} `json:"code"`
+				} `json:"properties"`
+			} `json:"payloads"`
+		} `json:"$defs"`
+	}
+	suite.Require().NoError(json.NewDecoder(response.Body).Decode(&schema))
+
+	types := []MsgType{
+		MsgTypeNewChat, MsgTypeSendMessage, MsgTypeCancelAnswer, MsgTypeSubscribe, MsgTypeUnsubscribe, MsgTypePing,
+		MsgTypeChatCreated, MsgTypeMessageAccepted, MsgTypeAnswerCanceled, MsgTypeSubscribed, MsgTypeUnsubscribed, MsgTypePong,
+		MsgTypePartialAnswer, MsgTypeAnswerEnd, MsgTypeError,
+	}
+	suite.Equal(ProtocolVersion, schema.Properties.V.Const)
+	suite.ElementsMatch(types, schema.Properties.Type.Enum)
+	for _, msgType := range types {
+		suite.Contains(schema.Defs.Envelopes, msgType)
+		suite.Contains(schema.Defs.Payloads, msgType)
+	}
+	suite.ElementsMatch([]ErrorCode{
+		ErrorCodeInvalidMessage, ErrorCodeUnsupportedVersion, ErrorCodeUnknownType,
+		ErrorCodeNotFound, ErrorCodeOverloaded, ErrorCodeRateLimited, ErrorCodeInternal,
+	}, schema.Defs.Payloads[MsgTypeError].Properties.Code.Enum)
+}
+
+func TestWebsocketsTestSuite(t *testing.T) {
+	suite.Run(t, new(WebsocketsTestSuite))
+}
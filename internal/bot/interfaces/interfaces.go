@@ -1,98 +1,124 @@
 package bot_interfaces
 
 import (
+	"connectly-interview/internal/bot/domain/bot_auth"
 	"connectly-interview/internal/bot/domain/bot_chat"
-	"connectly-interview/internal/bot/interfaces/daemon"
-	"connectly-interview/internal/bot/interfaces/http_server"
+	"connectly-interview/internal/bot/domain/bot_usage"
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 )
 
-// TODO: refactoring - this can be rethought and just have an array of communication interfaces
-//        instead of having each interface separately and separate functions inside here for each one.
-//        Basically ... Fast non-easily-scaleable architectural decision was taken here for the sake of doing it fast.
+var (
+	ErrInterfaceExists   = fmt.Errorf("communication interface already registered")
+	ErrInterfaceNotFound = fmt.Errorf("communication interface not found")
+	ErrAlreadyStarted    = fmt.Errorf("communication interfaces already started")
+	ErrNotStarted        = fmt.Errorf("communication interfaces not started")
+)
 
 // Interface is the interface that describes
 // which functions and behaviors a communication interface should be compatible with.
 type Interface interface {
-	// Start starts the communication interface
+	// Start starts the communication interface,
+	// any error of the interface while it's running is sent down the channel
 	Start() <-chan error
 	// Listen listens to the prompts of the interface
 	Listen() <-chan []byte
 }
 
-// TotalInterfaceTypes keeps track of how many interfaces there are
-const TotalInterfaceTypes = 3
+// Stopper is implemented by the communication interfaces that need to be stopped gracefully, e.g. to close their listeners
+type Stopper interface {
+	Stop() error
+}
 
-// TODO: Dangerous: it does not auto-update/generate // if the amount of interfaces changes, REMEMBER to change this
-//	 I don't know how, implement this in a different way. Unfortunately Golang does not have Enums, cant reflect on enums coz they dont exist ...
-//	 so it's the best way for now, but let's rethink this in the future shall we?
+// Answerer is implemented by the communication interfaces that send the answers back to their clients
+type Answerer interface {
+	// Answer sends a delta of a chat's answer to the clients, or the whole answer if it's done.
+	// The prompt id is the one the message was sent with (bot_chat.PromptIdFrom), for the clients that wait for the
+	// answer of a certain message rather than every answer of the chat.
+	Answer(chatId bot_chat.ChatId, promptId bot_chat.PromptId, answer []byte, done bool) error
+	// Fail ends a chat's answer that could not be compiled with the error, instead of the whole answer.
+	// The deltas that were sent before it are not an answer.
+	Fail(chatId bot_chat.ChatId, promptId bot_chat.PromptId, err error) error
+}
 
-// InterfaceType describes which communication interface it is (e.g. HTTP, grpc etc.)
-type InterfaceType uint8
+// Queuer is implemented by the communication interfaces that tell their clients when a message of a chat is queued
+type Queuer interface {
+	// Queued tells the clients that a message of the chat is waiting to be answered, whichever interface it came through
+	Queued(chatId bot_chat.ChatId)
+}
 
+// The names of the communication interfaces that come with the bot
 const (
-	InterfaceTypeHttpServer = iota + 1
-	InterfaceTypeDaemon     // To be implemented
-	InterfaceTypeGrpc       // To be implemented
+	InterfaceTypeHttpServer = "http_server"
+	InterfaceTypeDaemon     = "daemon"
+	InterfaceTypeGrpc       = "grpc"
 )
 
-type InterfaceTypes struct {
-	types []InterfaceType
+// InterfaceError is an error of a specific communication interface
+type InterfaceError struct {
+	Name string
+	Err  error
 }
 
-// HasAny returns if there are any running communication interface types
-func (types InterfaceTypes) HasAny() bool {
-	for i := 0; i < len(types.types); i++ {
-		item := types.types[i]
-		if item != 0 {
-			return true
-		}
-	}
-
-	return false
+func (e *InterfaceError) Error() string {
+	return fmt.Sprintf("communication interface %q: %s", e.Name, e.Err)
 }
 
-// Has returns if the communication interface is running
-func (types InterfaceTypes) Has(t InterfaceType) bool {
-	for i := 0; i < len(types.types); i++ {
-		item := types.types[i]
-		if item == t {
-			return true
-		}
-	}
-
-	return false
+func (e *InterfaceError) Unwrap() error {
+	return e.Err
 }
 
-// run checks if the interface is already running and if not it adds it to the list of running interfaces
-// so we can know which communication interfaces are running.
-func (types InterfaceTypes) run(t InterfaceType) error {
-	if types.Has(t) {
-		return fmt.Errorf("already running")
-	}
-
-	// interfaceTypes start from iota+1 = 1,
-	// and `types` is of length equal to the total interfaces,
-	// so we reduce it by 1
-	index := int(t) - 1
-	types.types[index] = t
+// Handlers are what the communication interfaces call when their clients talk to the bot.
+//
+// The interfaces authenticate their clients with Authenticate, and call the rest of the handlers
+// with a context that carries the client's user (see bot_auth.WithUser), which the chats are checked against.
+type Handlers struct {
+	// Authenticate returns the user of the token a client presents, or a bot_auth.ErrUnauthenticated
+	Authenticate func(token string) (bot_auth.UserId, error)
+	NewChat      func(ctx context.Context) (bot_chat.ChatId, error)
+	// NewChatMessage is called with every message of a chat,
+	// the context is done when the client that sent it goes away
+	NewChatMessage func(ctx context.Context, chatId bot_chat.ChatId, msg []byte) error
+	// CancelAnswer is called when a client cancels the answers of a chat that are still being compiled
+	CancelAnswer func(ctx context.Context, chatId bot_chat.ChatId) error
+	ListChats    func(ctx context.Context) ([]bot_chat.ChatId, error)
+	GetChat      func(ctx context.Context, chatId bot_chat.ChatId) (*bot_chat.Chat, error)
+	// GetHistory returns the turns of a chat, oldest first
+	GetHistory func(ctx context.Context, chatId bot_chat.ChatId) ([]bot_chat.Turn, error)
+	DeleteChat func(ctx context.Context, chatId bot_chat.ChatId) error
+	// GetUsage returns what the prompts of the user cost
+	GetUsage func(ctx context.Context) (bot_usage.Report, error)
+	// GetChatUsage returns what the prompts of a chat cost
+	GetChatUsage func(ctx context.Context, chatId bot_chat.ChatId) (bot_usage.Totals, error)
+}
 
-	return nil
+// registered is a communication interface in the registry
+type registered struct {
+	name  string
+	iface Interface
+	// err is the last error of the interface
+	err error
 }
 
+// Interfaces is the registry of the communication interfaces,
+// it starts and stops them together and fans their messages in a single message queue.
+//
+// Interfaces is an Interface itself.
 type Interfaces struct {
 	ctx context.Context
+	m   sync.RWMutex
 	// messageQueue is where the channel where all the messages of all the communication interfaces will come through
 	messageQueue chan []byte
-	// Http_server is literally the http server that will act as another communication interface
-	Http_server bot_interface_http.Server
-	// Daemon is a daemon socket communication interface
-	Daemon bot_interface_daemon.Daemon // not ready but an example of an interface
-	// interfaceTypes keeps which interface types are running
-	interfaceTypes        *InterfaceTypes
-	newChatHandler        func()
-	newChatMessageHandler func(chatId bot_chat.ChatId, msg []byte) error
+	// interfaces are the registered communication interfaces, in the order they were registered
+	interfaces []*registered
+	handlers   Handlers
+	started    bool
+	// stopped is closed once the interfaces are stopped
+	stopped chan struct{}
+	// listening are the goroutines that fan the messages of the interfaces in the message queue
+	listening sync.WaitGroup
 }
 
 type Option func(i *Interfaces)
@@ -103,26 +129,79 @@ func WithMessageQueueCapacity(cap uint32) Option {
 	}
 }
 
-func WithNewChatHandler(cb func()) Option {
+// WithAuthenticateHandler is called with the token of every client that connects, to tell who the client is
+func WithAuthenticateHandler(cb func(token string) (bot_auth.UserId, error)) Option {
 	return func(i *Interfaces) {
-		i.newChatHandler = cb
+		i.handlers.Authenticate = cb
 	}
 }
 
-func WithNewChatMessageHandler(cb func(chatId bot_chat.ChatId, msg []byte) error) Option {
+func WithNewChatHandler(cb func(ctx context.Context) (bot_chat.ChatId, error)) Option {
 	return func(i *Interfaces) {
-		i.newChatMessageHandler = cb
+		i.handlers.NewChat = cb
 	}
 }
 
-func New(ctx context.Context, opts ...Option) *Interfaces {
-	it := &InterfaceTypes{
-		types: make([]InterfaceType, TotalInterfaceTypes),
+// WithNewChatMessageHandler is called with every message of a chat,
+// the context is done when the client that sent it goes away
+func WithNewChatMessageHandler(cb func(ctx context.Context, chatId bot_chat.ChatId, msg []byte) error) Option {
+	return func(i *Interfaces) {
+		i.handlers.NewChatMessage = cb
+	}
+}
+
+// WithCancelAnswerHandler is called when a client cancels the answers of a chat that are still being compiled
+func WithCancelAnswerHandler(cb func(ctx context.Context, chatId bot_chat.ChatId) error) Option {
+	return func(i *Interfaces) {
+		i.handlers.CancelAnswer = cb
+	}
+}
+
+func WithListChatsHandler(cb func(ctx context.Context) ([]bot_chat.ChatId, error)) Option {
+	return func(i *Interfaces) {
+		i.handlers.ListChats = cb
+	}
+}
+
+// WithGetChatHandler is called when a client reads a chat
+func WithGetChatHandler(cb func(ctx context.Context, chatId bot_chat.ChatId) (*bot_chat.Chat, error)) Option {
+	return func(i *Interfaces) {
+		i.handlers.GetChat = cb
 	}
+}
+
+// WithGetHistoryHandler is called when a client reads the turns of a chat
+func WithGetHistoryHandler(cb func(ctx context.Context, chatId bot_chat.ChatId) ([]bot_chat.Turn, error)) Option {
+	return func(i *Interfaces) {
+		i.handlers.GetHistory = cb
+	}
+}
+
+// WithDeleteChatHandler is called when a client is done with a chat and deletes it
+func WithDeleteChatHandler(cb func(ctx context.Context, chatId bot_chat.ChatId) error) Option {
+	return func(i *Interfaces) {
+		i.handlers.DeleteChat = cb
+	}
+}
+
+// WithGetUsageHandler is called when a client reads what its prompts cost
+func WithGetUsageHandler(cb func(ctx context.Context) (bot_usage.Report, error)) Option {
+	return func(i *Interfaces) {
+		i.handlers.GetUsage = cb
+	}
+}
+
+// WithGetChatUsageHandler is called when a client reads what the prompts of a chat cost
+func WithGetChatUsageHandler(cb func(ctx context.Context, chatId bot_chat.ChatId) (bot_usage.Totals, error)) Option {
+	return func(i *Interfaces) {
+		i.handlers.GetChatUsage = cb
+	}
+}
 
+func New(ctx context.Context, opts ...Option) *Interfaces {
 	interfaces := &Interfaces{
-		ctx:            ctx,
-		interfaceTypes: it,
+		ctx:     ctx,
+		stopped: make(chan struct{}),
 	}
 
 	for _, o := range opts {
@@ -136,82 +215,274 @@ func New(ctx context.Context, opts ...Option) *Interfaces {
 	return interfaces
 }
 
-// Listen listens to all the interfaces that let the outside world communicate with the bot
-// and writes the prompts that come to the interface's message queue
-func (b *Interfaces) Listen() (prompts <-chan []byte) {
-	if b.interfaceTypes.HasAny() {
-		fmt.Printf("listening to communication interfaces:\n")
+// Handlers returns the handlers that a communication interface should call when its clients talk to the bot
+func (b *Interfaces) Handlers() Handlers {
+	return b.handlers
+}
+
+// Register adds the communication interface to the registry under the name,
+// it has to be registered before the interfaces are started.
+func (b *Interfaces) Register(name string, iface Interface) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.started {
+		return fmt.Errorf("could not register %q: %w", name, ErrAlreadyStarted)
 	}
 
-	if b.HasHttpServerRunning() {
-		promptChan, errChan := b.Http_server.Listen()
-		fmt.Printf("\t- http server\n")
+	for _, r := range b.interfaces {
+		if r.name == name {
+			return fmt.Errorf("%w: %q", ErrInterfaceExists, name)
+		}
+	}
+
+	b.interfaces = append(b.interfaces, &registered{
+		name:  name,
+		iface: iface,
+	})
+
+	return nil
+}
+
+// Get returns the communication interface registered under the name
+func (b *Interfaces) Get(name string) (Interface, error) {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	for _, r := range b.interfaces {
+		if r.name == name {
+			return r.iface, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrInterfaceNotFound, name)
+}
+
+// Names returns the names of the registered communication interfaces, in the order they were registered
+func (b *Interfaces) Names() []string {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	names := make([]string, 0, len(b.interfaces))
+	for _, r := range b.interfaces {
+		names = append(names, r.name)
+	}
+
+	return names
+}
+
+// Err returns the last error of the communication interface registered under the name
+func (b *Interfaces) Err(name string) error {
+	b.m.RLock()
+	defer b.m.RUnlock()
+
+	for _, r := range b.interfaces {
+		if r.name == name {
+			return r.err
+		}
+	}
+
+	return fmt.Errorf("%w: %q", ErrInterfaceNotFound, name)
+}
+
+// Start starts all the registered communication interfaces,
+// the errors of each one are sent down the channel as an *InterfaceError, until the interfaces are stopped.
+func (b *Interfaces) Start() <-chan error {
+	errs := make(chan error)
+
+	b.m.Lock()
+	if b.started {
+		b.m.Unlock()
 		go func() {
+			errs <- ErrAlreadyStarted
+			close(errs)
+		}()
+		return errs
+	}
+	b.started = true
+	interfaces := b.interfaces
+	b.m.Unlock()
+
+	if len(interfaces) > 0 {
+		fmt.Printf("starting communication interfaces:\n")
+	}
+
+	var wg sync.WaitGroup
+	for _, r := range interfaces {
+		fmt.Printf("\t- %s\n", r.name)
+		ifaceErrs := r.iface.Start()
+
+		wg.Add(1)
+		go func(r *registered) {
+			defer wg.Done()
 			for {
 				select {
-				case prompt := <-promptChan:
-					b.messageQueue <- prompt
-				case err := <-errChan:
-					fmt.Printf("error on http server request: %s", err)
+				case err, ok := <-ifaceErrs:
+					if !ok {
+						return
+					}
+					ifaceErr := &InterfaceError{Name: r.name, Err: err}
+					b.m.Lock()
+					r.err = ifaceErr
+					b.m.Unlock()
+
+					select {
+					case errs <- ifaceErr:
+					case <-b.stopped:
+						return
+					}
+				case <-b.stopped:
+					return
 				}
 			}
-		}()
+		}(r)
 	}
 
-	if b.HasDaemonRunning() {
-		promptChan := b.Daemon.Listen()
-		fmt.Printf("\t - daemon socket\n")
+	go func() {
+		wg.Wait()
+		close(errs)
+	}()
+
+	return errs
+}
+
+// Listen listens to all the interfaces that let the outside world communicate with the bot
+// and writes the prompts that come to the interface's message queue.
+// The message queue is closed once the interfaces are stopped.
+func (b *Interfaces) Listen() (prompts <-chan []byte) {
+	b.m.RLock()
+	interfaces := b.interfaces
+	b.m.RUnlock()
+
+	for _, r := range interfaces {
+		promptChan := r.iface.Listen()
+
+		b.listening.Add(1)
 		go func() {
+			defer b.listening.Done()
 			for {
 				select {
-				case prompt := <-promptChan:
-					b.messageQueue <- prompt
+				case prompt, ok := <-promptChan:
+					if !ok {
+						return
+					}
+					select {
+					case b.messageQueue <- prompt:
+					case <-b.stopped:
+						return
+					}
+				case <-b.stopped:
+					return
 				}
 			}
 		}()
 	}
 
+	go func() {
+		<-b.stopped
+		b.listening.Wait()
+		close(b.messageQueue)
+	}()
+
 	return b.messageQueue
 }
 
-// TODO: This design is faulty:
-//    it has the format of Init<InterfaceName>/Start<InterfaceName> (e.g. StartHttpServer()).
-//    Obviously, not quite practical, what if a new interface pops ups, what if we haven't implemented some of necessary functions? (no interface usage).
-//    And it's so much mis-usage of namespace,
-//      normally used be bot.Interfaces.Http.Init/Start, not bot.Interfaces.StartHttpServer.
-//    This should be fixed in the future but it's a fast way of implementing this now.
-
-func (b *Interfaces) InitHttpServer(addr string, certFile *string, keyFile *string) error {
-	if b.interfaceTypes.Has(InterfaceTypeHttpServer) {
-		return fmt.Errorf("already running http server")
+// Stop stops all the communication interfaces that can be stopped, in the reverse order they were registered,
+// and returns the errors of the ones that could not stop.
+func (b *Interfaces) Stop() error {
+	b.m.Lock()
+	if !b.started {
+		b.m.Unlock()
+		return ErrNotStarted
 	}
-
-	err := b.interfaceTypes.run(InterfaceTypeHttpServer)
-	if err != nil {
-		return err
+	select {
+	case <-b.stopped:
+		b.m.Unlock()
+		return nil
+	default:
 	}
+	close(b.stopped)
+	interfaces := b.interfaces
+	b.m.Unlock()
+
+	var errs []error
+	for i := len(interfaces) - 1; i >= 0; i-- {
+		r := interfaces[i]
+		stopper, ok := r.iface.(Stopper)
+		if !ok {
+			continue
+		}
 
-	if b.Http_server == nil {
-		b.Http_server = bot_interface_http.New(bot_interface_http.Server_Args{
-			Context:               b.ctx,
-			Address:               addr,
-			CertFile:              certFile,
-			KeyFile:               keyFile,
-			ExtraMiddlewares:      nil,
-			NewChatHandler:        b.newChatHandler,
-			NewChatMessageHandler: b.newChatMessageHandler,
-		})
+		err := stopper.Stop()
+		if err != nil {
+			ifaceErr := &InterfaceError{Name: r.name, Err: err}
+			b.m.Lock()
+			r.err = ifaceErr
+			b.m.Unlock()
+			errs = append(errs, ifaceErr)
+		}
 	}
 
-	fmt.Println("initiated http server")
+	return errors.Join(errs...)
+}
 
-	return nil
+// Queued tells the clients of every interface that a message of the chat is waiting to be answered
+func (b *Interfaces) Queued(chatId bot_chat.ChatId) {
+	b.m.RLock()
+	interfaces := b.interfaces
+	b.m.RUnlock()
+
+	for _, r := range interfaces {
+		queuer, ok := r.iface.(Queuer)
+		if !ok {
+			continue
+		}
+
+		queuer.Queued(chatId)
+	}
 }
 
-func (b *Interfaces) HasHttpServerRunning() bool {
-	return b.Http_server != nil && b.interfaceTypes.Has(InterfaceTypeHttpServer)
+// Answer sends a delta of a chat's answer back to the communication interfaces that answer their clients,
+// or the whole answer if it's done.
+func (b *Interfaces) Answer(chatId bot_chat.ChatId, promptId bot_chat.PromptId, answer []byte, done bool) error {
+	b.m.RLock()
+	interfaces := b.interfaces
+	b.m.RUnlock()
+
+	var errs []error
+	for _, r := range interfaces {
+		answerer, ok := r.iface.(Answerer)
+		if !ok {
+			continue
+		}
+
+		err := answerer.Answer(chatId, promptId, answer, done)
+		if err != nil {
+			errs = append(errs, &InterfaceError{Name: r.name, Err: fmt.Errorf("could not send answer: %w", err)})
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
-func (b *Interfaces) HasDaemonRunning() bool {
-	return b.Daemon != nil && b.interfaceTypes.Has(InterfaceTypeDaemon)
+// Fail tells the communication interfaces that answer their clients that a chat's answer failed with the error
+func (b *Interfaces) Fail(chatId bot_chat.ChatId, promptId bot_chat.PromptId, answerErr error) error {
+	b.m.RLock()
+	interfaces := b.interfaces
+	b.m.RUnlock()
+
+	var errs []error
+	for _, r := range interfaces {
+		answerer, ok := r.iface.(Answerer)
+		if !ok {
+			continue
+		}
+
+		err := answerer.Fail(chatId, promptId, answerErr)
+		if err != nil {
+			errs = append(errs, &InterfaceError{Name: r.name, Err: fmt.Errorf("could not send failed answer: %w", err)})
+		}
+	}
+
+	return errors.Join(errs...)
 }
@@ -0,0 +1,175 @@
+package bot_interfaces
+
+import (
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// fakeInterface is a communication interface that the tests drive by hand
+type fakeInterface struct {
+	errs    chan error
+	prompts chan []byte
+	answers []string
+	stopped *[]string
+	name    string
+	stopErr error
+}
+
+func newFakeInterface(name string, stopped *[]string) *fakeInterface {
+	return &fakeInterface{
+		errs:    make(chan error, 1),
+		prompts: make(chan []byte, 1),
+		stopped: stopped,
+		name:    name,
+	}
+}
+
+func (f *fakeInterface) Start() <-chan error {
+	return f.errs
+}
+
+func (f *fakeInterface) Listen() <-chan []byte {
+	return f.prompts
+}
+
+// stoppableInterface is a fake interface that can be stopped and answers its clients, and tells them what's queued
+type stoppableInterface struct {
+	*fakeInterface
+}
+
+func (f stoppableInterface) Stop() error {
+	*f.stopped = append(*f.stopped, f.name)
+	return f.stopErr
+}
+
+func (f stoppableInterface) Answer(chatId bot_chat.ChatId, promptId bot_chat.PromptId, answer []byte, done bool) error {
+	f.answers = append(f.answers, fmt.Sprintf("%s %t", answer, done))
+	return nil
+}
+
+func (f stoppableInterface) Fail(chatId bot_chat.ChatId, promptId bot_chat.PromptId, err error) error {
+	f.answers = append(f.answers, fmt.Sprintf("failed: %s", err))
+	return nil
+}
+
+func (f stoppableInterface) Queued(chatId bot_chat.ChatId) {
+	f.answers = append(f.answers, "queued")
+}
+
+type InterfacesTestSuite struct {
+	suite.Suite
+	interfaces *Interfaces
+	stopped    []string
+}
+
+func (suite *InterfacesTestSuite) SetupTest() {
+	suite.interfaces = New(context.Background())
+	suite.stopped = nil
+}
+
+func (suite *InterfacesTestSuite) TestRegister() {
+	suite.NoError(suite.interfaces.Register("one", newFakeInterface("one", &suite.stopped)))
+	suite.NoError(suite.interfaces.Register("two", newFakeInterface("two", &suite.stopped)))
+	suite.ErrorIs(suite.interfaces.Register("one", newFakeInterface("one", &suite.stopped)), ErrInterfaceExists)
+	suite.Equal([]string{"one", "two"}, suite.interfaces.Names())
+
+	_, err := suite.interfaces.Get("two")
+	suite.NoError(err)
+	_, err = suite.interfaces.Get("three")
+	suite.ErrorIs(err, ErrInterfaceNotFound)
+}
+
+func (suite *InterfacesTestSuite) TestRegisterAfterStart() {
+	suite.interfaces.Start()
+	suite.ErrorIs(suite.interfaces.Register("late", newFakeInterface("late", &suite.stopped)), ErrAlreadyStarted)
+}
+
+func (suite *InterfacesTestSuite) TestMessagesAreFannedIn() {
+	one := newFakeInterface("one", &suite.stopped)
+	two := newFakeInterface("two", &suite.stopped)
+	suite.NoError(suite.interfaces.Register("one", one))
+	suite.NoError(suite.interfaces.Register("two", two))
+
+	suite.interfaces.Start()
+	prompts := suite.interfaces.Listen()
+
+	one.prompts <- []byte("from one")
+	two.prompts <- []byte("from two")
+
+	var received []string
+	for i := 0; i < 2; i++ {
+		select {
+		case prompt := <-prompts:
+			received = append(received, string(prompt))
+		case <-time.After(time.Second * 5):
+			suite.FailNow("prompt was not fanned in")
+		}
+	}
+	suite.ElementsMatch([]string{"from one", "from two"}, received)
+}
+
+func (suite *InterfacesTestSuite) TestErrorsAreSurfacedPerInterface() {
+	one := newFakeInterface("one", &suite.stopped)
+	suite.NoError(suite.interfaces.Register("one", one))
+	suite.NoError(suite.interfaces.Register("two", newFakeInterface("two", &suite.stopped)))
+
+	errs := suite.interfaces.Start()
+	listenErr := fmt.Errorf("address already in use")
+	one.errs <- listenErr
+
+	err := <-errs
+	var ifaceErr *InterfaceError
+	suite.ErrorAs(err, &ifaceErr)
+	suite.Equal("one", ifaceErr.Name)
+	suite.ErrorIs(err, listenErr)
+
+	suite.ErrorIs(suite.interfaces.Err("one"), listenErr)
+	suite.NoError(suite.interfaces.Err("two"))
+}
+
+func (suite *InterfacesTestSuite) TestStopStopsAllAndClosesTheQueue() {
+	one := stoppableInterface{newFakeInterface("one", &suite.stopped)}
+	two := stoppableInterface{newFakeInterface("two", &suite.stopped)}
+	two.stopErr = fmt.Errorf("could not close listener")
+	suite.NoError(suite.interfaces.Register("one", one))
+	suite.NoError(suite.interfaces.Register("plain", newFakeInterface("plain", &suite.stopped)))
+	suite.NoError(suite.interfaces.Register("two", two))
+
+	suite.ErrorIs(suite.interfaces.Stop(), ErrNotStarted)
+
+	errs := suite.interfaces.Start()
+	prompts := suite.interfaces.Listen()
+
+	err := suite.interfaces.Stop()
+	suite.ErrorIs(err, two.stopErr)
+	suite.Equal([]string{"two", "one"}, suite.stopped)
+
+	select {
+	case _, ok := <-prompts:
+		suite.False(ok)
+	case <-time.After(time.Second * 5):
+		suite.FailNow("message queue was not closed")
+	}
+	for range errs {
+	}
+}
+
+func (suite *InterfacesTestSuite) TestAnswerGoesToAnswerers() {
+	one := stoppableInterface{newFakeInterface("one", &suite.stopped)}
+	suite.NoError(suite.interfaces.Register("one", one))
+	suite.NoError(suite.interfaces.Register("plain", newFakeInterface("plain", &suite.stopped)))
+
+	suite.interfaces.Queued(bot_chat.ChatId{})
+	suite.NoError(suite.interfaces.Answer(bot_chat.ChatId{}, "", []byte("hi"), true))
+	suite.NoError(suite.interfaces.Fail(bot_chat.ChatId{}, "", fmt.Errorf("model is unreachable")))
+	suite.Equal([]string{"queued", "hi true", "failed: model is unreachable"}, one.answers)
+}
+
+func TestInterfacesTestSuite(t *testing.T) {
+	suite.Run(t, new(InterfacesTestSuite))
+}
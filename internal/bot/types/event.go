@@ -0,0 +1,109 @@
+package types
+
+import (
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EventType is the kind of an event of the bus, which tells the type of its payload
+type EventType string
+
+const (
+	// EventNewChat is a chat that was created, its payload is a Communication_interface_incoming_new_chat
+	EventNewChat EventType = "new_chat"
+	// EventAnswer is the whole answer of a chat, its payload is a Communication_interface_outgoing_answer
+	EventAnswer EventType = "answer"
+	// EventAnswerChunk is a part of an answer as it's streamed, its payload is a Communication_interface_outgoing_answer_chunk
+	EventAnswerChunk EventType = "answer_chunk"
+	// EventUsage is what a prompt cost, its payload is a Communication_interface_outgoing_usage
+	EventUsage EventType = "usage"
+)
+
+// EventVersion is the version of the envelope and the payloads that the bot sends,
+// it changes whenever they change in a way the consumers of the older version can not read
+const EventVersion = 1
+
+var (
+	ErrInvalidEvent     = fmt.Errorf("invalid event")
+	ErrUnknownVersion   = fmt.Errorf("unknown event version")
+	ErrUnknownEventType = fmt.Errorf("unknown event type")
+)
+
+var eventTypes = map[EventType]bool{
+	EventNewChat:     true,
+	EventAnswer:      true,
+	EventAnswerChunk: true,
+	EventUsage:       true,
+}
+
+// Event is the envelope of everything the bot sends to the bus
+type Event struct {
+	Type    EventType `json:"type"`
+	Version int       `json:"version"`
+	// Id is unique to every event, so the consumers can tell the events that they got twice
+	Id string `json:"id"`
+	// ChatId is the chat the event is about, zero if it's not about a chat
+	ChatId bot_chat.ChatId `json:"chat_id"`
+	// User is the owner of the chat
+	User      string          `json:"user"`
+	Timestamp time.Time       `json:"timestamp"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// NewEvent returns an event of the current version with the payload, which is marshaled to json
+func NewEvent(eventType EventType, chatId bot_chat.ChatId, user string, payload any) (Event, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Event{}, fmt.Errorf("could not marshal payload of %s event: %w", eventType, err)
+	}
+
+	return Event{
+		Type:      eventType,
+		Version:   EventVersion,
+		Id:        uuid.NewString(),
+		ChatId:    chatId,
+		User:      user,
+		Timestamp: time.Now().UTC(),
+		Payload:   data,
+	}, nil
+}
+
+func (e *Event) Json() string {
+	jsonMsg, _ := json.Marshal(e)
+	return string(jsonMsg)
+}
+
+// DecodeEvent reads an event from the bus, it fails if the event is of a version or a type the bot does not know
+func DecodeEvent(data []byte) (Event, error) {
+	e := Event{}
+	err := json.Unmarshal(data, &e)
+	if err != nil {
+		return Event{}, fmt.Errorf("%w: %s", ErrInvalidEvent, err)
+	}
+
+	if e.Version != EventVersion {
+		return Event{}, fmt.Errorf("%w: %d", ErrUnknownVersion, e.Version)
+	}
+	if !eventTypes[e.Type] {
+		return Event{}, fmt.Errorf("%w: %q", ErrUnknownEventType, e.Type)
+	}
+	if e.Id == "" || e.Timestamp.IsZero() || len(e.Payload) == 0 {
+		return Event{}, fmt.Errorf("%w: %s event has no id, timestamp or payload", ErrInvalidEvent, e.Type)
+	}
+
+	return e, nil
+}
+
+// Decode unmarshals the payload of the event into the payload, which should be the type of its event type
+func (e *Event) Decode(payload any) error {
+	err := json.Unmarshal(e.Payload, payload)
+	if err != nil {
+		return fmt.Errorf("%w: payload of %s event: %s", ErrInvalidEvent, e.Type, err)
+	}
+
+	return nil
+}
@@ -2,7 +2,8 @@ package types
 
 import (
 	"connectly-interview/internal/bot/domain/bot_chat"
-	"fmt"
+	"encoding/json"
+	"time"
 )
 
 type Communication_interface_incoming_msg_topic int
@@ -24,15 +25,64 @@ type Communication_interface_incoming_new_chat_reply struct {
 }
 
 func (msg *Communication_interface_incoming_new_chat_reply) Json() string {
-	jsonMsg := fmt.Sprintf(`{"chat_id": %q", "prompt": %q}`, msg.ChatId, msg.Prompt)
-	return jsonMsg
+	jsonMsg, _ := json.Marshal(msg)
+	return string(jsonMsg)
 }
 
+// Communication_interface_incoming_new_chat is a chat that was created, as it's sent to the bus
 type Communication_interface_incoming_new_chat struct {
-	FromUser string
+	FromUser string `json:"from_user"`
 }
 
 func (msg *Communication_interface_incoming_new_chat) Json() string {
-	jsonMsg := fmt.Sprintf(`{"from_user": %q"}`, msg.FromUser)
-	return jsonMsg
+	jsonMsg, _ := json.Marshal(msg)
+	return string(jsonMsg)
+}
+
+// Communication_interface_outgoing_answer is the whole answer of a chat, as it's sent to the bus
+type Communication_interface_outgoing_answer struct {
+	ChatId bot_chat.ChatId `json:"chat_id"`
+	// User is the owner of the chat
+	User   string `json:"user"`
+	Answer string `json:"answer"`
+}
+
+func (msg *Communication_interface_outgoing_answer) Json() string {
+	jsonMsg, _ := json.Marshal(msg)
+	return string(jsonMsg)
+}
+
+// Communication_interface_outgoing_answer_chunk is a part of an answer as it's streamed, as it's sent to the bus
+type Communication_interface_outgoing_answer_chunk struct {
+	ChatId bot_chat.ChatId `json:"chat_id"`
+	// User is the owner of the chat
+	User  string `json:"user"`
+	Chunk string `json:"chunk"`
+}
+
+func (msg *Communication_interface_outgoing_answer_chunk) Json() string {
+	jsonMsg, _ := json.Marshal(msg)
+	return string(jsonMsg)
+}
+
+// Communication_interface_outgoing_usage is what a prompt cost, as it's sent to the bus
+type Communication_interface_outgoing_usage struct {
+	ChatId bot_chat.ChatId `json:"chat_id"`
+	// User is the owner of the chat
+	User             string `json:"user"`
+	Model            string `json:"model"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	TotalTokens      int    `json:"total_tokens"`
+	// Estimated is true when the provider did not tell the tokens, and they were counted by the bot instead
+	Estimated bool `json:"estimated"`
+	// Cost is in dollars, 0 if the model has no price
+	Cost   float64   `json:"cost"`
+	Priced bool      `json:"priced"`
+	At     time.Time `json:"at"`
+}
+
+func (msg *Communication_interface_outgoing_usage) Json() string {
+	jsonMsg, _ := json.Marshal(msg)
+	return string(jsonMsg)
 }
@@ -1 +1,84 @@
 package types
+
+import (
+	"connectly-interview/internal/bot/domain/bot_chat"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TypesTestSuite struct {
+	suite.Suite
+}
+
+func (suite *TypesTestSuite) TestPayloadsAreValidJson() {
+	chatId := bot_chat.NewChatId()
+	payloads := []interface{ Json() string }{
+		&Communication_interface_incoming_new_chat_reply{ChatId: chatId, Prompt: `say "hi"`},
+		&Communication_interface_incoming_new_chat{FromUser: "team-a"},
+		&Communication_interface_outgoing_answer_chunk{Chunk: "hi"},
+	}
+
+	for _, payload := range payloads {
+		suite.True(json.Valid([]byte(payload.Json())), payload.Json())
+	}
+
+	reply := Communication_interface_incoming_new_chat_reply{}
+	suite.Require().NoError(json.Unmarshal([]byte(payloads[0].Json()), &reply))
+	suite.Equal(chatId, reply.ChatId)
+	suite.Equal(`say "hi"`, reply.Prompt)
+}
+
+func (suite *TypesTestSuite) TestEventRoundTrip() {
+	chatId := bot_chat.NewChatId()
+	event, err := NewEvent(EventAnswer, chatId, "team-a", Communication_interface_outgoing_answer{
+		ChatId: chatId,
+		User:   "team-a",
+		Answer: "hello",
+	})
+	suite.Require().NoError(err)
+	suite.NotEmpty(event.Id)
+
+	decoded, err := DecodeEvent([]byte(event.Json()))
+	suite.Require().NoError(err)
+	suite.Equal(EventAnswer, decoded.Type)
+	suite.Equal(EventVersion, decoded.Version)
+	suite.Equal(event.Id, decoded.Id)
+	suite.Equal(chatId, decoded.ChatId)
+	suite.Equal("team-a", decoded.User)
+	suite.True(event.Timestamp.Equal(decoded.Timestamp))
+
+	answer := Communication_interface_outgoing_answer{}
+	suite.Require().NoError(decoded.Decode(&answer))
+	suite.Equal("hello", answer.Answer)
+
+	other, err := NewEvent(EventAnswer, chatId, "team-a", Communication_interface_outgoing_answer{})
+	suite.Require().NoError(err)
+	suite.NotEqual(event.Id, other.Id)
+}
+
+func (suite *TypesTestSuite) TestDecodeRejectsUnknownEvents() {
+	event, err := NewEvent(EventNewChat, bot_chat.NewChatId(), "team-a", Communication_interface_incoming_new_chat{FromUser: "team-a"})
+	suite.Require().NoError(err)
+
+	newer := event
+	newer.Version = EventVersion + 1
+	_, err = DecodeEvent([]byte(newer.Json()))
+	suite.ErrorIs(err, ErrUnknownVersion)
+
+	unknown := event
+	unknown.Type = "deleted_chat"
+	_, err = DecodeEvent([]byte(unknown.Json()))
+	suite.ErrorIs(err, ErrUnknownEventType)
+
+	_, err = DecodeEvent([]byte(`"a bare answer"`))
+	suite.ErrorIs(err, ErrInvalidEvent)
+
+	_, err = DecodeEvent([]byte(`{"type": "answer", "version": 1}`))
+	suite.ErrorIs(err, ErrInvalidEvent)
+}
+
+func TestTypesTestSuite(t *testing.T) {
+	suite.Run(t, new(TypesTestSuite))
+}
@@ -9,7 +9,9 @@ import (
 )
 
 var (
-	ErrNodeIsNil = fmt.Errorf("node is nil")
+	ErrNodeIsNil      = fmt.Errorf("node is nil")
+	ErrQueueEmpty     = fmt.Errorf("queue is empty")
+	ErrNodeNotInQueue = fmt.Errorf("node is not in the queue")
 )
 
 type LinkedNode[T any] struct {
@@ -85,6 +87,13 @@ func NewDoubleLinkedList[T any](values ...T) *DoubleLinkedNode[T] {
 	return root
 }
 
+func (n *DoubleLinkedNode[T]) Value() T {
+	n.m.RLock()
+	defer n.m.RUnlock()
+
+	return n.value
+}
+
 func (n *DoubleLinkedNode[T]) ChangeValue(newValue T) error {
 	if n == nil {
 		return ErrNodeIsNil
@@ -111,18 +120,101 @@ func NewQueue[T any](values ...T) *Queue[T] {
 	return queue
 }
 
-func (q *Queue[T]) Enqueue(val T) {
+// Enqueue adds the value to the back of the queue
+// and returns its node, so it can later be removed or moved in O(1).
+func (q *Queue[T]) Enqueue(val T) *DoubleLinkedNode[T] {
 	newNode := &DoubleLinkedNode[T]{value: val}
+	q.pushBack(newNode)
+
+	return newNode
+}
+
+func (q *Queue[T]) pushBack(node *DoubleLinkedNode[T]) {
+	node.previous = q.tail
+	node.next = nil
 	if q.tail != nil {
-		q.tail.next = newNode
-		newNode.previous = q.tail
+		q.tail.next = node
+	}
+
+	q.tail = node
+
+	if q.head == nil {
+		q.head = node
+	}
+}
+
+// unlink removes the node from the queue without checking that it belongs to it
+func (q *Queue[T]) unlink(node *DoubleLinkedNode[T]) {
+	if node.previous != nil {
+		node.previous.next = node.next
+	} else {
+		q.head = node.next
+	}
+
+	if node.next != nil {
+		node.next.previous = node.previous
+	} else {
+		q.tail = node.previous
+	}
+
+	node.previous = nil
+	node.next = nil
+}
+
+// contains returns if the node is linked in this queue.
+// A node that is linked somewhere has neighbours, otherwise it has to be the only node of the queue.
+func (q *Queue[T]) contains(node *DoubleLinkedNode[T]) bool {
+	if node.previous != nil || node.next != nil {
+		return true
+	}
+
+	return q.head == node
+}
+
+// Remove removes the node from the queue in O(1)
+func (q *Queue[T]) Remove(node *DoubleLinkedNode[T]) error {
+	if node == nil {
+		return ErrNodeIsNil
+	}
+
+	if !q.contains(node) {
+		return ErrNodeNotInQueue
+	}
+
+	q.unlink(node)
+
+	return nil
+}
+
+// MoveToBack moves the node to the back of the queue in O(1),
+// as if it was dequeued and enqueued again
+func (q *Queue[T]) MoveToBack(node *DoubleLinkedNode[T]) error {
+	if node == nil {
+		return ErrNodeIsNil
+	}
+
+	if !q.contains(node) {
+		return ErrNodeNotInQueue
+	}
+
+	if q.tail == node {
+		return nil
 	}
 
-	q.tail = newNode
+	q.unlink(node)
+	q.pushBack(node)
 
+	return nil
+}
+
+// Peek returns the value at the front of the queue without dequeuing it
+func (q *Queue[T]) Peek() (T, error) {
 	if q.head == nil {
-		q.head = newNode
+		var zeroVal T
+		return zeroVal, ErrQueueEmpty
 	}
+
+	return q.head.value, nil
 }
 
 // Delete deletes a value from the queue.
@@ -130,7 +222,7 @@ func (q *Queue[T]) Enqueue(val T) {
 // reflect.DeepEqual is fixable if we make sure that T always has an "IsEqual(other T)" function at least. (note for the future self)
 func (q *Queue[T]) Delete(val T) error {
 	if q.head == nil {
-		return fmt.Errorf("queue is empty")
+		return ErrQueueEmpty
 	}
 
 	current := q.head
@@ -156,6 +248,8 @@ func (q *Queue[T]) Delete(val T) error {
 					q.tail = current.previous
 				}
 			}
+			current.previous = nil
+			current.next = nil
 			return nil
 		}
 		current = current.next
@@ -167,15 +261,16 @@ func (q *Queue[T]) Delete(val T) error {
 func (q *Queue[T]) Dequeue() (T, error) {
 	if q.head == nil {
 		var zeroVal T
-		return zeroVal, fmt.Errorf("queue is empty")
+		return zeroVal, ErrQueueEmpty
 	}
-	dequeuedValue := q.head.value
+	dequeued := q.head
 	q.head = q.head.next
 	if q.head == nil {
 		q.tail = nil
 	} else {
 		q.head.previous = nil
 	}
+	dequeued.next = nil
 
-	return dequeuedValue, nil
+	return dequeued.value, nil
 }
@@ -102,6 +102,60 @@ func (suite *ListsTestSuite) TestQueueDelete() {
 	suite.Error(err, "should error when deleting a non-existent element")
 }
 
+func (suite *ListsTestSuite) TestQueueRemoveNode() {
+	q := NewQueue[int]()
+	one := q.Enqueue(1)
+	two := q.Enqueue(2)
+	three := q.Enqueue(3)
+
+	// Test removing a middle node
+	suite.NoError(q.Remove(two))
+	suite.Equal(1, q.head.value)
+	suite.Equal(3, q.head.next.value)
+	suite.ErrorIs(q.Remove(two), ErrNodeNotInQueue)
+
+	// Test removing the head and the tail
+	suite.NoError(q.Remove(one))
+	suite.Equal(3, q.head.value)
+	suite.NoError(q.Remove(three))
+	suite.Nil(q.head)
+	suite.Nil(q.tail)
+
+	suite.ErrorIs(q.Remove(nil), ErrNodeIsNil)
+}
+
+func (suite *ListsTestSuite) TestQueueMoveToBack() {
+	q := NewQueue[int]()
+	one := q.Enqueue(1)
+	q.Enqueue(2)
+	three := q.Enqueue(3)
+
+	suite.NoError(q.MoveToBack(one))
+	suite.Equal(2, q.head.value)
+	suite.Equal(1, q.tail.value)
+
+	// Moving the tail does nothing
+	suite.NoError(q.MoveToBack(one))
+	suite.Equal(1, q.tail.value)
+	suite.Equal(3, q.tail.previous.value)
+
+	val, err := q.Peek()
+	suite.NoError(err)
+	suite.Equal(2, val)
+
+	var order []int
+	for {
+		val, err := q.Dequeue()
+		if err != nil {
+			suite.ErrorIs(err, ErrQueueEmpty)
+			break
+		}
+		order = append(order, val)
+	}
+	suite.Equal([]int{2, 3, 1}, order)
+	suite.ErrorIs(q.MoveToBack(three), ErrNodeNotInQueue)
+}
+
 func TestListsTestSuite(t *testing.T) {
 	suite.Run(t, new(ListsTestSuite))
 }